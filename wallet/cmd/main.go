@@ -2,10 +2,26 @@ package main
 
 import (
 	"log"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+	"wallet/domain"
+	"wallet/wallet/auth"
 	"wallet/wallet/delivery"
+	"wallet/wallet/delivery/middleware"
+	"wallet/wallet/events"
+	"wallet/wallet/fx"
+	"wallet/wallet/jwks"
+	"wallet/wallet/repository"
+	"wallet/wallet/repository/memory"
 	"wallet/wallet/repository/mysql"
+	"wallet/wallet/repository/postgres"
+	"wallet/wallet/revocation"
+	"wallet/wallet/stream"
 	"wallet/wallet/usecase"
+	"wallet/wallet/webhook"
 
 	"github.com/buaazp/fasthttprouter"
 	"github.com/subosito/gotenv"
@@ -17,26 +33,327 @@ func init() {
 }
 
 func main() {
+	dsn := os.Getenv("DATA_SOURCE")
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(dsn, os.Args[2:]); err != nil {
+			log.Fatalf("Migrate error: %v", err)
+		}
+		return
+	}
+
 	r := fasthttprouter.New()
 
-	dbConn, err := mysql.NewMySQLDBInterface(os.Getenv("DATA_SOURCE"))
+	dbConn, err := newDBInterface(dsn)
 	if err != nil {
 		log.Fatalf("Db interface create error: %v", err)
 	}
+	if err := checkSchema(dsn); err != nil {
+		log.Fatalf("Schema check error: %v", err)
+	}
+
+	idempotencyTTL, err := time.ParseDuration(os.Getenv("IDEMPOTENCY_TTL"))
+	if err != nil {
+		log.Println("INFO|IDEMPOTENCY_TTL not set or invalid, keeping idempotency keys for 24h")
+		idempotencyTTL = 24 * time.Hour
+	}
+
+	holdTTL, err := time.ParseDuration(os.Getenv("HOLD_TTL"))
+	if err != nil {
+		log.Println("INFO|HOLD_TTL not set or invalid, holds expire after 168h")
+		holdTTL = 7 * 24 * time.Hour
+	}
+
+	scheduleRetryInterval, err := time.ParseDuration(os.Getenv("SCHEDULE_RETRY_INTERVAL"))
+	if err != nil {
+		log.Println("INFO|SCHEDULE_RETRY_INTERVAL not set or invalid, retrying failed scheduled transfers after 1h")
+		scheduleRetryInterval = time.Hour
+	}
+
+	webhookTimeout, err := time.ParseDuration(os.Getenv("WEBHOOK_TIMEOUT"))
+	if err != nil {
+		log.Println("INFO|WEBHOOK_TIMEOUT not set or invalid, giving up on webhook subscribers after 10s")
+		webhookTimeout = 10 * time.Second
+	}
+
+	accessTokenTTL, err := time.ParseDuration(os.Getenv("ACCESS_TOKEN_TTL"))
+	if err != nil {
+		log.Println("INFO|ACCESS_TOKEN_TTL not set or invalid, access tokens expire after 15m")
+		accessTokenTTL = 15 * time.Minute
+	}
+
+	refreshTokenTTL, err := time.ParseDuration(os.Getenv("REFRESH_TOKEN_TTL"))
+	if err != nil {
+		log.Println("INFO|REFRESH_TOKEN_TTL not set or invalid, refresh tokens expire after 720h")
+		refreshTokenTTL = 30 * 24 * time.Hour
+	}
+
+	revocationRetention, err := time.ParseDuration(os.Getenv("REVOCATION_RETENTION"))
+	if err != nil {
+		log.Println("INFO|REVOCATION_RETENTION not set or invalid, keeping revocations for 24h")
+		revocationRetention = 24 * time.Hour
+	}
+
+	revocationSyncInterval, err := time.ParseDuration(os.Getenv("REVOCATION_SYNC_INTERVAL"))
+	if err != nil {
+		log.Println("INFO|REVOCATION_SYNC_INTERVAL not set or invalid, syncing revocations every 10s")
+		revocationSyncInterval = 10 * time.Second
+	}
+
+	rates, err := newRateProvider(os.Getenv("FX_RATES_FILE"))
+	if err != nil {
+		log.Fatalf("FX rate provider create error: %v", err)
+	}
+
+	stepUp, err := newStepUpPolicy(os.Getenv("STEP_UP_THRESHOLD"), os.Getenv("STEP_UP_CURRENCY"))
+	if err != nil {
+		log.Fatalf("Step-up policy create error: %v", err)
+	}
+
+	verifier, err := newVerifier(os.Getenv("SECRET"), os.Getenv("JWKS_SOURCE"), os.Getenv("JWT_ISSUER"), os.Getenv("JWT_AUDIENCE"))
+	if err != nil {
+		log.Fatalf("Token verifier create error: %v", err)
+	}
+	middleware.SetVerifier(verifier)
+
+	revocations, err := newRevocationStore(os.Getenv("REVOCATIONS"), dbConn, revocationRetention)
+	if err != nil {
+		log.Fatalf("Revocation store create error: %v", err)
+	}
+	middleware.SetRevocationStore(revocations)
+	go syncRevocations(revocations, revocationSyncInterval)
 
 	defer dbConn.Close()
 	walletListUsecase := usecase.NewWalletListUsecase(dbConn)
-	transferUsecase := usecase.NewTransferUsecase(dbConn)
-	topUpUsecase := usecase.NewTopUpUsecase(dbConn)
+	transferUsecase := usecase.NewTransferUsecase(dbConn, idempotencyTTL, rates, stepUp)
+	topUpUsecase := usecase.NewTopUpUsecase(dbConn, idempotencyTTL)
 	addWalletUsecase := usecase.NewAddWalletUsecase(dbConn)
 	getWalletsUsecase := usecase.NewGetWalletsUsecase(dbConn)
 	getTransactionsUsecase := usecase.NewGetTransactionsUsecase(dbConn)
+	statementUsecase := usecase.NewStatementUsecase(dbConn, getTransactionsUsecase)
+	ledgerUsecase := usecase.NewLedgerUsecase(dbConn)
+	reversalUsecase := usecase.NewReversalUsecase(dbConn)
+	holdUsecase := usecase.NewHoldUsecase(dbConn, rates, holdTTL, stepUp)
+	go expireHolds(holdUsecase, time.Minute)
+	scheduleUsecase := usecase.NewScheduleUsecase(dbConn, transferUsecase, scheduleRetryInterval)
+	go runSchedules(scheduleUsecase, time.Minute)
+	batchUsecase := usecase.NewBatchUsecase(dbConn, transferUsecase, rates)
+	go runBatches(batchUsecase, 5*time.Second)
+	webhookUsecase := usecase.NewWebhookUsecase(dbConn, webhook.NewHTTPSender(webhookTimeout))
+	go deliverWebhooks(webhookUsecase, 5*time.Second)
+	broker := stream.NewBroker(usecase.WalletOwner(dbConn))
+	streamUsecase := usecase.NewStreamUsecase(dbConn, broker)
+	go followEvents(streamUsecase, time.Second)
+	publisher, err := newEventPublisher(os.Getenv("EVENTS_OUTPUT"), webhookUsecase)
+	if err != nil {
+		log.Fatalf("Event publisher create error: %v", err)
+	}
+	relayUsecase := usecase.NewRelayUsecase(dbConn, publisher)
+	go relayEvents(relayUsecase, time.Second)
+	issuer := auth.NewIssuer(os.Getenv("SECRET"), accessTokenTTL, os.Getenv("JWT_ISSUER"), os.Getenv("JWT_AUDIENCE"))
+	authUsecase := usecase.NewAuthUsecase(dbConn, issuer, revocations, refreshTokenTTL, auth.DefaultIterations)
+	sessionUsecase := usecase.NewSessionUsecase(dbConn, revocations)
+	stepUpUsecase := usecase.NewStepUpUsecase(dbConn, stepUp)
 
+	delivery.NewAuthHandler(r, authUsecase)
+	delivery.NewSessionHandler(r, sessionUsecase)
+	delivery.NewStepUpHandler(r, stepUpUsecase)
 	delivery.NewGetInfoHandler(r, getWalletsUsecase)
 	delivery.NewGetTransactionsHandler(r, getTransactionsUsecase)
+	delivery.NewStatementHandler(r, statementUsecase)
 	delivery.NewAddWalletHandler(r, addWalletUsecase)
 	delivery.NewTopUpHandler(r, topUpUsecase)
 	delivery.NewTransferHandler(r, transferUsecase)
 	delivery.NewWalletListHandler(r, walletListUsecase)
+	delivery.NewTrialBalanceHandler(r, ledgerUsecase)
+	delivery.NewReversalHandler(r, reversalUsecase)
+	delivery.NewHoldHandler(r, holdUsecase)
+	delivery.NewScheduleHandler(r, scheduleUsecase)
+	delivery.NewBatchHandler(r, batchUsecase)
+	delivery.NewWebhookHandler(r, webhookUsecase)
+	delivery.NewStreamHandler(r, streamUsecase)
+	delivery.NewV2Handler(r, addWalletUsecase, getWalletsUsecase, transferUsecase, getTransactionsUsecase)
 	fasthttp.ListenAndServe(":8070", r.Handler)
 }
+
+// newDBInterface picks repository backend by DSN scheme, "memory://" keeps everything in process for local development
+// and "postgres://" selects PostgreSQL, anything else is treated as a MySQL DSN
+func newDBInterface(dsn string) (repository.DBInterface, error) {
+	switch {
+	case strings.HasPrefix(dsn, "memory://"):
+		log.Println("INFO|Using in-memory DB, data is lost on restart")
+		return memory.NewMemoryDBInterface(), nil
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return postgres.NewPostgresDBInterface(dsn)
+	}
+	return mysql.NewMySQLDBInterface(dsn)
+}
+
+// newRevocationStore returns revocation store picked by mode, "memory" keeps revocations in this instance only and
+// anything else persists them to dbConn, shared by every instance. Revocations persisted so far are loaded
+func newRevocationStore(mode string, dbConn repository.DBInterface, retention time.Duration) (*revocation.Store, error) {
+	if mode == "memory" {
+		log.Println("INFO|Keeping revocations in memory, they are lost on restart and not shared between instances")
+		return revocation.NewStore(nil, retention), nil
+	}
+	store := revocation.NewStore(dbConn, retention)
+	if err := store.Sync(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// syncRevocations loads revocations made by other instances and drops expired ones every interval
+func syncRevocations(store *revocation.Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := store.Sync(); err != nil {
+			log.Println("ERROR|Syncing revocations:", err)
+		}
+		if _, err := store.Prune(); err != nil {
+			log.Println("ERROR|Pruning revocations:", err)
+		}
+	}
+}
+
+// expireHolds marks expired holds every interval so that they stop showing as active
+func expireHolds(uc usecase.HoldUsecase, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := uc.ExpireHolds(); err != nil {
+			log.Println("ERROR|Expiring holds:", err)
+		}
+	}
+}
+
+// runSchedules makes scheduled transfers that are due every interval
+func runSchedules(uc usecase.ScheduleUsecase, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := uc.RunDueSchedules(); err != nil {
+			log.Println("ERROR|Running schedules:", err)
+		}
+	}
+}
+
+// runBatches runs uploaded batches every interval
+func runBatches(uc usecase.BatchUsecase, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := uc.RunPendingBatches(); err != nil {
+			log.Println("ERROR|Running batches:", err)
+		}
+	}
+}
+
+// deliverWebhooks posts queued webhook deliveries that are due every interval
+func deliverWebhooks(uc usecase.WebhookUsecase, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := uc.DeliverDue(); err != nil {
+			log.Println("ERROR|Delivering webhooks:", err)
+		}
+	}
+}
+
+// relayEvents publishes events written to the outbox every interval
+func relayEvents(uc usecase.RelayUsecase, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := uc.Relay(); err != nil {
+			log.Println("ERROR|Relaying events:", err)
+		}
+	}
+}
+
+// followEvents hands events written to the outbox to clients of the streaming endpoint every interval
+func followEvents(uc usecase.StreamUsecase, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := uc.Follow(); err != nil {
+			log.Println("ERROR|Following events:", err)
+		}
+	}
+}
+
+// newEventPublisher returns publisher of outbox events to publishers and, if output is set, to "stdout" or the file
+// at output path as JSON lines
+func newEventPublisher(output string, publishers ...events.EventPublisher) (events.EventPublisher, error) {
+	switch output {
+	case "":
+	case "stdout":
+		publishers = append(publishers, events.NewStdoutPublisher())
+	default:
+		file, err := events.NewFilePublisher(output)
+		if err != nil {
+			return nil, err
+		}
+		publishers = append(publishers, file)
+	}
+	return events.NewMultiPublisher(publishers...), nil
+}
+
+// newRateProvider loads exchange rates from JSON file, without one only same-currency transfers are possible
+func newRateProvider(path string) (fx.FXRateProvider, error) {
+	if path == "" {
+		log.Println("INFO|FX_RATES_FILE not set, transfers between currencies are disabled")
+		return fx.NewStaticProvider(nil)
+	}
+	return fx.NewFileProvider(path)
+}
+
+// newStepUpPolicy returns policy asking for a one-time code on transfers of more than threshold in currency, which
+// defaults to domain.DefaultCurrency. Without threshold no transfer needs one. Wrong codes are limited by
+// STEP_UP_MAX_ATTEMPTS and STEP_UP_LOCKOUT, confirmations last CONFIRMATION_TTL
+func newStepUpPolicy(threshold, currency string) (domain.StepUpPolicy, error) {
+	if threshold == "" {
+		log.Println("INFO|STEP_UP_THRESHOLD not set, transfers need no one-time code")
+		return domain.StepUpPolicy{}, nil
+	}
+	if currency == "" {
+		currency = domain.DefaultCurrency
+	}
+	amount, err := domain.ParseMoney(threshold, currency)
+	if err != nil {
+		return domain.StepUpPolicy{}, err
+	}
+	policy := domain.StepUpPolicy{Threshold: amount}
+	if policy.MaxAttempts, err = strconv.Atoi(os.Getenv("STEP_UP_MAX_ATTEMPTS")); err != nil || policy.MaxAttempts < 1 {
+		log.Println("INFO|STEP_UP_MAX_ATTEMPTS not set or invalid, locking out after 5 wrong codes")
+		policy.MaxAttempts = 5
+	}
+	if policy.Lockout, err = time.ParseDuration(os.Getenv("STEP_UP_LOCKOUT")); err != nil {
+		log.Println("INFO|STEP_UP_LOCKOUT not set or invalid, locking out for 15m")
+		policy.Lockout = 15 * time.Minute
+	}
+	if policy.ConfirmationTTL, err = time.ParseDuration(os.Getenv("CONFIRMATION_TTL")); err != nil {
+		log.Println("INFO|CONFIRMATION_TTL not set or invalid, confirmations expire after 5m")
+		policy.ConfirmationTTL = 5 * time.Minute
+	}
+	return policy, nil
+}
+
+// newVerifier returns verifier of tokens signed with HMAC by secret and, if source is set, with RSA or ECDSA by keys
+// of the JWKS file or URL at source, reloaded every JWKS_REFRESH
+func newVerifier(secret, source, issuer, audience string) (*middleware.Verifier, error) {
+	if source == "" {
+		log.Println("INFO|JWKS_SOURCE not set, only HMAC signed tokens are accepted")
+		return middleware.NewVerifier(secret, nil, issuer, audience), nil
+	}
+	refresh, err := time.ParseDuration(os.Getenv("JWKS_REFRESH"))
+	if err != nil {
+		log.Println("INFO|JWKS_REFRESH not set or invalid, reloading JWKS every 1h")
+		refresh = time.Hour
+	}
+	keys, err := jwks.NewKeySet(source, refresh, &http.Client{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return middleware.NewVerifier(secret, keys, issuer, audience), nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"wallet/wallet/repository/migrate"
+	"wallet/wallet/repository/mysql"
+	"wallet/wallet/repository/postgres"
+)
+
+const migrateUsage = "usage: main migrate up|down|status"
+
+// newMigrator returns migrator for the backend chosen by DSN scheme, nil for the in-memory DB which has no schema
+func newMigrator(dsn string) (*migrate.Migrator, error) {
+	switch {
+	case strings.HasPrefix(dsn, "memory://"):
+		return nil, nil
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return postgres.NewMigrator(dsn)
+	}
+	return mysql.NewMigrator(dsn)
+}
+
+// runMigrate handles the migrate subcommand
+func runMigrate(dsn string, args []string) error {
+	if len(args) != 1 {
+		return errors.New(migrateUsage)
+	}
+	migrator, err := newMigrator(dsn)
+	if err != nil {
+		return err
+	}
+	if migrator == nil {
+		log.Println("INFO|In-memory DB has no schema to migrate")
+		return nil
+	}
+	defer migrator.Close()
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up()
+		if err != nil {
+			return err
+		}
+		log.Printf("INFO|Applied %d migrations\n", len(applied))
+	case "down":
+		migration, err := migrator.Down()
+		if err != nil {
+			return err
+		}
+		if migration == nil {
+			log.Println("INFO|No migrations to roll back")
+			return nil
+		}
+		log.Printf("INFO|Rolled back migration %d_%s\n", migration.Version, migration.Name)
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = "applied " + status.AppliedAt
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, state)
+		}
+	default:
+		return errors.New(migrateUsage)
+	}
+	return nil
+}
+
+// checkSchema refuses to serve on a DB that misses migrations
+func checkSchema(dsn string) error {
+	migrator, err := newMigrator(dsn)
+	if err != nil || migrator == nil {
+		return err
+	}
+	defer migrator.Close()
+	pending, err := migrator.Pending()
+	if err != nil {
+		return err
+	}
+	if pending > 0 {
+		return fmt.Errorf("schema is %d migrations behind, run `main migrate up`", pending)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package domain
+
+// Batch modes, an all-or-nothing batch reverses lines already made once one of them fails
+// while a best-effort one goes on with the rest
+const (
+	BatchAllOrNothing = "all_or_nothing"
+	BatchBestEffort   = "best_effort"
+)
+
+// Batch statuses, a rejected batch failed validation and was never stored, a partial one made some of its lines
+const (
+	BatchPending   = "pending"
+	BatchRunning   = "running"
+	BatchCompleted = "completed"
+	BatchPartial   = "partial"
+	BatchFailed    = "failed"
+	BatchRejected  = "rejected"
+)
+
+// Batch line statuses, lines after a failed one of an all-or-nothing batch are skipped
+const (
+	LinePending    = "pending"
+	LineSucceeded  = "succeeded"
+	LineFailed     = "failed"
+	LineRolledBack = "rolled_back"
+	LineSkipped    = "skipped"
+)
+
+// BatchInstruction is a line of an uploaded batch before validation, Amount is a decimal in currency of the source wallet
+type BatchInstruction struct {
+	To        string `json:"to"`
+	Amount    string `json:"amount"`
+	Reference string `json:"reference"`
+}
+
+// Batch transfers money from one wallet of IIN to the receivers of its lines, Total is what all of them add up to.
+// StepUp is the step-up decision it was created with and its lines are made with
+type Batch struct {
+	ID     int         `json:"id"`
+	Ts     string      `json:"ts"`
+	IIN    string      `json:"iin"`
+	From   string      `json:"from_acc"`
+	Mode   string      `json:"mode"`
+	Status string      `json:"status"`
+	Total  Money       `json:"total"`
+	StepUp string      `json:"step_up"`
+	Lines  []BatchLine `json:"lines"`
+}
+
+// BatchLine is a single transfer of a batch, Line numbers them from 1 in upload order
+type BatchLine struct {
+	Line          int    `json:"line"`
+	To            string `json:"to_acc"`
+	Amount        Money  `json:"amount"`
+	Reference     string `json:"reference,omitempty"`
+	Status        string `json:"status"`
+	TransactionID int    `json:"transactionId,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
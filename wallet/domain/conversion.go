@@ -0,0 +1,36 @@
+package domain
+
+// Conversion is money debited from one wallet and credited to another, Rate is the applied
+// exchange rate as a decimal string and is empty when both wallets share the currency
+type Conversion struct {
+	Debit  Money
+	Credit Money
+	Rate   string
+}
+
+// NewConversion returns conversion of the same amount without exchange
+func NewConversion(amount Money) Conversion {
+	return Conversion{Debit: amount, Credit: amount}
+}
+
+// FXAccount is the system clearing account through which money in currency is exchanged
+func FXAccount(currency string) string {
+	return "SYSTEM_FX_" + currency
+}
+
+// Postings returns ledger entries moving the conversion from debit to credit account. Money changing
+// currency passes through the FX accounts of both currencies so that each currency balances on its own
+func (c Conversion) Postings(debit, credit string) []Posting {
+	if c.Debit.Currency == c.Credit.Currency {
+		return []Posting{
+			{AccountNo: debit, Amount: -c.Debit.Amount, Currency: c.Debit.Currency},
+			{AccountNo: credit, Amount: c.Credit.Amount, Currency: c.Credit.Currency},
+		}
+	}
+	return []Posting{
+		{AccountNo: debit, Amount: -c.Debit.Amount, Currency: c.Debit.Currency},
+		{AccountNo: FXAccount(c.Debit.Currency), Amount: c.Debit.Amount, Currency: c.Debit.Currency},
+		{AccountNo: FXAccount(c.Credit.Currency), Amount: -c.Credit.Amount, Currency: c.Credit.Currency},
+		{AccountNo: credit, Amount: c.Credit.Amount, Currency: c.Credit.Currency},
+	}
+}
@@ -0,0 +1,25 @@
+package domain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConversionPostings(t *testing.T) {
+	same := NewConversion(NewMoney(500, "KZT")).Postings("A", "B")
+	assert.Equal(t, []Posting{
+		{AccountNo: "A", Amount: -500, Currency: "KZT"},
+		{AccountNo: "B", Amount: 500, Currency: "KZT"},
+	}, same)
+
+	fx := Conversion{Debit: NewMoney(1000, "USD"), Credit: NewMoney(470250, "KZT"), Rate: "470.25"}.Postings("A", "B")
+	sums := make(map[string]int64)
+	for _, posting := range fx {
+		sums[posting.Currency] += posting.Amount
+	}
+	assert.Len(t, fx, 4)
+	assert.Equal(t, map[string]int64{"USD": 0, "KZT": 0}, sums)
+	assert.Equal(t, "SYSTEM_FX_USD", fx[1].AccountNo)
+	assert.Equal(t, "SYSTEM_FX_KZT", fx[2].AccountNo)
+}
@@ -0,0 +1,82 @@
+package domain
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// Wallet event types webhook subscriptions can ask for
+const (
+	EventWalletCreated    = "wallet.created"
+	EventWalletToppedUp   = "wallet.topped_up"
+	EventTransferSent     = "transfer.sent"
+	EventTransferReceived = "transfer.received"
+)
+
+// EventTypes lists every event type, a subscription without event types gets all of them
+var EventTypes = []string{EventWalletCreated, EventWalletToppedUp, EventTransferSent, EventTransferReceived}
+
+// IsEventType reports whether eventType is one of EventTypes
+func IsEventType(eventType string) bool {
+	for _, t := range EventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is something that happened to Account, Counterparty is the other wallet of a transfer. ID is unique to the
+// event and stays the same however many times it is published, so that consumers can drop repeats
+type Event struct {
+	ID            string    `json:"id"`
+	Type          string    `json:"type"`
+	Ts            time.Time `json:"ts"`
+	Account       string    `json:"account"`
+	Counterparty  string    `json:"counterparty,omitempty"`
+	Amount        *Money    `json:"amount,omitempty"`
+	TransactionID int       `json:"transactionId,omitempty"`
+}
+
+// Replay is what a resuming stream client missed, Events written after the last event it got or Reset when they can
+// not be replayed and the client should refetch its wallets instead
+type Replay struct {
+	Events []Event
+	Reset  bool
+}
+
+// NewEvent returns event of eventType that happened to account now with a new random ID
+func NewEvent(eventType, account string) Event {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return Event{
+		ID:      hex.EncodeToString(id),
+		Type:    eventType,
+		Ts:      time.Now().UTC().Truncate(time.Second),
+		Account: account,
+	}
+}
+
+// NewTransferEvents returns events of both sides of transaction converting money between from and to. FundingAccount
+// has no wallet to notify, so a side of it gets no event
+func NewTransferEvents(from, to string, conv Conversion, transactionID int) []Event {
+	sent, received := NewEvent(EventTransferSent, from), NewEvent(EventTransferReceived, to)
+	sent.Counterparty, sent.Amount, sent.TransactionID = to, &conv.Debit, transactionID
+	received.Counterparty, received.Amount, received.TransactionID = from, &conv.Credit, transactionID
+	events := make([]Event, 0, 2)
+	if from != FundingAccount {
+		events = append(events, sent)
+	}
+	if to != FundingAccount {
+		events = append(events, received)
+	}
+	return events
+}
+
+// Payload returns event as published
+func (e Event) Payload() string {
+	payload, _ := json.Marshal(e)
+	return string(payload)
+}
@@ -0,0 +1,44 @@
+package domain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewEvent(t *testing.T) {
+	e, other := NewEvent(EventWalletCreated, "KZT0000000001"), NewEvent(EventWalletCreated, "KZT0000000001")
+	assert.Len(t, e.ID, 32)
+	assert.NotEqual(t, e.ID, other.ID)
+	assert.Zero(t, e.Ts.Nanosecond())
+	assert.JSONEq(t, `{"id":"`+e.ID+`","type":"wallet.created","ts":"`+e.Ts.Format("2006-01-02T15:04:05Z")+`","account":"KZT0000000001"}`, e.Payload())
+}
+
+func TestNewTransferEvents(t *testing.T) {
+	conv := Conversion{Debit: NewMoney(1000, "USD"), Credit: NewMoney(470250, "KZT"), Rate: "470.25"}
+	events := NewTransferEvents("USD0000000001", "KZT0000000002", conv, 3)
+	if assert.Len(t, events, 2) {
+		sent, received := events[0], events[1]
+		assert.Equal(t, EventTransferSent, sent.Type)
+		assert.Equal(t, "USD0000000001", sent.Account)
+		assert.Equal(t, "KZT0000000002", sent.Counterparty)
+		assert.Equal(t, NewMoney(1000, "USD"), *sent.Amount)
+		assert.Equal(t, EventTransferReceived, received.Type)
+		assert.Equal(t, "KZT0000000002", received.Account)
+		assert.Equal(t, "USD0000000001", received.Counterparty)
+		assert.Equal(t, NewMoney(470250, "KZT"), *received.Amount)
+		assert.Equal(t, 3, sent.TransactionID)
+		assert.Equal(t, 3, received.TransactionID)
+		assert.NotEqual(t, sent.ID, received.ID)
+	}
+}
+
+func TestNewTransferEventsFundingAccount(t *testing.T) {
+	conv := NewConversion(NewMoney(100, "KZT"))
+	events := NewTransferEvents("KZT0000000001", FundingAccount, conv, 4)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, EventTransferSent, events[0].Type)
+		assert.Equal(t, "KZT0000000001", events[0].Account)
+		assert.Equal(t, FundingAccount, events[0].Counterparty)
+	}
+}
@@ -0,0 +1,112 @@
+package domain
+
+import (
+	"encoding/base64"
+	"strconv"
+	"time"
+	"wallet/myerrors"
+)
+
+// Directions of transactions relative to the account whose history is read
+const (
+	DirectionIn  = "in"
+	DirectionOut = "out"
+)
+
+// TransactionTypes are transfer types transaction history can be filtered by
+var TransactionTypes = []string{"topup", "transfer", ReversalType, HoldType}
+
+// TransactionFilter selects transaction history of Account, zero fields don't restrict it.
+// Amounts are in minor units of the account's side of a transaction, what was sent for outgoing
+// and what was received for incoming ones. Cursor is ID of the last transaction of the previous page
+// and Limit of 0 returns every match
+type TransactionFilter struct {
+	Account      string
+	Since        time.Time
+	Until        time.Time
+	Type         string
+	Direction    string
+	Counterparty string
+	MinAmount    *int64
+	MaxAmount    *int64
+	Cursor       int
+	Limit        int
+	Desc         bool
+}
+
+// Validate checks that filter criteria are known and ranges are not empty
+func (f TransactionFilter) Validate() error {
+	if f.Type != "" && !isTransactionType(f.Type) {
+		return myerrors.ErrInvalidFilter
+	}
+	if f.Direction != "" && f.Direction != DirectionIn && f.Direction != DirectionOut {
+		return myerrors.ErrInvalidFilter
+	}
+	if !f.Since.IsZero() && !f.Until.IsZero() && !f.Since.Before(f.Until) {
+		return myerrors.ErrInvalidFilter
+	}
+	if f.MinAmount != nil && f.MaxAmount != nil && *f.MinAmount > *f.MaxAmount {
+		return myerrors.ErrInvalidFilter
+	}
+	if f.Cursor < 0 || f.Limit < 0 {
+		return myerrors.ErrInvalidFilter
+	}
+	return nil
+}
+
+// Matches reports whether transaction made at ts passes the filter, leaving cursor and limit aside
+func (f TransactionFilter) Matches(t Transaction, ts time.Time) bool {
+	out, in := t.From == f.Account, t.To == f.Account
+	switch {
+	case f.Direction == DirectionOut && !out, f.Direction == DirectionIn && !in, !out && !in:
+		return false
+	case f.Type != "" && t.Type != f.Type:
+		return false
+	case !f.Since.IsZero() && ts.Before(f.Since), !f.Until.IsZero() && !ts.Before(f.Until):
+		return false
+	}
+	if f.Counterparty != "" && !(out && t.To == f.Counterparty) && !(in && t.From == f.Counterparty) {
+		return false
+	}
+	amount := t.Credited.Amount
+	if out {
+		amount = t.Amount.Amount
+	}
+	if f.MinAmount != nil && amount < *f.MinAmount || f.MaxAmount != nil && amount > *f.MaxAmount {
+		return false
+	}
+	return true
+}
+
+// TransactionPage is one page of transaction history, NextCursor is empty on the last one
+type TransactionPage struct {
+	Transactions []Transaction
+	NextCursor   string
+}
+
+// EncodeCursor returns opaque cursor continuing history after transaction with given ID
+func EncodeCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(id)))
+}
+
+// DecodeCursor returns ID of the transaction cursor continues after
+func DecodeCursor(cursor string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, myerrors.ErrInvalidFilter
+	}
+	id, err := strconv.Atoi(string(raw))
+	if err != nil || id <= 0 {
+		return 0, myerrors.ErrInvalidFilter
+	}
+	return id, nil
+}
+
+func isTransactionType(transferType string) bool {
+	for _, t := range TransactionTypes {
+		if t == transferType {
+			return true
+		}
+	}
+	return false
+}
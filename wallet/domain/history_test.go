@@ -0,0 +1,52 @@
+package domain
+
+import (
+	"testing"
+	"time"
+	"wallet/myerrors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransactionFilterValidate(t *testing.T) {
+	now := time.Now()
+	low, high := int64(100), int64(50)
+	assert.NoError(t, TransactionFilter{Type: "topup", Direction: DirectionIn, Since: now, Until: now.Add(time.Hour)}.Validate())
+	for _, f := range []TransactionFilter{
+		{Type: "gift"},
+		{Direction: "both"},
+		{Since: now, Until: now},
+		{MinAmount: &low, MaxAmount: &high},
+		{Limit: -1},
+	} {
+		assert.Equal(t, myerrors.ErrInvalidFilter, f.Validate(), "%+v", f)
+	}
+}
+
+func TestTransactionFilterMatches(t *testing.T) {
+	now := time.Now()
+	tx := Transaction{Type: "transfer", From: "KZT0000000001", To: "USD0000000002", Amount: NewMoney(47025, "KZT"), Credited: NewMoney(100, "USD")}
+	out := TransactionFilter{Account: "KZT0000000001"}
+	in := TransactionFilter{Account: "USD0000000002"}
+	min := int64(1000)
+
+	assert.True(t, out.Matches(tx, now))
+	assert.False(t, TransactionFilter{Account: "KZT0000000003"}.Matches(tx, now))
+	assert.False(t, TransactionFilter{Account: out.Account, Direction: DirectionIn}.Matches(tx, now))
+	assert.True(t, TransactionFilter{Account: in.Account, Counterparty: out.Account}.Matches(tx, now))
+	assert.False(t, TransactionFilter{Account: out.Account, Type: "topup"}.Matches(tx, now))
+	assert.False(t, TransactionFilter{Account: out.Account, Until: now}.Matches(tx, now))
+	// amounts are compared on the account's side of the transaction
+	assert.True(t, TransactionFilter{Account: out.Account, MinAmount: &min}.Matches(tx, now))
+	assert.False(t, TransactionFilter{Account: in.Account, MinAmount: &min}.Matches(tx, now))
+}
+
+func TestCursor(t *testing.T) {
+	id, err := DecodeCursor(EncodeCursor(42))
+	assert.NoError(t, err)
+	assert.Equal(t, 42, id)
+	for _, cursor := range []string{"", "!!", EncodeCursor(0), "YWJj"} {
+		_, err = DecodeCursor(cursor)
+		assert.Equal(t, myerrors.ErrInvalidFilter, err, cursor)
+	}
+}
@@ -0,0 +1,35 @@
+package domain
+
+import "time"
+
+// Hold statuses, an active hold past ExpiresAt counts as expired even before it is marked so
+const (
+	HoldActive   = "active"
+	HoldCaptured = "captured"
+	HoldReleased = "released"
+	HoldExpired  = "expired"
+)
+
+// HoldType is transfer type of transactions capturing a hold
+const HoldType = "capture"
+
+// Hold reserves Amount of a wallet until it is captured into a transfer, released or expires.
+// Captured is the part that was transferred, the rest went back to the available balance. A hold is placed for the
+// merchant owning Payee and is only ever captured into Payee, StepUp is how the owner of the wallet authorized it
+type Hold struct {
+	ID            int       `json:"id"`
+	Ts            string    `json:"ts"`
+	AccountNo     string    `json:"accountno"`
+	Payee         string    `json:"payee"`
+	Amount        Money     `json:"amount"`
+	Captured      Money     `json:"captured"`
+	Status        string    `json:"status"`
+	TransactionID int       `json:"transactionId,omitempty"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+	StepUp        string    `json:"step_up,omitempty"`
+}
+
+// IsActive reports whether hold still reserves money at given time
+func (h Hold) IsActive(now time.Time) bool {
+	return h.Status == HoldActive && now.Before(h.ExpiresAt)
+}
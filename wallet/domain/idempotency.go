@@ -0,0 +1,14 @@
+package domain
+
+import "time"
+
+// IdempotencyKey is a client-supplied key stored together with the transaction it produced,
+// Response holds the JSON encoded result replayed to the client
+type IdempotencyKey struct {
+	Key           string    `json:"key"`
+	IIN           string    `json:"iin"`
+	RequestHash   string    `json:"requestHash"`
+	Response      string    `json:"response"`
+	TransactionID int       `json:"transactionId"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+}
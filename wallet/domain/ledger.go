@@ -0,0 +1,23 @@
+package domain
+
+// FundingAccount is the system account debited by top-ups, it has no wallet and its balance is negative
+const FundingAccount = "SYSTEM_FUNDING"
+
+// Posting is a single ledger entry of a transaction in minor units of Currency, credits are positive and debits negative
+type Posting struct {
+	ID            int    `json:"id"`
+	TransactionID int    `json:"transactionId"`
+	AccountNo     string `json:"accountno"`
+	Amount        int64  `json:"amount"`
+	Currency      string `json:"currency"`
+}
+
+// TrialBalance is the result of checking that postings of every currency sum up to zero and that balance of every
+// wallet is what its postings add up to, it is Balanced only if both hold
+type TrialBalance struct {
+	Totals     map[string]int64 `json:"totals"`
+	Postings   int              `json:"postings"`
+	Unbalanced []int            `json:"unbalancedTransactions"`
+	Mismatched []string         `json:"mismatchedWallets"`
+	Balanced   bool             `json:"balanced"`
+}
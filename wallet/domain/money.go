@@ -0,0 +1,131 @@
+package domain
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"wallet/myerrors"
+)
+
+// DefaultCurrency is the currency of wallets and amounts when client does not ask for another one
+const DefaultCurrency = "KZT"
+
+// currencyExponents holds number of minor unit digits per supported ISO 4217 currency
+var currencyExponents = map[string]int{
+	"KZT": 2,
+	"USD": 2,
+	"EUR": 2,
+}
+
+// CurrencyExponent returns number of minor unit digits of currency, false if currency is not supported
+func CurrencyExponent(currency string) (int, bool) {
+	exp, ok := currencyExponents[currency]
+	return exp, ok
+}
+
+// Money is an amount in minor units (e.g. tiyn for KZT) of the given currency
+type Money struct {
+	Amount   int64
+	Currency string
+}
+
+// moneyJSON is the wire format of Money, amount is a decimal string so clients never see floats
+type moneyJSON struct {
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// NewMoney returns money of amount minor units in currency
+func NewMoney(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+// ParseMoney parses non-negative decimal amount like "123" or "123.45" in currency, at most as many fraction digits as currency allows
+func ParseMoney(s, currency string) (Money, error) {
+	exp, ok := currencyExponents[currency]
+	if !ok {
+		return Money{}, myerrors.ErrInvalidAmt
+	}
+	whole, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		whole, frac = s[:i], s[i+1:]
+		if frac == "" {
+			return Money{}, myerrors.ErrInvalidAmt
+		}
+	}
+	if whole == "" || len(frac) > exp || !isDigits(whole) || !isDigits(frac) {
+		return Money{}, myerrors.ErrInvalidAmt
+	}
+	frac += strings.Repeat("0", exp-len(frac))
+	amount, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return Money{}, myerrors.ErrInvalidAmt
+	}
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+// Validate checks that money is non-negative and in a supported currency
+func (m Money) Validate() error {
+	if _, ok := currencyExponents[m.Currency]; !ok || m.Amount < 0 {
+		return myerrors.ErrInvalidAmt
+	}
+	return nil
+}
+
+// IsPositive reports whether money is a valid amount above zero
+func (m Money) IsPositive() bool {
+	return m.Validate() == nil && m.Amount > 0
+}
+
+// Decimal formats amount in major units without currency, e.g. "123.45"
+func (m Money) Decimal() string {
+	exp := currencyExponents[m.Currency]
+	sign, amount := "", m.Amount
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	digits := strconv.FormatInt(amount, 10)
+	if exp == 0 {
+		return sign + digits
+	}
+	if len(digits) <= exp {
+		digits = strings.Repeat("0", exp-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-exp] + "." + digits[len(digits)-exp:]
+}
+
+// String formats money with its currency, e.g. "123.45 KZT"
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(moneyJSON{Amount: m.Decimal(), Currency: m.Currency})
+}
+
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var raw moneyJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	negative := strings.HasPrefix(raw.Amount, "-")
+	parsed, err := ParseMoney(strings.TrimPrefix(raw.Amount, "-"), raw.Currency)
+	if err != nil {
+		return fmt.Errorf("money %q %q: %w", raw.Amount, raw.Currency, err)
+	}
+	if negative {
+		parsed.Amount = -parsed.Amount
+	}
+	*m = parsed
+	return nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,58 @@
+package domain
+
+import (
+	"encoding/json"
+	"testing"
+	"wallet/myerrors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMoney(t *testing.T) {
+	for input, expected := range map[string]int64{
+		"0":       0,
+		"123":     12300,
+		"123.4":   12340,
+		"123.45":  12345,
+		"0.01":    1,
+		"0001.10": 110,
+	} {
+		m, err := ParseMoney(input, DefaultCurrency)
+		assert.NoError(t, err, input)
+		assert.Equal(t, NewMoney(expected, DefaultCurrency), m, input)
+	}
+
+	for _, input := range []string{"", "-1", "+1", "1.", ".5", "1.234", "abc", "1e3", "1,5", "99999999999999999999"} {
+		_, err := ParseMoney(input, DefaultCurrency)
+		assert.Equal(t, myerrors.ErrInvalidAmt, err, input)
+	}
+
+	_, err := ParseMoney("1", "XXX")
+	assert.Equal(t, myerrors.ErrInvalidAmt, err)
+}
+
+func TestMoneyFormat(t *testing.T) {
+	assert.Equal(t, "123.45", NewMoney(12345, DefaultCurrency).Decimal())
+	assert.Equal(t, "0.05", NewMoney(5, DefaultCurrency).Decimal())
+	assert.Equal(t, "-1.50", NewMoney(-150, DefaultCurrency).Decimal())
+	assert.Equal(t, "10.00 KZT", NewMoney(1000, DefaultCurrency).String())
+}
+
+func TestMoneyValidate(t *testing.T) {
+	assert.NoError(t, NewMoney(0, DefaultCurrency).Validate())
+	assert.Error(t, NewMoney(-1, DefaultCurrency).Validate())
+	assert.Error(t, NewMoney(1, "").Validate())
+	assert.False(t, NewMoney(0, DefaultCurrency).IsPositive())
+	assert.True(t, NewMoney(1, DefaultCurrency).IsPositive())
+}
+
+func TestMoneyJSON(t *testing.T) {
+	data, err := json.Marshal(NewMoney(12345, DefaultCurrency))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"amount":"123.45","currency":"KZT"}`, string(data))
+
+	var m Money
+	assert.NoError(t, json.Unmarshal([]byte(`{"amount":"-0.50","currency":"KZT"}`), &m))
+	assert.Equal(t, NewMoney(-50, DefaultCurrency), m)
+	assert.Error(t, json.Unmarshal([]byte(`{"amount":"1.5.0","currency":"KZT"}`), &m))
+}
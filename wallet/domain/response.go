@@ -1,9 +1,34 @@
 package domain
 
 type Response struct {
-	OK           bool          `json:"ok"`
-	Message      string        `json:"message"`
-	WalletList   []string      `json:"walletList"`
-	Wallets      []Wallet      `json:"wallets"`
-	Transactions []Transaction `json:"transactions"`
+	OK            bool           `json:"ok"`
+	Message       string         `json:"message"`
+	Amount        *Money         `json:"amount,omitempty"`
+	WalletList    []string       `json:"walletList"`
+	Wallets       []Wallet       `json:"wallets"`
+	Transactions  []Transaction  `json:"transactions"`
+	NextCursor    string         `json:"nextCursor,omitempty"`
+	TrialBalance  *TrialBalance  `json:"trialBalance,omitempty"`
+	Hold          *Hold          `json:"hold,omitempty"`
+	Schedules     []Schedule     `json:"schedules,omitempty"`
+	Batch         *Batch         `json:"batch,omitempty"`
+	Subscriptions []Subscription `json:"subscriptions,omitempty"`
+	Deliveries    []Delivery     `json:"deliveries,omitempty"`
+}
+
+// FieldError tells what is wrong with a field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Problem is the body of failed responses as RFC 7807 problem details. Code is the stable machine code of the error
+// and Errors lists what is wrong with which fields of the request
+type Problem struct {
+	Type   string       `json:"type"`
+	Title  string       `json:"title"`
+	Status int          `json:"status"`
+	Detail string       `json:"detail,omitempty"`
+	Code   string       `json:"code"`
+	Errors []FieldError `json:"errors,omitempty"`
 }
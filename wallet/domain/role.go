@@ -0,0 +1,69 @@
+package domain
+
+import "time"
+
+// Permission allows its holder something, PermOwnAccount is the baseline of every role and the others reach beyond
+// the user's own wallets
+type Permission string
+
+const (
+	// PermOwnAccount allows using the user's own wallets, sessions and settings
+	PermOwnAccount Permission = "own-account"
+	// PermReadAnyWallet allows reading balances, history and statements of wallets of any user
+	PermReadAnyWallet Permission = "read-any-wallet"
+	// PermManageAnyWallet allows cancelling schedules, settling holds and managing webhooks of any user, and registering
+	// users for any IIN
+	PermManageAnyWallet Permission = "manage-any-wallet"
+	// PermReverseTransaction allows refunding transactions
+	PermReverseTransaction Permission = "reverse-transaction"
+	// PermFreezeAccount allows freezing and unfreezing wallets. Freezing itself is out of scope of role-based access
+	// control and no route offers it yet, operators and admins hold the permission ahead of the routes that will need it
+	PermFreezeAccount Permission = "freeze-account"
+	// PermViewAudit allows viewing the ledger trial balance and other audit reports
+	PermViewAudit Permission = "view-audit"
+	// PermRevokeSessions allows revoking every session and token of any user
+	PermRevokeSessions Permission = "revoke-sessions"
+)
+
+// Role names a set of permissions, tokens carry roles of the user in "roles" claim
+type Role string
+
+const (
+	RoleCustomer Role = "customer"
+	RoleSupport  Role = "support"
+	RoleAuditor  Role = "auditor"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+// RolePermissions are permissions each role grants, customers only get to their own wallets
+var RolePermissions = map[Role][]Permission{
+	RoleCustomer: {PermOwnAccount},
+	RoleSupport:  {PermOwnAccount, PermReadAnyWallet},
+	RoleAuditor:  {PermOwnAccount, PermReadAnyWallet, PermViewAudit},
+	RoleOperator: {PermOwnAccount, PermReadAnyWallet, PermManageAnyWallet, PermReverseTransaction, PermFreezeAccount, PermRevokeSessions},
+	RoleAdmin:    {PermOwnAccount, PermReadAnyWallet, PermManageAnyWallet, PermReverseTransaction, PermFreezeAccount, PermViewAudit, PermRevokeSessions},
+}
+
+// Principal is the user a request is made by with their roles. TokenID and SessionID are "jti" and "sid" claims of
+// the token, either may be empty for tokens from issuers that don't set them
+type Principal struct {
+	IIN       string
+	Roles     []Role
+	TokenID   string
+	SessionID string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// Can reports whether any role of the principal grants perm, unknown roles grant nothing, not even PermOwnAccount
+func (p Principal) Can(perm Permission) bool {
+	for _, role := range p.Roles {
+		for _, granted := range RolePermissions[role] {
+			if granted == perm {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,26 @@
+package domain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrincipalCan(t *testing.T) {
+	customer := Principal{IIN: "910815450350", Roles: []Role{RoleCustomer}}
+	assert.True(t, customer.Can(PermOwnAccount))
+	assert.False(t, customer.Can(PermReadAnyWallet))
+
+	auditor := Principal{Roles: []Role{RoleCustomer, RoleAuditor}}
+	assert.True(t, auditor.Can(PermReadAnyWallet))
+	assert.True(t, auditor.Can(PermViewAudit))
+	assert.False(t, auditor.Can(PermReverseTransaction))
+	assert.False(t, auditor.Can(PermFreezeAccount))
+	assert.True(t, Principal{Roles: []Role{RoleOperator}}.Can(PermFreezeAccount))
+
+	for _, perm := range []Permission{PermOwnAccount, PermReadAnyWallet, PermManageAnyWallet, PermReverseTransaction, PermFreezeAccount, PermViewAudit, PermRevokeSessions} {
+		assert.True(t, Principal{Roles: []Role{RoleAdmin}}.Can(perm), perm)
+		assert.False(t, Principal{Roles: []Role{"root"}}.Can(perm), perm)
+		assert.False(t, Principal{}.Can(perm), perm)
+	}
+}
@@ -0,0 +1,45 @@
+package domain
+
+import "time"
+
+// Schedule statuses, a paused schedule stopped after too many failed runs and is not run again
+const (
+	ScheduleActive    = "active"
+	SchedulePaused    = "paused"
+	ScheduleCancelled = "cancelled"
+	ScheduleDone      = "done"
+)
+
+// Schedule run outcomes
+const (
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+)
+
+// Schedule transfers Amount from one wallet of IIN to another at NextRun. A one-off schedule has no Recurrence
+// and is done after its run, a recurring one is run again at the next time its cron expression matches.
+// Failures counts consecutive runs that failed on insufficient funds, StepUp is the step-up decision it was created
+// with and its runs are made with
+type Schedule struct {
+	ID         int           `json:"id"`
+	Ts         string        `json:"ts"`
+	IIN        string        `json:"iin"`
+	From       string        `json:"from_acc"`
+	To         string        `json:"to_acc"`
+	Amount     Money         `json:"amount"`
+	Recurrence string        `json:"recurrence,omitempty"`
+	NextRun    time.Time     `json:"nextRun"`
+	Status     string        `json:"status"`
+	Failures   int           `json:"failures"`
+	StepUp     string        `json:"step_up"`
+	Runs       []ScheduleRun `json:"runs,omitempty"`
+}
+
+// ScheduleRun records outcome of a schedule executed at Ts
+type ScheduleRun struct {
+	ID         int       `json:"id"`
+	ScheduleID int       `json:"scheduleId"`
+	Ts         time.Time `json:"ts"`
+	Outcome    string    `json:"outcome"`
+	Error      string    `json:"error,omitempty"`
+}
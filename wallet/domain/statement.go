@@ -0,0 +1,51 @@
+package domain
+
+import "time"
+
+// StatementLine is a transaction as it shows on a statement, Change is how it moved the balance and Balance what
+// the balance was after it
+type StatementLine struct {
+	Transaction
+	Counterparty string `json:"counterparty"`
+	Change       Money  `json:"change"`
+	Balance      Money  `json:"balance"`
+}
+
+// Statement lists transactions of an account made in [Since, Until) with balances before, after and in between
+type Statement struct {
+	AccountNo string          `json:"accountno"`
+	Since     time.Time       `json:"since"`
+	Until     time.Time       `json:"until"`
+	Opening   Money           `json:"openingBalance"`
+	Closing   Money           `json:"closingBalance"`
+	Lines     []StatementLine `json:"lines"`
+}
+
+// NewStatement returns statement of account starting at opening balance, transactions go in the order they were made
+func NewStatement(account string, since, until time.Time, opening Money, transactions []Transaction) *Statement {
+	s := &Statement{
+		AccountNo: account,
+		Since:     since,
+		Until:     until,
+		Opening:   opening,
+		Lines:     make([]StatementLine, 0, len(transactions)),
+	}
+	balance := opening.Amount
+	for _, t := range transactions {
+		line := StatementLine{Transaction: t, Counterparty: t.From}
+		var change int64
+		if t.From == account {
+			change -= t.Amount.Amount
+			line.Counterparty = t.To
+		}
+		if t.To == account {
+			change += t.Credited.Amount
+		}
+		balance += change
+		line.Change = NewMoney(change, opening.Currency)
+		line.Balance = NewMoney(balance, opening.Currency)
+		s.Lines = append(s.Lines, line)
+	}
+	s.Closing = NewMoney(balance, opening.Currency)
+	return s
+}
@@ -0,0 +1,79 @@
+package domain
+
+import "time"
+
+// Step-up decisions recorded on transfers, schedules and batches. Transfers at or below the threshold need no second
+// factor, scheduled and batch transfers run with the decision their schedule or batch was created with
+const (
+	StepUpNotRequired  = "not_required"
+	StepUpTOTP         = "totp"
+	StepUpConfirmation = "confirmation"
+)
+
+// StepUpPolicy tells which transfers need a second factor and how wrong codes are dealt with. Transfers of more than
+// Threshold, converted to its currency, need a one-time code or a confirmation token, a zero Threshold turns step-up
+// off. MaxAttempts wrong codes in a row lock the user out of codes for Lockout
+type StepUpPolicy struct {
+	Threshold       Money
+	MaxAttempts     int
+	Lockout         time.Duration
+	ConfirmationTTL time.Duration
+}
+
+// Enabled tells if any transfer needs step-up
+func (p StepUpPolicy) Enabled() bool {
+	return p.Threshold.Currency != ""
+}
+
+// TransferAuth is the second factor a transfer is made with, Code is a one-time code of the user's authenticator and
+// ConfirmationToken comes from confirming the transfer with a code beforehand
+type TransferAuth struct {
+	Code              string
+	ConfirmationToken string
+}
+
+// StepUp is the step-up decision a transfer is made with. A transfer made with a confirmation uses up the one of
+// ConfirmationHash along with it, so that a transfer that fails leaves the confirmation for another try
+type StepUp struct {
+	Decision         string
+	ConfirmationHash string
+}
+
+// TOTP is the TOTP authenticator of IIN, it is pending until activated with a code. LastStep is the time step of the
+// last accepted code, so that a code is accepted once
+type TOTP struct {
+	IIN            string
+	Secret         string
+	Active         bool
+	LastStep       int64
+	FailedAttempts int
+	LockedUntil    time.Time
+}
+
+// TOTPEnrolment is what the user adds to their authenticator app, URI is meant to be shown as a QR code
+type TOTPEnrolment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// TransferConfirmation lets IIN make the transfer of Amount from From to To once until ExpiresAt without a code, it
+// is stored by Hash of its token
+type TransferConfirmation struct {
+	Hash      string
+	IIN       string
+	From      string
+	To        string
+	Amount    Money
+	ExpiresAt time.Time
+}
+
+// Matches tells if transfer of amt from to by IIN is the one confirmed
+func (c TransferConfirmation) Matches(IIN, from, to string, amt Money) bool {
+	return c.IIN == IIN && c.From == from && c.To == to && c.Amount == amt
+}
+
+// ConfirmationToken is what the confirm endpoint responds with, ExpiresIn is its lifetime in seconds
+type ConfirmationToken struct {
+	ConfirmationToken string `json:"confirmationToken"`
+	ExpiresIn         int    `json:"expiresIn"`
+}
@@ -1,10 +1,87 @@
 package domain
 
+import (
+	"encoding/json"
+	"math/big"
+	"wallet/myerrors"
+)
+
+// ReversalType is transfer type of transactions compensating an earlier one
+const ReversalType = "reversal"
+
 type Transaction struct {
-	ID     int    `json:"id"`
-	Ts     string `json:"ts"`
-	Type   string `json:"transfer_type"`
-	From   string `json:"from_acc"`
-	To     string `json:"to_acc"`
-	Amount int    `json:"amount"`
+	ID         int    `json:"id"`
+	Ts         string `json:"ts"`
+	Type       string `json:"transfer_type"`
+	From       string `json:"from_acc"`
+	To         string `json:"to_acc"`
+	Amount     Money  `json:"amount"`
+	Credited   Money  `json:"credited"`
+	Rate       string `json:"rate,omitempty"`
+	ReversesID int    `json:"reverses_id,omitempty"`
+	StepUp     string `json:"step_up,omitempty"`
+}
+
+// NewTransfer returns transaction of given id moving money of conv from to, authorized by stepUp decision
+func NewTransfer(transactionID int, from, to string, conv Conversion, stepUp string) Transaction {
+	return Transaction{
+		ID:       transactionID,
+		Type:     "transfer",
+		From:     from,
+		To:       to,
+		Amount:   conv.Debit,
+		Credited: conv.Credit,
+		Rate:     conv.Rate,
+		StepUp:   stepUp,
+	}
+}
+
+// DecodeTransfer decodes transaction of NewTransfer stored as response of idempotent transfer
+func DecodeTransfer(response string) (*Transaction, error) {
+	var transfer Transaction
+	if err := json.Unmarshal([]byte(response), &transfer); err != nil {
+		return nil, err
+	}
+	return &transfer, nil
+}
+
+// Refund returns conversion taking amount of credited money back from receiver of the transaction, refunded is how
+// much of it earlier reversals already took back and nil amount refunds everything left. The sender gets back a share
+// of the debited money at the original rate, rounded so that all partial refunds together return exactly the debit
+func (t Transaction) Refund(refunded int64, amount *Money) (Conversion, error) {
+	if t.Type == ReversalType {
+		return Conversion{}, myerrors.ErrNotReversible
+	}
+	left := t.Credited.Amount - refunded
+	if left <= 0 {
+		return Conversion{}, myerrors.ErrAlreadyReversed
+	}
+	refund := NewMoney(left, t.Credited.Currency)
+	if amount != nil {
+		if !amount.IsPositive() {
+			return Conversion{}, myerrors.ErrInvalidAmt
+		}
+		if amount.Currency != t.Credited.Currency {
+			return Conversion{}, myerrors.ErrCurrencyMismatch
+		}
+		if amount.Amount > left {
+			return Conversion{}, myerrors.ErrRefundTooLarge
+		}
+		refund = *amount
+	}
+	returned := t.share(refunded+refund.Amount) - t.share(refunded)
+	return Conversion{
+		Debit:  refund,
+		Credit: NewMoney(returned, t.Amount.Currency),
+		Rate:   t.Rate,
+	}, nil
+}
+
+// share returns part of debited amount matching credited minor units, rounded down
+func (t Transaction) share(credited int64) int64 {
+	if t.Credited.Amount == 0 {
+		return 0
+	}
+	n := new(big.Int).Mul(big.NewInt(t.Amount.Amount), big.NewInt(credited))
+	return n.Quo(n, big.NewInt(t.Credited.Amount)).Int64()
 }
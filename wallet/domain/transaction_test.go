@@ -0,0 +1,52 @@
+package domain
+
+import (
+	"testing"
+	"wallet/myerrors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransactionRefund(t *testing.T) {
+	tx := Transaction{ID: 1, Type: "transfer", Amount: NewMoney(500, "KZT"), Credited: NewMoney(500, "KZT")}
+
+	conv, err := tx.Refund(0, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, NewConversion(NewMoney(500, "KZT")), conv)
+
+	partial := NewMoney(200, "KZT")
+	conv, err = tx.Refund(100, &partial)
+	assert.NoError(t, err)
+	assert.Equal(t, NewConversion(partial), conv)
+
+	_, err = tx.Refund(400, &partial)
+	assert.Equal(t, myerrors.ErrRefundTooLarge, err)
+	_, err = tx.Refund(500, nil)
+	assert.Equal(t, myerrors.ErrAlreadyReversed, err)
+	usd := NewMoney(1, "USD")
+	_, err = tx.Refund(0, &usd)
+	assert.Equal(t, myerrors.ErrCurrencyMismatch, err)
+	zero := NewMoney(0, "KZT")
+	_, err = tx.Refund(0, &zero)
+	assert.Equal(t, myerrors.ErrInvalidAmt, err)
+
+	_, err = Transaction{Type: ReversalType, Amount: NewMoney(1, "KZT"), Credited: NewMoney(1, "KZT")}.Refund(0, nil)
+	assert.Equal(t, myerrors.ErrNotReversible, err)
+}
+
+func TestTransactionRefundFX(t *testing.T) {
+	// 10.00 USD was exchanged into 4702.51 KZT
+	tx := Transaction{ID: 1, Type: "transfer", Amount: NewMoney(1000, "USD"), Credited: NewMoney(470251, "KZT"), Rate: "470.25"}
+
+	var returned, refunded int64
+	for _, part := range []int64{100000, 100000, 270251} {
+		amount := NewMoney(part, "KZT")
+		conv, err := tx.Refund(refunded, &amount)
+		assert.NoError(t, err)
+		assert.Equal(t, "USD", conv.Credit.Currency)
+		assert.Equal(t, "470.25", conv.Rate)
+		refunded += part
+		returned += conv.Credit.Amount
+	}
+	assert.Equal(t, int64(1000), returned, "partial refunds add up to the original debit")
+}
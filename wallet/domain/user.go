@@ -0,0 +1,65 @@
+package domain
+
+import "time"
+
+// Refresh token statuses, a used token was exchanged for the next one of its family
+const (
+	RefreshTokenActive  = "active"
+	RefreshTokenUsed    = "used"
+	RefreshTokenRevoked = "revoked"
+)
+
+// User is a user of the built-in auth service, tokens issued to them carry IIN, Username, Ts as "createdAt" and Roles
+type User struct {
+	ID           int    `json:"id"`
+	Ts           string `json:"ts"`
+	IIN          string `json:"iin"`
+	Username     string `json:"username"`
+	PasswordHash string `json:"-"`
+	Roles        []Role `json:"roles"`
+}
+
+// RefreshToken is a refresh token of the user, stored by the hash of its value. Every login starts a family of tokens,
+// each refresh uses up the token for the next one of the family and presenting a used token revokes the whole family
+type RefreshToken struct {
+	Ts        string
+	Hash      string
+	FamilyID  string
+	UserID    int
+	Status    string
+	ExpiresAt time.Time
+}
+
+// TokenPair is what the auth service responds with on login and refresh, AccessToken goes to "token" header of
+// requests and ExpiresIn is its lifetime in seconds
+type TokenPair struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresIn    int    `json:"expiresIn"`
+}
+
+// Session is a login of the user kept alive by refreshing, its ID is the family ID of its refresh tokens and "sid"
+// claim of access tokens issued in it
+type Session struct {
+	ID          string    `json:"id"`
+	CreatedAt   string    `json:"createdAt"`
+	RefreshedAt string    `json:"refreshedAt"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+	Current     bool      `json:"current"`
+}
+
+// Kinds of revocations, a user revocation revokes every token of the IIN issued before it
+const (
+	RevokedToken   = "token"
+	RevokedSession = "session"
+	RevokedUser    = "user"
+)
+
+// Revocation revokes tokens with jti, sid or IIN Subject depending on Kind. It is kept until ExpiresAt, by when every
+// token it revokes has expired anyway
+type Revocation struct {
+	Kind      string
+	Subject   string
+	RevokedAt time.Time
+	ExpiresAt time.Time
+}
@@ -1,11 +1,13 @@
 package domain
 
+// Wallet holds Ledger balance of posted transactions and Available balance, which is the ledger
+// balance less money reserved by active holds
 type Wallet struct {
 	ID        int    `json:"id"`
 	Ts        string `json:"ts"`
 	UpdatedAt string `json:"updatedAt"`
 	AccountNo string `json:"accountno"`
 	IIN       string `json:"iin"`
-	Transfer  int    `json:"transfer"`
-	Amount    int    `json:"amount"`
+	Ledger    Money  `json:"ledger"`
+	Available Money  `json:"available"`
 }
@@ -0,0 +1,47 @@
+package domain
+
+import "time"
+
+// Webhook delivery statuses, a dead delivery ran out of attempts and is kept in the dead-letter list
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// Subscription asks for events of wallets of IIN to be posted to URL signed with Secret
+type Subscription struct {
+	ID     int      `json:"id"`
+	Ts     string   `json:"ts"`
+	IIN    string   `json:"iin"`
+	URL    string   `json:"url"`
+	Secret string   `json:"secret,omitempty"`
+	Events []string `json:"events"`
+}
+
+// Wants reports whether subscription asked for events of eventType
+func (s Subscription) Wants(eventType string) bool {
+	for _, t := range s.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivery is an event queued for a subscription of IIN, it is attempted again at NextAttempt until it is delivered or dead
+type Delivery struct {
+	ID             int       `json:"id"`
+	Ts             string    `json:"ts"`
+	SubscriptionID int       `json:"subscriptionId"`
+	IIN            string    `json:"iin"`
+	URL            string    `json:"url"`
+	Secret         string    `json:"-"`
+	EventID        string    `json:"eventId"`
+	EventType      string    `json:"eventType"`
+	Payload        string    `json:"payload"`
+	Status         string    `json:"status"`
+	Attempts       int       `json:"attempts"`
+	NextAttempt    time.Time `json:"nextAttempt"`
+	LastError      string    `json:"lastError,omitempty"`
+}
@@ -7,9 +7,11 @@ require (
 	github.com/buaazp/fasthttprouter v0.1.1
 	github.com/go-sql-driver/mysql v1.6.0
 	github.com/golang-jwt/jwt v3.2.2+incompatible
+	github.com/lib/pq v1.10.4
 	github.com/stretchr/testify v1.7.0
 	github.com/subosito/gotenv v1.2.0
 	github.com/valyala/fasthttp v1.31.0
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 )
 
 require (
@@ -1,13 +1,108 @@
+// Package myerrors is the catalogue of errors the wallet reports to clients. Every error has a stable machine code
+// clients can rely on and a kind that delivery maps to a response status
 package myerrors
 
-import "errors"
+// Kind tells what sort of failure an error is
+type Kind int
+
+const (
+	// Internal errors are failures of the service itself, their details are not shown to clients
+	Internal Kind = iota
+	// Invalid errors are requests that are malformed or have invalid values
+	Invalid
+	// Unauthorized errors are requests without valid credentials
+	Unauthorized
+	// Forbidden errors are requests for something the user may not do or see
+	Forbidden
+	// NotFound errors are requests for something that does not exist
+	NotFound
+	// Conflict errors are requests clashing with the current state of what they target
+	Conflict
+	// UnsupportedMediaType errors are requests with a body of a type that is not accepted
+	UnsupportedMediaType
+	// Unprocessable errors are valid requests that can't be carried out, such as transfers without enough funds
+	Unprocessable
+	// TooManyRequests errors are requests refused until a lockout of the user is over
+	TooManyRequests
+)
+
+// Error is an error of the catalogue. Wrap it with %w to add context, errors.As finds it under the wrapping
+type Error struct {
+	Kind    Kind
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// New returns Error of kind with machine code and message shown to clients
+func New(kind Kind, code, message string) *Error {
+	return &Error{
+		Kind:    kind,
+		Code:    code,
+		Message: message,
+	}
+}
 
 var (
-	ErrGotInvalidAcc     = errors.New("invalid length of account retrieved from DB")
-	ErrIINMismatch       = errors.New("IINs don't match")
-	ErrInvalidAmt        = errors.New("invalid amount")
-	ErrInvalidToken      = errors.New("invalid token")
-	ErrInsufficientFunds = errors.New("insufficient funds")
-	ErrTokenExpired      = errors.New("Token is expired")
-	ErrUpdateRows        = errors.New("failed to update both rows")
+	ErrGotInvalidAcc        = New(Internal, "invalid_account_retrieved", "invalid length of account retrieved from DB")
+	ErrIINMismatch          = New(Forbidden, "iin_mismatch", "IINs don't match")
+	ErrInvalidAmt           = New(Invalid, "invalid_amount", "invalid amount")
+	ErrInvalidToken         = New(Unauthorized, "invalid_token", "invalid token")
+	ErrInsufficientFunds    = New(Unprocessable, "insufficient_funds", "insufficient funds")
+	ErrTokenExpired         = New(Unauthorized, "token_expired", "Token is expired")
+	ErrUpdateRows           = New(Internal, "update_rows", "failed to update both rows")
+	ErrIdempotencyConflict  = New(Conflict, "idempotency_conflict", "idempotency key already used with a different request")
+	ErrPermissionDenied     = New(Forbidden, "permission_denied", "permission denied")
+	ErrUnsupportedCurrency  = New(Invalid, "unsupported_currency", "unsupported currency")
+	ErrCurrencyMismatch     = New(Unprocessable, "currency_mismatch", "amount currency does not match wallet currency")
+	ErrRateUnavailable      = New(Unprocessable, "rate_unavailable", "exchange rate unavailable")
+	ErrTxNotFound           = New(NotFound, "transaction_not_found", "transaction not found")
+	ErrNotReversible        = New(Unprocessable, "not_reversible", "transaction can not be reversed")
+	ErrAlreadyReversed      = New(Conflict, "already_reversed", "transaction already fully reversed")
+	ErrRefundTooLarge       = New(Unprocessable, "refund_too_large", "refund exceeds amount left to reverse")
+	ErrHoldNotFound         = New(NotFound, "hold_not_found", "hold not found")
+	ErrHoldNotActive        = New(Conflict, "hold_not_active", "hold is no longer active")
+	ErrHoldPayeeMismatch    = New(Forbidden, "hold_payee_mismatch", "hold can only be captured into its payee")
+	ErrCaptureTooLarge      = New(Unprocessable, "capture_too_large", "capture exceeds held amount")
+	ErrInvalidSchedule      = New(Invalid, "invalid_schedule", "invalid schedule")
+	ErrScheduleNotFound     = New(NotFound, "schedule_not_found", "schedule not found")
+	ErrScheduleNotActive    = New(Conflict, "schedule_not_active", "schedule is no longer active")
+	ErrInvalidFilter        = New(Invalid, "invalid_filter", "invalid transaction filter")
+	ErrInvalidPeriod        = New(Invalid, "invalid_period", "invalid statement period")
+	ErrUnsupportedFormat    = New(Invalid, "unsupported_format", "unsupported statement format")
+	ErrInvalidBatch         = New(Invalid, "invalid_batch", "invalid batch")
+	ErrBatchNotFound        = New(NotFound, "batch_not_found", "batch not found")
+	ErrDuplicateReference   = New(Invalid, "duplicate_reference", "duplicate reference")
+	ErrWalletNotFound       = New(NotFound, "wallet_not_found", "wallet not found")
+	ErrInvalidSubscription  = New(Invalid, "invalid_subscription", "invalid webhook subscription")
+	ErrForbiddenWebhookHost = New(Invalid, "forbidden_webhook_host", "webhook URL must not point at loopback, link-local or private addresses")
+	ErrSubscriptionNotFound = New(NotFound, "subscription_not_found", "webhook subscription not found")
+	ErrDeliveryNotFound     = New(NotFound, "delivery_not_found", "webhook delivery not found")
+	ErrDeliveryNotDead      = New(Conflict, "delivery_not_dead", "webhook delivery is not dead")
+	ErrEventNotFound        = New(NotFound, "event_not_found", "event not found")
+	ErrWalletLimit          = New(Unprocessable, "wallet_limit", "no more account numbers left for wallets")
+	ErrInvalidRequest       = New(Invalid, "invalid_request", "invalid request")
+	ErrUnsupportedMediaType = New(UnsupportedMediaType, "unsupported_media_type", "content type must be application/json")
+	ErrInternal             = New(Internal, "internal", "internal error")
+	ErrInvalidIIN           = New(Invalid, "invalid_iin", "IIN must be 12 digits")
+	ErrInvalidUsername      = New(Invalid, "invalid_username", "username must be 3 to 64 letters, digits, dots, dashes or underscores")
+	ErrWeakPassword         = New(Invalid, "weak_password", "password must be 8 to 128 characters long")
+	ErrUserExists           = New(Conflict, "user_exists", "user with this username or IIN already exists")
+	ErrIINOwnershipRequired = New(Forbidden, "iin_ownership_required", "registering an IIN needs a token of that IIN")
+	ErrUserNotFound         = New(NotFound, "user_not_found", "user not found")
+	ErrInvalidCredentials   = New(Unauthorized, "invalid_credentials", "invalid username or password")
+	ErrInvalidRefreshToken  = New(Unauthorized, "invalid_refresh_token", "invalid or expired refresh token")
+	ErrRefreshTokenReused   = New(Unauthorized, "refresh_token_reused", "refresh token was already used, the session is revoked")
+	ErrTokenRevoked         = New(Unauthorized, "token_revoked", "token is revoked")
+	ErrSessionNotFound      = New(NotFound, "session_not_found", "session not found")
+	ErrTokenNotRevocable    = New(Invalid, "token_not_revocable", "token has neither jti nor sid to revoke it by")
+	ErrStepUpRequired       = New(Forbidden, "step_up_required", "transfer above the step-up threshold needs a one-time code or confirmation token")
+	ErrTOTPNotEnrolled      = New(Forbidden, "totp_not_enrolled", "no authenticator is enrolled")
+	ErrTOTPAlreadyEnrolled  = New(Conflict, "totp_already_enrolled", "an authenticator is already enrolled")
+	ErrInvalidOTP           = New(Forbidden, "invalid_otp", "invalid one-time code")
+	ErrOTPLocked            = New(TooManyRequests, "otp_locked", "too many wrong one-time codes, try again later")
+	ErrInvalidConfirmation  = New(Forbidden, "invalid_confirmation", "invalid, used or expired confirmation token")
 )
@@ -0,0 +1,22 @@
+package myerrors
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestError(t *testing.T) {
+	err := fmt.Errorf("transfer from KZT0000000001: %w", ErrInsufficientFunds)
+	assert.True(t, errors.Is(err, ErrInsufficientFunds))
+	assert.False(t, errors.Is(err, ErrInvalidAmt))
+
+	var e *Error
+	if assert.True(t, errors.As(err, &e)) {
+		assert.Equal(t, Unprocessable, e.Kind)
+		assert.Equal(t, "insufficient_funds", e.Code)
+	}
+	assert.Equal(t, "transfer from KZT0000000001: insufficient funds", err.Error())
+}
@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"net/url"
+	"testing"
+	"time"
+	"wallet/domain"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPassword(t *testing.T) {
+	hash, err := HashPassword("correct horse", 1000)
+	assert.NoError(t, err)
+	other, err := HashPassword("correct horse", 1000)
+	assert.NoError(t, err)
+	assert.NotEqual(t, hash, other, "salt is random")
+
+	ok, err := CheckPassword(hash, "correct horse")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = CheckPassword(hash, "battery staple")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	// hashes stored by earlier releases keep checking out
+	ok, err = CheckPassword("pbkdf2-sha256$1000$MDEyMzQ1Njc4OWFiY2RlZg$cBg8D2DungRB9k76szThf5ehfyBz991ay6PT8Srwk4M", "correct horse")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	for _, invalid := range []string{"", "plain", "bcrypt$10$c2FsdA$a2V5", "pbkdf2-sha256$x$c2FsdA$a2V5", "pbkdf2-sha256$10$!$a2V5"} {
+		_, err := CheckPassword(invalid, "correct horse")
+		assert.ErrorIs(t, err, ErrInvalidHash, invalid)
+	}
+}
+
+func TestAccessToken(t *testing.T) {
+	issuer := NewIssuer("secret", 15*time.Minute, "https://wallet.local", "wallet")
+	now := time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC)
+	issuer.now = func() time.Time { return now }
+	user := domain.User{IIN: "910815450350", Username: "sth", Ts: "2021-12-31 19:36:36", Roles: []domain.Role{domain.RoleCustomer}}
+
+	token, err := issuer.AccessToken(user, "family")
+	assert.NoError(t, err)
+	parsed, parts, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+	assert.NoError(t, err)
+	assert.Equal(t, "HS256", parsed.Method.Alg())
+	claims := parsed.Claims.(jwt.MapClaims)
+	assert.Equal(t, "910815450350", claims["iin"])
+	assert.Equal(t, "sth", claims["username"])
+	assert.Equal(t, "2021-12-31 19:36:36", claims["createdAt"])
+	assert.Equal(t, []interface{}{"customer"}, claims["roles"])
+	assert.Equal(t, float64(now.Add(15*time.Minute).Unix()), claims["exp"])
+	assert.Equal(t, "https://wallet.local", claims["iss"])
+	assert.Equal(t, "wallet", claims["aud"])
+	assert.NotEmpty(t, claims["jti"])
+	assert.Equal(t, "family", claims["sid"])
+
+	assert.NoError(t, jwt.SigningMethodHS256.Verify(parts[0]+"."+parts[1], parts[2], []byte("secret")), "signed with the secret")
+}
+
+func TestOpaqueToken(t *testing.T) {
+	a, err := NewOpaqueToken()
+	assert.NoError(t, err)
+	b, err := NewOpaqueToken()
+	assert.NoError(t, err)
+	assert.NotEqual(t, a, b)
+	assert.Len(t, a, 43)
+	assert.Equal(t, HashToken(a), HashToken(a))
+	assert.NotEqual(t, HashToken(a), HashToken(b))
+}
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B test vectors of SHA1, cut to 6 digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	for unix, code := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		got, err := TOTPCode(secret, TOTPStep(time.Unix(unix, 0)))
+		assert.NoError(t, err)
+		assert.Equal(t, code, got, unix)
+	}
+	_, err := TOTPCode("not base32!", 1)
+	assert.Error(t, err)
+}
+
+func TestCheckTOTP(t *testing.T) {
+	secret, err := NewTOTPSecret()
+	assert.NoError(t, err)
+	assert.Len(t, secret, 32)
+	now := time.Date(2022, 1, 10, 12, 0, 10, 0, time.UTC)
+
+	for _, offset := range []time.Duration{-30 * time.Second, 0, 30 * time.Second} {
+		code, err := TOTPCode(secret, TOTPStep(now.Add(offset)))
+		assert.NoError(t, err)
+		step, ok, err := CheckTOTP(secret, code, now)
+		assert.NoError(t, err)
+		assert.True(t, ok, offset)
+		assert.Equal(t, TOTPStep(now.Add(offset)), step)
+	}
+	code, err := TOTPCode(secret, TOTPStep(now.Add(-time.Minute)))
+	assert.NoError(t, err)
+	_, ok, err := CheckTOTP(secret, code, now)
+	assert.NoError(t, err)
+	assert.False(t, ok, "codes two steps old are rejected")
+	_, ok, err = CheckTOTP(secret, "", now)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri, err := url.Parse(TOTPURI("Wallet", "910815450350", "GEZDGNBVGY3TQOJQ"))
+	assert.NoError(t, err)
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, "/Wallet:910815450350", uri.Path)
+	assert.Equal(t, "GEZDGNBVGY3TQOJQ", uri.Query().Get("secret"))
+	assert.Equal(t, "Wallet", uri.Query().Get("issuer"))
+	assert.Equal(t, "6", uri.Query().Get("digits"))
+}
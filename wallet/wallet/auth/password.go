@@ -0,0 +1,64 @@
+// Package auth hashes passwords of users of the built-in auth service, issues their access and refresh tokens and
+// checks one-time codes of their authenticators
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// passwordScheme prefixes password hashes, which are "pbkdf2-sha256$<iterations>$<salt>$<key>" with salt and key in
+// base64url so that iterations can be raised later without breaking stored hashes
+const passwordScheme = "pbkdf2-sha256"
+
+// DefaultIterations are PBKDF2 iterations of new password hashes
+const DefaultIterations = 600000
+
+const (
+	saltSize = 16
+	keySize  = 32
+)
+
+// ErrInvalidHash is returned for stored password hashes that can't be parsed
+var ErrInvalidHash = errors.New("invalid password hash")
+
+// HashPassword hashes password with PBKDF2-HMAC-SHA256 over a random salt
+func HashPassword(password string, iterations int) (string, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2.Key([]byte(password), salt, iterations, keySize, sha256.New)
+	return fmt.Sprintf("%s$%d$%s$%s", passwordScheme, iterations,
+		base64.RawURLEncoding.EncodeToString(salt), base64.RawURLEncoding.EncodeToString(key)), nil
+}
+
+// CheckPassword reports whether password matches hash made by HashPassword
+func CheckPassword(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme {
+		return false, ErrInvalidHash
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false, ErrInvalidHash
+	}
+	salt, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false, ErrInvalidHash
+	}
+	key, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return false, ErrInvalidHash
+	}
+	derived := pbkdf2.Key([]byte(password), salt, iterations, len(key), sha256.New)
+	return subtle.ConstantTimeCompare(derived, key) == 1, nil
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+	"wallet/domain"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Issuer signs access tokens with HMAC by the secret ProcessTokenMiddleware verifies them with
+type Issuer struct {
+	secret   []byte
+	ttl      time.Duration
+	issuer   string
+	audience string
+	now      func() time.Time
+}
+
+// TTL is how long access tokens are valid for
+func (i *Issuer) TTL() time.Duration {
+	return i.ttl
+}
+
+// AccessToken returns access token of user in session sessionID with the claims ProcessTokenMiddleware expects
+func (i *Issuer) AccessToken(user domain.User, sessionID string) (string, error) {
+	jti, err := NewOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	now := i.now()
+	claims := jwt.MapClaims{
+		"jti":       jti,
+		"sid":       sessionID,
+		"iat":       now.Unix(),
+		"exp":       now.Add(i.ttl).Unix(),
+		"iin":       user.IIN,
+		"username":  user.Username,
+		"createdAt": user.Ts,
+		"roles":     user.Roles,
+	}
+	if i.issuer != "" {
+		claims["iss"] = i.issuer
+	}
+	if i.audience != "" {
+		claims["aud"] = i.audience
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(i.secret)
+}
+
+// NewIssuer returns Issuer of access tokens signed by secret valid for ttl, non-empty issuer and audience are set as
+// iss and aud claims
+func NewIssuer(secret string, ttl time.Duration, issuer, audience string) *Issuer {
+	return &Issuer{
+		secret:   []byte(secret),
+		ttl:      ttl,
+		issuer:   issuer,
+		audience: audience,
+		now:      time.Now,
+	}
+}
+
+// NewOpaqueToken returns random token for refresh tokens and IDs that must not be guessable
+func NewOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns hash refresh token is stored by, so that a leaked table can't be used to refresh
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
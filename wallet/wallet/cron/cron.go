@@ -0,0 +1,143 @@
+// Package cron parses the five-field cron expressions recurring transfers are scheduled with
+package cron
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"wallet/myerrors"
+)
+
+// maxYears bounds the search for the next run of expressions such as "0 0 30 2 *" that never match
+const maxYears = 5
+
+// shortcuts are the named expressions accepted besides the five fields
+var shortcuts = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+// field describes one of minute, hour, day of month, month and day of week
+type field struct {
+	min, max int
+}
+
+var fields = []field{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+// Schedule is a parsed expression, each field is a bit set of the values it matches
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	// anyDay is set unless both day of month and day of week are restricted,
+	// in which case a day matching either of them matches like in Vixie cron
+	anyDay bool
+}
+
+// Parse parses "minute hour day-of-month month day-of-week" with *, lists, ranges and steps, or one of the @ shortcuts
+func Parse(expr string) (*Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if shortcut, ok := shortcuts[expr]; ok {
+		expr = shortcut
+	}
+	parts := strings.Fields(expr)
+	if len(parts) != len(fields) {
+		return nil, myerrors.ErrInvalidSchedule
+	}
+	sets := make([]uint64, len(fields))
+	for i, part := range parts {
+		set, err := parseField(part, fields[i])
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = set
+	}
+	// Sunday may be written as 7
+	if sets[4]&(1<<7) != 0 {
+		sets[4] = sets[4]&^(1<<7) | 1
+	}
+	return &Schedule{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		anyDay: strings.HasPrefix(parts[2], "*") || strings.HasPrefix(parts[4], "*"),
+	}, nil
+}
+
+// parseField parses comma separated list of "*", "n", "n-m", each optionally followed by "/step"
+func parseField(part string, f field) (uint64, error) {
+	max := f.max
+	if f.max == 6 {
+		max = 7
+	}
+	var set uint64
+	for _, item := range strings.Split(part, ",") {
+		rng, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			if rng = item[:i]; rng == "" {
+				return 0, myerrors.ErrInvalidSchedule
+			}
+			if step, err = strconv.Atoi(item[i+1:]); err != nil || step <= 0 {
+				return 0, myerrors.ErrInvalidSchedule
+			}
+		}
+		lo, hi := f.min, f.max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, myerrors.ErrInvalidSchedule
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, myerrors.ErrInvalidSchedule
+				}
+			} else if step > 1 {
+				hi = f.max
+			}
+		}
+		if lo < f.min || hi > max || lo > hi {
+			return 0, myerrors.ErrInvalidSchedule
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// Next returns the first time after t the schedule matches, in t's location, or zero time if it never does
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(maxYears, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// matchDay reports whether day of t matches day of month and day of week fields
+func (s *Schedule) matchDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.anyDay {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,40 @@
+package cron
+
+import (
+	"testing"
+	"time"
+	"wallet/myerrors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNext(t *testing.T) {
+	// Friday
+	from := time.Date(2022, 1, 14, 10, 30, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2022, 1, 14, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2022, 1, 14, 10, 45, 0, 0, time.UTC)},
+		{"0 9 1 * *", time.Date(2022, 2, 1, 9, 0, 0, 0, time.UTC)},
+		{"30 10 * * 1-5", time.Date(2022, 1, 17, 10, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2022, 1, 16, 0, 0, 0, 0, time.UTC)},
+		{"0 12 13,20 * 5", time.Date(2022, 1, 14, 12, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		s, err := Parse(tt.expr)
+		if assert.NoError(t, err, tt.expr) {
+			assert.Equal(t, tt.next, s.Next(from), tt.expr)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "/5 * * * *", "a * * * *", "@often"} {
+		_, err := Parse(expr)
+		assert.Equal(t, myerrors.ErrInvalidSchedule, err, expr)
+	}
+}
@@ -0,0 +1,155 @@
+package delivery
+
+import (
+	"errors"
+	"log"
+	"wallet/domain"
+	"wallet/myerrors"
+	"wallet/wallet/delivery/middleware"
+	"wallet/wallet/delivery/response"
+	"wallet/wallet/usecase"
+
+	"github.com/buaazp/fasthttprouter"
+	"github.com/valyala/fasthttp"
+)
+
+// AuthHandler serves the built-in auth service, its routes take JSON bodies and need no token except to register an
+// IIN that already owns wallets
+type AuthHandler struct {
+	uc usecase.AuthUsecase
+}
+
+// registerRequest is the body of POST /auth/register
+type registerRequest struct {
+	IIN      string `json:"iin"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// loginRequest is the body of POST /auth/login
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// refreshRequest is the body of POST /auth/refresh and POST /auth/logout
+type refreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// Register handles creation of a user, responding with the user. Registering an IIN that owns wallets takes a token
+// of that IIN, or of a user allowed to manage any wallet
+func (h *AuthHandler) Register(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|Register endpoint hit")
+	var req registerRequest
+	if !decodeV2Body(ctx, &req) {
+		return
+	}
+	fields := requireField(nil, "iin", req.IIN)
+	fields = requireField(fields, "username", req.Username)
+	fields = requireField(fields, "password", req.Password)
+	if len(fields) > 0 {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidRequest, fields...)
+		return
+	}
+	principal, _ := middleware.GetPrincipal(ctx)
+	user, err := h.uc.Register(req.IIN, req.Username, req.Password, principal.IIN, middleware.Granted(ctx))
+	if err != nil {
+		respondAuthError(ctx, err)
+		return
+	}
+	response.ResponseV2(ctx, fasthttp.StatusCreated, user)
+}
+
+// Login handles exchange of username and password for access and refresh tokens
+func (h *AuthHandler) Login(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|Login endpoint hit")
+	var req loginRequest
+	if !decodeV2Body(ctx, &req) {
+		return
+	}
+	fields := requireField(nil, "username", req.Username)
+	fields = requireField(fields, "password", req.Password)
+	if len(fields) > 0 {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidRequest, fields...)
+		return
+	}
+	tokens, err := h.uc.Login(req.Username, req.Password)
+	if err != nil {
+		respondAuthError(ctx, err)
+		return
+	}
+	response.ResponseV2(ctx, fasthttp.StatusOK, tokens)
+}
+
+// Refresh handles exchange of refresh token for new access and refresh tokens, the old refresh token is used up
+func (h *AuthHandler) Refresh(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|Refresh endpoint hit")
+	var req refreshRequest
+	if !decodeV2Body(ctx, &req) {
+		return
+	}
+	if fields := requireField(nil, "refreshToken", req.RefreshToken); len(fields) > 0 {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidRequest, fields...)
+		return
+	}
+	tokens, err := h.uc.Refresh(req.RefreshToken)
+	if err != nil {
+		respondAuthError(ctx, err)
+		return
+	}
+	response.ResponseV2(ctx, fasthttp.StatusOK, tokens)
+}
+
+// Logout handles revocation of refresh token and every token refreshed from the same login
+func (h *AuthHandler) Logout(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|Logout endpoint hit")
+	var req refreshRequest
+	if !decodeV2Body(ctx, &req) {
+		return
+	}
+	if fields := requireField(nil, "refreshToken", req.RefreshToken); len(fields) > 0 {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidRequest, fields...)
+		return
+	}
+	if err := h.uc.Logout(req.RefreshToken); err != nil {
+		respondAuthError(ctx, err)
+		return
+	}
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// requireField adds error of field name to fields if its value is empty
+func requireField(fields []domain.FieldError, name, value string) []domain.FieldError {
+	if value == "" {
+		fields = append(fields, domain.FieldError{Field: name, Message: "is required"})
+	}
+	return fields
+}
+
+// respondAuthError logs err of auth operation and responds with its problem details, pointing invalid registration
+// values at the field they came from
+func respondAuthError(ctx *fasthttp.RequestCtx, err error) {
+	log.Println("ERROR|Auth handler:", err)
+	var fields []domain.FieldError
+	switch {
+	case errors.Is(err, myerrors.ErrInvalidIIN):
+		fields = append(fields, domain.FieldError{Field: "iin", Message: err.Error()})
+	case errors.Is(err, myerrors.ErrInvalidUsername):
+		fields = append(fields, domain.FieldError{Field: "username", Message: err.Error()})
+	case errors.Is(err, myerrors.ErrWeakPassword):
+		fields = append(fields, domain.FieldError{Field: "password", Message: err.Error()})
+	}
+	response.RespondWithProblem(ctx, err, fields...)
+}
+
+// NewAuthHandler sets POST /auth/register, /auth/login, /auth/refresh and /auth/logout routes
+func NewAuthHandler(r *fasthttprouter.Router, uc usecase.AuthUsecase) {
+	handler := &AuthHandler{
+		uc: uc,
+	}
+	route(r, "POST", "/auth/register", handler.Register)
+	r.POST("/auth/login", handler.Login)
+	r.POST("/auth/refresh", handler.Refresh)
+	r.POST("/auth/logout", handler.Logout)
+}
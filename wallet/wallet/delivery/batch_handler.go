@@ -0,0 +1,125 @@
+package delivery
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"wallet/domain"
+	"wallet/myerrors"
+	"wallet/wallet/delivery/response"
+	"wallet/wallet/usecase"
+
+	"github.com/buaazp/fasthttprouter"
+	"github.com/valyala/fasthttp"
+)
+
+type BatchHandler struct {
+	uc usecase.BatchUsecase
+}
+
+// CreateBatch handles upload of bulk transfers from the wallet in "from" header. Body is either CSV with to, amount
+// and reference columns and an optional header row or, with application/json content type, an array of
+// {"to", "amount", "reference"} objects. "mode" header takes all_or_nothing (the default) or best_effort
+func (h *BatchHandler) CreateBatch(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|CreateBatch endpoint hit")
+	IIN, ok := getIIN(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	from := string(ctx.Request.Header.Peek("from"))
+	if from == "" {
+		response.RespondWithError(ctx, fasthttp.StatusBadRequest, "accountno not provided")
+		return
+	}
+	instructions, err := parseBatch(ctx.Request.Header.ContentType(), ctx.PostBody())
+	if err != nil {
+		log.Println("ERROR|Parsing batch:", err)
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidBatch)
+		return
+	}
+
+	b, err := h.uc.CreateBatch(from, string(ctx.Request.Header.Peek("mode")), instructions, IIN, getTransferAuth(ctx))
+	if err != nil {
+		if b != nil {
+			response.ResponseBatch(ctx, fasthttp.StatusBadRequest, b)
+			return
+		}
+		respondBatchError(ctx, err)
+		return
+	}
+	response.ResponseBatch(ctx, fasthttp.StatusAccepted, b)
+}
+
+// GetBatch handles polling status of the batch in "batch" header with the outcome of each of its lines
+func (h *BatchHandler) GetBatch(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|GetBatch endpoint hit")
+	IIN, anyWallet, ok := getIINAndGrant(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	batchID, err := strconv.Atoi(string(ctx.Request.Header.Peek("batch")))
+	if err != nil {
+		response.RespondWithError(ctx, fasthttp.StatusBadRequest, "invalid batch")
+		return
+	}
+	b, err := h.uc.GetBatch(batchID, IIN, anyWallet)
+	if err != nil {
+		respondBatchError(ctx, err)
+		return
+	}
+	response.ResponseBatch(ctx, fasthttp.StatusOK, b)
+}
+
+// parseBatch reads instructions from CSV or JSON body
+func parseBatch(contentType, body []byte) ([]domain.BatchInstruction, error) {
+	var instructions []domain.BatchInstruction
+	if bytes.HasPrefix(contentType, []byte("application/json")) {
+		err := json.Unmarshal(body, &instructions)
+		return instructions, err
+	}
+
+	r := csv.NewReader(bytes.NewReader(body))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	for first := true; ; first = false {
+		record, err := r.Read()
+		if err == io.EOF {
+			return instructions, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if first && strings.EqualFold(record[0], "to") {
+			continue
+		}
+		if len(record) < 2 || len(record) > 3 {
+			return nil, myerrors.ErrInvalidBatch
+		}
+		in := domain.BatchInstruction{To: record[0], Amount: record[1]}
+		if len(record) == 3 {
+			in.Reference = record[2]
+		}
+		instructions = append(instructions, in)
+	}
+}
+
+// respondBatchError logs err of batch operation and responds with its problem details
+func respondBatchError(ctx *fasthttp.RequestCtx, err error) {
+	log.Println("ERROR|Batch handler:", err)
+	response.RespondWithProblem(ctx, err)
+}
+
+// NewBatchHandler sets /batch routes, POST uploads a batch and GET polls its status
+func NewBatchHandler(r *fasthttprouter.Router, uc usecase.BatchUsecase) {
+	handler := &BatchHandler{
+		uc: uc,
+	}
+	route(r, "POST", "/batch", handler.CreateBatch)
+	route(r, "GET", "/batch", handler.GetBatch)
+}
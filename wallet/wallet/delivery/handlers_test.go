@@ -1,10 +1,28 @@
 package delivery
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
 	"net"
+	"net/http"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+	"wallet/domain"
+	"wallet/myerrors"
+	"wallet/wallet/auth"
+	"wallet/wallet/delivery/middleware"
+	"wallet/wallet/fx"
+	"wallet/wallet/repository/memory"
+	"wallet/wallet/revocation"
+	"wallet/wallet/stream"
+	"wallet/wallet/usecase"
 
+	"github.com/buaazp/fasthttprouter"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
 	"github.com/valyala/fasthttp"
 	"github.com/valyala/fasthttp/fasthttputil"
 )
@@ -24,6 +42,39 @@ var testTable = []struct {
 	{"get-transactions", "/transactions", "GET", []headerData{
 		{key: "account", value: "account"},
 	}, fasthttp.StatusOK},
+	{"get-transactions-filtered", "/transactions", "GET", []headerData{
+		{key: "account", value: "account"},
+		{key: "since", value: "2022-01-01"},
+		{key: "until", value: "2022-01-31T18:00:00Z"},
+		{key: "type", value: "transfer"},
+		{key: "direction", value: "out"},
+		{key: "counterparty", value: "KZT0000000002"},
+		{key: "min_amount", value: "10.50"},
+		{key: "max_amount", value: "100"},
+		{key: "sort", value: "desc"},
+		{key: "limit", value: "20"},
+		{key: "cursor", value: "NDI"},
+	}, fasthttp.StatusOK},
+	{"get-statement", "/statement", "GET", []headerData{
+		{key: "account", value: "account"},
+		{key: "month", value: "2022-01"},
+	}, fasthttp.StatusOK},
+	{"get-statement-pdf", "/statement", "GET", []headerData{
+		{key: "account", value: "account"},
+		{key: "since", value: "2022-01-01"},
+		{key: "until", value: "2022-03-31"},
+		{key: "format", value: "pdf"},
+	}, fasthttp.StatusOK},
+	{"get-statement-camt053", "/statement", "GET", []headerData{
+		{key: "account", value: "account"},
+		{key: "month", value: "2022-01"},
+		{key: "format", value: "camt053"},
+	}, fasthttp.StatusOK},
+	{"get-statement-mt940", "/statement", "GET", []headerData{
+		{key: "account", value: "account"},
+		{key: "month", value: "2022-01"},
+		{key: "format", value: "mt940"},
+	}, fasthttp.StatusOK},
 	{"get-transfer", "/transfer", "GET", []headerData{
 		{key: "from", value: "account"},
 		{key: "to", value: "account"},
@@ -42,6 +93,12 @@ var testTable = []struct {
 	{"get-walletlist", "/wallets", "GET", []headerData{
 		{key: "iin", value: "12345"},
 	}, fasthttp.StatusOK},
+	{"get-transfer-idempotent", "/transfer", "GET", []headerData{
+		{key: "from", value: "account"},
+		{key: "to", value: "account"},
+		{key: "amount", value: "123"},
+		{key: "Idempotency-Key", value: "new"},
+	}, fasthttp.StatusOK},
 }
 
 var testTableErr = []struct {
@@ -58,6 +115,54 @@ var testTableErr = []struct {
 	{"get-transactions", "/transactions", "GET", []headerData{
 		{key: "account", value: "abc"},
 	}, fasthttp.StatusForbidden},
+	{"get-transactions", "/transactions", "GET", []headerData{
+		{key: "account", value: "account"},
+		{key: "direction", value: "sideways"},
+	}, fasthttp.StatusBadRequest},
+	{"get-transactions", "/transactions", "GET", []headerData{
+		{key: "account", value: "account"},
+		{key: "since", value: "yesterday"},
+	}, fasthttp.StatusBadRequest},
+	{"get-transactions", "/transactions", "GET", []headerData{
+		{key: "account", value: "account"},
+		{key: "since", value: "2022-02-01"},
+		{key: "until", value: "2022-01-01"},
+	}, fasthttp.StatusBadRequest},
+	{"get-transactions", "/transactions", "GET", []headerData{
+		{key: "account", value: "account"},
+		{key: "cursor", value: "not a cursor"},
+	}, fasthttp.StatusBadRequest},
+	{"get-transactions", "/transactions", "GET", []headerData{
+		{key: "account", value: "account"},
+		{key: "limit", value: "0"},
+	}, fasthttp.StatusBadRequest},
+	{"get-transactions", "/transactions", "GET", []headerData{
+		{key: "account", value: "account"},
+		{key: "sort", value: "random"},
+	}, fasthttp.StatusBadRequest},
+	{"get-statement", "/statement", "GET", []headerData{
+		{key: "month", value: "2022-01"},
+	}, fasthttp.StatusBadRequest},
+	{"get-statement", "/statement", "GET", []headerData{
+		{key: "account", value: "account"},
+	}, fasthttp.StatusBadRequest},
+	{"get-statement", "/statement", "GET", []headerData{
+		{key: "account", value: "account"},
+		{key: "month", value: "January"},
+	}, fasthttp.StatusBadRequest},
+	{"get-statement", "/statement", "GET", []headerData{
+		{key: "account", value: "account"},
+		{key: "month", value: "2022-01"},
+		{key: "format", value: "xlsx"},
+	}, fasthttp.StatusBadRequest},
+	{"get-statement", "/statement", "GET", []headerData{
+		{key: "account", value: "abc"},
+		{key: "month", value: "2022-01"},
+	}, fasthttp.StatusForbidden},
+	{"get-statement", "/statement", "GET", []headerData{
+		{key: "account", value: "unknown"},
+		{key: "month", value: "2022-01"},
+	}, fasthttp.StatusNotFound},
 	{"get-transfer", "/transfer", "GET", []headerData{}, fasthttp.StatusBadRequest},
 	{"get-transfer", "/transfer", "GET", []headerData{
 		{key: "from", value: "wrong"},
@@ -68,16 +173,16 @@ var testTableErr = []struct {
 		{key: "from", value: "abc"},
 		{key: "to", value: "wrong"},
 		{key: "amount", value: "123"},
-	}, fasthttp.StatusInternalServerError},
+	}, fasthttp.StatusForbidden},
 	{"get-transfer", "/transfer", "GET", []headerData{
-		{key: "from", value: "wrongg"},
-		{key: "to", value: "abc"},
-		{key: "amount", value: "123"},
-	}, fasthttp.StatusInternalServerError},
+		{key: "from", value: "ok"},
+		{key: "to", value: "ok"},
+		{key: "amount", value: "999999"},
+	}, fasthttp.StatusUnprocessableEntity},
 	{"get-transfer", "/transfer", "GET", []headerData{
 		{key: "from", value: "ok"},
 		{key: "to", value: "ok"},
-		{key: "amount", value: "insufficient"},
+		{key: "amount", value: "1.001"},
 	}, fasthttp.StatusBadRequest},
 	{"get-topup", "/topup", "GET", []headerData{
 		{key: "account", value: "KZT0000000001"},
@@ -92,6 +197,68 @@ var testTableErr = []struct {
 		{key: "iin", value: "wrong"},
 	}, fasthttp.StatusForbidden},
 	{"get-info", "/info", "GET", []headerData{}, fasthttp.StatusBadRequest},
+	{"get-transfer", "/transfer", "GET", []headerData{
+		{key: "from", value: "ok"},
+		{key: "to", value: "ok"},
+		{key: "amount", value: "123"},
+		{key: "Idempotency-Key", value: "conflict"},
+	}, fasthttp.StatusConflict},
+	{"get-transfer", "/transfer", "GET", []headerData{
+		{key: "from", value: "ok"},
+		{key: "to", value: "ok"},
+		{key: "amount", value: "123"},
+		{key: "Idempotency-Key", value: "wrong"},
+	}, fasthttp.StatusInternalServerError},
+	{"get-topup", "/topup", "GET", []headerData{
+		{key: "account", value: "KZT0000000001"},
+		{key: "amount", value: "76"},
+		{key: "Idempotency-Key", value: "conflict"},
+	}, fasthttp.StatusConflict},
+	{"get-trial-balance", "/admin/trial-balance", "GET", []headerData{}, fasthttp.StatusForbidden},
+	{"get-reverse", "/admin/reverse", "GET", []headerData{
+		{key: "transaction", value: "1"},
+	}, fasthttp.StatusForbidden},
+	{"get-reverse", "/admin/reverse", "GET", []headerData{
+		{key: "transaction", value: "abc"},
+	}, fasthttp.StatusForbidden},
+}
+
+var testTableCurrency = []struct {
+	name               string
+	url                string
+	method             string
+	params             []headerData
+	expectedStatusCode int
+}{
+	{"get-transfer-fx", "/transfer", "GET", []headerData{
+		{key: "from", value: "USD0000000001"},
+		{key: "to", value: "KZT0000000002"},
+		{key: "amount", value: "10.50"},
+		{key: "currency", value: "USD"},
+	}, fasthttp.StatusOK},
+	{"get-add-currency", "/add", "GET", []headerData{
+		{key: "currency", value: "EUR"},
+	}, fasthttp.StatusOK},
+	{"get-add-currency", "/add", "GET", []headerData{
+		{key: "currency", value: "XXX"},
+	}, fasthttp.StatusBadRequest},
+	{"get-transfer-fx", "/transfer", "GET", []headerData{
+		{key: "from", value: "KZT0000000001"},
+		{key: "to", value: "USD0000000002"},
+		{key: "amount", value: "10"},
+		{key: "currency", value: "USD"},
+	}, fasthttp.StatusUnprocessableEntity},
+	{"get-transfer-fx", "/transfer", "GET", []headerData{
+		{key: "from", value: "EUR0000000001"},
+		{key: "to", value: "USD0000000002"},
+		{key: "amount", value: "10"},
+		{key: "currency", value: "EUR"},
+	}, fasthttp.StatusUnprocessableEntity},
+	{"get-topup-currency", "/topup", "GET", []headerData{
+		{key: "account", value: "KZT0000000001"},
+		{key: "amount", value: "10"},
+		{key: "currency", value: "USD"},
+	}, fasthttp.StatusUnprocessableEntity},
 }
 
 func TestHandlers(t *testing.T) {
@@ -197,3 +364,1004 @@ func TestHandlersError(t *testing.T) {
 		fasthttp.ReleaseResponse(res)
 	}
 }
+
+var testTableHold = []struct {
+	name               string
+	url                string
+	method             string
+	params             []headerData
+	expectedStatusCode int
+}{
+	{"get-hold", "/hold", "GET", []headerData{
+		{key: "account", value: "KZT0000000001"},
+		{key: "payee", value: "KZT0000000002"},
+		{key: "amount", value: "100"},
+		{key: "ttl", value: "30m"},
+	}, fasthttp.StatusOK},
+	{"get-hold", "/hold", "GET", []headerData{
+		{key: "account", value: "KZT0000000001"},
+		{key: "payee", value: "KZT0000000002"},
+		{key: "amount", value: "100"},
+		{key: "ttl", value: "soon"},
+	}, fasthttp.StatusBadRequest},
+	{"get-hold", "/hold", "GET", []headerData{
+		{key: "account", value: "KZT0000000001"},
+		{key: "amount", value: "100"},
+	}, fasthttp.StatusBadRequest},
+	{"get-hold", "/hold", "GET", []headerData{
+		{key: "account", value: "abc"},
+		{key: "payee", value: "KZT0000000002"},
+		{key: "amount", value: "100"},
+	}, fasthttp.StatusForbidden},
+	{"get-hold", "/hold", "GET", []headerData{
+		{key: "account", value: "KZT0000000001"},
+		{key: "payee", value: "KZT0000000002"},
+		{key: "amount", value: "999999"},
+	}, fasthttp.StatusUnprocessableEntity},
+	{"get-hold-capture", "/hold/capture", "GET", []headerData{
+		{key: "hold", value: "1"},
+		{key: "to", value: "KZT0000000002"},
+		{key: "amount", value: "60"},
+	}, fasthttp.StatusOK},
+	{"get-hold-capture", "/hold/capture", "GET", []headerData{
+		{key: "hold", value: "1"},
+	}, fasthttp.StatusOK},
+	{"get-hold-capture", "/hold/capture", "GET", []headerData{
+		{key: "hold", value: "1"},
+		{key: "to", value: "KZT0000000003"},
+	}, fasthttp.StatusForbidden},
+	{"get-hold-capture", "/hold/capture", "GET", []headerData{
+		{key: "hold", value: "1"},
+		{key: "to", value: "KZT0000000002"},
+		{key: "amount", value: "100.01"},
+	}, fasthttp.StatusUnprocessableEntity},
+	{"get-hold-capture", "/hold/capture", "GET", []headerData{
+		{key: "hold", value: "404"},
+		{key: "to", value: "KZT0000000002"},
+	}, fasthttp.StatusNotFound},
+	{"get-hold-capture", "/hold/capture", "GET", []headerData{
+		{key: "hold", value: "409"},
+		{key: "to", value: "KZT0000000002"},
+	}, fasthttp.StatusConflict},
+	{"get-hold-release", "/hold/release", "GET", []headerData{
+		{key: "hold", value: "1"},
+	}, fasthttp.StatusOK},
+	{"get-hold-release", "/hold/release", "GET", []headerData{
+		{key: "hold", value: "409"},
+	}, fasthttp.StatusConflict},
+	{"get-hold-release", "/hold/release", "GET", []headerData{
+		{key: "hold", value: "abc"},
+	}, fasthttp.StatusBadRequest},
+}
+
+func TestCurrencyHandlers(t *testing.T) {
+	s := newTestServer(t, testServerOptions{})
+	access := s.token(nil)
+	for _, tt := range testTableCurrency {
+		status, body := s.do(testRequest{method: tt.method, url: tt.url, token: access, headers: tt.params})
+		if status != tt.expectedStatusCode {
+			t.Errorf("for %s, expected %d but got %d: %s", tt.name, tt.expectedStatusCode, status, body)
+		}
+	}
+}
+
+var testTableSchedule = []struct {
+	name               string
+	url                string
+	method             string
+	params             []headerData
+	expectedStatusCode int
+}{
+	{"get-schedule", "/schedule", "GET", []headerData{
+		{key: "from", value: "KZT0000000001"},
+		{key: "to", value: "KZT0000000002"},
+		{key: "amount", value: "150000"},
+		{key: "every", value: "0 9 1 * *"},
+	}, fasthttp.StatusOK},
+	{"get-schedule", "/schedule", "GET", []headerData{
+		{key: "from", value: "KZT0000000001"},
+		{key: "to", value: "KZT0000000002"},
+		{key: "amount", value: "100"},
+		{key: "at", value: "2053-09-08T19:21:28Z"},
+	}, fasthttp.StatusOK},
+	{"get-schedule", "/schedule", "GET", []headerData{
+		{key: "from", value: "KZT0000000001"},
+		{key: "to", value: "KZT0000000002"},
+		{key: "amount", value: "100"},
+	}, fasthttp.StatusBadRequest},
+	{"get-schedule", "/schedule", "GET", []headerData{
+		{key: "from", value: "KZT0000000001"},
+		{key: "to", value: "KZT0000000002"},
+		{key: "amount", value: "100"},
+		{key: "at", value: "2021-12-31T19:36:36Z"},
+	}, fasthttp.StatusBadRequest},
+	{"get-schedule", "/schedule", "GET", []headerData{
+		{key: "from", value: "KZT0000000001"},
+		{key: "to", value: "KZT0000000002"},
+		{key: "amount", value: "100"},
+		{key: "every", value: "every day"},
+	}, fasthttp.StatusBadRequest},
+	{"get-schedule", "/schedule", "GET", []headerData{
+		{key: "from", value: "abc"},
+		{key: "to", value: "KZT0000000002"},
+		{key: "amount", value: "100"},
+		{key: "every", value: "@daily"},
+	}, fasthttp.StatusForbidden},
+	{"get-schedules", "/schedules", "GET", []headerData{}, fasthttp.StatusOK},
+	{"get-schedule-cancel", "/schedule/cancel", "GET", []headerData{
+		{key: "schedule", value: "1"},
+	}, fasthttp.StatusOK},
+	{"get-schedule-cancel", "/schedule/cancel", "GET", []headerData{
+		{key: "schedule", value: "403"},
+	}, fasthttp.StatusForbidden},
+	{"get-schedule-cancel", "/schedule/cancel", "GET", []headerData{
+		{key: "schedule", value: "404"},
+	}, fasthttp.StatusNotFound},
+	{"get-schedule-cancel", "/schedule/cancel", "GET", []headerData{
+		{key: "schedule", value: "409"},
+	}, fasthttp.StatusConflict},
+}
+
+func TestHoldHandlers(t *testing.T) {
+	s := newTestServer(t, testServerOptions{})
+	access := s.token(nil)
+	for _, tt := range testTableHold {
+		status, body := s.do(testRequest{method: tt.method, url: tt.url, token: access, headers: tt.params})
+		if status != tt.expectedStatusCode {
+			t.Errorf("for %s, expected %d but got %d: %s", tt.name, tt.expectedStatusCode, status, body)
+		}
+	}
+}
+
+func TestScheduleHandlers(t *testing.T) {
+	s := newTestServer(t, testServerOptions{})
+	access := s.token(nil)
+	for _, tt := range testTableSchedule {
+		status, body := s.do(testRequest{method: tt.method, url: tt.url, token: access, headers: tt.params})
+		if status != tt.expectedStatusCode {
+			t.Errorf("for %s, expected %d but got %d: %s", tt.name, tt.expectedStatusCode, status, body)
+		}
+	}
+}
+
+var testTableBatch = []struct {
+	name               string
+	method             string
+	contentType        string
+	body               string
+	params             []headerData
+	expectedStatusCode int
+}{
+	{"post-batch-csv", "POST", "text/csv", "to,amount,reference\nKZT0000000002,10.50,salary-1\nKZT0000000003,20,salary-2\n", []headerData{
+		{key: "from", value: "KZT0000000001"},
+		{key: "mode", value: "best_effort"},
+	}, fasthttp.StatusAccepted},
+	{"post-batch-json", "POST", "application/json", `[{"to":"KZT0000000002","amount":"10.50","reference":"salary-1"}]`, []headerData{
+		{key: "from", value: "KZT0000000001"},
+		{key: "mode", value: "best_effort"},
+	}, fasthttp.StatusAccepted},
+	{"post-batch-insufficient", "POST", "text/csv", "KZT0000000002,10.50\n", []headerData{
+		{key: "from", value: "KZT0000000001"},
+	}, fasthttp.StatusUnprocessableEntity},
+	{"post-batch-invalid-lines", "POST", "text/csv", "KZT0000000002,-1,a\nKZT0000000003,5,b\nKZT0000000004,5,b\n", []headerData{
+		{key: "from", value: "KZT0000000001"},
+		{key: "mode", value: "best_effort"},
+	}, fasthttp.StatusBadRequest},
+	{"post-batch-invalid-mode", "POST", "text/csv", "KZT0000000002,10.50\n", []headerData{
+		{key: "from", value: "KZT0000000001"},
+		{key: "mode", value: "sometimes"},
+	}, fasthttp.StatusBadRequest},
+	{"post-batch-malformed", "POST", "application/json", `{"to":`, []headerData{
+		{key: "from", value: "KZT0000000001"},
+	}, fasthttp.StatusBadRequest},
+	{"post-batch-empty", "POST", "text/csv", "", []headerData{
+		{key: "from", value: "KZT0000000001"},
+	}, fasthttp.StatusBadRequest},
+	{"post-batch-iin", "POST", "text/csv", "KZT0000000002,10.50\n", []headerData{
+		{key: "from", value: "abc"},
+	}, fasthttp.StatusForbidden},
+	{"get-batch", "GET", "", "", []headerData{
+		{key: "batch", value: "1"},
+	}, fasthttp.StatusOK},
+	{"get-batch", "GET", "", "", []headerData{
+		{key: "batch", value: "403"},
+	}, fasthttp.StatusForbidden},
+	{"get-batch", "GET", "", "", []headerData{
+		{key: "batch", value: "404"},
+	}, fasthttp.StatusNotFound},
+	{"get-batch", "GET", "", "", []headerData{
+		{key: "batch", value: "x"},
+	}, fasthttp.StatusBadRequest},
+}
+
+func TestBatchHandlers(t *testing.T) {
+	s := newTestServer(t, testServerOptions{})
+	access := s.token(nil)
+	for _, tt := range testTableBatch {
+		status, body := s.do(testRequest{method: tt.method, url: "/batch", token: access, contentType: tt.contentType, body: tt.body, headers: tt.params})
+		if status != tt.expectedStatusCode {
+			t.Errorf("for %s, expected %d but got %d: %s", tt.name, tt.expectedStatusCode, status, body)
+		}
+	}
+}
+
+var testTableWebhook = []struct {
+	name               string
+	url                string
+	params             []headerData
+	expectedStatusCode int
+}{
+	{"get-webhook", "/webhook", []headerData{
+		{key: "url", value: "https://example.com/hook"},
+		{key: "events", value: "transfer.sent, transfer.received"},
+	}, fasthttp.StatusOK},
+	{"get-webhook", "/webhook", []headerData{
+		{key: "url", value: "https://example.com/hook"},
+		{key: "secret", value: "secret"},
+	}, fasthttp.StatusOK},
+	{"get-webhook", "/webhook", []headerData{
+		{key: "url", value: "ftp://example.com/hook"},
+	}, fasthttp.StatusBadRequest},
+	{"get-webhook", "/webhook", []headerData{
+		{key: "url", value: "http://169.254.169.254/latest/meta-data"},
+	}, fasthttp.StatusBadRequest},
+	{"get-webhook", "/webhook", []headerData{
+		{key: "url", value: "http://127.0.0.1:8080/hook"},
+	}, fasthttp.StatusBadRequest},
+	{"get-webhook", "/webhook", []headerData{
+		{key: "url", value: "https://example.com/hook"},
+		{key: "events", value: "wallet.deleted"},
+	}, fasthttp.StatusBadRequest},
+	{"get-webhooks", "/webhooks", []headerData{}, fasthttp.StatusOK},
+	{"get-webhook-delete", "/webhook/delete", []headerData{
+		{key: "subscription", value: "1"},
+	}, fasthttp.StatusOK},
+	{"get-webhook-delete", "/webhook/delete", []headerData{
+		{key: "subscription", value: "403"},
+	}, fasthttp.StatusForbidden},
+	{"get-webhook-delete", "/webhook/delete", []headerData{
+		{key: "subscription", value: "404"},
+	}, fasthttp.StatusNotFound},
+	{"get-webhook-delete", "/webhook/delete", []headerData{}, fasthttp.StatusBadRequest},
+	{"get-webhooks-dead", "/webhooks/dead", []headerData{}, fasthttp.StatusOK},
+	{"get-webhook-redeliver", "/webhook/redeliver", []headerData{
+		{key: "delivery", value: "1"},
+	}, fasthttp.StatusOK},
+	{"get-webhook-redeliver", "/webhook/redeliver", []headerData{
+		{key: "delivery", value: "403"},
+	}, fasthttp.StatusForbidden},
+	{"get-webhook-redeliver", "/webhook/redeliver", []headerData{
+		{key: "delivery", value: "404"},
+	}, fasthttp.StatusNotFound},
+	{"get-webhook-redeliver", "/webhook/redeliver", []headerData{
+		{key: "delivery", value: "409"},
+	}, fasthttp.StatusConflict},
+}
+
+func TestWebhookHandlers(t *testing.T) {
+	s := newTestServer(t, testServerOptions{})
+	access := s.token(nil)
+	for _, tt := range testTableWebhook {
+		status, body := s.do(testRequest{method: "GET", url: tt.url, token: access, headers: tt.params})
+		if status != tt.expectedStatusCode {
+			t.Errorf("for %s, expected %d but got %d: %s", tt.name, tt.expectedStatusCode, status, body)
+		}
+	}
+}
+
+func TestStreamHandler(t *testing.T) {
+	db := memory.NewMemoryDBInterface()
+	if err := db.InsertWallet("KZT0000000001", "910815450350", domain.DefaultCurrency); err != nil {
+		t.Fatal(err)
+	}
+	uc := usecase.NewStreamUsecase(db, stream.NewBroker(usecase.WalletOwner(db)))
+	s := newTestServer(t, testServerOptions{routes: func(r *fasthttprouter.Router) {
+		NewStreamHandler(r, uc)
+	}})
+	access := s.token(nil)
+	// open returns reader of the stream body, which lasts as long as the token
+	open := func(access, lastEventID string) (*bufio.Reader, net.Conn) {
+		conn, err := s.ln.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "GET /stream HTTP/1.1\r\nHost: test.com\r\ntoken: %s\r\nLast-Event-ID: %s\r\n\r\n", access, lastEventID)
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != fasthttp.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("expected 200 event stream but got %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+		}
+		return bufio.NewReader(res.Body), conn
+	}
+	// next returns lines of the next event
+	next := func(body *bufio.Reader) []string {
+		var lines []string
+		for {
+			line, err := body.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line == "\n" {
+				return lines
+			}
+			lines = append(lines, strings.TrimSuffix(line, "\n"))
+		}
+	}
+
+	// relay marks events of the outbox published as the relay of any instance would and returns their IDs, the
+	// stream gets them by following the outbox
+	relay := func() []string {
+		events, err := db.GetUnpublishedEvents(100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, e := range events {
+			if err := db.MarkEventPublished(e.ID, time.Now()); err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, e.ID)
+		}
+		if _, err := uc.Follow(); err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+	amount := domain.NewMoney(100, domain.DefaultCurrency)
+	topUp := func(account string) {
+		if err := db.TopUp(account, amount, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.InsertWallet("KZT0000000002", "880316450123", domain.DefaultCurrency); err != nil {
+		t.Fatal(err)
+	}
+	relay()
+
+	body, conn := open(access, "")
+	if lines := next(body); len(lines) != 2 || lines[0] != "event: balance" || !strings.Contains(lines[1], `"accountno":"KZT0000000001"`) {
+		t.Errorf("expected balance of the wallet first but got %q", lines)
+	}
+	topUp("KZT0000000001")
+	topUp("KZT0000000002")
+	// wallets created after the stream was opened are streamed too
+	if err := db.InsertWallet("KZT0000000003", "910815450350", domain.DefaultCurrency); err != nil {
+		t.Fatal(err)
+	}
+	ids := relay()
+	if lines := next(body); len(lines) != 3 || lines[0] != "id: "+ids[0] || lines[1] != "event: wallet.topped_up" {
+		t.Errorf("expected top-up event but got %q", lines)
+	}
+	if lines := next(body); len(lines) != 2 || lines[0] != "event: balance" {
+		t.Errorf("expected balance after event but got %q", lines)
+	}
+	if lines := next(body); len(lines) != 3 || lines[0] != "id: "+ids[2] || lines[1] != "event: wallet.created" {
+		t.Errorf("expected creation of the new wallet but got %q", lines)
+	}
+	conn.Close()
+
+	// a client resuming gets what it missed from the outbox before the balances, published yet or not
+	topUp("KZT0000000003")
+	body, conn = open(access, ids[0])
+	if lines := next(body); len(lines) != 3 || lines[0] != "id: "+ids[2] {
+		t.Errorf("expected missed creation of the wallet but got %q", lines)
+	}
+	if lines := next(body); len(lines) != 3 || lines[1] != "event: wallet.topped_up" || !strings.Contains(lines[2], "KZT0000000003") {
+		t.Errorf("expected missed top-up but got %q", lines)
+	}
+	// replayed events are not sent again once the relay publishes them
+	missed := relay()
+	topUp("KZT0000000001")
+	relay()
+	for _, account := range []string{"KZT0000000001", "KZT0000000003"} {
+		if lines := next(body); len(lines) != 2 || !strings.Contains(lines[1], account) {
+			t.Errorf("expected balance of %s but got %q", account, lines)
+		}
+	}
+	if lines := next(body); len(lines) != 3 || lines[0] == "id: "+missed[0] || lines[1] != "event: wallet.topped_up" {
+		t.Errorf("expected the new top-up but got %q", lines)
+	}
+	conn.Close()
+
+	// a client whose last event is unknown is told to reset
+	body, conn = open(access, "unknown")
+	if lines := next(body); len(lines) != 2 || lines[0] != "event: reset" {
+		t.Errorf("expected reset but got %q", lines)
+	}
+	conn.Close()
+
+	// the stream ends once its token expires or is revoked
+	body, conn = open(s.token(jwt.MapClaims{"exp": time.Now().Add(2 * time.Second).Unix()}), "")
+	for {
+		lines := next(body)
+		if lines[0] == "event: balance" {
+			continue
+		}
+		if len(lines) != 2 || lines[0] != "event: end" || lines[1] != `data: {"code":"token_expired"}` {
+			t.Errorf("expected end of expired token but got %q", lines)
+		}
+		break
+	}
+	conn.Close()
+	revocations := revocation.NewStore(nil, time.Hour)
+	middleware.SetRevocationStore(revocations)
+	defer middleware.SetRevocationStore(nil)
+	body, conn = open(s.token(jwt.MapClaims{"jti": "stream"}), "")
+	defer conn.Close()
+	if err := revocations.RevokeToken("stream", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		lines := next(body)
+		if lines[0] == "event: balance" {
+			continue
+		}
+		if len(lines) != 2 || lines[0] != "event: end" || lines[1] != `data: {"code":"token_revoked"}` {
+			t.Errorf("expected end of revoked token but got %q", lines)
+		}
+		break
+	}
+}
+
+var testTableV2 = []struct {
+	name               string
+	method             string
+	url                string
+	contentType        string
+	body               string
+	params             []headerData
+	expectedStatusCode int
+	expectedBody       string
+}{
+	{"create-wallet", "POST", "/v2/wallets", "application/json", `{"currency":"USD"}`, nil, fasthttp.StatusCreated, `"currency":"USD"`},
+	{"create-wallet-default-currency", "POST", "/v2/wallets", "", "", nil, fasthttp.StatusCreated, ""},
+	{"create-wallet-unsupported-currency", "POST", "/v2/wallets", "application/json", `{"currency":"XYZ"}`, nil, fasthttp.StatusBadRequest, `{"field":"currency","message":"unsupported currency"}`},
+	{"create-wallet-unknown-field", "POST", "/v2/wallets", "application/json", `{"currency":"USD","iin":"1"}`, nil, fasthttp.StatusBadRequest, `{"field":"iin","message":"unknown field"}`},
+	{"create-wallet-not-json", "POST", "/v2/wallets", "text/plain", "USD", nil, fasthttp.StatusUnsupportedMediaType, `"code":"unsupported_media_type"`},
+	{"get-wallets", "GET", "/v2/wallets", "", "", nil, fasthttp.StatusOK, `{"wallets":[]}`},
+	{"get-wallet", "GET", "/v2/wallets/KZT0000000001", "", "", nil, fasthttp.StatusOK, ""},
+	{"get-wallet-other", "GET", "/v2/wallets/other", "", "", nil, fasthttp.StatusForbidden, `"code":"iin_mismatch"`},
+	{"get-wallet-unknown", "GET", "/v2/wallets/wrong", "", "", nil, fasthttp.StatusNotFound, `"type":"/errors/wallet_not_found","title":"wallet not found","status":404`},
+	{"get-transactions", "GET", "/v2/wallets/KZT0000000001/transactions?since=2022-01-01&sort=desc&limit=10", "", "", nil, fasthttp.StatusOK, `{"transactions":[]}`},
+	{"get-transactions-invalid-filter", "GET", "/v2/wallets/KZT0000000001/transactions?direction=sideways", "", "", nil, fasthttp.StatusBadRequest, `{"field":"direction","message":"invalid transaction filter"}`},
+	{"get-transactions-empty-range", "GET", "/v2/wallets/KZT0000000001/transactions?since=2022-02-01&until=2022-01-01", "", "", nil, fasthttp.StatusBadRequest, ""},
+	{"get-transactions-other", "GET", "/v2/wallets/other/transactions", "", "", nil, fasthttp.StatusForbidden, ""},
+	{"transfer", "POST", "/v2/transfers", "application/json", `{"from":"KZT0000000001","to":"KZT0000000002","amount":"10.50"}`, nil, fasthttp.StatusCreated, `{"id":1,"from":"KZT0000000001","to":"KZT0000000002","amount":{"amount":"10.50","currency":"KZT"}}`},
+	{"transfer-cross-currency", "POST", "/v2/transfers", "application/json", `{"from":"USD0000000001","to":"KZT0000000002","amount":"10","currency":"USD"}`, nil, fasthttp.StatusCreated, ""},
+	{"transfer-missing-fields", "POST", "/v2/transfers", "application/json", `{"amount":"-1"}`, nil, fasthttp.StatusBadRequest, `[{"field":"from","message":"is required"},{"field":"to","message":"is required"},{"field":"amount","message":"must be a positive decimal in KZT"}]`},
+	{"transfer-amount-number", "POST", "/v2/transfers", "application/json", `{"from":"KZT0000000001","to":"KZT0000000002","amount":10}`, nil, fasthttp.StatusBadRequest, `{"field":"amount","message":"must be a string"}`},
+	{"transfer-malformed", "POST", "/v2/transfers", "application/json", `{"from":`, nil, fasthttp.StatusBadRequest, ""},
+	{"transfer-insufficient", "POST", "/v2/transfers", "application/json", `{"from":"KZT0000000001","to":"KZT0000000002","amount":"999999"}`, nil, fasthttp.StatusUnprocessableEntity, `"code":"insufficient_funds"`},
+	{"transfer-not-owner", "POST", "/v2/transfers", "application/json", `{"from":"abc","to":"KZT0000000002","amount":"1"}`, nil, fasthttp.StatusForbidden, ""},
+	{"transfer-idempotency-conflict", "POST", "/v2/transfers", "application/json", `{"from":"KZT0000000001","to":"KZT0000000002","amount":"1"}`, []headerData{
+		{key: "Idempotency-Key", value: "conflict"},
+	}, fasthttp.StatusConflict, ""},
+	{"transfer-get", "GET", "/v2/transfers", "", "", nil, fasthttp.StatusMethodNotAllowed, ""},
+}
+
+func TestV2Handlers(t *testing.T) {
+	s := newTestServer(t, testServerOptions{})
+	access := s.token(nil)
+	for _, tt := range testTableV2 {
+		status, body := s.do(testRequest{method: tt.method, url: tt.url, token: access, contentType: tt.contentType, body: tt.body, headers: tt.params})
+		if status != tt.expectedStatusCode {
+			t.Errorf("for %s, expected %d but got %d: %s", tt.name, tt.expectedStatusCode, status, body)
+		}
+		if !strings.Contains(body, tt.expectedBody) {
+			t.Errorf("for %s, expected body containing %s but got %s", tt.name, tt.expectedBody, body)
+		}
+	}
+}
+
+func TestTransferReplay(t *testing.T) {
+	db := memory.NewMemoryDBInterface()
+	for _, account := range []string{"KZT0000000001", "KZT0000000002"} {
+		if err := db.InsertWallet(account, "910815450350", domain.DefaultCurrency); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.TopUp("KZT0000000001", domain.NewMoney(10000, domain.DefaultCurrency), nil); err != nil {
+		t.Fatal(err)
+	}
+	rates, err := fx.NewStaticProvider(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfers := usecase.NewTransferUsecase(db, time.Hour, rates, domain.StepUpPolicy{})
+	s := newTestServer(t, testServerOptions{routes: func(r *fasthttprouter.Router) {
+		NewTransferHandler(r, transfers)
+		NewV2Handler(r, usecase.NewAddWalletUsecase(db), usecase.NewGetWalletsUsecase(db), transfers, usecase.NewGetTransactionsUsecase(db))
+	}})
+	access := s.token(nil)
+	v1 := func() int {
+		status, body := s.request("GET", "/transfer", access, "", headerData{"from", "KZT0000000001"},
+			headerData{"to", "KZT0000000002"}, headerData{"amount", "10"}, headerData{"Idempotency-Key", "v1"})
+		assert.Equal(t, fasthttp.StatusOK, status, body)
+		var res domain.Response
+		assert.NoError(t, json.Unmarshal([]byte(body), &res))
+		if !assert.Len(t, res.Transactions, 1) {
+			return 0
+		}
+		return res.Transactions[0].ID
+	}
+	v2 := func() int {
+		status, body := s.request("POST", "/v2/transfers", access, `{"from":"KZT0000000001","to":"KZT0000000002","amount":"10"}`,
+			headerData{"Idempotency-Key", "v2"})
+		assert.Equal(t, fasthttp.StatusCreated, status, body)
+		var res transferResponse
+		assert.NoError(t, json.Unmarshal([]byte(body), &res))
+		return res.ID
+	}
+
+	// a replayed transfer is answered with the transaction of the first request, which is only made once
+	first := v1()
+	assert.NotZero(t, first)
+	assert.Equal(t, first, v1())
+	second := v2()
+	assert.NotZero(t, second)
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, second, v2())
+	amount, err := db.GetAmount("KZT0000000001")
+	assert.NoError(t, err)
+	assert.Equal(t, domain.NewMoney(8000, domain.DefaultCurrency), amount)
+}
+
+// roleEndpoints are requests made by every role of roleTokens in TestRoles, expected maps each role to the status
+// it gets. Unknown roles have no permissions, not even to their own wallets
+var roleEndpoints = []struct {
+	name     string
+	url      string
+	params   []headerData
+	expected map[string]int
+}{
+	{"own-info", "/info", []headerData{
+		{key: "iin", value: "910815450350"},
+	}, map[string]int{"customer": 200, "support": 200, "auditor": 200, "operator": 200, "admin": 200, "legacy-admin": 200, "unknown": 403}},
+	{"other-info", "/info", []headerData{
+		{key: "iin", value: "other"},
+	}, map[string]int{"customer": 403, "support": 200, "auditor": 200, "operator": 200, "admin": 200, "legacy-admin": 200, "unknown": 403}},
+	{"other-wallet", "/v2/wallets/other", nil,
+		map[string]int{"customer": 403, "support": 200, "auditor": 200, "operator": 200, "admin": 200, "legacy-admin": 200, "unknown": 403}},
+	{"cancel-other-schedule", "/schedule/cancel", []headerData{
+		{key: "schedule", value: "403"},
+	}, map[string]int{"customer": 403, "support": 403, "auditor": 403, "operator": 200, "admin": 200, "legacy-admin": 200, "unknown": 403}},
+	{"release-hold", "/hold/release", []headerData{
+		{key: "hold", value: "1"},
+	}, map[string]int{"customer": 200, "support": 200, "auditor": 200, "operator": 200, "admin": 200, "legacy-admin": 200, "unknown": 403}},
+	{"release-other-hold", "/hold/release", []headerData{
+		{key: "hold", value: "403"},
+	}, map[string]int{"customer": 403, "support": 403, "auditor": 403, "operator": 200, "admin": 200, "legacy-admin": 200, "unknown": 403}},
+	{"capture-other-hold", "/hold/capture", []headerData{
+		{key: "hold", value: "403"},
+	}, map[string]int{"customer": 403, "support": 403, "auditor": 403, "operator": 200, "admin": 200, "legacy-admin": 200, "unknown": 403}},
+	{"reverse", "/admin/reverse", []headerData{
+		{key: "transaction", value: "1"},
+	}, map[string]int{"customer": 403, "support": 403, "auditor": 403, "operator": 200, "admin": 200, "legacy-admin": 200, "unknown": 403}},
+	{"reverse-invalid", "/admin/reverse", []headerData{
+		{key: "transaction", value: "1"},
+		{key: "amount", value: "-1"},
+	}, map[string]int{"customer": 403, "support": 403, "auditor": 403, "operator": 400, "admin": 400, "legacy-admin": 400, "unknown": 403}},
+	{"trial-balance", "/admin/trial-balance", nil,
+		map[string]int{"customer": 403, "support": 403, "auditor": 200, "operator": 403, "admin": 200, "legacy-admin": 200, "unknown": 403}},
+}
+
+// roleTokens are claims of tokens of each role, tokens issued before roles carry admin claim instead
+var roleTokens = map[string]jwt.MapClaims{
+	"customer":     {"roles": []string{"customer"}},
+	"support":      {"roles": []string{"support"}},
+	"auditor":      {"roles": []string{"auditor"}},
+	"operator":     {"roles": []string{"operator"}},
+	"admin":        {"roles": []string{"customer", "admin"}},
+	"legacy-admin": {"admin": true},
+	"unknown":      {"roles": []string{"root"}},
+}
+
+func TestRoles(t *testing.T) {
+	s := newTestServer(t, testServerOptions{})
+	for role, claims := range roleTokens {
+		access := s.token(claims)
+		for _, tt := range roleEndpoints {
+			status, body := s.do(testRequest{method: "GET", url: tt.url, token: access, headers: tt.params})
+			if status != tt.expected[role] {
+				t.Errorf("for %s as %s, expected %d but got %d: %s", tt.name, role, tt.expected[role], status, body)
+			}
+		}
+	}
+}
+
+func TestAuthHandlers(t *testing.T) {
+	s := newTestServer(t, testServerOptions{})
+	tokens := func(body string) domain.TokenPair {
+		var pair domain.TokenPair
+		assert.NoError(t, json.Unmarshal([]byte(body), &pair))
+		assert.NotEmpty(t, pair.AccessToken)
+		assert.NotEmpty(t, pair.RefreshToken)
+		assert.Equal(t, 60, pair.ExpiresIn)
+		return pair
+	}
+
+	access := s.token(nil)
+	status, body := s.request("POST", "/auth/register", "", `{"iin":"910815450350","username":"sth","password":"correct horse"}`)
+	assert.Equal(t, fasthttp.StatusUnauthorized, status, "registering needs a token of the IIN")
+	status, body = s.request("POST", "/auth/register", access, `{"iin":"910815450350","username":"sth","password":"correct horse"}`)
+	assert.Equal(t, fasthttp.StatusCreated, status)
+	assert.Contains(t, body, `"username":"sth"`)
+	assert.NotContains(t, body, "pbkdf2")
+	status, body = s.request("POST", "/auth/register", access, `{"iin":"910815450350","username":"other","password":"correct horse"}`)
+	assert.Equal(t, fasthttp.StatusConflict, status)
+	assert.Contains(t, body, `"code":"user_exists"`)
+	status, body = s.request("POST", "/auth/register", access, `{"iin":"9108","username":"x","password":"short"}`)
+	assert.Equal(t, fasthttp.StatusBadRequest, status)
+	assert.Contains(t, body, `"field":"iin"`)
+	status, body = s.request("POST", "/auth/register", access, `{"username":"sth"}`)
+	assert.Equal(t, fasthttp.StatusBadRequest, status)
+	assert.Contains(t, body, `[{"field":"iin","message":"is required"},{"field":"password","message":"is required"}]`)
+
+	status, body = s.request("POST", "/auth/login", "", `{"username":"sth","password":"wrong password"}`)
+	assert.Equal(t, fasthttp.StatusUnauthorized, status)
+	assert.Contains(t, body, `"code":"invalid_credentials"`)
+	status, _ = s.request("POST", "/auth/login", "", `{"username":"nobody","password":"correct horse"}`)
+	assert.Equal(t, fasthttp.StatusUnauthorized, status)
+	status, body = s.request("POST", "/auth/login", "", `{"username":"sth","password":"correct horse"}`)
+	assert.Equal(t, fasthttp.StatusOK, status)
+	login := tokens(body)
+
+	// access tokens issued here are accepted by the token middleware
+	status, body = s.request("GET", "/v2/wallets", login.AccessToken, "")
+	assert.Equal(t, fasthttp.StatusOK, status, body)
+
+	status, body = s.request("POST", "/auth/refresh", "", `{"refreshToken":"`+login.RefreshToken+`"}`)
+	assert.Equal(t, fasthttp.StatusOK, status)
+	refreshed := tokens(body)
+	assert.NotEqual(t, login.RefreshToken, refreshed.RefreshToken)
+
+	// replaying the used token revokes the family, including the token it was exchanged for
+	status, body = s.request("POST", "/auth/refresh", "", `{"refreshToken":"`+login.RefreshToken+`"}`)
+	assert.Equal(t, fasthttp.StatusUnauthorized, status)
+	assert.Contains(t, body, `"code":"refresh_token_reused"`)
+	status, body = s.request("POST", "/auth/refresh", "", `{"refreshToken":"`+refreshed.RefreshToken+`"}`)
+	assert.Equal(t, fasthttp.StatusUnauthorized, status)
+	assert.Contains(t, body, `"code":"invalid_refresh_token"`)
+
+	status, body = s.request("POST", "/auth/login", "", `{"username":"sth","password":"correct horse"}`)
+	assert.Equal(t, fasthttp.StatusOK, status)
+	relogin := tokens(body)
+	status, _ = s.request("POST", "/auth/logout", "", `{"refreshToken":"`+relogin.RefreshToken+`"}`)
+	assert.Equal(t, fasthttp.StatusNoContent, status)
+	status, _ = s.request("POST", "/auth/refresh", "", `{"refreshToken":"`+relogin.RefreshToken+`"}`)
+	assert.Equal(t, fasthttp.StatusUnauthorized, status)
+	status, _ = s.request("POST", "/auth/logout", "", `{"refreshToken":"unknown"}`)
+	assert.Equal(t, fasthttp.StatusUnauthorized, status)
+	status, _ = s.request("POST", "/auth/refresh", "", `{}`)
+	assert.Equal(t, fasthttp.StatusBadRequest, status)
+}
+
+func TestRegisterIINOwnership(t *testing.T) {
+	const owner, other = "880316450123", "870412450456"
+	db := memory.NewMemoryDBInterface()
+	for account, IIN := range map[string]string{"KZT0000000001": owner, "KZT0000000002": other} {
+		if err := db.InsertWallet(account, IIN, domain.DefaultCurrency); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newTestServer(t, testServerOptions{routes: func(r *fasthttprouter.Router) {
+		NewAuthHandler(r, usecase.NewAuthUsecase(db, auth.NewIssuer(ACCESS_SECRET, time.Minute, "", ""),
+			revocation.NewStore(db, time.Hour), time.Hour, 1000))
+	}})
+	register := func(IIN, username string, claims jwt.MapClaims) (int, string) {
+		var token string
+		if claims != nil {
+			token = s.token(claims)
+		}
+		return s.request("POST", "/auth/register", token, `{"iin":"`+IIN+`","username":"`+username+`","password":"correct horse"}`)
+	}
+
+	// wallets made before their IIN had a user can't be taken over by registering the IIN
+	status, body := register(owner, "thief", nil)
+	assert.Equal(t, fasthttp.StatusUnauthorized, status)
+	assert.Contains(t, body, `"code":"invalid_token"`)
+	status, body = register(owner, "thief", jwt.MapClaims{"iin": "910815450350"})
+	assert.Equal(t, fasthttp.StatusForbidden, status)
+	assert.Contains(t, body, `"code":"iin_ownership_required"`)
+	status, body = register(owner, "thief", jwt.MapClaims{"iin": "910815450350", "roles": []string{"support"}})
+	assert.Equal(t, fasthttp.StatusForbidden, status, body)
+	status, body = register(owner, "thief", jwt.MapClaims{"iin": owner, "exp": time.Now().Add(-time.Minute).Unix()})
+	assert.Equal(t, fasthttp.StatusUnauthorized, status)
+	assert.Contains(t, body, `"code":"token_expired"`)
+	_, err := db.GetUserByUsername("thief")
+	assert.Equal(t, myerrors.ErrUserNotFound, err)
+
+	status, body = register(owner, "owner", jwt.MapClaims{"iin": owner})
+	assert.Equal(t, fasthttp.StatusCreated, status, body)
+	status, body = register(other, "operated", jwt.MapClaims{"iin": "910815450350", "roles": []string{"operator"}})
+	assert.Equal(t, fasthttp.StatusCreated, status, body)
+	// nor can an IIN be claimed before its owner opens a wallet
+	status, body = register("950101450777", "squatter", nil)
+	assert.Equal(t, fasthttp.StatusUnauthorized, status, body)
+	status, body = register("950101450777", "squatter", jwt.MapClaims{"iin": "910815450350"})
+	assert.Equal(t, fasthttp.StatusForbidden, status)
+	assert.Contains(t, body, `"code":"iin_ownership_required"`)
+	status, body = register("950101450777", "newcomer", jwt.MapClaims{"iin": "950101450777"})
+	assert.Equal(t, fasthttp.StatusCreated, status, body)
+}
+
+func TestSessionHandlers(t *testing.T) {
+	s := newTestServer(t, testServerOptions{})
+	login := func() domain.TokenPair {
+		status, body := s.request("POST", "/auth/login", "", `{"username":"sessions","password":"correct horse"}`)
+		assert.Equal(t, fasthttp.StatusOK, status)
+		var pair domain.TokenPair
+		assert.NoError(t, json.Unmarshal([]byte(body), &pair))
+		return pair
+	}
+	sessions := func(token string) []domain.Session {
+		status, body := s.request("GET", "/auth/sessions", token, "")
+		assert.Equal(t, fasthttp.StatusOK, status, body)
+		var list []domain.Session
+		assert.NoError(t, json.Unmarshal([]byte(body), &list))
+		return list
+	}
+
+	status, _ := s.request("POST", "/auth/register", s.token(jwt.MapClaims{"iin": "880316450123"}), `{"iin":"880316450123","username":"sessions","password":"correct horse"}`)
+	assert.Equal(t, fasthttp.StatusCreated, status)
+	phone, laptop := login(), login()
+
+	list := sessions(phone.AccessToken)
+	assert.Len(t, list, 2)
+	var current, other string
+	for _, session := range list {
+		if session.Current {
+			current = session.ID
+		} else {
+			other = session.ID
+		}
+	}
+	assert.NotEmpty(t, current)
+	assert.NotEmpty(t, other)
+
+	// revoking the laptop session from the phone cuts off its access token right away
+	status, body := s.request("POST", "/auth/sessions/revoke", phone.AccessToken, `{"session":"`+other+`"}`)
+	assert.Equal(t, fasthttp.StatusNoContent, status, body)
+	status, body = s.request("GET", "/auth/sessions", laptop.AccessToken, "")
+	assert.Equal(t, fasthttp.StatusUnauthorized, status)
+	assert.Contains(t, body, `"code":"token_revoked"`)
+	status, _ = s.request("POST", "/auth/refresh", "", `{"refreshToken":"`+laptop.RefreshToken+`"}`)
+	assert.Equal(t, fasthttp.StatusUnauthorized, status)
+	assert.Len(t, sessions(phone.AccessToken), 1)
+	status, body = s.request("POST", "/auth/sessions/revoke", phone.AccessToken, `{"session":"`+other+`"}`)
+	assert.Equal(t, fasthttp.StatusNotFound, status)
+	assert.Contains(t, body, `"code":"session_not_found"`)
+	status, body = s.request("POST", "/auth/sessions/revoke", phone.AccessToken, `{}`)
+	assert.Equal(t, fasthttp.StatusBadRequest, status)
+	assert.Contains(t, body, `"field":"session"`)
+
+	// revoking the presented token ends its session too
+	status, _ = s.request("POST", "/auth/revoke", phone.AccessToken, "")
+	assert.Equal(t, fasthttp.StatusNoContent, status)
+	status, _ = s.request("GET", "/auth/sessions", phone.AccessToken, "")
+	assert.Equal(t, fasthttp.StatusUnauthorized, status)
+	status, _ = s.request("POST", "/auth/refresh", "", `{"refreshToken":"`+phone.RefreshToken+`"}`)
+	assert.Equal(t, fasthttp.StatusUnauthorized, status)
+	status, body = s.request("POST", "/auth/revoke", s.token(nil), "")
+	assert.Equal(t, fasthttp.StatusBadRequest, status)
+	assert.Contains(t, body, `"code":"token_not_revocable"`)
+
+	// admins revoke every session of an IIN
+	tablet := login()
+	status, _ = s.request("POST", "/admin/revoke-sessions", s.token(nil), `{"iin":"880316450123"}`)
+	assert.Equal(t, fasthttp.StatusForbidden, status)
+	admin := s.token(jwt.MapClaims{"roles": []string{"admin"}})
+	status, body = s.request("POST", "/admin/revoke-sessions", admin, `{"iin":"880316450123"}`)
+	assert.Equal(t, fasthttp.StatusNoContent, status, body)
+	status, _ = s.request("GET", "/auth/sessions", tablet.AccessToken, "")
+	assert.Equal(t, fasthttp.StatusUnauthorized, status)
+	status, _ = s.request("POST", "/auth/refresh", "", `{"refreshToken":"`+tablet.RefreshToken+`"}`)
+	assert.Equal(t, fasthttp.StatusUnauthorized, status)
+	status, _ = s.request("POST", "/admin/revoke-sessions", admin, `{}`)
+	assert.Equal(t, fasthttp.StatusBadRequest, status)
+}
+
+func TestStepUpHandlers(t *testing.T) {
+	const other = "870412450456"
+	db := memory.NewMemoryDBInterface()
+	for _, w := range []struct{ account, IIN string }{
+		{"KZT0000000001", "910815450350"},
+		{"KZT0000000002", "950101450777"},
+		{"KZT0000000003", other},
+	} {
+		if err := db.InsertWallet(w.account, w.IIN, domain.DefaultCurrency); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the wallet of the other user is topped up once a transfer with a confirmation has failed
+	for _, account := range []string{"KZT0000000001", "KZT0000000002"} {
+		if err := db.TopUp(account, domain.NewMoney(100000000, domain.DefaultCurrency), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rates, err := fx.NewStaticProvider(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := domain.StepUpPolicy{
+		Threshold:       domain.NewMoney(100000, domain.DefaultCurrency),
+		MaxAttempts:     3,
+		Lockout:         time.Hour,
+		ConfirmationTTL: time.Minute,
+	}
+	transfers := usecase.NewTransferUsecase(db, time.Hour, rates, policy)
+	s := newTestServer(t, testServerOptions{routes: func(r *fasthttprouter.Router) {
+		NewStepUpHandler(r, usecase.NewStepUpUsecase(db, policy))
+		NewV2Handler(r, usecase.NewAddWalletUsecase(db), usecase.NewGetWalletsUsecase(db), transfers, usecase.NewGetTransactionsUsecase(db))
+		NewHoldHandler(r, usecase.NewHoldUsecase(db, rates, time.Hour, policy))
+		NewScheduleHandler(r, usecase.NewScheduleUsecase(db, transfers, time.Minute))
+		NewBatchHandler(r, usecase.NewBatchUsecase(db, transfers, rates))
+	}})
+	capture := func(token string, headers ...headerData) (int, string) {
+		return s.request("GET", "/hold/capture", token, "", headers...)
+	}
+	enrol := func(token string) string {
+		status, body := s.request("POST", "/auth/totp/enrol", token, "")
+		assert.Equal(t, fasthttp.StatusCreated, status, body)
+		var enrolment domain.TOTPEnrolment
+		assert.NoError(t, json.Unmarshal([]byte(body), &enrolment))
+		assert.Contains(t, enrolment.URI, "otpauth://totp/")
+		return enrolment.Secret
+	}
+	// codes of the current step and the next one are both accepted whenever the step changes during the test
+	step := auth.TOTPStep(time.Now())
+	code := func(secret string, step int64) string {
+		code, err := auth.TOTPCode(secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+	access, otherAccess, payerAccess := s.token(nil), s.token(jwt.MapClaims{"iin": other}), s.token(jwt.MapClaims{"iin": "950101450777"})
+	const small = `{"from":"KZT0000000001","to":"KZT0000000002","amount":"10"}`
+	large := func(from, extra string) string {
+		return `{"from":"` + from + `","to":"KZT0000000002","amount":"5000"` + extra + `}`
+	}
+
+	status, body := s.request("POST", "/v2/transfers", access, small)
+	assert.Equal(t, fasthttp.StatusCreated, status, body)
+	status, body = s.request("POST", "/v2/transfers", access, large("KZT0000000001", ""))
+	assert.Equal(t, fasthttp.StatusForbidden, status)
+	assert.Contains(t, body, `"code":"step_up_required"`)
+	// placing a hold is stepped up just like a transfer is, the capture moves money authorized by the owner then
+	place := func(amount string) (int, string) {
+		return s.request("GET", "/hold", access, "", headerData{"account", "KZT0000000001"},
+			headerData{"payee", "KZT0000000002"}, headerData{"amount", amount})
+	}
+	status, body = place("5000")
+	assert.Equal(t, fasthttp.StatusForbidden, status)
+	assert.Contains(t, body, `"code":"step_up_required"`)
+	status, body = place("1000")
+	assert.Equal(t, fasthttp.StatusOK, status, body)
+	var placed domain.Response
+	assert.NoError(t, json.Unmarshal([]byte(body), &placed))
+	if !assert.NotNil(t, placed.Hold) {
+		return
+	}
+	assert.Equal(t, "KZT0000000002", placed.Hold.Payee)
+	hold := headerData{"hold", strconv.Itoa(placed.Hold.ID)}
+	// only the owner of the payee captures, and only into the payee
+	status, body = capture(otherAccess, hold)
+	assert.Equal(t, fasthttp.StatusForbidden, status)
+	assert.Contains(t, body, `"code":"iin_mismatch"`)
+	status, body = capture(otherAccess, hold, headerData{"to", "KZT0000000003"})
+	assert.Equal(t, fasthttp.StatusForbidden, status)
+	assert.Contains(t, body, `"code":"iin_mismatch"`)
+	status, body = capture(access, hold)
+	assert.Equal(t, fasthttp.StatusForbidden, status)
+	assert.Contains(t, body, `"code":"iin_mismatch"`)
+	status, body = capture(payerAccess, hold, headerData{"to", "KZT0000000003"})
+	assert.Equal(t, fasthttp.StatusForbidden, status)
+	assert.Contains(t, body, `"code":"hold_payee_mismatch"`)
+	status, body = capture(payerAccess, hold)
+	assert.Equal(t, fasthttp.StatusOK, status, body)
+	assert.Contains(t, body, `"status":"`+domain.HoldCaptured+`"`)
+
+	// a pending authenticator gives no codes for transfers
+	secret := enrol(access)
+	status, body = s.request("POST", "/v2/transfers", access, large("KZT0000000001", `,"otp":"`+code(secret, step)+`"`))
+	assert.Equal(t, fasthttp.StatusForbidden, status)
+	assert.Contains(t, body, `"code":"totp_not_enrolled"`)
+	status, body = s.request("POST", "/auth/totp/activate", access, `{"otp":"`+code(secret, step)+`"}`)
+	assert.Equal(t, fasthttp.StatusNoContent, status, body)
+	status, body = s.request("POST", "/auth/totp/enrol", access, "")
+	assert.Equal(t, fasthttp.StatusConflict, status, body)
+
+	// a code is accepted once
+	status, body = s.request("POST", "/v2/transfers", access, large("KZT0000000001", `,"otp":"`+code(secret, step)+`"`))
+	assert.Equal(t, fasthttp.StatusForbidden, status)
+	assert.Contains(t, body, `"code":"invalid_otp"`)
+	status, body = s.request("POST", "/v2/transfers", access, large("KZT0000000001", `,"otp":"`+code(secret, step+1)+`"`))
+	assert.Equal(t, fasthttp.StatusCreated, status, body)
+
+	// wrong codes in a row lock the user out, even of right ones
+	for i := 0; i < policy.MaxAttempts; i++ {
+		status, body = s.request("POST", "/v2/transfers", access, large("KZT0000000001", `,"otp":"000000"`))
+		assert.Equal(t, fasthttp.StatusForbidden, status)
+		assert.Contains(t, body, `"code":"invalid_otp"`)
+	}
+	status, body = s.request("POST", "/auth/totp/disable", access, `{"otp":"`+code(secret, step+1)+`"}`)
+	assert.Equal(t, fasthttp.StatusTooManyRequests, status)
+	assert.Contains(t, body, `"code":"otp_locked"`)
+
+	// a confirmation token makes the confirmed transfer once
+	otherSecret := enrol(otherAccess)
+	status, body = s.request("POST", "/auth/totp/activate", otherAccess, `{"otp":"`+code(otherSecret, step)+`"}`)
+	assert.Equal(t, fasthttp.StatusNoContent, status, body)
+	status, body = s.request("POST", "/v2/transfers/confirm", otherAccess, large("KZT0000000003", ""))
+	assert.Equal(t, fasthttp.StatusBadRequest, status)
+	assert.Contains(t, body, `"field":"otp"`)
+	status, body = s.request("POST", "/v2/transfers/confirm", otherAccess, large("KZT0000000003", `,"otp":"`+code(otherSecret, step+1)+`"`))
+	assert.Equal(t, fasthttp.StatusCreated, status, body)
+	var confirmation domain.ConfirmationToken
+	assert.NoError(t, json.Unmarshal([]byte(body), &confirmation))
+	assert.Equal(t, 60, confirmation.ExpiresIn)
+	withToken := `,"confirmationToken":"` + confirmation.ConfirmationToken + `"`
+	status, body = s.request("POST", "/v2/transfers", otherAccess, large("KZT0000000003", withToken))
+	assert.Equal(t, fasthttp.StatusUnprocessableEntity, status)
+	assert.Contains(t, body, `"code":"insufficient_funds"`)
+	if err := db.TopUp("KZT0000000003", domain.NewMoney(100000000, domain.DefaultCurrency), nil); err != nil {
+		t.Fatal(err)
+	}
+	status, body = s.request("POST", "/v2/transfers", otherAccess, large("KZT0000000003", withToken))
+	assert.Equal(t, fasthttp.StatusCreated, status, body)
+	status, body = s.request("POST", "/v2/transfers", otherAccess, large("KZT0000000003", withToken))
+	assert.Equal(t, fasthttp.StatusForbidden, status)
+	assert.Contains(t, body, `"code":"invalid_confirmation"`)
+	status, body = s.request("POST", "/v2/transfers/confirm", otherAccess, large("KZT0000000003", `,"otp":"`+code(otherSecret, step+1)+`"`))
+	assert.Equal(t, fasthttp.StatusForbidden, status)
+	assert.Contains(t, body, `"code":"invalid_otp"`)
+
+	// schedules and batches are stepped up when created as their transfers run without the user
+	schedule := func(headers ...headerData) (int, string) {
+		return s.request("GET", "/schedule", payerAccess, "", append([]headerData{{"from", "KZT0000000002"},
+			{"to", "KZT0000000001"}, {"amount", "5000"}, {"at", time.Now().Add(time.Hour).Format(time.RFC3339)}}, headers...)...)
+	}
+	const largeBatch = `[{"to":"KZT0000000001","amount":"3000"},{"to":"KZT0000000003","amount":"3000"}]`
+	batch := func(instructions string, headers ...headerData) (int, string) {
+		return s.request("POST", "/batch", payerAccess, instructions, append([]headerData{{"from", "KZT0000000002"}}, headers...)...)
+	}
+	status, body = schedule()
+	assert.Equal(t, fasthttp.StatusForbidden, status)
+	assert.Contains(t, body, `"code":"step_up_required"`)
+	status, body = batch(largeBatch)
+	assert.Equal(t, fasthttp.StatusForbidden, status)
+	assert.Contains(t, body, `"code":"step_up_required"`)
+	status, body = batch(`[{"to":"KZT0000000001","amount":"10"},{"to":"KZT0000000003","amount":"10"}]`)
+	assert.Equal(t, fasthttp.StatusAccepted, status, body)
+	assert.Contains(t, body, `"step_up":"not_required"`)
+
+	payerSecret := enrol(payerAccess)
+	status, body = s.request("POST", "/auth/totp/activate", payerAccess, `{"otp":"`+code(payerSecret, step-1)+`"}`)
+	assert.Equal(t, fasthttp.StatusNoContent, status, body)
+	status, body = schedule(headerData{"otp", code(payerSecret, step)})
+	assert.Equal(t, fasthttp.StatusOK, status, body)
+	assert.Contains(t, body, `"step_up":"totp"`)
+	// a batch is confirmed for its total without receiver
+	status, body = s.request("POST", "/v2/transfers/confirm", payerAccess, `{"from":"KZT0000000002","amount":"6000","otp":"`+code(payerSecret, step+1)+`"}`)
+	assert.Equal(t, fasthttp.StatusCreated, status, body)
+	assert.NoError(t, json.Unmarshal([]byte(body), &confirmation))
+	status, body = batch(largeBatch, headerData{"confirmation_token", confirmation.ConfirmationToken})
+	assert.Equal(t, fasthttp.StatusAccepted, status, body)
+	assert.Contains(t, body, `"step_up":"confirmation"`)
+	status, body = batch(largeBatch, headerData{"confirmation_token", confirmation.ConfirmationToken})
+	assert.Equal(t, fasthttp.StatusForbidden, status)
+	assert.Contains(t, body, `"code":"invalid_confirmation"`)
+
+	var decisions []string
+	for _, account := range []string{"KZT0000000001", "KZT0000000003"} {
+		transactions, err := db.GetTransactions(domain.TransactionFilter{Account: account, Direction: domain.DirectionOut})
+		assert.NoError(t, err)
+		for _, transaction := range transactions {
+			decisions = append(decisions, transaction.StepUp)
+		}
+	}
+	assert.Equal(t, []string{domain.StepUpNotRequired, domain.StepUpNotRequired, domain.StepUpTOTP, domain.StepUpConfirmation}, decisions)
+}
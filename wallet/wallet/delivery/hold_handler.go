@@ -0,0 +1,125 @@
+package delivery
+
+import (
+	"log"
+	"strconv"
+	"time"
+	"wallet/domain"
+	"wallet/myerrors"
+	"wallet/wallet/delivery/response"
+	"wallet/wallet/usecase"
+
+	"github.com/buaazp/fasthttprouter"
+	"github.com/valyala/fasthttp"
+)
+
+type HoldHandler struct {
+	uc usecase.HoldUsecase
+}
+
+// PlaceHold handles reserving money of a wallet for the merchant owning payee, ttl header is optional and takes Go
+// durations such as "30m". Holds above the step-up threshold take "otp" or "confirmation_token" header
+func (h *HoldHandler) PlaceHold(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|PlaceHold endpoint hit")
+	IIN, ok := getIIN(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	account := string(ctx.Request.Header.Peek("account"))
+	payee := string(ctx.Request.Header.Peek("payee"))
+	if account == "" || payee == "" {
+		response.RespondWithError(ctx, fasthttp.StatusBadRequest, "Invalid form data")
+		return
+	}
+	amount, err := domain.ParseMoney(string(ctx.Request.Header.Peek("amount")), getCurrency(ctx))
+	if err != nil {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidAmt)
+		return
+	}
+	var ttl time.Duration
+	if value := string(ctx.Request.Header.Peek("ttl")); value != "" {
+		if ttl, err = time.ParseDuration(value); err != nil || ttl <= 0 {
+			response.RespondWithError(ctx, fasthttp.StatusBadRequest, "invalid ttl")
+			return
+		}
+	}
+
+	hold, err := h.uc.PlaceHold(account, payee, amount, ttl, IIN, getTransferAuth(ctx))
+	if err != nil {
+		respondHoldError(ctx, err)
+		return
+	}
+	response.ResponseHold(ctx, hold)
+}
+
+// CaptureHold handles transfer of a held amount to the payee of the hold, amount header is optional and defaults to
+// the whole hold. The to header is optional too and has to be the payee if set
+func (h *HoldHandler) CaptureHold(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|CaptureHold endpoint hit")
+	IIN, anyWallet, ok := getIINAndGrant(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	holdID, err := strconv.Atoi(string(ctx.Request.Header.Peek("hold")))
+	if err != nil {
+		response.RespondWithError(ctx, fasthttp.StatusBadRequest, "invalid hold")
+		return
+	}
+	to := string(ctx.Request.Header.Peek("to"))
+	var amount *domain.Money
+	if value := string(ctx.Request.Header.Peek("amount")); value != "" {
+		parsed, err := domain.ParseMoney(value, getCurrency(ctx))
+		if err != nil {
+			response.RespondWithProblem(ctx, myerrors.ErrInvalidAmt)
+			return
+		}
+		amount = &parsed
+	}
+
+	hold, err := h.uc.CaptureHold(holdID, to, amount, IIN, anyWallet)
+	if err != nil {
+		respondHoldError(ctx, err)
+		return
+	}
+	response.ResponseHold(ctx, hold)
+}
+
+// ReleaseHold handles giving held money back to the available balance
+func (h *HoldHandler) ReleaseHold(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|ReleaseHold endpoint hit")
+	IIN, anyWallet, ok := getIINAndGrant(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	holdID, err := strconv.Atoi(string(ctx.Request.Header.Peek("hold")))
+	if err != nil {
+		response.RespondWithError(ctx, fasthttp.StatusBadRequest, "invalid hold")
+		return
+	}
+
+	hold, err := h.uc.ReleaseHold(holdID, IIN, anyWallet)
+	if err != nil {
+		respondHoldError(ctx, err)
+		return
+	}
+	response.ResponseHold(ctx, hold)
+}
+
+// respondHoldError logs err of hold operation and responds with its problem details
+func respondHoldError(ctx *fasthttp.RequestCtx, err error) {
+	log.Println("ERROR|Hold handler:", err)
+	response.RespondWithProblem(ctx, err)
+}
+
+// NewHoldHandler sets /hold, /hold/capture and /hold/release routes
+func NewHoldHandler(r *fasthttprouter.Router, uc usecase.HoldUsecase) {
+	handler := &HoldHandler{
+		uc: uc,
+	}
+	route(r, "GET", "/hold", handler.PlaceHold)
+	route(r, "GET", "/hold/capture", handler.CaptureHold)
+	route(r, "GET", "/hold/release", handler.ReleaseHold)
+}
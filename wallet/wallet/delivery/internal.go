@@ -1,6 +1,9 @@
 package delivery
 
 import (
+	"wallet/domain"
+	"wallet/wallet/delivery/middleware"
+
 	"github.com/valyala/fasthttp"
 )
 
@@ -15,14 +18,39 @@ func getHeaderValues(ctx *fasthttp.RequestCtx, headers ...string) bool {
 	return true
 }
 
-func getIINAndRole(ctx *fasthttp.RequestCtx) (string, bool, bool) {
-	IIN, ok := ctx.UserValue("IIN").(string)
+// getIIN gets IIN of the user the request is made by
+func getIIN(ctx *fasthttp.RequestCtx) (string, bool) {
+	principal, ok := middleware.GetPrincipal(ctx)
+	return principal.IIN, ok
+}
+
+// getIINAndGrant gets IIN of the user the request is made by and whether they have the permission routePolicies
+// grants on the route
+func getIINAndGrant(ctx *fasthttp.RequestCtx) (string, bool, bool) {
+	principal, ok := middleware.GetPrincipal(ctx)
 	if !ok {
 		return "", false, false
 	}
-	isAdmin, ok := ctx.UserValue("isAdmin").(bool)
-	if !ok {
-		return "", false, false
+	return principal.IIN, middleware.Granted(ctx), true
+}
+
+// getIdempotencyKey retrieves optional idempotency key sent by client in request headers
+func getIdempotencyKey(ctx *fasthttp.RequestCtx) string {
+	return string(ctx.Request.Header.Peek("Idempotency-Key"))
+}
+
+// getTransferAuth retrieves optional one-time code and confirmation token sent by client in request headers
+func getTransferAuth(ctx *fasthttp.RequestCtx) domain.TransferAuth {
+	return domain.TransferAuth{
+		Code:              string(ctx.Request.Header.Peek("otp")),
+		ConfirmationToken: string(ctx.Request.Header.Peek("confirmation_token")),
+	}
+}
+
+// getCurrency retrieves optional currency sent by client in request headers, default currency if there is none
+func getCurrency(ctx *fasthttp.RequestCtx) string {
+	if currency := string(ctx.Request.Header.Peek("currency")); currency != "" {
+		return currency
 	}
-	return IIN, isAdmin, true
+	return domain.DefaultCurrency
 }
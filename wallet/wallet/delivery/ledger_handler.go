@@ -0,0 +1,43 @@
+package delivery
+
+import (
+	"log"
+	"wallet/myerrors"
+	"wallet/wallet/delivery/response"
+	"wallet/wallet/usecase"
+
+	"github.com/buaazp/fasthttprouter"
+	"github.com/valyala/fasthttp"
+)
+
+type TrialBalanceHandler struct {
+	uc usecase.LedgerUsecase
+}
+
+// GetTrialBalance handles verification of ledger trial balance
+func (h *TrialBalanceHandler) GetTrialBalance(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|GetTrialBalance hit")
+	_, canAudit, ok := getIINAndGrant(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	tb, err := h.uc.GetTrialBalance(canAudit)
+	if err != nil {
+		log.Println("ERROR|Getting trial balance:", err)
+		response.RespondWithProblem(ctx, err)
+		return
+	}
+	if !tb.Balanced {
+		log.Printf("ERROR|Trial balance does not sum to zero: %+v\n", tb)
+	}
+	response.ResponseTrialBalance(ctx, tb)
+}
+
+// NewTrialBalanceHandler sets /admin/trial-balance route
+func NewTrialBalanceHandler(r *fasthttprouter.Router, uc usecase.LedgerUsecase) {
+	handler := &TrialBalanceHandler{
+		uc: uc,
+	}
+	route(r, "GET", "/admin/trial-balance", handler.GetTrialBalance)
+}
@@ -4,10 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"os"
+	"sync"
 	"time"
+	"wallet/domain"
 	"wallet/myerrors"
 	"wallet/wallet/delivery/response"
+	"wallet/wallet/revocation"
 
 	"github.com/golang-jwt/jwt"
 	"github.com/valyala/fasthttp"
@@ -15,14 +17,32 @@ import (
 
 const TOKEN = "token"
 
-var ErrInvalidToken = errors.New("Invalid token") // TODO? hz kak
+// PRINCIPAL is the context key of domain.Principal of the user
+const PRINCIPAL = "principal"
+
+// GRANTED is the context key of whether the user has the permission set by GrantPermission
+const GRANTED = "granted"
+
+// revocations is set by SetRevocationStore, without it tokens are valid until they expire. Streams check it for as
+// long as they are open, so it is guarded by revocationsMu
+var (
+	revocations   *revocation.Store
+	revocationsMu sync.RWMutex
+)
+
+// SetRevocationStore makes ProcessTokenMiddleware reject tokens revoked in store
+func SetRevocationStore(store *revocation.Store) {
+	revocationsMu.Lock()
+	defer revocationsMu.Unlock()
+	revocations = store
+}
 
 // ProcessTokenAndCtxMiddleware extracts IIN from token and populates it to context
 func ProcessTokenMiddleware(next fasthttp.RequestHandler) fasthttp.RequestHandler {
 	return func(ctx *fasthttp.RequestCtx) {
 		if err := parseToken(ctx); err != nil {
 			log.Println("ERROR|ProcessTokenMiddleware", err)
-			response.RespondWithError(ctx, fasthttp.StatusForbidden, "Invalid token")
+			response.RespondWithProblem(ctx, tokenError(err))
 			return
 		}
 		log.Println("INFO|Token successfuly processed")
@@ -30,59 +50,100 @@ func ProcessTokenMiddleware(next fasthttp.RequestHandler) fasthttp.RequestHandle
 	}
 }
 
-// extractIINAndRole extracts IIN and role from token
-func extractIINAndRole(token string) (string, bool, error) {
-	fmt.Println("extracting claims from ", token)
-	JWTToken, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Failed to extract token metadata, unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(os.Getenv("SECRET")), nil
-	})
+// tokenError tells the client why its token was rejected, tokens that are neither expired nor revoked are invalid
+func tokenError(err error) error {
+	var validation *jwt.ValidationError
+	switch {
+	case errors.Is(err, myerrors.ErrTokenRevoked), errors.Is(err, myerrors.ErrTokenExpired):
+		return err
+	case errors.As(err, &validation) && validation.Errors&jwt.ValidationErrorExpired != 0:
+		return myerrors.ErrTokenExpired
+	}
+	return myerrors.ErrInvalidToken
+}
 
+// extractPrincipal extracts IIN and roles of the user from token. Roles come from "roles" claim, tokens issued before
+// roles with "admin" claim set get admin role and everyone else is a customer
+func extractPrincipal(token string) (domain.Principal, error) {
+	claims, err := getVerifier().Verify(token)
 	if err != nil {
 		log.Printf("ERROR|Native parse err:%q", err.Error())
-		return "", false, err
+		return domain.Principal{}, err
+	}
+	log.Println("INFO|Middlewrare: token ok & valid")
+	roles, err := extractRoles(claims)
+	if err != nil {
+		return domain.Principal{}, err
+	}
+	_, ok := claims["username"].(string)
+	if !ok {
+		return domain.Principal{}, fmt.Errorf("Field username not found")
+	}
+	// tokens issued before "createdAt" carry the user timestamp as "userts"
+	_, ok = claims["createdAt"].(string)
+	if !ok {
+		_, ok = claims["userts"].(string)
+	}
+	if !ok {
+		return domain.Principal{}, fmt.Errorf("Field userts not found")
 	}
-	claims, ok := JWTToken.Claims.(jwt.MapClaims)
 
-	var IIN string
-	var admin bool
+	IIN, ok := claims["iin"].(string)
+	if !ok {
+		return domain.Principal{}, fmt.Errorf("Field iin not found")
+	}
 
-	if ok && JWTToken.Valid {
-		log.Println("INFO|Middlewrare: token ok & valid")
-		admin, ok = claims["admin"].(bool)
-		if !ok {
-			return "", false, fmt.Errorf("Field admin not found")
-		}
-		_, ok = claims["username"].(string)
-		if !ok {
-			return "", false, fmt.Errorf("Field username not found")
-		}
-		_, ok = claims["createdAt"].(string)
-		if !ok {
-			return "", false, fmt.Errorf("Field userts not found")
-		}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return domain.Principal{}, fmt.Errorf("Field exp not found")
+	}
 
-		IIN, ok = claims["iin"].(string)
-		if !ok {
-			return "", false, fmt.Errorf("Field iin not found")
-		}
+	expiredTime := time.Unix(int64(exp), 0)
+	if time.Now().After(expiredTime) {
+		return domain.Principal{}, myerrors.ErrTokenExpired
+	}
+	// jti, sid and iat are optional, tokens issued before revocation or by other issuers may lack them
+	jti, _ := claims["jti"].(string)
+	sid, _ := claims["sid"].(string)
+	iat, _ := claims["iat"].(float64)
+	principal := domain.Principal{IIN: IIN, Roles: roles, TokenID: jti, SessionID: sid, IssuedAt: time.Unix(int64(iat), 0), ExpiresAt: expiredTime}
+	if Revoked(principal) {
+		return domain.Principal{}, myerrors.ErrTokenRevoked
+	}
+	log.Println("INFO|Middleware: everything ok, passing IIN and roles from parsed token")
+	return principal, nil
+}
 
-		exp, ok := claims["exp"].(float64)
+// Revoked tells if the token principal was extracted from has been revoked since, for requests outliving the check
+// of ProcessTokenMiddleware
+func Revoked(principal domain.Principal) bool {
+	revocationsMu.RLock()
+	store := revocations
+	revocationsMu.RUnlock()
+	return store != nil && store.IsRevoked(principal.TokenID, principal.SessionID, principal.IIN, principal.IssuedAt)
+}
+
+// extractRoles extracts roles of the user from claims
+func extractRoles(claims jwt.MapClaims) ([]domain.Role, error) {
+	if raw, ok := claims["roles"]; ok {
+		list, ok := raw.([]interface{})
 		if !ok {
-			return "", false, fmt.Errorf("Field exp not found")
+			return nil, fmt.Errorf("Field roles is not a list")
 		}
-
-		expiredTime := time.Unix(int64(exp), 0)
-		if time.Now().After(expiredTime) {
-			return "", false, myerrors.ErrTokenExpired
+		roles := make([]domain.Role, 0, len(list))
+		for _, role := range list {
+			name, ok := role.(string)
+			if !ok {
+				return nil, fmt.Errorf("Field roles has a non string role")
+			}
+			roles = append(roles, domain.Role(name))
 		}
-		log.Println("INFO|Middleware: everything ok, passing IIN and role from parsed token")
-		return string(IIN), admin, nil
+		return roles, nil
 	}
-	log.Println("INFO|Middleware: token not ok or not valid")
-	return "", false, myerrors.ErrInvalidToken
+	if admin, _ := claims["admin"].(bool); admin {
+		return []domain.Role{domain.RoleAdmin}, nil
+	}
+	return []domain.Role{domain.RoleCustomer}, nil
 }
 
 // parseToken gets token from request header and populates IIN to context
@@ -91,12 +152,47 @@ func parseToken(ctx *fasthttp.RequestCtx) error {
 	if token == "" {
 		return fmt.Errorf("Couldn't find token")
 	}
-	IIN, isAdmin, err := extractIINAndRole(token)
+	principal, err := extractPrincipal(token)
 	if err != nil {
 		return err
 	}
-	ctx.SetUserValue("IIN", IIN)
-	log.Println("setting isadmin", isAdmin)
-	ctx.SetUserValue("isAdmin", isAdmin)
+	ctx.SetUserValue("IIN", principal.IIN)
+	log.Println("setting roles", principal.Roles)
+	ctx.SetUserValue(PRINCIPAL, principal)
 	return nil
 }
+
+// GetPrincipal gets the user populated to context by ProcessTokenMiddleware
+func GetPrincipal(ctx *fasthttp.RequestCtx) (domain.Principal, bool) {
+	principal, ok := ctx.UserValue(PRINCIPAL).(domain.Principal)
+	return principal, ok
+}
+
+// RequirePermission lets requests through to next only if the user has perm, it goes inside ProcessTokenMiddleware
+func RequirePermission(perm domain.Permission, next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		principal, ok := GetPrincipal(ctx)
+		if !ok || !principal.Can(perm) {
+			log.Printf("ERROR|RequirePermission: %s lacks %s\n", principal.IIN, perm)
+			response.RespondWithProblem(ctx, myerrors.ErrPermissionDenied)
+			return
+		}
+		next(ctx)
+	}
+}
+
+// GrantPermission lets every request through to next telling it through Granted whether the user has perm, for
+// routes reaching wallets of other users only with perm. It goes inside ProcessTokenMiddleware
+func GrantPermission(perm domain.Permission, next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		principal, _ := GetPrincipal(ctx)
+		ctx.SetUserValue(GRANTED, principal.Can(perm))
+		next(ctx)
+	}
+}
+
+// Granted tells whether the user has the permission the route is wrapped in with GrantPermission
+func Granted(ctx *fasthttp.RequestCtx) bool {
+	granted, _ := ctx.UserValue(GRANTED).(bool)
+	return granted
+}
@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+	"os"
+	"wallet/wallet/jwks"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Verifier checks signatures of tokens and who they were issued by and for
+type Verifier struct {
+	secret   []byte
+	keys     *jwks.KeySet
+	issuer   string
+	audience string
+}
+
+// verifier is set by SetVerifier, without one tokens are signed with HMAC by SECRET from the environment
+var verifier *Verifier
+
+// SetVerifier makes ProcessTokenMiddleware verify tokens with v
+func SetVerifier(v *Verifier) {
+	verifier = v
+}
+
+// getVerifier returns the verifier tokens are checked with
+func getVerifier() *Verifier {
+	if verifier != nil {
+		return verifier
+	}
+	return NewVerifier(os.Getenv("SECRET"), nil, "", "")
+}
+
+// Verify parses token checking its signature, expiry, nbf and, when the verifier has them, iss and aud claims
+func (v *Verifier) Verify(token string) (jwt.MapClaims, error) {
+	JWTToken, err := jwt.Parse(token, v.key)
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := JWTToken.Claims.(jwt.MapClaims)
+	if !ok || !JWTToken.Valid {
+		return nil, fmt.Errorf("token is not valid")
+	}
+	if v.issuer != "" && !claims.VerifyIssuer(v.issuer, true) {
+		return nil, fmt.Errorf("unexpected issuer %v", claims["iss"])
+	}
+	if v.audience != "" && !claims.VerifyAudience(v.audience, true) {
+		return nil, fmt.Errorf("unexpected audience %v", claims["aud"])
+	}
+	return claims, nil
+}
+
+// key picks the key token is verified with, HMAC needs the secret and RSA and ECDSA a key of the key set with the
+// token's kid. Tokens signed by other methods or by a key of another type are rejected
+func (v *Verifier) key(token *jwt.Token) (interface{}, error) {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if len(v.secret) == 0 {
+			return nil, fmt.Errorf("HMAC signed tokens are not accepted")
+		}
+		return v.secret, nil
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		if v.keys == nil {
+			return nil, fmt.Errorf("%v signed tokens are not accepted", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		key, err := v.keys.Key(kid)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", kid, err)
+		}
+		switch key.(type) {
+		case *rsa.PublicKey:
+			if _, ok := token.Method.(*jwt.SigningMethodRSA); ok {
+				return key, nil
+			}
+		case *ecdsa.PublicKey:
+			if _, ok := token.Method.(*jwt.SigningMethodECDSA); ok {
+				return key, nil
+			}
+		}
+		return nil, fmt.Errorf("key %q can't verify %v signed tokens", kid, token.Header["alg"])
+	}
+	return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+}
+
+// NewVerifier returns Verifier accepting tokens signed with HMAC by secret and with RSA or ECDSA by keys, either may
+// be left empty to turn its methods off. Non-empty issuer and audience must match iss and aud claims of tokens
+func NewVerifier(secret string, keys *jwks.KeySet, issuer, audience string) *Verifier {
+	return &Verifier{
+		secret:   []byte(secret),
+		keys:     keys,
+		issuer:   issuer,
+		audience: audience,
+	}
+}
@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"wallet/wallet/jwks"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func encodeInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+// writeKeySet writes JWKS with rsaKey under kid "rsa" and ecKey under "ec" and loads it
+func writeKeySet(t *testing.T, rsaKey *rsa.PublicKey, ecKey *ecdsa.PublicKey) *jwks.KeySet {
+	data, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "n": encodeInt(rsaKey.N), "e": encodeInt(big.NewInt(int64(rsaKey.E)))},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encodeInt(ecKey.X), "y": encodeInt(ecKey.Y)},
+	}})
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, os.WriteFile(path, data, 0o600))
+	keys, err := jwks.NewKeySet(path, time.Hour, nil)
+	assert.NoError(t, err)
+	return keys
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	assert.NoError(t, err)
+	return signed
+}
+
+func TestVerifier(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	keys := writeKeySet(t, &rsaKey.PublicKey, &ecKey.PublicKey)
+
+	withClaims := func(extra jwt.MapClaims) jwt.MapClaims {
+		claims := validClaims()
+		claims["iss"] = "https://auth.example"
+		claims["aud"] = "wallet"
+		for k, v := range extra {
+			claims[k] = v
+		}
+		return claims
+	}
+
+	v := NewVerifier("", keys, "https://auth.example", "wallet")
+	hmacV := NewVerifier(testSecret, nil, "", "")
+	tests := []struct {
+		name     string
+		verifier *Verifier
+		token    string
+		ok       bool
+	}{
+		{"RS256", v, sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, withClaims(nil)), true},
+		{"ES256", v, sign(t, jwt.SigningMethodES256, "ec", ecKey, withClaims(nil)), true},
+		{"audience list", v, sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, withClaims(jwt.MapClaims{"aud": []string{"other", "wallet"}})), true},
+		{"HS256 with secret", hmacV, sign(t, jwt.SigningMethodHS256, "", []byte(testSecret), validClaims()), true},
+		{"unknown kid", v, sign(t, jwt.SigningMethodRS256, "gone", rsaKey, withClaims(nil)), false},
+		{"kid of other key type", v, sign(t, jwt.SigningMethodRS256, "ec", rsaKey, withClaims(nil)), false},
+		{"key not in set", v, sign(t, jwt.SigningMethodRS256, "rsa", otherKey, withClaims(nil)), false},
+		{"HS256 without secret", v, sign(t, jwt.SigningMethodHS256, "", []byte(testSecret), withClaims(nil)), false},
+		{"RS256 without keys", hmacV, sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, validClaims()), false},
+		{"none", v, sign(t, jwt.SigningMethodNone, "", jwt.UnsafeAllowNoneSignatureType, withClaims(nil)), false},
+		{"wrong issuer", v, sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, withClaims(jwt.MapClaims{"iss": "https://evil.example"})), false},
+		{"no issuer", v, sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, withClaims(jwt.MapClaims{"iss": nil})), false},
+		{"wrong audience", v, sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, withClaims(jwt.MapClaims{"aud": "other"})), false},
+		{"not yet valid", v, sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, withClaims(jwt.MapClaims{"nbf": time.Now().Add(time.Minute).Unix()})), false},
+		{"expired", v, sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, withClaims(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})), false},
+	}
+	for _, tt := range tests {
+		claims, err := tt.verifier.Verify(tt.token)
+		if tt.ok {
+			assert.NoError(t, err, tt.name)
+			assert.Equal(t, "910815450350", claims["iin"], tt.name)
+		} else {
+			assert.Error(t, err, tt.name)
+		}
+	}
+}
+
+func TestSetVerifier(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	t.Setenv("SECRET", testSecret)
+	hmacToken := sign(t, jwt.SigningMethodHS256, "", []byte(testSecret), validClaims())
+	rsaToken := sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, validClaims())
+
+	_, err = extractPrincipal(hmacToken)
+	assert.NoError(t, err, "SECRET verifies tokens by default")
+	_, err = extractPrincipal(rsaToken)
+	assert.Error(t, err)
+
+	SetVerifier(NewVerifier("", writeKeySet(t, &rsaKey.PublicKey, &ecKey.PublicKey), "", ""))
+	defer SetVerifier(nil)
+	principal, err := extractPrincipal(rsaToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "910815450350", principal.IIN)
+	_, err = extractPrincipal(hmacToken)
+	assert.Error(t, err)
+}
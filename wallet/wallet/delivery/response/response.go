@@ -2,27 +2,31 @@ package response
 
 import (
 	"encoding/json"
+	"errors"
+	"log"
 	"wallet/domain"
+	"wallet/myerrors"
 
 	"github.com/valyala/fasthttp"
 )
 
-func RespondWithError(ctx *fasthttp.RequestCtx, status int, message string) {
-	ctx.SetStatusCode(status)
+func ResponseJSON(ctx *fasthttp.RequestCtx, data string) {
+	ctx.SetStatusCode(fasthttp.StatusOK)
 	json.NewEncoder(ctx).Encode(
 		domain.Response{
-			OK:      false,
-			Message: message,
+			OK:      true,
+			Message: data,
 		},
 	)
 }
 
-func ResponseJSON(ctx *fasthttp.RequestCtx, data string) {
+func ResponseMoney(ctx *fasthttp.RequestCtx, amount domain.Money) {
 	ctx.SetStatusCode(fasthttp.StatusOK)
 	json.NewEncoder(ctx).Encode(
 		domain.Response{
 			OK:      true,
-			Message: data,
+			Message: amount.String(),
+			Amount:  &amount,
 		},
 	)
 }
@@ -56,3 +60,155 @@ func ResponseTransactions(ctx *fasthttp.RequestCtx, ts []domain.Transaction) {
 		},
 	)
 }
+
+// ResponseTransfer responds with the transaction of a transfer, keeping the message clients got before
+func ResponseTransfer(ctx *fasthttp.RequestCtx, transfer *domain.Transaction) {
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	json.NewEncoder(ctx).Encode(
+		domain.Response{
+			OK:           true,
+			Message:      "success!",
+			Transactions: []domain.Transaction{*transfer},
+		},
+	)
+}
+
+func ResponseTransactionPage(ctx *fasthttp.RequestCtx, page *domain.TransactionPage) {
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	json.NewEncoder(ctx).Encode(
+		domain.Response{
+			OK:           true,
+			Transactions: page.Transactions,
+			NextCursor:   page.NextCursor,
+		},
+	)
+}
+
+func ResponseTrialBalance(ctx *fasthttp.RequestCtx, tb *domain.TrialBalance) {
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	json.NewEncoder(ctx).Encode(
+		domain.Response{
+			OK:           true,
+			TrialBalance: tb,
+		},
+	)
+}
+
+func ResponseHold(ctx *fasthttp.RequestCtx, hold *domain.Hold) {
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	json.NewEncoder(ctx).Encode(
+		domain.Response{
+			OK:   true,
+			Hold: hold,
+		},
+	)
+}
+
+func ResponseSchedules(ctx *fasthttp.RequestCtx, schedules []domain.Schedule) {
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	json.NewEncoder(ctx).Encode(
+		domain.Response{
+			OK:        true,
+			Schedules: schedules,
+		},
+	)
+}
+
+func ResponseBatch(ctx *fasthttp.RequestCtx, status int, batch *domain.Batch) {
+	ctx.SetStatusCode(status)
+	res := domain.Response{
+		OK:    status < fasthttp.StatusBadRequest,
+		Batch: batch,
+	}
+	if batch.Status == domain.BatchRejected {
+		res.Message = "invalid batch"
+	}
+	json.NewEncoder(ctx).Encode(res)
+}
+
+func ResponseSubscriptions(ctx *fasthttp.RequestCtx, subscriptions []domain.Subscription) {
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	json.NewEncoder(ctx).Encode(
+		domain.Response{
+			OK:            true,
+			Subscriptions: subscriptions,
+		},
+	)
+}
+
+func ResponseDeliveries(ctx *fasthttp.RequestCtx, deliveries []domain.Delivery) {
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	json.NewEncoder(ctx).Encode(
+		domain.Response{
+			OK:         true,
+			Deliveries: deliveries,
+		},
+	)
+}
+
+// ResponseV2 writes body of a v2 API response as is
+func ResponseV2(ctx *fasthttp.RequestCtx, status int, body interface{}) {
+	ctx.SetStatusCode(status)
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(body)
+}
+
+// problemContentType is the media type of RFC 7807 problem details
+const problemContentType = "application/problem+json"
+
+// statuses maps kinds of catalogue errors to response statuses
+var statuses = map[myerrors.Kind]int{
+	myerrors.Internal:             fasthttp.StatusInternalServerError,
+	myerrors.Invalid:              fasthttp.StatusBadRequest,
+	myerrors.Unauthorized:         fasthttp.StatusUnauthorized,
+	myerrors.Forbidden:            fasthttp.StatusForbidden,
+	myerrors.NotFound:             fasthttp.StatusNotFound,
+	myerrors.Conflict:             fasthttp.StatusConflict,
+	myerrors.UnsupportedMediaType: fasthttp.StatusUnsupportedMediaType,
+	myerrors.Unprocessable:        fasthttp.StatusUnprocessableEntity,
+	myerrors.TooManyRequests:      fasthttp.StatusTooManyRequests,
+}
+
+// RespondWithProblem writes err as problem details with the status of the catalogue error it wraps, fields tell what
+// is wrong with which field of the request. Errors outside the catalogue and internal ones are logged and written as
+// myerrors.ErrInternal, so that their details are not shown
+func RespondWithProblem(ctx *fasthttp.RequestCtx, err error, fields ...domain.FieldError) {
+	var e *myerrors.Error
+	if !errors.As(err, &e) || e.Kind == myerrors.Internal {
+		log.Println("ERROR|Internal error:", err)
+		e = myerrors.ErrInternal
+	}
+	status, ok := statuses[e.Kind]
+	if !ok {
+		status = fasthttp.StatusInternalServerError
+	}
+	writeProblem(ctx, domain.Problem{
+		Type:   "/errors/" + e.Code,
+		Title:  e.Message,
+		Status: status,
+		Code:   e.Code,
+		Errors: fields,
+	})
+}
+
+// RespondWithError writes problem details of status with message as detail, for failures that are not errors of
+// the catalogue, such as a missing request header
+func RespondWithError(ctx *fasthttp.RequestCtx, status int, message string) {
+	e := myerrors.ErrInvalidRequest
+	if status >= fasthttp.StatusInternalServerError {
+		e = myerrors.ErrInternal
+	}
+	writeProblem(ctx, domain.Problem{
+		Type:   "/errors/" + e.Code,
+		Title:  e.Message,
+		Status: status,
+		Detail: message,
+		Code:   e.Code,
+	})
+}
+
+func writeProblem(ctx *fasthttp.RequestCtx, problem domain.Problem) {
+	ctx.SetStatusCode(problem.Status)
+	ctx.SetContentType(problemContentType)
+	json.NewEncoder(ctx).Encode(problem)
+}
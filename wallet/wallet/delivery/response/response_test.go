@@ -0,0 +1,61 @@
+package response
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"wallet/domain"
+	"wallet/myerrors"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestRespondWithProblem(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"unknown account", myerrors.ErrWalletNotFound, fasthttp.StatusNotFound, "wallet_not_found"},
+		{"mismatch", myerrors.ErrIINMismatch, fasthttp.StatusForbidden, "iin_mismatch"},
+		{"insufficient funds", myerrors.ErrInsufficientFunds, fasthttp.StatusUnprocessableEntity, "insufficient_funds"},
+		{"locked out", myerrors.ErrOTPLocked, fasthttp.StatusTooManyRequests, "otp_locked"},
+		{"wrapped", fmt.Errorf("transfer: %w", myerrors.ErrHoldNotActive), fasthttp.StatusConflict, "hold_not_active"},
+		{"internal", myerrors.ErrUpdateRows, fasthttp.StatusInternalServerError, "internal"},
+		{"outside catalogue", errors.New("dial tcp 10.0.0.1:3306: connection refused"), fasthttp.StatusInternalServerError, "internal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ctx fasthttp.RequestCtx
+			RespondWithProblem(&ctx, tt.err)
+
+			assert.Equal(t, tt.status, ctx.Response.StatusCode())
+			assert.Equal(t, "application/problem+json", string(ctx.Response.Header.ContentType()))
+			var problem domain.Problem
+			assert.NoError(t, json.Unmarshal(ctx.Response.Body(), &problem))
+			assert.Equal(t, tt.status, problem.Status)
+			assert.Equal(t, tt.code, problem.Code)
+			assert.Equal(t, "/errors/"+tt.code, problem.Type)
+			if tt.code == "internal" {
+				assert.NotContains(t, string(ctx.Response.Body()), tt.err.Error())
+			}
+		})
+	}
+}
+
+func TestRespondWithProblemFields(t *testing.T) {
+	var ctx fasthttp.RequestCtx
+	RespondWithProblem(&ctx, myerrors.ErrInvalidRequest, domain.FieldError{Field: "to", Message: "is required"})
+	assert.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+	assert.JSONEq(t, `{"type":"/errors/invalid_request","title":"invalid request","status":400,"code":"invalid_request","errors":[{"field":"to","message":"is required"}]}`, string(ctx.Response.Body()))
+}
+
+func TestRespondWithError(t *testing.T) {
+	var ctx fasthttp.RequestCtx
+	RespondWithError(&ctx, fasthttp.StatusBadRequest, "accountno not provided")
+	assert.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+	assert.JSONEq(t, `{"type":"/errors/invalid_request","title":"invalid request","status":400,"detail":"accountno not provided","code":"invalid_request"}`, string(ctx.Response.Body()))
+}
@@ -0,0 +1,74 @@
+package delivery
+
+import (
+	"fmt"
+	"wallet/domain"
+	"wallet/wallet/delivery/middleware"
+
+	"github.com/buaazp/fasthttprouter"
+	"github.com/valyala/fasthttp"
+)
+
+// routePolicy is how a route taking a token is authorized. Users without Require are rejected, whether they have
+// Grant is passed to the handler to reach wallets of other users
+type routePolicy struct {
+	Require domain.Permission
+	Grant   domain.Permission
+}
+
+// routePolicies declares the permissions of every route taking a token, keyed by method and path
+var routePolicies = map[string]routePolicy{
+	"POST /auth/register":                   {Require: domain.PermOwnAccount, Grant: domain.PermManageAnyWallet},
+	"GET /auth/sessions":                    {Require: domain.PermOwnAccount},
+	"POST /auth/sessions/revoke":            {Require: domain.PermOwnAccount},
+	"POST /auth/revoke":                     {Require: domain.PermOwnAccount},
+	"POST /auth/totp/enrol":                 {Require: domain.PermOwnAccount},
+	"POST /auth/totp/activate":              {Require: domain.PermOwnAccount},
+	"POST /auth/totp/disable":               {Require: domain.PermOwnAccount},
+	"GET /add":                              {Require: domain.PermOwnAccount},
+	"GET /info":                             {Require: domain.PermOwnAccount, Grant: domain.PermReadAnyWallet},
+	"GET /wallets":                          {Require: domain.PermOwnAccount},
+	"GET /topup":                            {Require: domain.PermOwnAccount},
+	"GET /transfer":                         {Require: domain.PermOwnAccount},
+	"GET /transactions":                     {Require: domain.PermOwnAccount, Grant: domain.PermReadAnyWallet},
+	"GET /statement":                        {Require: domain.PermOwnAccount, Grant: domain.PermReadAnyWallet},
+	"GET /stream":                           {Require: domain.PermOwnAccount},
+	"GET /hold":                             {Require: domain.PermOwnAccount},
+	"GET /hold/capture":                     {Require: domain.PermOwnAccount, Grant: domain.PermManageAnyWallet},
+	"GET /hold/release":                     {Require: domain.PermOwnAccount, Grant: domain.PermManageAnyWallet},
+	"GET /schedule":                         {Require: domain.PermOwnAccount},
+	"GET /schedules":                        {Require: domain.PermOwnAccount},
+	"GET /schedule/cancel":                  {Require: domain.PermOwnAccount, Grant: domain.PermManageAnyWallet},
+	"POST /batch":                           {Require: domain.PermOwnAccount},
+	"GET /batch":                            {Require: domain.PermOwnAccount, Grant: domain.PermReadAnyWallet},
+	"GET /webhook":                          {Require: domain.PermOwnAccount},
+	"GET /webhooks":                         {Require: domain.PermOwnAccount},
+	"GET /webhook/delete":                   {Require: domain.PermOwnAccount, Grant: domain.PermManageAnyWallet},
+	"GET /webhooks/dead":                    {Require: domain.PermOwnAccount},
+	"GET /webhook/redeliver":                {Require: domain.PermOwnAccount, Grant: domain.PermManageAnyWallet},
+	"POST /v2/wallets":                      {Require: domain.PermOwnAccount},
+	"GET /v2/wallets":                       {Require: domain.PermOwnAccount},
+	"GET /v2/wallets/:account":              {Require: domain.PermOwnAccount, Grant: domain.PermReadAnyWallet},
+	"GET /v2/wallets/:account/transactions": {Require: domain.PermOwnAccount, Grant: domain.PermReadAnyWallet},
+	"POST /v2/transfers":                    {Require: domain.PermOwnAccount},
+	"POST /v2/transfers/confirm":            {Require: domain.PermOwnAccount},
+	"GET /admin/reverse":                    {Require: domain.PermReverseTransaction, Grant: domain.PermReverseTransaction},
+	"GET /admin/trial-balance":              {Require: domain.PermViewAudit, Grant: domain.PermViewAudit},
+	"POST /admin/revoke-sessions":           {Require: domain.PermRevokeSessions},
+}
+
+// route sets handler on method and path of r behind token middleware and the policy routePolicies declares for it,
+// a route missing from routePolicies is a programming error
+func route(r *fasthttprouter.Router, method, path string, handler fasthttp.RequestHandler) {
+	policy, ok := routePolicies[method+" "+path]
+	if !ok {
+		panic(fmt.Sprintf("no policy declared for %s %s", method, path))
+	}
+	if policy.Grant != "" {
+		handler = middleware.GrantPermission(policy.Grant, handler)
+	}
+	if policy.Require != "" {
+		handler = middleware.RequirePermission(policy.Require, handler)
+	}
+	r.Handle(method, path, middleware.ProcessTokenMiddleware(handler))
+}
@@ -0,0 +1,107 @@
+package delivery
+
+import (
+	"log"
+	"strconv"
+	"time"
+	"wallet/domain"
+	"wallet/myerrors"
+	"wallet/wallet/delivery/response"
+	"wallet/wallet/usecase"
+
+	"github.com/buaazp/fasthttprouter"
+	"github.com/valyala/fasthttp"
+)
+
+type ScheduleHandler struct {
+	uc usecase.ScheduleUsecase
+}
+
+// CreateSchedule handles scheduling a transfer, "at" header takes an RFC 3339 time and "every" a cron expression,
+// at least one of them is required
+func (h *ScheduleHandler) CreateSchedule(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|CreateSchedule endpoint hit")
+	IIN, ok := getIIN(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	values, ok := getTransferValues(ctx)
+	if !ok {
+		response.RespondWithError(ctx, fasthttp.StatusBadRequest, "Invalid form data")
+		return
+	}
+	from, to := values[0], values[1]
+	amount, err := domain.ParseMoney(values[2], getCurrency(ctx))
+	if err != nil {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidAmt)
+		return
+	}
+	var at time.Time
+	if value := string(ctx.Request.Header.Peek("at")); value != "" {
+		if at, err = time.Parse(time.RFC3339, value); err != nil {
+			response.RespondWithError(ctx, fasthttp.StatusBadRequest, "invalid time")
+			return
+		}
+	}
+
+	s, err := h.uc.CreateSchedule(from, to, amount, at, string(ctx.Request.Header.Peek("every")), IIN, getTransferAuth(ctx))
+	if err != nil {
+		respondScheduleError(ctx, err)
+		return
+	}
+	response.ResponseSchedules(ctx, []domain.Schedule{*s})
+}
+
+// GetSchedules handles retrieval of the user's schedules with outcomes of their runs
+func (h *ScheduleHandler) GetSchedules(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|GetSchedules endpoint hit")
+	IIN, ok := getIIN(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	schedules, err := h.uc.GetSchedules(IIN)
+	if err != nil {
+		respondScheduleError(ctx, err)
+		return
+	}
+	response.ResponseSchedules(ctx, schedules)
+}
+
+// CancelSchedule handles stopping a schedule
+func (h *ScheduleHandler) CancelSchedule(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|CancelSchedule endpoint hit")
+	IIN, anyWallet, ok := getIINAndGrant(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	scheduleID, err := strconv.Atoi(string(ctx.Request.Header.Peek("schedule")))
+	if err != nil {
+		response.RespondWithError(ctx, fasthttp.StatusBadRequest, "invalid schedule")
+		return
+	}
+	s, err := h.uc.CancelSchedule(scheduleID, IIN, anyWallet)
+	if err != nil {
+		respondScheduleError(ctx, err)
+		return
+	}
+	response.ResponseSchedules(ctx, []domain.Schedule{*s})
+}
+
+// respondScheduleError logs err of schedule operation and responds with its problem details
+func respondScheduleError(ctx *fasthttp.RequestCtx, err error) {
+	log.Println("ERROR|Schedule handler:", err)
+	response.RespondWithProblem(ctx, err)
+}
+
+// NewScheduleHandler sets /schedule, /schedules and /schedule/cancel routes
+func NewScheduleHandler(r *fasthttprouter.Router, uc usecase.ScheduleUsecase) {
+	handler := &ScheduleHandler{
+		uc: uc,
+	}
+	route(r, "GET", "/schedule", handler.CreateSchedule)
+	route(r, "GET", "/schedules", handler.GetSchedules)
+	route(r, "GET", "/schedule/cancel", handler.CancelSchedule)
+}
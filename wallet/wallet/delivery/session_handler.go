@@ -0,0 +1,114 @@
+package delivery
+
+import (
+	"log"
+	"wallet/myerrors"
+	"wallet/wallet/delivery/middleware"
+	"wallet/wallet/delivery/response"
+	"wallet/wallet/usecase"
+
+	"github.com/buaazp/fasthttprouter"
+	"github.com/valyala/fasthttp"
+)
+
+// SessionHandler serves listing and revocation of sessions, its routes take JSON bodies
+type SessionHandler struct {
+	uc usecase.SessionUsecase
+}
+
+// revokeSessionRequest is the body of POST /auth/sessions/revoke
+type revokeSessionRequest struct {
+	Session string `json:"session"`
+}
+
+// revokeSessionsRequest is the body of POST /admin/revoke-sessions
+type revokeSessionsRequest struct {
+	IIN string `json:"iin"`
+}
+
+// GetSessions handles listing of active sessions of the user
+func (h *SessionHandler) GetSessions(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|GetSessions endpoint hit")
+	principal, ok := middleware.GetPrincipal(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	sessions, err := h.uc.GetSessions(principal.IIN, principal.SessionID)
+	if err != nil {
+		log.Println("ERROR|Getting sessions:", err)
+		response.RespondWithProblem(ctx, err)
+		return
+	}
+	response.ResponseV2(ctx, fasthttp.StatusOK, sessions)
+}
+
+// RevokeSession handles revocation of a session of the user
+func (h *SessionHandler) RevokeSession(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|RevokeSession endpoint hit")
+	principal, ok := middleware.GetPrincipal(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	var req revokeSessionRequest
+	if !decodeV2Body(ctx, &req) {
+		return
+	}
+	if fields := requireField(nil, "session", req.Session); len(fields) > 0 {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidRequest, fields...)
+		return
+	}
+	if err := h.uc.RevokeSession(principal.IIN, req.Session); err != nil {
+		log.Println("ERROR|Revoking session:", err)
+		response.RespondWithProblem(ctx, err)
+		return
+	}
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// RevokeToken handles revocation of the token the request is made with and the session it was issued in
+func (h *SessionHandler) RevokeToken(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|RevokeToken endpoint hit")
+	principal, ok := middleware.GetPrincipal(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	if err := h.uc.RevokeToken(principal); err != nil {
+		log.Println("ERROR|Revoking token:", err)
+		response.RespondWithProblem(ctx, err)
+		return
+	}
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// RevokeAllSessions handles revocation of every session and token of an IIN by an admin
+func (h *SessionHandler) RevokeAllSessions(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|RevokeAllSessions endpoint hit")
+	var req revokeSessionsRequest
+	if !decodeV2Body(ctx, &req) {
+		return
+	}
+	if fields := requireField(nil, "iin", req.IIN); len(fields) > 0 {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidRequest, fields...)
+		return
+	}
+	if err := h.uc.RevokeAllSessions(req.IIN); err != nil {
+		log.Println("ERROR|Revoking sessions:", err)
+		response.RespondWithProblem(ctx, err)
+		return
+	}
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// NewSessionHandler sets GET /auth/sessions, POST /auth/sessions/revoke, /auth/revoke and /admin/revoke-sessions routes
+func NewSessionHandler(r *fasthttprouter.Router, uc usecase.SessionUsecase) {
+	handler := &SessionHandler{
+		uc: uc,
+	}
+	route(r, "GET", "/auth/sessions", handler.GetSessions)
+	route(r, "POST", "/auth/sessions/revoke", handler.RevokeSession)
+	route(r, "POST", "/auth/revoke", handler.RevokeToken)
+	route(r, "POST", "/admin/revoke-sessions", handler.RevokeAllSessions)
+}
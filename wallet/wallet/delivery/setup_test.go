@@ -3,15 +3,26 @@ package delivery
 import (
 	"fmt"
 	"log"
+	"net"
+	"strings"
+	"testing"
 	"time"
 	"wallet/domain"
 	"wallet/myerrors"
+	"wallet/wallet/auth"
+	"wallet/wallet/delivery/middleware"
+	"wallet/wallet/fx"
 	"wallet/wallet/repository"
+	"wallet/wallet/repository/memory"
+	"wallet/wallet/revocation"
+	"wallet/wallet/stream"
 	"wallet/wallet/usecase"
+	"wallet/wallet/webhook"
 
 	"github.com/buaazp/fasthttprouter"
 	"github.com/golang-jwt/jwt"
 	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
 )
 
 const (
@@ -26,32 +37,160 @@ func getRoutes() fasthttp.RequestHandler {
 		log.Fatalf("Db interface create error: %v", err)
 	}
 	//defer dbConn.Close()
+	rates, err := fx.NewStaticProvider(map[string]string{"USD/KZT": "470.25"})
+	if err != nil {
+		log.Fatalf("FX rate provider create error: %v", err)
+	}
 	walletListUsecase := usecase.NewWalletListUsecase(dbConn)
-	transferUsecase := usecase.NewTransferUsecase(dbConn)
-	topUpUsecase := usecase.NewTopUpUsecase(dbConn)
+	transferUsecase := usecase.NewTransferUsecase(dbConn, time.Hour, rates, domain.StepUpPolicy{})
+	topUpUsecase := usecase.NewTopUpUsecase(dbConn, time.Hour)
 	addWalletUsecase := usecase.NewAddWalletUsecase(dbConn)
 	getWalletsUsecase := usecase.NewGetWalletsUsecase(dbConn)
 	getTransactionsUsecase := usecase.NewGetTransactionsUsecase(dbConn)
+	statementUsecase := usecase.NewStatementUsecase(dbConn, getTransactionsUsecase)
+	ledgerUsecase := usecase.NewLedgerUsecase(dbConn)
+	reversalUsecase := usecase.NewReversalUsecase(dbConn)
+	holdUsecase := usecase.NewHoldUsecase(dbConn, rates, time.Hour, domain.StepUpPolicy{})
+	scheduleUsecase := usecase.NewScheduleUsecase(dbConn, transferUsecase, time.Hour)
+	batchUsecase := usecase.NewBatchUsecase(dbConn, transferUsecase, rates)
+	webhookUsecase := usecase.NewWebhookUsecase(dbConn, webhook.NewHTTPSender(time.Second))
+	streamUsecase := usecase.NewStreamUsecase(dbConn, stream.NewBroker(usecase.WalletOwner(dbConn)))
+	// users live in memory so that tokens issued by the auth routes can be refreshed and revoked for real
+	users := memory.NewMemoryDBInterface()
+	revocations := revocation.NewStore(users, time.Hour)
+	middleware.SetVerifier(middleware.NewVerifier(ACCESS_SECRET, nil, "", ""))
+	middleware.SetRevocationStore(revocations)
+	authUsecase := usecase.NewAuthUsecase(users, auth.NewIssuer(ACCESS_SECRET, time.Minute, "", ""), revocations, time.Hour, 1000)
+	sessionUsecase := usecase.NewSessionUsecase(users, revocations)
 
+	NewAuthHandler(r, authUsecase)
+	NewSessionHandler(r, sessionUsecase)
 	NewGetInfoHandler(r, getWalletsUsecase)
 	NewGetTransactionsHandler(r, getTransactionsUsecase)
+	NewStatementHandler(r, statementUsecase)
 	NewAddWalletHandler(r, addWalletUsecase)
 	NewTopUpHandler(r, topUpUsecase)
 	NewTransferHandler(r, transferUsecase)
 	NewWalletListHandler(r, walletListUsecase)
+	NewTrialBalanceHandler(r, ledgerUsecase)
+	NewReversalHandler(r, reversalUsecase)
+	NewHoldHandler(r, holdUsecase)
+	NewScheduleHandler(r, scheduleUsecase)
+	NewBatchHandler(r, batchUsecase)
+	NewWebhookHandler(r, webhookUsecase)
+	NewStreamHandler(r, streamUsecase)
+	NewV2Handler(r, addWalletUsecase, getWalletsUsecase, transferUsecase, getTransactionsUsecase)
 	return r.Handler
 }
 
+// testServerOptions configures newTestServer
+type testServerOptions struct {
+	// routes sets the routes to serve instead of those of getRoutes
+	routes func(r *fasthttprouter.Router)
+}
+
+// testServer serves the routes of a test over an in-memory listener
+type testServer struct {
+	t      *testing.T
+	ln     *fasthttputil.InmemoryListener
+	client *fasthttp.Client
+}
+
+// testRequest is a request made to testServer, body without contentType is sent as JSON
+type testRequest struct {
+	method      string
+	url         string
+	token       string
+	contentType string
+	body        string
+	headers     []headerData
+}
+
+// newTestServer serves routes of opts until the test ends
+func newTestServer(t *testing.T, opts testServerOptions) *testServer {
+	handler := getRoutes()
+	if opts.routes != nil {
+		r := fasthttprouter.New()
+		opts.routes(r)
+		handler = r.Handler
+	}
+	ln := fasthttputil.NewInmemoryListener()
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	s := &fasthttp.Server{
+		Handler: handler,
+	}
+	go s.Serve(ln) //nolint:errcheck
+	return &testServer{
+		t:  t,
+		ln: ln,
+		client: &fasthttp.Client{
+			Dial: func(addr string) (net.Conn, error) {
+				return ln.Dial()
+			},
+		},
+	}
+}
+
+// do makes req and returns status and body of the response
+func (s *testServer) do(req testRequest) (int, string) {
+	r, res := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(r)
+	defer fasthttp.ReleaseResponse(res)
+	r.Header.SetMethod(req.method)
+	r.SetRequestURI("http://test.com" + req.url)
+	if req.token != "" {
+		r.Header.Add("token", req.token)
+	}
+	for _, h := range req.headers {
+		r.Header.Add(h.key, h.value)
+	}
+	switch {
+	case req.contentType != "":
+		r.Header.SetContentType(req.contentType)
+	case req.body != "":
+		r.Header.SetContentType("application/json")
+	}
+	r.SetBodyString(req.body)
+	if err := s.client.Do(r, res); err != nil {
+		s.t.Fatal(err)
+	}
+	return res.StatusCode(), string(res.Body())
+}
+
+// request makes method request to url with token, body and headers
+func (s *testServer) request(method, url, token, body string, headers ...headerData) (int, string) {
+	return s.do(testRequest{method: method, url: url, token: token, body: body, headers: headers})
+}
+
+// token signs token of the test user with extra claims, failing the test if it can't
+func (s *testServer) token(extra jwt.MapClaims) string {
+	token, err := generateTestToken(extra)
+	if err != nil {
+		s.t.Fatal("Couldn't generate token", err)
+	}
+	return token
+}
+
 func GenerateTestToken() (string, error) {
+	return generateTestToken(jwt.MapClaims{"admin": false})
+}
+
+// generateTestToken signs token of the test user with extra claims such as roles
+func generateTestToken(extra jwt.MapClaims) (string, error) {
 	accessTokenExp := time.Now().Add(20 * time.Second).Unix()
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"admin":    false,
+	claims := jwt.MapClaims{
 		"exp":      accessTokenExp,
 		"iat":      1640024899,
 		"iin":      "910815450350",
 		"username": "sth",
 		"userts":   "2021-12-31 19:36:36",
-	})
+	}
+	for name, value := range extra {
+		claims[name] = value
+	}
+	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
 	accessTokenString, err := accessToken.SignedString([]byte(ACCESS_SECRET))
 
@@ -68,7 +207,7 @@ func (m *testDB) GetLastAccountNo() (string, error) {
 	return "KZT0000000000", nil
 }
 
-func (m *testDB) InsertWallet(account, IIN string) error {
+func (m *testDB) InsertWallet(account, IIN, currency string) error {
 	return nil
 }
 
@@ -79,22 +218,31 @@ func (m *testDB) GetWallets(IIN string) ([]domain.Wallet, error) {
 	return nil, nil
 }
 
-func (m *testDB) TopUp(account string, amt int) error {
+func (m *testDB) GetWallet(account string) (*domain.Wallet, error) {
+	ledger, _ := m.GetAmount(account)
+	switch account {
+	case "wrong":
+		return nil, myerrors.ErrWalletNotFound
+	case "other":
+		return &domain.Wallet{AccountNo: account, IIN: "other", Ledger: ledger, Available: ledger}, nil
+	}
+	return &domain.Wallet{AccountNo: account, IIN: "910815450350", Ledger: ledger, Available: ledger}, nil
+}
+
+func (m *testDB) TopUp(account string, amt domain.Money, key *domain.IdempotencyKey) error {
 	if account == "wrong" {
 		return fmt.Errorf("Wrong acc")
 	}
 	return nil
 }
 
-func (m *testDB) GetAmount(account string) (string, error) {
-	return "", nil
-}
-
-func (m *testDB) SetZeroStatus(from, to string) error {
-	if from == "wrongg" {
-		return fmt.Errorf("Wrong acc")
+func (m *testDB) GetAmount(account string) (domain.Money, error) {
+	for _, currency := range []string{"USD", "EUR"} {
+		if strings.HasPrefix(account, currency) {
+			return domain.NewMoney(0, currency), nil
+		}
 	}
-	return nil
+	return domain.NewMoney(0, domain.DefaultCurrency), nil
 }
 
 func (m *testDB) ConfirmIIN(IIN, account string) (bool, error) {
@@ -104,34 +252,308 @@ func (m *testDB) ConfirmIIN(IIN, account string) (bool, error) {
 	return true, nil
 }
 
-func (m *testDB) GetTransactions(account string) ([]domain.Transaction, error) {
-	if account == "wrong" {
+func (m *testDB) GetTransactions(filter domain.TransactionFilter) ([]domain.Transaction, error) {
+	if filter.Account == "wrong" {
 		return nil, fmt.Errorf("Wrong acc")
 	}
 	return nil, nil
 }
 
-func (m *testDB) Transfer(from, to, amt string) error {
-	if to == "wrong" {
-		return fmt.Errorf("Wrong acc")
+func (m *testDB) GetBalanceAt(account string, at time.Time) (domain.Money, error) {
+	if account == "unknown" {
+		return domain.Money{}, myerrors.ErrWalletNotFound
 	}
-	if amt == "insufficient" {
-		return myerrors.ErrInsufficientFunds
+	return domain.NewMoney(1000, domain.DefaultCurrency), nil
+}
+
+func (m *testDB) Transfer(from, to string, conv domain.Conversion, key *domain.IdempotencyKey, stepUp domain.StepUp) (*domain.Transaction, error) {
+	if from == "wrong" || to == "wrong" {
+		return nil, fmt.Errorf("Wrong acc")
+	}
+	if conv.Debit.Decimal() == "999999.00" {
+		return nil, myerrors.ErrInsufficientFunds
+	}
+	transfer := domain.NewTransfer(1, from, to, conv, stepUp.Decision)
+	return &transfer, nil
+}
+
+func (m *testDB) GetIdempotencyKey(IIN, key string) (*domain.IdempotencyKey, error) {
+	switch key {
+	case "wrong":
+		return nil, fmt.Errorf("Wrong key")
+	case "conflict":
+		return &domain.IdempotencyKey{Key: key, IIN: IIN, RequestHash: "different"}, nil
 	}
+	return nil, nil
+}
+
+func (m *testDB) GetWalletList(IIN string) ([]string, error) {
+	return nil, nil
+}
+
+func (m *testDB) GetTrialBalance() (*domain.TrialBalance, error) {
+	return &domain.TrialBalance{Balanced: true}, nil
+}
+
+func (m *testDB) Reverse(transactionID int, amt *domain.Money) (*domain.Transaction, error) {
+	return &domain.Transaction{ID: transactionID + 1, Type: domain.ReversalType, ReversesID: transactionID}, nil
+}
+
+func (m *testDB) PlaceHold(account, payee string, amt domain.Money, expiresAt time.Time, stepUp domain.StepUp) (*domain.Hold, error) {
+	if amt.Decimal() == "999999.00" {
+		return nil, myerrors.ErrInsufficientFunds
+	}
+	return &domain.Hold{ID: 1, AccountNo: account, Payee: payee, Amount: amt, Status: domain.HoldActive, ExpiresAt: expiresAt, StepUp: stepUp.Decision}, nil
+}
+
+func (m *testDB) GetHold(holdID int) (*domain.Hold, error) {
+	switch holdID {
+	case 404:
+		return nil, myerrors.ErrHoldNotFound
+	case 403:
+		return &domain.Hold{ID: holdID, AccountNo: "abc", Payee: "abc", Amount: domain.NewMoney(10000, domain.DefaultCurrency), Status: domain.HoldActive}, nil
+	}
+	return &domain.Hold{ID: holdID, AccountNo: "KZT0000000001", Payee: "KZT0000000002", Amount: domain.NewMoney(10000, domain.DefaultCurrency), Status: domain.HoldActive}, nil
+}
+
+func (m *testDB) CaptureHold(holdID int, conv domain.Conversion) (*domain.Hold, error) {
+	if holdID == 409 {
+		return nil, myerrors.ErrHoldNotActive
+	}
+	if conv.Debit.Amount > 10000 {
+		return nil, myerrors.ErrCaptureTooLarge
+	}
+	return &domain.Hold{ID: holdID, Captured: conv.Debit, Status: domain.HoldCaptured, TransactionID: 1}, nil
+}
+
+func (m *testDB) ReleaseHold(holdID int) (*domain.Hold, error) {
+	if holdID == 409 {
+		return nil, myerrors.ErrHoldNotActive
+	}
+	return &domain.Hold{ID: holdID, Status: domain.HoldReleased}, nil
+}
+
+func (m *testDB) ExpireHolds(now time.Time) (int, error) {
+	return 0, nil
+}
+
+func (m *testDB) InsertSchedule(s domain.Schedule, stepUp domain.StepUp) (*domain.Schedule, error) {
+	s.ID, s.Status, s.StepUp = 1, domain.ScheduleActive, stepUp.Decision
+	return &s, nil
+}
+
+func (m *testDB) GetSchedule(scheduleID int) (*domain.Schedule, error) {
+	switch scheduleID {
+	case 404:
+		return nil, myerrors.ErrScheduleNotFound
+	case 403:
+		return &domain.Schedule{ID: scheduleID, IIN: "other", Status: domain.ScheduleActive}, nil
+	}
+	return &domain.Schedule{ID: scheduleID, IIN: "910815450350", Status: domain.ScheduleActive}, nil
+}
+
+func (m *testDB) GetSchedules(IIN string) ([]domain.Schedule, error) {
+	return []domain.Schedule{{ID: 1, IIN: IIN, Status: domain.ScheduleActive}}, nil
+}
+
+func (m *testDB) GetScheduleRuns(scheduleID int) ([]domain.ScheduleRun, error) {
+	return nil, nil
+}
+
+func (m *testDB) CancelSchedule(scheduleID int) (*domain.Schedule, error) {
+	if scheduleID == 409 {
+		return nil, myerrors.ErrScheduleNotActive
+	}
+	return &domain.Schedule{ID: scheduleID, Status: domain.ScheduleCancelled}, nil
+}
+
+func (m *testDB) GetDueSchedules(now time.Time) ([]domain.Schedule, error) {
+	return nil, nil
+}
+
+func (m *testDB) RecordScheduleRun(s domain.Schedule, run domain.ScheduleRun) error {
 	return nil
 }
 
-func (m *testDB) UpdateTransferStatus(from, to string) error {
-	if from == "wrong" {
-		return fmt.Errorf("Wrong acc")
+func (m *testDB) InsertBatch(b domain.Batch, stepUp domain.StepUp) (*domain.Batch, error) {
+	b.ID, b.StepUp = 1, stepUp.Decision
+	return &b, nil
+}
+
+func (m *testDB) GetBatch(batchID int) (*domain.Batch, error) {
+	switch batchID {
+	case 404:
+		return nil, myerrors.ErrBatchNotFound
+	case 403:
+		return &domain.Batch{ID: batchID, IIN: "other", Status: domain.BatchPending}, nil
+	}
+	return &domain.Batch{ID: batchID, IIN: "910815450350", Status: domain.BatchCompleted}, nil
+}
+
+func (m *testDB) GetPendingBatches() ([]domain.Batch, error) {
+	return nil, nil
+}
+
+func (m *testDB) ClaimBatch(batchID int) (bool, error) {
+	return true, nil
+}
+
+func (m *testDB) UpdateBatchLine(batchID int, line domain.BatchLine) error {
+	return nil
+}
+
+func (m *testDB) FinishBatch(batchID int, status string) error {
+	return nil
+}
+
+func (m *testDB) InsertSubscription(s domain.Subscription) (*domain.Subscription, error) {
+	s.ID = 1
+	return &s, nil
+}
+
+func (m *testDB) GetSubscription(subscriptionID int) (*domain.Subscription, error) {
+	switch subscriptionID {
+	case 404:
+		return nil, myerrors.ErrSubscriptionNotFound
+	case 403:
+		return &domain.Subscription{ID: subscriptionID, IIN: "other"}, nil
 	}
+	return &domain.Subscription{ID: subscriptionID, IIN: "910815450350"}, nil
+}
+
+func (m *testDB) GetSubscriptions(IIN string) ([]domain.Subscription, error) {
+	return []domain.Subscription{{ID: 1, IIN: IIN, Secret: "secret", Events: domain.EventTypes}}, nil
+}
+
+func (m *testDB) DeleteSubscription(subscriptionID int) error {
 	return nil
 }
 
-func (m *testDB) GetWalletList(IIN string) ([]string, error) {
+func (m *testDB) EnqueueEvent(e domain.Event) (int, error) {
+	return 0, nil
+}
+
+func (m *testDB) GetDueDeliveries(now time.Time, limit int) ([]domain.Delivery, error) {
 	return nil, nil
 }
 
+func (m *testDB) RecordDelivery(d domain.Delivery) error {
+	return nil
+}
+
+func (m *testDB) GetDelivery(deliveryID int) (*domain.Delivery, error) {
+	switch deliveryID {
+	case 404:
+		return nil, myerrors.ErrDeliveryNotFound
+	case 403:
+		return &domain.Delivery{ID: deliveryID, IIN: "other", Status: domain.DeliveryDead}, nil
+	}
+	return &domain.Delivery{ID: deliveryID, IIN: "910815450350", Status: domain.DeliveryDead}, nil
+}
+
+func (m *testDB) GetDeadDeliveries(IIN string) ([]domain.Delivery, error) {
+	return nil, nil
+}
+
+func (m *testDB) RequeueDelivery(deliveryID int, now time.Time) error {
+	if deliveryID == 409 {
+		return myerrors.ErrDeliveryNotDead
+	}
+	return nil
+}
+
+func (m *testDB) GetUnpublishedEvents(limit int) ([]domain.Event, error) {
+	return nil, nil
+}
+
+func (m *testDB) MarkEventPublished(eventID string, at time.Time) error {
+	return nil
+}
+
+func (m *testDB) GetEventsAfter(IIN, eventID string, limit int) ([]domain.Event, error) {
+	return nil, myerrors.ErrEventNotFound
+}
+
+func (m *testDB) GetOutboxPosition() (int64, error) {
+	return 0, nil
+}
+
+func (m *testDB) GetEventsSince(position int64, limit int) ([]domain.Event, int64, error) {
+	return nil, position, nil
+}
+
+func (m *testDB) InsertUser(u domain.User) (*domain.User, error) {
+	return nil, fmt.Errorf("users are not kept in testDB")
+}
+
+func (m *testDB) GetUser(userID int) (*domain.User, error) {
+	return nil, myerrors.ErrUserNotFound
+}
+
+func (m *testDB) GetUserByUsername(username string) (*domain.User, error) {
+	return nil, myerrors.ErrUserNotFound
+}
+
+func (m *testDB) InsertRefreshToken(t domain.RefreshToken) error {
+	return nil
+}
+
+func (m *testDB) GetRefreshToken(hash string) (*domain.RefreshToken, error) {
+	return nil, myerrors.ErrInvalidRefreshToken
+}
+
+func (m *testDB) RotateRefreshToken(hash string, next domain.RefreshToken) (bool, error) {
+	return false, nil
+}
+
+func (m *testDB) RevokeRefreshTokens(familyID string) error {
+	return nil
+}
+
+func (m *testDB) GetSessions(IIN string, now time.Time) ([]domain.Session, error) {
+	return nil, nil
+}
+
+func (m *testDB) InsertRevocation(r domain.Revocation) error {
+	return nil
+}
+
+func (m *testDB) GetRevocations(since time.Time) ([]domain.Revocation, error) {
+	return nil, nil
+}
+
+func (m *testDB) DeleteExpiredRevocations(now time.Time) (int, error) {
+	return 0, nil
+}
+
+func (m *testDB) GetTOTP(IIN string) (*domain.TOTP, error) {
+	return nil, myerrors.ErrTOTPNotEnrolled
+}
+
+func (m *testDB) SaveTOTP(t domain.TOTP) error {
+	return nil
+}
+
+func (m *testDB) UseTOTPStep(IIN string, step int64, activate bool) (bool, error) {
+	return false, nil
+}
+
+func (m *testDB) FailTOTP(IIN string, maxAttempts int, lockedUntil time.Time) error {
+	return nil
+}
+
+func (m *testDB) DeleteTOTP(IIN string) error {
+	return nil
+}
+
+func (m *testDB) InsertTransferConfirmation(c domain.TransferConfirmation) error {
+	return nil
+}
+
+func (m *testDB) GetTransferConfirmation(hash string, now time.Time) (*domain.TransferConfirmation, error) {
+	return nil, myerrors.ErrInvalidConfirmation
+}
+
 func NewMySQLDBInterface(dbURL string) (repository.DBInterface, error) {
 	return &testDB{}, nil
 }
@@ -0,0 +1,90 @@
+package delivery
+
+import (
+	"fmt"
+	"log"
+	"time"
+	"wallet/myerrors"
+	"wallet/wallet/delivery/response"
+	"wallet/wallet/statement"
+	"wallet/wallet/usecase"
+
+	"github.com/buaazp/fasthttprouter"
+	"github.com/valyala/fasthttp"
+)
+
+type StatementHandler struct {
+	uc usecase.StatementUsecase
+}
+
+// GetStatement handles export of account statement. Period is given either by month header such as "2022-01" or by
+// since and until headers taking RFC 3339 times or dates, format header takes csv (the default), jsonl, pdf,
+// camt053 (ISO 20022 XML) or mt940 (SWIFT text)
+func (h *StatementHandler) GetStatement(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|GetStatement endpoint hit")
+	IIN, anyWallet, ok := getIINAndGrant(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	account := string(ctx.Request.Header.Peek("account"))
+	if account == "" {
+		response.RespondWithError(ctx, fasthttp.StatusBadRequest, "accountno not provided")
+		return
+	}
+	format := string(ctx.Request.Header.Peek("format"))
+	if format == "" {
+		format = statement.CSV
+	}
+	contentType, ok := statement.ContentType(format)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrUnsupportedFormat)
+		return
+	}
+	since, until, err := getStatementPeriod(ctx)
+	if err != nil {
+		response.RespondWithProblem(ctx, err)
+		return
+	}
+
+	s, err := h.uc.GetStatement(IIN, account, since, until, anyWallet)
+	if err != nil {
+		log.Println("ERROR|Getting statement:", err)
+		response.RespondWithProblem(ctx, err)
+		return
+	}
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetContentType(contentType)
+	ctx.Response.Header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"statement-%s-%s.%s\"", account, since.Format("20060102"), statement.Extension(format)))
+	if err := statement.Write(ctx, s, format); err != nil {
+		log.Println("ERROR|Writing statement:", err)
+	}
+}
+
+// getStatementPeriod retrieves statement period from month header or since and until headers
+func getStatementPeriod(ctx *fasthttp.RequestCtx) (time.Time, time.Time, error) {
+	if month := string(ctx.Request.Header.Peek("month")); month != "" {
+		since, err := time.Parse("2006-01", month)
+		if err != nil {
+			return time.Time{}, time.Time{}, myerrors.ErrInvalidPeriod
+		}
+		return since, since.AddDate(0, 1, 0), nil
+	}
+	since, err := parseHistoryTime(string(ctx.Request.Header.Peek("since")), false)
+	if err != nil {
+		return time.Time{}, time.Time{}, myerrors.ErrInvalidPeriod
+	}
+	until, err := parseHistoryTime(string(ctx.Request.Header.Peek("until")), true)
+	if err != nil {
+		return time.Time{}, time.Time{}, myerrors.ErrInvalidPeriod
+	}
+	return since, until, nil
+}
+
+// NewStatementHandler sets /statement route
+func NewStatementHandler(r *fasthttprouter.Router, uc usecase.StatementUsecase) {
+	handler := &StatementHandler{
+		uc: uc,
+	}
+	route(r, "GET", "/statement", handler.GetStatement)
+}
@@ -0,0 +1,113 @@
+package delivery
+
+import (
+	"log"
+	"wallet/myerrors"
+	"wallet/wallet/delivery/response"
+	"wallet/wallet/usecase"
+
+	"github.com/buaazp/fasthttprouter"
+	"github.com/valyala/fasthttp"
+)
+
+// StepUpHandler serves enrolment of TOTP authenticators and confirmation of transfers with their codes, its routes
+// take JSON bodies
+type StepUpHandler struct {
+	uc usecase.StepUpUsecase
+}
+
+// otpRequest is the body of POST /auth/totp/activate and /auth/totp/disable
+type otpRequest struct {
+	OTP string `json:"otp"`
+}
+
+// EnrolTOTP handles enrolment of an authenticator of the user, responding with its secret
+func (h *StepUpHandler) EnrolTOTP(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|EnrolTOTP endpoint hit")
+	IIN, ok := getIIN(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	enrolment, err := h.uc.EnrolTOTP(IIN)
+	if err != nil {
+		log.Println("ERROR|Enrolling authenticator:", err)
+		response.RespondWithProblem(ctx, err)
+		return
+	}
+	response.ResponseV2(ctx, fasthttp.StatusCreated, enrolment)
+}
+
+// ActivateTOTP handles activation of the enrolled authenticator of the user with its code
+func (h *StepUpHandler) ActivateTOTP(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|ActivateTOTP endpoint hit")
+	h.withOTP(ctx, h.uc.ActivateTOTP)
+}
+
+// DisableTOTP handles removal of the authenticator of the user, which takes its code
+func (h *StepUpHandler) DisableTOTP(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|DisableTOTP endpoint hit")
+	h.withOTP(ctx, h.uc.DisableTOTP)
+}
+
+// withOTP calls do with IIN of the user and the code in request body
+func (h *StepUpHandler) withOTP(ctx *fasthttp.RequestCtx, do func(IIN, code string) error) {
+	IIN, ok := getIIN(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	var req otpRequest
+	if !decodeV2Body(ctx, &req) {
+		return
+	}
+	if fields := requireField(nil, "otp", req.OTP); len(fields) > 0 {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidRequest, fields...)
+		return
+	}
+	if err := do(IIN, req.OTP); err != nil {
+		log.Println("ERROR|Checking one-time code:", err)
+		response.RespondWithProblem(ctx, err)
+		return
+	}
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// ConfirmTransfer handles confirmation of a transfer, schedule or batch with a code ahead of making it, responding
+// with the token to make it with. A batch is confirmed for its total without receiver
+func (h *StepUpHandler) ConfirmTransfer(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|ConfirmTransfer endpoint hit")
+	IIN, ok := getIIN(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	var req transferRequest
+	if !decodeV2Body(ctx, &req) {
+		return
+	}
+	amount, fields := validateTransfer(&req, false)
+	fields = requireField(fields, "otp", req.OTP)
+	if len(fields) > 0 {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidRequest, fields...)
+		return
+	}
+	token, err := h.uc.ConfirmTransfer(req.From, req.To, amount, IIN, req.OTP)
+	if err != nil {
+		respondV2Error(ctx, err)
+		return
+	}
+	response.ResponseV2(ctx, fasthttp.StatusCreated, token)
+}
+
+// NewStepUpHandler sets POST /auth/totp/enrol, /auth/totp/activate, /auth/totp/disable and /v2/transfers/confirm
+// routes
+func NewStepUpHandler(r *fasthttprouter.Router, uc usecase.StepUpUsecase) {
+	handler := &StepUpHandler{
+		uc: uc,
+	}
+	route(r, "POST", "/auth/totp/enrol", handler.EnrolTOTP)
+	route(r, "POST", "/auth/totp/activate", handler.ActivateTOTP)
+	route(r, "POST", "/auth/totp/disable", handler.DisableTOTP)
+	route(r, "POST", "/v2/transfers/confirm", handler.ConfirmTransfer)
+}
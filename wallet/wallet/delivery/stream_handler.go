@@ -0,0 +1,161 @@
+package delivery
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"time"
+	"wallet/domain"
+	"wallet/myerrors"
+	"wallet/wallet/delivery/middleware"
+	"wallet/wallet/delivery/response"
+	"wallet/wallet/stream"
+	"wallet/wallet/usecase"
+
+	"github.com/buaazp/fasthttprouter"
+	"github.com/valyala/fasthttp"
+)
+
+// heartbeatInterval is how often an idle stream is written to, so that proxies keep it open and gone clients are
+// noticed
+const heartbeatInterval = 15 * time.Second
+
+// balanceEvent names server-sent events carrying the current balance of a wallet
+const balanceEvent = "balance"
+
+// resetEvent names server-sent event telling a resuming client that missed events can't be replayed, so that it
+// refetches its wallets and history
+const resetEvent = "reset"
+
+// endEvent names the last server-sent event of a stream whose token expired or was revoked, carrying the code of the
+// reason. The client reconnects with a fresh token
+const endEvent = "end"
+
+// revocationCheckInterval is how often a stream checks whether its token was revoked
+const revocationCheckInterval = time.Second
+
+type StreamHandler struct {
+	uc usecase.StreamUsecase
+}
+
+// Stream handles pushing events of the user's wallets as server-sent events named by event type, each followed by
+// a "balance" event with the wallet it changed. The stream starts with balances of all the wallets. Clients resume
+// by sending the ID of the last event they got in "Last-Event-ID" header, as browsers do on reconnect, and get the
+// events they missed or a "reset" event when those can't be replayed. The stream ends with an "end" event once the
+// token it was opened with expires or is revoked
+func (h *StreamHandler) Stream(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|Stream endpoint hit")
+	IIN, ok := getIIN(ctx)
+	principal, found := middleware.GetPrincipal(ctx)
+	if !ok || !found {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	s, replay, wallets, err := h.uc.Open(IIN, string(ctx.Request.Header.Peek("Last-Event-ID")))
+	if err != nil {
+		log.Println("ERROR|Opening stream:", err)
+		response.RespondWithProblem(ctx, err)
+		return
+	}
+	ctx.SetContentType("text/event-stream")
+	ctx.Response.Header.Set("Cache-Control", "no-cache")
+	ctx.Response.Header.Set("X-Accel-Buffering", "no")
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer s.Close()
+		if replay.Reset {
+			if err := stream.WriteEvent(w, "", resetEvent, []byte("{}")); err != nil {
+				return
+			}
+		}
+		replayed := make(map[string]bool, len(replay.Events))
+		for _, e := range replay.Events {
+			replayed[e.ID] = true
+			if err := writeStreamEvent(w, e); err != nil {
+				return
+			}
+		}
+		for _, wallet := range wallets {
+			if err := writeBalance(w, wallet); err != nil {
+				return
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+		expiry := time.NewTimer(time.Until(principal.ExpiresAt))
+		defer expiry.Stop()
+		revocationCheck := time.NewTicker(revocationCheckInterval)
+		defer revocationCheck.Stop()
+		for {
+			select {
+			case e, ok := <-s.C:
+				if !ok {
+					log.Printf("INFO|Stream of %s dropped, client is too slow\n", IIN)
+					return
+				}
+				if replayed[e.ID] {
+					continue
+				}
+				if err := writeStreamEvent(w, e); err != nil {
+					return
+				}
+				wallet, err := h.uc.GetWallet(IIN, e.Account)
+				if err != nil {
+					log.Printf("ERROR|Getting balance of %s: %v\n", e.Account, err)
+				} else if err := writeBalance(w, *wallet); err != nil {
+					return
+				}
+			case <-heartbeat.C:
+				if err := stream.WriteHeartbeat(w); err != nil {
+					return
+				}
+			case <-expiry.C:
+				log.Printf("INFO|Stream of %s ended, token expired\n", IIN)
+				writeEnd(w, myerrors.ErrTokenExpired)
+				return
+			case <-revocationCheck.C:
+				if middleware.Revoked(principal) {
+					log.Printf("INFO|Stream of %s ended, token revoked\n", IIN)
+					writeEnd(w, myerrors.ErrTokenRevoked)
+					return
+				}
+			}
+			if err := w.Flush(); err != nil {
+				log.Printf("INFO|Stream of %s closed: %v\n", IIN, err)
+				return
+			}
+		}
+	})
+}
+
+// writeStreamEvent writes e as server-sent event with its ID
+func writeStreamEvent(w *bufio.Writer, e domain.Event) error {
+	return stream.WriteEvent(w, e.ID, e.Type, []byte(e.Payload()))
+}
+
+// writeBalance writes wallet as balance server-sent event
+func writeBalance(w *bufio.Writer, wallet domain.Wallet) error {
+	data, err := json.Marshal(wallet)
+	if err != nil {
+		return err
+	}
+	return stream.WriteEvent(w, "", balanceEvent, data)
+}
+
+// writeEnd writes end server-sent event with the code of reason and flushes it, the stream is closed next anyway
+func writeEnd(w *bufio.Writer, reason *myerrors.Error) {
+	data, _ := json.Marshal(map[string]string{"code": reason.Code})
+	if err := stream.WriteEvent(w, "", endEvent, data); err == nil {
+		w.Flush()
+	}
+}
+
+// NewStreamHandler sets /stream route
+func NewStreamHandler(r *fasthttprouter.Router, uc usecase.StreamUsecase) {
+	handler := &StreamHandler{
+		uc: uc,
+	}
+	route(r, "GET", "/stream", handler.Stream)
+}
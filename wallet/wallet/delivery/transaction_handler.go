@@ -2,8 +2,10 @@ package delivery
 
 import (
 	"log"
+	"strconv"
+	"time"
+	"wallet/domain"
 	"wallet/myerrors"
-	"wallet/wallet/delivery/middleware"
 	"wallet/wallet/delivery/response"
 	"wallet/wallet/usecase"
 
@@ -15,7 +17,9 @@ type TransferHandler struct {
 	uc usecase.TransferUsecase
 }
 
-// TransferHandler handles account transactions
+// TransferHandler handles account transactions and responds with the transaction, a replayed "Idempotency-Key" gets
+// the transaction of the first request. Transfers above the step-up threshold take "otp" or "confirmation_token"
+// header
 func (h *TransferHandler) Transfer(ctx *fasthttp.RequestCtx) {
 	log.Println("INFO|Transfer endpoint hit")
 	values, ok := getTransferValues(ctx)
@@ -23,28 +27,29 @@ func (h *TransferHandler) Transfer(ctx *fasthttp.RequestCtx) {
 		response.RespondWithError(ctx, fasthttp.StatusBadRequest, "Invalid form data")
 		return
 	}
-	from, to, amount := values[0], values[1], values[2]
+	from, to := values[0], values[1]
+	amount, err := domain.ParseMoney(values[2], getCurrency(ctx))
+	if err != nil {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidAmt)
+		return
+	}
 
 	IIN, ok := ctx.UserValue(("IIN")).(string)
 	if !ok {
 		log.Println("ERROR|Failed to get IIN from ctx")
-		response.RespondWithError(ctx, fasthttp.StatusInternalServerError, "")
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
 		return
 	}
 
-	if err := h.uc.MakeTransfer(from, to, amount, IIN); err != nil {
-		if err == myerrors.ErrInsufficientFunds {
-			log.Println("ERROR|Insufficient funds to deduct from account")
-			response.RespondWithError(ctx, fasthttp.StatusBadRequest, "insufficient funds")
-			return
-		}
-		log.Println("ERROR|", err)
-		response.RespondWithError(ctx, fasthttp.StatusInternalServerError, err.Error())
+	transfer, err := h.uc.MakeTransfer(from, to, amount, IIN, getIdempotencyKey(ctx), getTransferAuth(ctx))
+	if err != nil {
+		log.Println("ERROR|Transfer handler:", err)
+		response.RespondWithProblem(ctx, err)
 		return
 	}
 
-	log.Println("INFO|Successfully set transfer status back to 0")
-	response.ResponseJSON(ctx, "success!")
+	log.Println("INFO|Transfer completed successfully")
+	response.ResponseTransfer(ctx, transfer)
 }
 
 // NewTransferHandler sets /transfer route
@@ -52,7 +57,7 @@ func NewTransferHandler(r *fasthttprouter.Router, uc usecase.TransferUsecase) {
 	handler := &TransferHandler{
 		uc: uc,
 	}
-	r.GET("/transfer", middleware.ProcessTokenMiddleware(handler.Transfer))
+	route(r, "GET", "/transfer", handler.Transfer)
 }
 
 // getTransferValues retrieves account numbers and trasnfer amount from request headers
@@ -72,7 +77,10 @@ type GetTransactionsHandler struct {
 	uc usecase.GetTransactionsUsecase
 }
 
-// GetTransacions handles retieval of account transaction history
+// GetTransacions handles retieval of account transaction history one page at a time. Optional headers narrow it down:
+// since and until take RFC 3339 times or dates, until a date includes the whole day, type takes a transfer type,
+// direction "in" or "out", counterparty an account, min_amount and max_amount amounts in the account's currency and
+// sort "asc" or "desc". Cursor continues after the page nextCursor was returned with and limit sizes the page
 func (h *GetTransactionsHandler) GetTransactions(ctx *fasthttp.RequestCtx) {
 	log.Println("INFO|GetTransactions hit")
 
@@ -83,31 +91,113 @@ func (h *GetTransactionsHandler) GetTransactions(ctx *fasthttp.RequestCtx) {
 		response.RespondWithError(ctx, fasthttp.StatusBadRequest, "accountno not provided")
 		return
 	}
-
-	IIN, ok := ctx.UserValue(("IIN")).(string)
-	if !ok {
-		log.Println("ERROR|Failed to get IIN from ctx")
-		response.RespondWithError(ctx, fasthttp.StatusInternalServerError, "")
+	filter, field, err := getTransactionFilter(ctx)
+	if err != nil {
+		log.Println("ERROR|Parsing transaction filter:", err)
+		response.RespondWithProblem(ctx, err, domain.FieldError{Field: field, Message: err.Error()})
 		return
 	}
-	isAdmin, ok := ctx.UserValue("isAdmin").(bool)
+	filter.Account = account
+
+	IIN, anyWallet, ok := getIINAndGrant(ctx)
 	if !ok {
-		log.Println("ERROR|Failed to get role from ctx")
-		response.RespondWithError(ctx, fasthttp.StatusInternalServerError, "")
+		log.Println("ERROR|Failed to get IIN and/or role from ctx")
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
 		return
 	}
 
-	transactions, err := h.uc.GetTransactions(IIN, account, isAdmin)
+	page, err := h.uc.GetTransactions(IIN, filter, anyWallet)
 	if err != nil {
 		log.Println("ERROR|Getting transactions:", err)
-		if err == myerrors.ErrIINMismatch {
-			response.RespondWithError(ctx, fasthttp.StatusForbidden, err.Error())
-			return
-		}
-		response.RespondWithError(ctx, fasthttp.StatusInternalServerError, "")
+		response.RespondWithProblem(ctx, err)
 		return
 	}
-	response.ResponseTransactions(ctx, transactions)
+	response.ResponseTransactionPage(ctx, page)
+}
+
+// getTransactionFilter retrieves optional transaction history filter sent by client in request headers, on error
+// the name of the header that failed is returned too
+func getTransactionFilter(ctx *fasthttp.RequestCtx) (domain.TransactionFilter, string, error) {
+	return parseTransactionFilter(func(name string) string {
+		return string(ctx.Request.Header.Peek(name))
+	}, getCurrency(ctx))
+}
+
+// parseTransactionFilter parses transaction history filter from parameters looked up by value, amounts are in currency.
+// On error the name of the parameter that failed is returned too
+func parseTransactionFilter(value func(name string) string, currency string) (domain.TransactionFilter, string, error) {
+	filter := domain.TransactionFilter{
+		Type:         value("type"),
+		Direction:    value("direction"),
+		Counterparty: value("counterparty"),
+	}
+	if (domain.TransactionFilter{Type: filter.Type}).Validate() != nil {
+		return filter, "type", myerrors.ErrInvalidFilter
+	}
+	if (domain.TransactionFilter{Direction: filter.Direction}).Validate() != nil {
+		return filter, "direction", myerrors.ErrInvalidFilter
+	}
+	var err error
+	if v := value("cursor"); v != "" {
+		if filter.Cursor, err = domain.DecodeCursor(v); err != nil {
+			return filter, "cursor", err
+		}
+	}
+	if v := value("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit <= 0 {
+			return filter, "limit", myerrors.ErrInvalidFilter
+		}
+	}
+	if filter.Since, err = parseHistoryTime(value("since"), false); err != nil {
+		return filter, "since", err
+	}
+	if filter.Until, err = parseHistoryTime(value("until"), true); err != nil {
+		return filter, "until", err
+	}
+	if filter.MinAmount, err = parseAmountBound(value("min_amount"), currency); err != nil {
+		return filter, "min_amount", err
+	}
+	if filter.MaxAmount, err = parseAmountBound(value("max_amount"), currency); err != nil {
+		return filter, "max_amount", err
+	}
+	switch value("sort") {
+	case "", "asc":
+	case "desc":
+		filter.Desc = true
+	default:
+		return filter, "sort", myerrors.ErrInvalidFilter
+	}
+	return filter, "", nil
+}
+
+// parseAmountBound parses optional amount in currency into minor units
+func parseAmountBound(value, currency string) (*int64, error) {
+	if value == "" {
+		return nil, nil
+	}
+	amount, err := domain.ParseMoney(value, currency)
+	if err != nil {
+		return nil, myerrors.ErrInvalidFilter
+	}
+	return &amount.Amount, nil
+}
+
+// parseHistoryTime parses RFC 3339 time or a date, which stands for its end when endOfDay is set
+func parseHistoryTime(value string, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, myerrors.ErrInvalidFilter
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
 }
 
 // NewGetTransactionsHandler sets /transactions route
@@ -115,5 +205,49 @@ func NewGetTransactionsHandler(r *fasthttprouter.Router, uc usecase.GetTransacti
 	handler := &GetTransactionsHandler{
 		uc: uc,
 	}
-	r.GET("/transactions", middleware.ProcessTokenMiddleware(handler.GetTransactions))
+	route(r, "GET", "/transactions", handler.GetTransactions)
+}
+
+type ReversalHandler struct {
+	uc usecase.ReversalUsecase
+}
+
+// Reverse handles full or partial refund of a transaction, amount header is optional and defaults to everything left
+func (h *ReversalHandler) Reverse(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|Reverse endpoint hit")
+	_, canReverse, ok := getIINAndGrant(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	transactionID, err := strconv.Atoi(string(ctx.Request.Header.Peek("transaction")))
+	if err != nil {
+		response.RespondWithError(ctx, fasthttp.StatusBadRequest, "invalid transaction")
+		return
+	}
+	var amount *domain.Money
+	if value := string(ctx.Request.Header.Peek("amount")); value != "" {
+		parsed, err := domain.ParseMoney(value, getCurrency(ctx))
+		if err != nil {
+			response.RespondWithProblem(ctx, myerrors.ErrInvalidAmt)
+			return
+		}
+		amount = &parsed
+	}
+
+	reversal, err := h.uc.Reverse(transactionID, amount, canReverse)
+	if err != nil {
+		log.Println("ERROR|Reverse handler:", err)
+		response.RespondWithProblem(ctx, err)
+		return
+	}
+	response.ResponseTransactions(ctx, []domain.Transaction{*reversal})
+}
+
+// NewReversalHandler sets /admin/reverse route
+func NewReversalHandler(r *fasthttprouter.Router, uc usecase.ReversalUsecase) {
+	handler := &ReversalHandler{
+		uc: uc,
+	}
+	route(r, "GET", "/admin/reverse", handler.Reverse)
 }
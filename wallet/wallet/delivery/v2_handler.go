@@ -0,0 +1,277 @@
+package delivery
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"wallet/domain"
+	"wallet/myerrors"
+	"wallet/wallet/delivery/response"
+	"wallet/wallet/usecase"
+
+	"github.com/buaazp/fasthttprouter"
+	"github.com/valyala/fasthttp"
+)
+
+// V2Handler serves resource-oriented routes under /v2. Requests carry their parameters in JSON bodies or query
+// strings rather than headers and responses are the resources themselves rather than wrapped in domain.Response
+type V2Handler struct {
+	addWallet    usecase.AddWalletUsecase
+	wallets      usecase.GetWalletsUsecase
+	transfers    usecase.TransferUsecase
+	transactions usecase.GetTransactionsUsecase
+}
+
+// createWalletRequest is the body of POST /v2/wallets, currency defaults to domain.DefaultCurrency
+type createWalletRequest struct {
+	Currency string `json:"currency"`
+}
+
+// transferRequest is the body of POST /v2/transfers, amount is a decimal in currency, which defaults to
+// domain.DefaultCurrency. Transfers above the step-up threshold take otp or confirmationToken
+type transferRequest struct {
+	From              string `json:"from"`
+	To                string `json:"to"`
+	Amount            string `json:"amount"`
+	Currency          string `json:"currency"`
+	OTP               string `json:"otp"`
+	ConfirmationToken string `json:"confirmationToken"`
+}
+
+type transferResponse struct {
+	ID     int          `json:"id"`
+	From   string       `json:"from"`
+	To     string       `json:"to"`
+	Amount domain.Money `json:"amount"`
+}
+
+type walletsResponse struct {
+	Wallets []domain.Wallet `json:"wallets"`
+}
+
+type transactionsResponse struct {
+	Transactions []domain.Transaction `json:"transactions"`
+	NextCursor   string               `json:"nextCursor,omitempty"`
+}
+
+// CreateWallet handles creation of a wallet for the user, responding with the wallet and its URL in Location header
+func (h *V2Handler) CreateWallet(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|V2 CreateWallet endpoint hit")
+	IIN, ok := getIIN(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	var req createWalletRequest
+	if !decodeV2Body(ctx, &req) {
+		return
+	}
+	if req.Currency == "" {
+		req.Currency = domain.DefaultCurrency
+	}
+	account, err := h.addWallet.MakeWallet(IIN, req.Currency)
+	if err != nil {
+		respondV2Error(ctx, err)
+		return
+	}
+	wallet, err := h.wallets.GetWallet(IIN, account, false)
+	if err != nil {
+		respondV2Error(ctx, err)
+		return
+	}
+	log.Printf("INFO|Created new wallet for user %s under account %s\n", IIN, account)
+	ctx.Response.Header.Set("Location", "/v2/wallets/"+account)
+	response.ResponseV2(ctx, fasthttp.StatusCreated, wallet)
+}
+
+// GetWallets handles retrieval of the user's wallets with their balances
+func (h *V2Handler) GetWallets(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|V2 GetWallets endpoint hit")
+	IIN, ok := getIIN(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	wallets, err := h.wallets.GetWallets(IIN)
+	if err != nil {
+		respondV2Error(ctx, err)
+		return
+	}
+	if wallets == nil {
+		wallets = []domain.Wallet{}
+	}
+	response.ResponseV2(ctx, fasthttp.StatusOK, walletsResponse{Wallets: wallets})
+}
+
+// GetWallet handles retrieval of the wallet in the URL, admins may get any wallet
+func (h *V2Handler) GetWallet(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|V2 GetWallet endpoint hit")
+	IIN, anyWallet, ok := getIINAndGrant(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	account, _ := ctx.UserValue("account").(string)
+	wallet, err := h.wallets.GetWallet(IIN, account, anyWallet)
+	if err != nil {
+		respondV2Error(ctx, err)
+		return
+	}
+	response.ResponseV2(ctx, fasthttp.StatusOK, wallet)
+}
+
+// GetTransactions handles retrieval of transaction history of the wallet in the URL one page at a time. The query
+// string takes the filters the v1 route takes in headers, with amounts in the wallet's currency
+func (h *V2Handler) GetTransactions(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|V2 GetTransactions endpoint hit")
+	IIN, anyWallet, ok := getIINAndGrant(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	account, _ := ctx.UserValue("account").(string)
+	wallet, err := h.wallets.GetWallet(IIN, account, anyWallet)
+	if err != nil {
+		respondV2Error(ctx, err)
+		return
+	}
+	filter, field, err := parseTransactionFilter(func(name string) string {
+		return string(ctx.QueryArgs().Peek(name))
+	}, wallet.Ledger.Currency)
+	if err != nil {
+		response.RespondWithProblem(ctx, err, domain.FieldError{Field: field, Message: err.Error()})
+		return
+	}
+	filter.Account = account
+
+	page, err := h.transactions.GetTransactions(IIN, filter, anyWallet)
+	if err != nil {
+		respondV2Error(ctx, err)
+		return
+	}
+	if page.Transactions == nil {
+		page.Transactions = []domain.Transaction{}
+	}
+	response.ResponseV2(ctx, fasthttp.StatusOK, transactionsResponse{Transactions: page.Transactions, NextCursor: page.NextCursor})
+}
+
+// Transfer handles moving money from a wallet of the user, an optional "Idempotency-Key" header makes retries safe
+// and answers them with the transaction of the first request
+func (h *V2Handler) Transfer(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|V2 Transfer endpoint hit")
+	IIN, ok := getIIN(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	var req transferRequest
+	if !decodeV2Body(ctx, &req) {
+		return
+	}
+	amount, fields := validateTransfer(&req, true)
+	if len(fields) > 0 {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidRequest, fields...)
+		return
+	}
+	transferAuth := domain.TransferAuth{Code: req.OTP, ConfirmationToken: req.ConfirmationToken}
+	transfer, err := h.transfers.MakeTransfer(req.From, req.To, amount, IIN, getIdempotencyKey(ctx), transferAuth)
+	if err != nil {
+		respondV2Error(ctx, err)
+		return
+	}
+	log.Println("INFO|Transfer completed successfully")
+	response.ResponseV2(ctx, fasthttp.StatusCreated, transferResponse{ID: transfer.ID, From: transfer.From, To: transfer.To, Amount: transfer.Amount})
+}
+
+// validateTransfer checks every field of req and parses its amount, defaulting currency. The receiver is only
+// required when requireTo is set
+func validateTransfer(req *transferRequest, requireTo bool) (domain.Money, []domain.FieldError) {
+	var fields []domain.FieldError
+	if req.From == "" {
+		fields = append(fields, domain.FieldError{Field: "from", Message: "is required"})
+	}
+	if requireTo && req.To == "" {
+		fields = append(fields, domain.FieldError{Field: "to", Message: "is required"})
+	}
+	if req.Currency == "" {
+		req.Currency = domain.DefaultCurrency
+	}
+	if _, ok := domain.CurrencyExponent(req.Currency); !ok {
+		fields = append(fields, domain.FieldError{Field: "currency", Message: myerrors.ErrUnsupportedCurrency.Error()})
+		return domain.Money{}, fields
+	}
+	amount, err := domain.ParseMoney(req.Amount, req.Currency)
+	switch {
+	case req.Amount == "":
+		fields = append(fields, domain.FieldError{Field: "amount", Message: "is required"})
+	case err != nil || !amount.IsPositive():
+		fields = append(fields, domain.FieldError{Field: "amount", Message: "must be a positive decimal in " + req.Currency})
+	}
+	return amount, fields
+}
+
+// decodeV2Body decodes JSON request body into v, responding with what is wrong with the body if it can't.
+// An empty body leaves v as is
+func decodeV2Body(ctx *fasthttp.RequestCtx, v interface{}) bool {
+	body := ctx.PostBody()
+	if len(bytes.TrimSpace(body)) == 0 {
+		return true
+	}
+	if !bytes.HasPrefix(ctx.Request.Header.ContentType(), []byte("application/json")) {
+		response.RespondWithProblem(ctx, myerrors.ErrUnsupportedMediaType)
+		return false
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil {
+		return true
+	}
+	log.Println("ERROR|Decoding v2 request body:", err)
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &typeErr):
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidRequest,
+			domain.FieldError{Field: typeErr.Field, Message: "must be a " + typeErr.Type.String()})
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidRequest,
+			domain.FieldError{Field: field, Message: "unknown field"})
+	default:
+		response.RespondWithError(ctx, fasthttp.StatusBadRequest, "malformed JSON body")
+	}
+	return false
+}
+
+// respondV2Error logs err of v2 operation and responds with its problem details, pointing invalid amounts and
+// currencies at the field of the request they came from
+func respondV2Error(ctx *fasthttp.RequestCtx, err error) {
+	log.Println("ERROR|V2 handler:", err)
+	var fields []domain.FieldError
+	switch {
+	case errors.Is(err, myerrors.ErrInvalidAmt):
+		fields = append(fields, domain.FieldError{Field: "amount", Message: err.Error()})
+	case errors.Is(err, myerrors.ErrUnsupportedCurrency):
+		fields = append(fields, domain.FieldError{Field: "currency", Message: err.Error()})
+	}
+	response.RespondWithProblem(ctx, err, fields...)
+}
+
+// NewV2Handler sets POST /v2/wallets, GET /v2/wallets, GET /v2/wallets/:account,
+// GET /v2/wallets/:account/transactions and POST /v2/transfers routes
+func NewV2Handler(r *fasthttprouter.Router, addWallet usecase.AddWalletUsecase, wallets usecase.GetWalletsUsecase,
+	transfers usecase.TransferUsecase, transactions usecase.GetTransactionsUsecase) {
+	handler := &V2Handler{
+		addWallet:    addWallet,
+		wallets:      wallets,
+		transfers:    transfers,
+		transactions: transactions,
+	}
+	route(r, "POST", "/v2/wallets", handler.CreateWallet)
+	route(r, "GET", "/v2/wallets", handler.GetWallets)
+	route(r, "GET", "/v2/wallets/:account", handler.GetWallet)
+	route(r, "GET", "/v2/wallets/:account/transactions", handler.GetTransactions)
+	route(r, "POST", "/v2/transfers", handler.Transfer)
+}
@@ -3,8 +3,8 @@ package delivery
 import (
 	"fmt"
 	"log"
+	"wallet/domain"
 	"wallet/myerrors"
-	"wallet/wallet/delivery/middleware"
 	"wallet/wallet/delivery/response"
 	"wallet/wallet/usecase"
 
@@ -16,18 +16,19 @@ type AddWalletHandler struct {
 	uc usecase.AddWalletUsecase
 }
 
-// AddWallet hadnles creation of new wallet
+// AddWallet hadnles creation of new wallet in currency requested by client
 func (h *AddWalletHandler) AddWallet(ctx *fasthttp.RequestCtx) {
 	log.Println("INFO|AddWallet endpoint hit")
-	IIN, _, ok := getIINAndRole(ctx)
+	IIN, ok := getIIN(ctx)
 	if !ok {
-		response.RespondWithError(ctx, fasthttp.StatusInternalServerError, "")
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
 		return
 	}
 	log.Println("INFO|getIIN successful")
-	account, err := h.uc.MakeWallet(IIN)
+	account, err := h.uc.MakeWallet(IIN, getCurrency(ctx))
 	if err != nil {
-		response.RespondWithError(ctx, fasthttp.StatusInternalServerError, err.Error())
+		log.Println("ERROR|AddWallet handler:", err)
+		response.RespondWithProblem(ctx, err)
 		return
 	}
 	log.Printf("INFO|Created new wallet for user %s under account%s\n", IIN, account)
@@ -39,35 +40,38 @@ func NewAddWalletHandler(r *fasthttprouter.Router, uc usecase.AddWalletUsecase)
 	handler := &AddWalletHandler{
 		uc: uc,
 	}
-	r.GET("/add", middleware.ProcessTokenMiddleware(handler.AddWallet))
+	route(r, "GET", "/add", handler.AddWallet)
 }
 
 type GetInfoHandler struct {
 	uc usecase.GetWalletsUsecase
 }
 
-// GetInfo hadnles retrieval of user account info
+// GetInfo hadnles retrieval of account info of the user in iin header, reading other users needs PermReadAnyWallet
 func (h *GetInfoHandler) GetInfo(ctx *fasthttp.RequestCtx) {
 	log.Println("INFO|GetInfo hit")
-	tokenIIN, isAdmin, ok := getIINAndRole(ctx)
+	tokenIIN, anyWallet, ok := getIINAndGrant(ctx)
 	if !ok {
-		response.RespondWithError(ctx, fasthttp.StatusInternalServerError, "Failed to get IIN and/or role")
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
 		return
 	}
-	if isAdmin {
-		IIN := string(ctx.Request.Header.Peek("iin"))
-		if IIN == "" {
-			response.RespondWithError(ctx, fasthttp.StatusBadRequest, "Failed to get IIN")
-			return
-		}
-		log.Println("received iin", IIN)
-		tokenIIN = IIN
+	IIN := string(ctx.Request.Header.Peek("iin"))
+	if IIN == "" {
+		response.RespondWithError(ctx, fasthttp.StatusBadRequest, "Failed to get IIN")
+		return
+	}
+	log.Println("received iin", IIN)
+	if IIN != tokenIIN && !anyWallet {
+		log.Printf("ERROR|GetInfo handler: %s may not read wallets of %s\n", tokenIIN, IIN)
+		response.RespondWithProblem(ctx, myerrors.ErrIINMismatch)
+		return
 	}
 
-	log.Println("INFO|retrieved IIN successfully, sending IIN", tokenIIN)
-	wallets, err := h.uc.GetWallets(tokenIIN)
+	log.Println("INFO|retrieved IIN successfully, sending IIN", IIN)
+	wallets, err := h.uc.GetWallets(IIN)
 	if err != nil {
-		response.RespondWithError(ctx, fasthttp.StatusInternalServerError, err.Error())
+		log.Println("ERROR|GetInfo handler:", err)
+		response.RespondWithProblem(ctx, err)
 		return
 	}
 	response.ResponseWallets(ctx, wallets)
@@ -77,7 +81,7 @@ func NewGetInfoHandler(r *fasthttprouter.Router, uc usecase.GetWalletsUsecase) {
 	handler := &GetInfoHandler{
 		uc: uc,
 	}
-	r.GET("/info", middleware.ProcessTokenMiddleware(handler.GetInfo))
+	route(r, "GET", "/info", handler.GetInfo)
 }
 
 type WalletListHandler struct {
@@ -87,17 +91,17 @@ type WalletListHandler struct {
 // GetWalletList handles retrieval of user account list
 func (h *WalletListHandler) GetWalletList(ctx *fasthttp.RequestCtx) {
 	log.Println("INFO|GetWalletList endpoint hit")
-	IIN, _, ok := getIINAndRole(ctx)
+	IIN, ok := getIIN(ctx)
 	if !ok {
-		response.RespondWithError(ctx, fasthttp.StatusInternalServerError, "Failed to get IIN and/or role")
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
 		return
 	}
-	log.Println("INFO|getIINAndRole successful")
+	log.Println("INFO|getIIN successful")
 
 	walletList, err := h.uc.GetWalletList(IIN)
 	if err != nil {
-		fmt.Println("ERROR|GetWalletList handler:", err)
-		response.RespondWithError(ctx, fasthttp.StatusInternalServerError, err.Error())
+		log.Println("ERROR|GetWalletList handler:", err)
+		response.RespondWithProblem(ctx, err)
 		return
 	}
 	if len(walletList) == 0 {
@@ -113,7 +117,7 @@ func NewWalletListHandler(r *fasthttprouter.Router, uc usecase.WalletListUsecase
 	handler := &WalletListHandler{
 		uc: uc,
 	}
-	r.GET("/wallets", middleware.ProcessTokenMiddleware(handler.GetWalletList))
+	route(r, "GET", "/wallets", handler.GetWalletList)
 }
 
 type TopUpHandler struct {
@@ -123,9 +127,9 @@ type TopUpHandler struct {
 // TopUp hadnles account replenishment
 func (h *TopUpHandler) TopUp(ctx *fasthttp.RequestCtx) {
 	log.Println("INFO|Topup endpoint hit")
-	IIN, _, ok := getIINAndRole(ctx)
+	IIN, ok := getIIN(ctx)
 	if !ok {
-		response.RespondWithError(ctx, fasthttp.StatusInternalServerError, "")
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
 		return
 	}
 	values, ok := getTopupValues(ctx)
@@ -133,27 +137,27 @@ func (h *TopUpHandler) TopUp(ctx *fasthttp.RequestCtx) {
 		response.RespondWithError(ctx, fasthttp.StatusBadRequest, "invalid form data")
 		return
 	}
-	accountNo, amount := values[0], values[1]
-	fmt.Println(accountNo, amount, "acc#, amt")
-	res, err := h.uc.TopUp(IIN, accountNo, amount)
+	accountNo := values[0]
+	amount, err := domain.ParseMoney(values[1], getCurrency(ctx))
+	if err != nil {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidAmt)
+		return
+	}
+	res, err := h.uc.TopUp(IIN, accountNo, amount, getIdempotencyKey(ctx))
 	if err != nil {
 		log.Println("ERROR|Topup handler:", err)
-		if err == myerrors.ErrInvalidAmt {
-			response.RespondWithError(ctx, fasthttp.StatusBadRequest, "invalid amount")
-			return
-		}
-		response.RespondWithError(ctx, fasthttp.StatusInternalServerError, err.Error())
+		response.RespondWithProblem(ctx, err)
 		return
 	}
-	log.Printf("INFO|Account %s amount updated to%s\n", accountNo, res)
-	response.ResponseJSON(ctx, res)
+	log.Printf("INFO|Account %s amount updated to %s\n", accountNo, res)
+	response.ResponseMoney(ctx, res)
 }
 
 func NewTopUpHandler(r *fasthttprouter.Router, uc usecase.TopUpUsecase) {
 	handler := &TopUpHandler{
 		uc: uc,
 	}
-	r.GET("/topup", middleware.ProcessTokenMiddleware(handler.TopUp))
+	route(r, "GET", "/topup", handler.TopUp)
 }
 
 // getTopupValues retrieves account number and topup amount from headers
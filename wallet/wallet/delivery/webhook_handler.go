@@ -0,0 +1,132 @@
+package delivery
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"wallet/domain"
+	"wallet/myerrors"
+	"wallet/wallet/delivery/response"
+	"wallet/wallet/usecase"
+
+	"github.com/buaazp/fasthttprouter"
+	"github.com/valyala/fasthttp"
+)
+
+type WebhookHandler struct {
+	uc usecase.WebhookUsecase
+}
+
+// Subscribe handles subscribing "url" header to events of the user's wallets. "events" header takes a comma
+// separated list of event types, all of them by default, and "secret" the key deliveries are signed with,
+// a generated one by default. The response is the only time the secret is shown
+func (h *WebhookHandler) Subscribe(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|Subscribe endpoint hit")
+	IIN, ok := getIIN(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	var events []string
+	if value := string(ctx.Request.Header.Peek("events")); value != "" {
+		for _, e := range strings.Split(value, ",") {
+			events = append(events, strings.TrimSpace(e))
+		}
+	}
+	s, err := h.uc.Subscribe(string(ctx.Request.Header.Peek("url")), string(ctx.Request.Header.Peek("secret")), events, IIN)
+	if err != nil {
+		respondWebhookError(ctx, err)
+		return
+	}
+	response.ResponseSubscriptions(ctx, []domain.Subscription{*s})
+}
+
+// GetSubscriptions handles retrieval of the user's webhook subscriptions
+func (h *WebhookHandler) GetSubscriptions(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|GetSubscriptions endpoint hit")
+	IIN, ok := getIIN(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	subscriptions, err := h.uc.GetSubscriptions(IIN)
+	if err != nil {
+		respondWebhookError(ctx, err)
+		return
+	}
+	response.ResponseSubscriptions(ctx, subscriptions)
+}
+
+// Unsubscribe handles deleting the subscription in "subscription" header
+func (h *WebhookHandler) Unsubscribe(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|Unsubscribe endpoint hit")
+	IIN, anyWallet, ok := getIINAndGrant(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	subscriptionID, err := strconv.Atoi(string(ctx.Request.Header.Peek("subscription")))
+	if err != nil {
+		response.RespondWithError(ctx, fasthttp.StatusBadRequest, "invalid subscription")
+		return
+	}
+	if err := h.uc.Unsubscribe(subscriptionID, IIN, anyWallet); err != nil {
+		respondWebhookError(ctx, err)
+		return
+	}
+	response.ResponseJSON(ctx, "success!")
+}
+
+// GetDeadDeliveries handles retrieval of deliveries to the user's subscriptions that ran out of attempts
+func (h *WebhookHandler) GetDeadDeliveries(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|GetDeadDeliveries endpoint hit")
+	IIN, ok := getIIN(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	deliveries, err := h.uc.GetDeadDeliveries(IIN)
+	if err != nil {
+		respondWebhookError(ctx, err)
+		return
+	}
+	response.ResponseDeliveries(ctx, deliveries)
+}
+
+// Redeliver handles queueing the dead delivery in "delivery" header again
+func (h *WebhookHandler) Redeliver(ctx *fasthttp.RequestCtx) {
+	log.Println("INFO|Redeliver endpoint hit")
+	IIN, anyWallet, ok := getIINAndGrant(ctx)
+	if !ok {
+		response.RespondWithProblem(ctx, myerrors.ErrInvalidToken)
+		return
+	}
+	deliveryID, err := strconv.Atoi(string(ctx.Request.Header.Peek("delivery")))
+	if err != nil {
+		response.RespondWithError(ctx, fasthttp.StatusBadRequest, "invalid delivery")
+		return
+	}
+	if err := h.uc.Redeliver(deliveryID, IIN, anyWallet); err != nil {
+		respondWebhookError(ctx, err)
+		return
+	}
+	response.ResponseJSON(ctx, "success!")
+}
+
+// respondWebhookError logs err of webhook operation and responds with its problem details
+func respondWebhookError(ctx *fasthttp.RequestCtx, err error) {
+	log.Println("ERROR|Webhook handler:", err)
+	response.RespondWithProblem(ctx, err)
+}
+
+// NewWebhookHandler sets /webhook, /webhooks, /webhook/delete, /webhooks/dead and /webhook/redeliver routes
+func NewWebhookHandler(r *fasthttprouter.Router, uc usecase.WebhookUsecase) {
+	handler := &WebhookHandler{
+		uc: uc,
+	}
+	route(r, "GET", "/webhook", handler.Subscribe)
+	route(r, "GET", "/webhooks", handler.GetSubscriptions)
+	route(r, "GET", "/webhook/delete", handler.Unsubscribe)
+	route(r, "GET", "/webhooks/dead", handler.GetDeadDeliveries)
+	route(r, "GET", "/webhook/redeliver", handler.Redeliver)
+}
@@ -0,0 +1,97 @@
+// Package events publishes wallet events relayed from the outbox to pluggable destinations
+package events
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"wallet/domain"
+)
+
+// EventPublisher hands events over to a destination. Events are published at least once, so a publisher may get
+// the same event again after a failure and is expected to drop repeats by event ID
+type EventPublisher interface {
+	Publish(e domain.Event) error
+}
+
+type writerPublisher struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// Publish writes e as a single line of JSON
+func (p *writerPublisher) Publish(e domain.Event) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.enc.Encode(e)
+}
+
+// NewWriterPublisher returns EventPublisher writing events to w as JSON lines
+func NewWriterPublisher(w io.Writer) EventPublisher {
+	return &writerPublisher{enc: json.NewEncoder(w)}
+}
+
+// NewStdoutPublisher returns EventPublisher writing events to standard output as JSON lines
+func NewStdoutPublisher() EventPublisher {
+	return NewWriterPublisher(os.Stdout)
+}
+
+// NewFilePublisher returns EventPublisher appending events to file at path as JSON lines, the file is created if
+// missing
+func NewFilePublisher(path string) (EventPublisher, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriterPublisher(f), nil
+}
+
+// MemoryPublisher keeps published events in process, dropping events it already got
+type MemoryPublisher struct {
+	mu     sync.Mutex
+	events []domain.Event
+	seen   map[string]bool
+}
+
+// Publish keeps e unless an event with the same ID was published before
+func (p *MemoryPublisher) Publish(e domain.Event) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.seen[e.ID] {
+		return nil
+	}
+	p.seen[e.ID] = true
+	p.events = append(p.events, e)
+	return nil
+}
+
+// Events returns published events in the order they were published
+func (p *MemoryPublisher) Events() []domain.Event {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]domain.Event(nil), p.events...)
+}
+
+// NewMemoryPublisher returns empty MemoryPublisher
+func NewMemoryPublisher() *MemoryPublisher {
+	return &MemoryPublisher{seen: make(map[string]bool)}
+}
+
+type multiPublisher []EventPublisher
+
+// Publish hands e to every publisher in turn and stops at the first error, the event is then published again to
+// all of them, the ones that already got it drop the repeat
+func (m multiPublisher) Publish(e domain.Event) error {
+	for _, p := range m {
+		if err := p.Publish(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewMultiPublisher returns EventPublisher publishing every event to all of publishers
+func NewMultiPublisher(publishers ...EventPublisher) EventPublisher {
+	return multiPublisher(publishers)
+}
@@ -0,0 +1,82 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"wallet/domain"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	created  = domain.Event{ID: "4f1e", Type: domain.EventWalletCreated, Ts: time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC), Account: "KZT0000000001"}
+	toppedUp = domain.Event{ID: "5a2b", Type: domain.EventWalletToppedUp, Ts: time.Date(2022, 1, 10, 12, 0, 1, 0, time.UTC), Account: "KZT0000000001"}
+)
+
+func TestWriterPublisher(t *testing.T) {
+	var buf bytes.Buffer
+	p := NewWriterPublisher(&buf)
+	assert.NoError(t, p.Publish(created))
+	assert.NoError(t, p.Publish(toppedUp))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.JSONEq(t, created.Payload(), lines[0])
+		var e domain.Event
+		assert.NoError(t, json.Unmarshal([]byte(lines[1]), &e))
+		assert.Equal(t, toppedUp, e)
+	}
+}
+
+func TestFilePublisher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	p, err := NewFilePublisher(path)
+	assert.NoError(t, err)
+	assert.NoError(t, p.Publish(created))
+
+	// a restarted relay appends to what is already there
+	p, err = NewFilePublisher(path)
+	assert.NoError(t, err)
+	assert.NoError(t, p.Publish(toppedUp))
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(data), "\n"))
+
+	_, err = NewFilePublisher(filepath.Join(path, "nested"))
+	assert.Error(t, err)
+}
+
+func TestMemoryPublisherDropsRepeats(t *testing.T) {
+	p := NewMemoryPublisher()
+	assert.NoError(t, p.Publish(created))
+	assert.NoError(t, p.Publish(toppedUp))
+	assert.NoError(t, p.Publish(created))
+	assert.Equal(t, []domain.Event{created, toppedUp}, p.Events())
+}
+
+type failingPublisher struct{ calls int }
+
+func (p *failingPublisher) Publish(e domain.Event) error {
+	p.calls++
+	return errors.New("unavailable")
+}
+
+func TestMultiPublisher(t *testing.T) {
+	first, second := NewMemoryPublisher(), NewMemoryPublisher()
+	assert.NoError(t, NewMultiPublisher(first, second).Publish(created))
+	assert.Equal(t, []domain.Event{created}, first.Events())
+	assert.Equal(t, []domain.Event{created}, second.Events())
+
+	// publishers after a failing one are not tried
+	failing, last := &failingPublisher{}, NewMemoryPublisher()
+	assert.EqualError(t, NewMultiPublisher(first, failing, last).Publish(toppedUp), "unavailable")
+	assert.Equal(t, 1, failing.calls)
+	assert.Len(t, first.Events(), 2)
+	assert.Empty(t, last.Events())
+}
@@ -0,0 +1,97 @@
+// Package fx converts money between currencies using pluggable exchange rate providers
+package fx
+
+import (
+	"encoding/json"
+	"math/big"
+	"os"
+	"strings"
+	"wallet/domain"
+	"wallet/myerrors"
+)
+
+// FXRateProvider returns how many units of quote currency one unit of base currency buys, as a decimal string
+type FXRateProvider interface {
+	Rate(base, quote string) (string, error)
+}
+
+// rateDigits is precision of rates derived by inverting a configured pair
+const rateDigits = 10
+
+type staticProvider struct {
+	rates map[string]*big.Rat
+}
+
+// Rate returns configured rate of base/quote pair, falling back to the inverse of quote/base
+func (p *staticProvider) Rate(base, quote string) (string, error) {
+	if base == quote {
+		return "1", nil
+	}
+	if rate, ok := p.rates[base+"/"+quote]; ok {
+		return formatRate(rate), nil
+	}
+	if rate, ok := p.rates[quote+"/"+base]; ok {
+		return formatRate(new(big.Rat).Inv(rate)), nil
+	}
+	return "", myerrors.ErrRateUnavailable
+}
+
+// NewStaticProvider returns provider of fixed rates keyed by pair like "USD/KZT"
+func NewStaticProvider(rates map[string]string) (FXRateProvider, error) {
+	p := &staticProvider{rates: make(map[string]*big.Rat, len(rates))}
+	for pair, value := range rates {
+		rate, ok := new(big.Rat).SetString(value)
+		if !ok || rate.Sign() <= 0 || strings.Count(pair, "/") != 1 {
+			return nil, myerrors.ErrRateUnavailable
+		}
+		p.rates[pair] = rate
+	}
+	return p, nil
+}
+
+// NewFileProvider returns static provider of rates read from JSON file like {"USD/KZT": "470.25"}
+func NewFileProvider(path string) (FXRateProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rates map[string]string
+	if err := json.Unmarshal(data, &rates); err != nil {
+		return nil, err
+	}
+	return NewStaticProvider(rates)
+}
+
+// Convert exchanges amount into quote currency at rate, rounding down to the quote currency's minor unit
+func Convert(amount domain.Money, quote, rate string) (domain.Money, error) {
+	fromExp, ok := domain.CurrencyExponent(amount.Currency)
+	if !ok {
+		return domain.Money{}, myerrors.ErrUnsupportedCurrency
+	}
+	toExp, ok := domain.CurrencyExponent(quote)
+	if !ok {
+		return domain.Money{}, myerrors.ErrUnsupportedCurrency
+	}
+	r, ok := new(big.Rat).SetString(rate)
+	if !ok || r.Sign() <= 0 {
+		return domain.Money{}, myerrors.ErrRateUnavailable
+	}
+	converted := new(big.Rat).SetInt64(amount.Amount)
+	converted.Mul(converted, r)
+	converted.Mul(converted, new(big.Rat).SetFrac(pow10(toExp), pow10(fromExp)))
+	minor := new(big.Int).Quo(converted.Num(), converted.Denom())
+	if !minor.IsInt64() {
+		return domain.Money{}, myerrors.ErrInvalidAmt
+	}
+	return domain.NewMoney(minor.Int64(), quote), nil
+}
+
+func formatRate(rate *big.Rat) string {
+	s := rate.FloatString(rateDigits)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
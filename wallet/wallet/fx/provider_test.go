@@ -0,0 +1,65 @@
+package fx
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"wallet/domain"
+	"wallet/myerrors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticProvider(t *testing.T) {
+	p, err := NewStaticProvider(map[string]string{"USD/KZT": "470.25", "EUR/KZT": "500"})
+	assert.NoError(t, err)
+
+	rate, err := p.Rate("USD", "KZT")
+	assert.NoError(t, err)
+	assert.Equal(t, "470.25", rate)
+
+	rate, err = p.Rate("KZT", "EUR")
+	assert.NoError(t, err)
+	assert.Equal(t, "0.002", rate)
+
+	rate, err = p.Rate("KZT", "KZT")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", rate)
+
+	_, err = p.Rate("USD", "EUR")
+	assert.Equal(t, myerrors.ErrRateUnavailable, err)
+
+	_, err = NewStaticProvider(map[string]string{"USD/KZT": "-1"})
+	assert.Error(t, err)
+}
+
+func TestFileProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rates.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"USD/KZT": "470.25"}`), 0600))
+
+	p, err := NewFileProvider(path)
+	assert.NoError(t, err)
+	rate, err := p.Rate("USD", "KZT")
+	assert.NoError(t, err)
+	assert.Equal(t, "470.25", rate)
+
+	_, err = NewFileProvider(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestConvert(t *testing.T) {
+	// 10.00 USD at 470.25 is 4702.50 KZT
+	m, err := Convert(domain.NewMoney(1000, "USD"), "KZT", "470.25")
+	assert.NoError(t, err)
+	assert.Equal(t, domain.NewMoney(470250, "KZT"), m)
+
+	// 1.00 KZT at 0.0021 is 0.0021 USD, rounded down to 0.00
+	m, err = Convert(domain.NewMoney(100, "KZT"), "USD", "0.0021")
+	assert.NoError(t, err)
+	assert.Equal(t, domain.NewMoney(0, "USD"), m)
+
+	_, err = Convert(domain.NewMoney(100, "KZT"), "XXX", "1")
+	assert.Equal(t, myerrors.ErrUnsupportedCurrency, err)
+	_, err = Convert(domain.NewMoney(100, "KZT"), "USD", "abc")
+	assert.Equal(t, myerrors.ErrRateUnavailable, err)
+}
@@ -0,0 +1,229 @@
+// Package jwks loads public keys tokens are signed with from a JSON Web Key Set (RFC 7517) kept in a file or served
+// at a URL by the identity provider
+package jwks
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSetSize caps how much of a key set is read
+const maxSetSize = 1 << 20
+
+// minReloadInterval is how often tokens with an unknown key ID may make KeySet reload its source, so that a flood
+// of forged tokens does not hammer the identity provider
+const minReloadInterval = time.Minute
+
+// ErrUnknownKey is returned for key IDs the key set does not have
+var ErrUnknownKey = errors.New("unknown signing key")
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Parse parses RSA and EC signing keys of JSON Web Key Set by key ID, keys of other types or uses are skipped
+func Parse(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = parseRSA(k)
+		case "EC":
+			key, err = parseEC(k)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		if _, ok := keys[k.Kid]; ok {
+			return nil, fmt.Errorf("key %q is in the set twice", k.Kid)
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func parseRSA(k jsonWebKey) (*rsa.PublicKey, error) {
+	n, err := decodeInt(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := decodeInt(k.E)
+	if err != nil {
+		return nil, err
+	}
+	if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid RSA exponent")
+	}
+	if n.BitLen() < 2048 {
+		return nil, errors.New("RSA modulus is shorter than 2048 bits")
+	}
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+func parseEC(k jsonWebKey) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+	}
+	x, err := decodeInt(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := decodeInt(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("point is not on the curve")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// decodeInt decodes unsigned big-endian integer in base64url without padding
+func decodeInt(value string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(raw) == 0 {
+		return nil, errors.New("invalid integer")
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
+
+// KeySet keeps keys of a JSON Web Key Set loaded from a file or an http(s) URL. Keys are reloaded once they are older
+// than the refresh interval and when a token names a key ID the set does not have, so that keys added for rotation
+// are picked up before the old ones are dropped from the source. A failed reload keeps the keys loaded before
+type KeySet struct {
+	source  string
+	client  *http.Client
+	refresh time.Duration
+	now     func() time.Time
+
+	mu         sync.Mutex
+	keys       map[string]crypto.PublicKey
+	loaded     time.Time
+	lastReload time.Time
+}
+
+// Key returns key with kid, a token without kid may only be verified by a set of one key
+func (s *KeySet) Key(kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if now.Sub(s.loaded) >= s.refresh {
+		s.reload(now)
+	}
+	if key, ok := s.lookup(kid); ok {
+		return key, nil
+	}
+	if now.Sub(s.lastReload) >= minReloadInterval {
+		s.reload(now)
+		if key, ok := s.lookup(kid); ok {
+			return key, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+func (s *KeySet) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, true
+		}
+	}
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+// reload loads keys from source, keeping the current ones if it fails
+func (s *KeySet) reload(now time.Time) {
+	s.lastReload = now
+	keys, err := s.load()
+	if err != nil {
+		log.Printf("ERROR|Reloading JWKS from %s: %v\n", s.source, err)
+		return
+	}
+	s.keys = keys
+	s.loaded = now
+}
+
+func (s *KeySet) load() (map[string]crypto.PublicKey, error) {
+	if !strings.HasPrefix(s.source, "http://") && !strings.HasPrefix(s.source, "https://") {
+		data, err := os.ReadFile(s.source)
+		if err != nil {
+			return nil, err
+		}
+		return Parse(data)
+	}
+	res, err := s.client.Get(s.source)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", res.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxSetSize))
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// NewKeySet returns KeySet loaded from source, a file path or an http(s) URL fetched with client, reloading keys
+// every refresh interval
+func NewKeySet(source string, refresh time.Duration, client *http.Client) (*KeySet, error) {
+	s := &KeySet{
+		source:  source,
+		client:  client,
+		refresh: refresh,
+		now:     time.Now,
+	}
+	keys, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	s.keys = keys
+	s.loaded = s.now()
+	s.lastReload = s.loaded
+	return s, nil
+}
@@ -0,0 +1,156 @@
+package jwks
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encodeInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"n":   encodeInt(key.N),
+		"e":   encodeInt(big.NewInt(int64(key.E))),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "EC",
+		"kid": kid,
+		"crv": key.Curve.Params().Name,
+		"x":   encodeInt(key.X),
+		"y":   encodeInt(key.Y),
+	}
+}
+
+func marshalSet(t *testing.T, keys ...map[string]string) []byte {
+	data, err := json.Marshal(map[string]interface{}{"keys": keys})
+	assert.NoError(t, err)
+	return data
+}
+
+func TestParse(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	keys, err := Parse(marshalSet(t,
+		rsaJWK("rsa", &rsaKey.PublicKey),
+		ecJWK("ec", &ecKey.PublicKey),
+		map[string]string{"kty": "RSA", "kid": "enc", "use": "enc"},
+		map[string]string{"kty": "oct", "kid": "secret", "k": "c2VjcmV0"},
+	))
+	assert.NoError(t, err)
+	assert.Len(t, keys, 2)
+	assert.Equal(t, &rsaKey.PublicKey, keys["rsa"])
+	assert.True(t, ecKey.PublicKey.Equal(keys["ec"]))
+
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	offCurve := ecJWK("ec", &ecKey.PublicKey)
+	offCurve["y"] = encodeInt(new(big.Int).Add(ecKey.Y, big.NewInt(1)))
+	for name, data := range map[string][]byte{
+		"not json":      []byte("{"),
+		"short modulus": marshalSet(t, rsaJWK("rsa", &small.PublicKey)),
+		"bad base64":    marshalSet(t, map[string]string{"kty": "RSA", "n": "!", "e": "AQAB"}),
+		"unknown curve": marshalSet(t, map[string]string{"kty": "EC", "crv": "P-192", "x": "AQ", "y": "AQ"}),
+		"off curve":     marshalSet(t, offCurve),
+		"duplicate kid": marshalSet(t, rsaJWK("rsa", &rsaKey.PublicKey), ecJWK("rsa", &ecKey.PublicKey)),
+	} {
+		_, err := Parse(data)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestKeySetFileRotation(t *testing.T) {
+	oldKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	newKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, os.WriteFile(path, marshalSet(t, ecJWK("old", &oldKey.PublicKey)), 0o600))
+
+	set, err := NewKeySet(path, time.Hour, nil)
+	assert.NoError(t, err)
+	now := time.Now()
+	set.now = func() time.Time { return now }
+
+	key, err := set.Key("")
+	assert.NoError(t, err)
+	assert.True(t, oldKey.PublicKey.Equal(key), "the only key verifies tokens without kid")
+
+	// new key is published next to the old one, tokens signed with it make the set reload
+	assert.NoError(t, os.WriteFile(path, marshalSet(t, ecJWK("old", &oldKey.PublicKey), ecJWK("new", &newKey.PublicKey)), 0o600))
+	_, err = set.Key("new")
+	assert.ErrorIs(t, err, ErrUnknownKey, "unknown kids reload at most once a minute")
+	now = now.Add(minReloadInterval)
+	key, err = set.Key("new")
+	assert.NoError(t, err)
+	assert.True(t, newKey.PublicKey.Equal(key))
+	_, err = set.Key("old")
+	assert.NoError(t, err, "old key still verifies tokens during overlap")
+	_, err = set.Key("")
+	assert.ErrorIs(t, err, ErrUnknownKey, "kid is required once there are several keys")
+
+	// a broken source keeps the keys loaded before
+	assert.NoError(t, os.WriteFile(path, []byte("{"), 0o600))
+	now = now.Add(time.Hour)
+	_, err = set.Key("old")
+	assert.NoError(t, err)
+
+	// old key is retired on the next refresh
+	assert.NoError(t, os.WriteFile(path, marshalSet(t, ecJWK("new", &newKey.PublicKey)), 0o600))
+	now = now.Add(time.Hour)
+	_, err = set.Key("old")
+	assert.ErrorIs(t, err, ErrUnknownKey)
+	_, err = set.Key("new")
+	assert.NoError(t, err)
+}
+
+func TestKeySetURL(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	requests := 0
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(status)
+		w.Write(marshalSet(t, rsaJWK("rsa", &rsaKey.PublicKey)))
+	}))
+	defer server.Close()
+
+	set, err := NewKeySet(server.URL, time.Hour, server.Client())
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		key, err := set.Key("rsa")
+		assert.NoError(t, err)
+		assert.Equal(t, &rsaKey.PublicKey, key)
+	}
+	assert.Equal(t, 1, requests, "keys are cached until refresh")
+
+	status = http.StatusInternalServerError
+	_, err = NewKeySet(server.URL, time.Hour, server.Client())
+	assert.Error(t, err)
+	_, err = NewKeySet(filepath.Join(t.TempDir(), "missing.json"), time.Hour, nil)
+	assert.Error(t, err)
+}
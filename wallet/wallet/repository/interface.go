@@ -1,18 +1,75 @@
 package repository
 
-import "wallet/domain"
+import (
+	"time"
+	"wallet/domain"
+)
 
 type DBInterface interface {
 	GetLastAccountNo() (string, error)
-	InsertWallet(account, IIN string) error
-	GetAmount(string) (string, error)
+	InsertWallet(account, IIN, currency string) error
+	GetAmount(string) (domain.Money, error)
 	GetWallets(string) ([]domain.Wallet, error)
+	GetWallet(account string) (*domain.Wallet, error)
 	GetWalletList(string) ([]string, error)
-	UpdateTransferStatus(from, to string) error
-	GetTransactions(account string) ([]domain.Transaction, error)
+	GetTransactions(filter domain.TransactionFilter) ([]domain.Transaction, error)
+	GetBalanceAt(account string, at time.Time) (domain.Money, error)
 	ConfirmIIN(IIN, account string) (bool, error)
 	Close()
-	TopUp(string, int) error
-	Transfer(from, to, amt string) error
-	SetZeroStatus(from, to string) error
+	TopUp(account string, amt domain.Money, key *domain.IdempotencyKey) error
+	Transfer(from, to string, conv domain.Conversion, key *domain.IdempotencyKey, stepUp domain.StepUp) (*domain.Transaction, error)
+	GetIdempotencyKey(IIN, key string) (*domain.IdempotencyKey, error)
+	GetTrialBalance() (*domain.TrialBalance, error)
+	Reverse(transactionID int, amt *domain.Money) (*domain.Transaction, error)
+	PlaceHold(account, payee string, amt domain.Money, expiresAt time.Time, stepUp domain.StepUp) (*domain.Hold, error)
+	GetHold(holdID int) (*domain.Hold, error)
+	CaptureHold(holdID int, conv domain.Conversion) (*domain.Hold, error)
+	ReleaseHold(holdID int) (*domain.Hold, error)
+	ExpireHolds(now time.Time) (int, error)
+	InsertSchedule(s domain.Schedule, stepUp domain.StepUp) (*domain.Schedule, error)
+	GetSchedule(scheduleID int) (*domain.Schedule, error)
+	GetSchedules(IIN string) ([]domain.Schedule, error)
+	GetScheduleRuns(scheduleID int) ([]domain.ScheduleRun, error)
+	CancelSchedule(scheduleID int) (*domain.Schedule, error)
+	GetDueSchedules(now time.Time) ([]domain.Schedule, error)
+	RecordScheduleRun(s domain.Schedule, run domain.ScheduleRun) error
+	InsertBatch(b domain.Batch, stepUp domain.StepUp) (*domain.Batch, error)
+	GetBatch(batchID int) (*domain.Batch, error)
+	GetPendingBatches() ([]domain.Batch, error)
+	ClaimBatch(batchID int) (bool, error)
+	UpdateBatchLine(batchID int, line domain.BatchLine) error
+	FinishBatch(batchID int, status string) error
+	InsertSubscription(s domain.Subscription) (*domain.Subscription, error)
+	GetSubscription(subscriptionID int) (*domain.Subscription, error)
+	GetSubscriptions(IIN string) ([]domain.Subscription, error)
+	DeleteSubscription(subscriptionID int) error
+	EnqueueEvent(e domain.Event) (int, error)
+	GetDueDeliveries(now time.Time, limit int) ([]domain.Delivery, error)
+	RecordDelivery(d domain.Delivery) error
+	GetDelivery(deliveryID int) (*domain.Delivery, error)
+	GetDeadDeliveries(IIN string) ([]domain.Delivery, error)
+	RequeueDelivery(deliveryID int, now time.Time) error
+	GetUnpublishedEvents(limit int) ([]domain.Event, error)
+	MarkEventPublished(eventID string, at time.Time) error
+	GetEventsAfter(IIN, eventID string, limit int) ([]domain.Event, error)
+	GetOutboxPosition() (int64, error)
+	GetEventsSince(position int64, limit int) ([]domain.Event, int64, error)
+	InsertUser(u domain.User) (*domain.User, error)
+	GetUser(userID int) (*domain.User, error)
+	GetUserByUsername(username string) (*domain.User, error)
+	InsertRefreshToken(t domain.RefreshToken) error
+	GetRefreshToken(hash string) (*domain.RefreshToken, error)
+	RotateRefreshToken(hash string, next domain.RefreshToken) (bool, error)
+	RevokeRefreshTokens(familyID string) error
+	GetSessions(IIN string, now time.Time) ([]domain.Session, error)
+	InsertRevocation(r domain.Revocation) error
+	GetRevocations(since time.Time) ([]domain.Revocation, error)
+	DeleteExpiredRevocations(now time.Time) (int, error)
+	GetTOTP(IIN string) (*domain.TOTP, error)
+	SaveTOTP(t domain.TOTP) error
+	UseTOTPStep(IIN string, step int64, activate bool) (bool, error)
+	FailTOTP(IIN string, maxAttempts int, lockedUntil time.Time) error
+	DeleteTOTP(IIN string) error
+	InsertTransferConfirmation(c domain.TransferConfirmation) error
+	GetTransferConfirmation(hash string, now time.Time) (*domain.TransferConfirmation, error)
 }
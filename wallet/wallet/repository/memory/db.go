@@ -0,0 +1,1296 @@
+package memory
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+	"wallet/domain"
+	"wallet/myerrors"
+	"wallet/wallet/repository"
+)
+
+// tsLayout matches the way MySQL renders TIMESTAMP columns
+const tsLayout = "2006-01-02 15:04:05"
+
+type memoryDBInterface struct {
+	mu            sync.Mutex
+	wallets       []*domain.Wallet
+	byAccount     map[string]*domain.Wallet
+	transactions  []domain.Transaction
+	postings      []domain.Posting
+	holds         []domain.Hold
+	schedules     []domain.Schedule
+	scheduleRuns  []domain.ScheduleRun
+	batches       []domain.Batch
+	subscriptions []domain.Subscription
+	deliveries    []domain.Delivery
+	outbox        []outboxEvent
+	// lastSubscriptionID and lastDeliveryID keep IDs unique as deleted subscriptions take their deliveries with them
+	lastSubscriptionID int
+	lastDeliveryID     int
+	idempotencyKeys    map[string]domain.IdempotencyKey
+	users              []domain.User
+	refreshTokens      map[string]domain.RefreshToken
+	revocations        map[string]domain.Revocation
+	totps              map[string]domain.TOTP
+	confirmations      map[string]transferConfirmation
+}
+
+// transferConfirmation is a confirmation of a transfer along with whether it was used
+type transferConfirmation struct {
+	confirmation domain.TransferConfirmation
+	used         bool
+}
+
+// outboxEvent is an event of the outbox along with whether the relay published it
+type outboxEvent struct {
+	event     domain.Event
+	published bool
+}
+
+// GetLastAccountNo retrieves most recent account
+func (m *memoryDBInterface) GetLastAccountNo() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.wallets) == 0 {
+		return "", sql.ErrNoRows
+	}
+	lastAccountNo := m.wallets[len(m.wallets)-1].AccountNo
+	if len(lastAccountNo) != 13 {
+		return "", fmt.Errorf("%w: %q", myerrors.ErrGotInvalidAcc, lastAccountNo)
+	}
+	return lastAccountNo, nil
+}
+
+// InsertWallet stores newly created wallet of given currency, account numbers are unique
+func (m *memoryDBInterface) InsertWallet(account, IIN, currency string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.byAccount[account]; ok {
+		return fmt.Errorf("Duplicate entry '%s' for key 'wallets.accountno'", account)
+	}
+	now := time.Now().Format(tsLayout)
+	wallet := &domain.Wallet{
+		ID:        len(m.wallets) + 1,
+		Ts:        now,
+		UpdatedAt: now,
+		AccountNo: account,
+		IIN:       IIN,
+		Ledger:    domain.NewMoney(0, currency),
+		Available: domain.NewMoney(0, currency),
+	}
+	m.wallets = append(m.wallets, wallet)
+	m.byAccount[account] = wallet
+	m.outbox = append(m.outbox, outboxEvent{event: domain.NewEvent(domain.EventWalletCreated, account)})
+	return nil
+}
+
+// GetAmount retrieves account amount
+func (m *memoryDBInterface) GetAmount(account string) (domain.Money, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	wallet, ok := m.byAccount[account]
+	if !ok {
+		return domain.Money{}, myerrors.ErrWalletNotFound
+	}
+	return wallet.Ledger, nil
+}
+
+// GetWallets retrieves wallets by given IIN
+func (m *memoryDBInterface) GetWallets(IIN string) ([]domain.Wallet, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var wallets []domain.Wallet
+	for _, wallet := range m.wallets {
+		if wallet.IIN == IIN {
+			w := *wallet
+			w.Available.Amount = m.available(wallet)
+			wallets = append(wallets, w)
+		}
+	}
+	return wallets, nil
+}
+
+// GetWallet retrieves wallet by account number
+func (m *memoryDBInterface) GetWallet(account string) (*domain.Wallet, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	wallet, ok := m.byAccount[account]
+	if !ok {
+		return nil, myerrors.ErrWalletNotFound
+	}
+	w := *wallet
+	w.Available.Amount = m.available(wallet)
+	return &w, nil
+}
+
+// GetWalletList gets all accounts under requested user
+func (m *memoryDBInterface) GetWalletList(IIN string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var wallets []string
+	for _, wallet := range m.wallets {
+		if wallet.IIN == IIN {
+			wallets = append(wallets, wallet.AccountNo)
+		}
+	}
+	return wallets, nil
+}
+
+// GetTransactions gets transactions of an account matching filter ordered by ID
+func (m *memoryDBInterface) GetTransactions(filter domain.TransactionFilter) ([]domain.Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var transactions []domain.Transaction
+	for i := range m.transactions {
+		transaction := m.transactions[i]
+		if filter.Desc {
+			transaction = m.transactions[len(m.transactions)-1-i]
+		}
+		if filter.Cursor != 0 && (!filter.Desc && transaction.ID <= filter.Cursor || filter.Desc && transaction.ID >= filter.Cursor) {
+			continue
+		}
+		ts, err := time.ParseInLocation(tsLayout, transaction.Ts, time.Local)
+		if err != nil {
+			return nil, err
+		}
+		if !filter.Matches(transaction, ts) {
+			continue
+		}
+		transactions = append(transactions, transaction)
+		if len(transactions) == filter.Limit {
+			break
+		}
+	}
+	return transactions, nil
+}
+
+// GetBalanceAt sums up ledger postings of account made by transactions before at
+func (m *memoryDBInterface) GetBalanceAt(account string, at time.Time) (domain.Money, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	wallet, ok := m.byAccount[account]
+	if !ok {
+		return domain.Money{}, myerrors.ErrWalletNotFound
+	}
+	balance := domain.NewMoney(0, wallet.Ledger.Currency)
+	for _, posting := range m.postings {
+		if posting.AccountNo != account {
+			continue
+		}
+		ts, err := time.ParseInLocation(tsLayout, m.transactions[posting.TransactionID-1].Ts, time.Local)
+		if err != nil {
+			return domain.Money{}, err
+		}
+		if ts.Before(at) {
+			balance.Amount += posting.Amount
+		}
+	}
+	return balance, nil
+}
+
+// ConfirmIIN checks against IIN for requested account
+func (m *memoryDBInterface) ConfirmIIN(IIN, account string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	wallet, ok := m.byAccount[account]
+	if !ok {
+		return false, myerrors.ErrWalletNotFound
+	}
+	return wallet.IIN == IIN, nil
+}
+
+// Close does nothing, data lives as long as the process
+func (m *memoryDBInterface) Close() {}
+
+// TopUp implements account replenishment, storing the idempotency key (if any) together with the transaction
+func (m *memoryDBInterface) TopUp(account string, amt domain.Money, key *domain.IdempotencyKey) error {
+	if err := amt.Validate(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	wallet, ok := m.byAccount[account]
+	if !ok || wallet.Ledger.Currency != amt.Currency {
+		log.Println("ERROR|TopUp memory DB rows=0")
+		return myerrors.ErrUpdateRows
+	}
+	if key != nil {
+		if replay, err := m.checkIdempotencyKey(key); err != nil || replay {
+			return err
+		}
+	}
+	wallet.Ledger.Amount += amt.Amount
+	wallet.UpdatedAt = time.Now().Format(tsLayout)
+	id := m.insertTransaction("topup", domain.FundingAccount, account, domain.NewConversion(amt))
+	event := domain.NewEvent(domain.EventWalletToppedUp, account)
+	event.Amount, event.TransactionID = &amt, id
+	m.outbox = append(m.outbox, outboxEvent{event: event})
+	if key != nil {
+		response, err := json.Marshal(wallet.Ledger)
+		if err != nil {
+			return err
+		}
+		key.Response = string(response)
+		m.saveIdempotencyKey(key, id)
+	}
+	return nil
+}
+
+// Transfer handles money transfer between accounts under a single lock, storing the idempotency key (if any) together with the transaction.
+// A replayed key returns the transaction stored with it
+func (m *memoryDBInterface) Transfer(from, to string, conv domain.Conversion, key *domain.IdempotencyKey, stepUp domain.StepUp) (*domain.Transaction, error) {
+	if err := conv.Debit.Validate(); err != nil {
+		return nil, err
+	}
+	if err := conv.Credit.Validate(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fromWallet, ok := m.byAccount[from]
+	if !ok {
+		return nil, myerrors.ErrWalletNotFound
+	}
+	toWallet, ok := m.byAccount[to]
+	if !ok {
+		return nil, myerrors.ErrWalletNotFound
+	}
+	if key != nil {
+		replay, err := m.checkIdempotencyKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if replay {
+			return domain.DecodeTransfer(key.Response)
+		}
+	}
+	if fromWallet.Ledger.Currency != conv.Debit.Currency || toWallet.Ledger.Currency != conv.Credit.Currency {
+		return nil, myerrors.ErrCurrencyMismatch
+	}
+	if m.available(fromWallet) < conv.Debit.Amount {
+		return nil, myerrors.ErrInsufficientFunds
+	}
+	if err := m.useTransferConfirmation(stepUp.ConfirmationHash); err != nil {
+		return nil, err
+	}
+	id := m.move("transfer", from, to, conv)
+	m.transactions[id-1].StepUp = stepUp.Decision
+	for _, e := range domain.NewTransferEvents(from, to, conv, id) {
+		m.outbox = append(m.outbox, outboxEvent{event: e})
+	}
+	transfer := domain.NewTransfer(id, from, to, conv, stepUp.Decision)
+	if key != nil {
+		response, err := json.Marshal(transfer)
+		if err != nil {
+			return nil, err
+		}
+		key.Response = string(response)
+		m.saveIdempotencyKey(key, id)
+	}
+	return &transfer, nil
+}
+
+// Reverse refunds amt (everything left if nil) of transaction back to its sender under a single lock
+func (m *memoryDBInterface) Reverse(transactionID int, amt *domain.Money) (*domain.Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if transactionID < 1 || transactionID > len(m.transactions) {
+		return nil, myerrors.ErrTxNotFound
+	}
+	original := m.transactions[transactionID-1]
+	var refunded int64
+	for _, transaction := range m.transactions {
+		if transaction.ReversesID == transactionID {
+			refunded += transaction.Amount.Amount
+		}
+	}
+	conv, err := original.Refund(refunded, amt)
+	if err != nil {
+		return nil, err
+	}
+
+	// money goes back from the receiver to the sender, the funding account of a top-up has no wallet
+	from, to := original.To, original.From
+	fromWallet, ok := m.byAccount[from]
+	if !ok {
+		return nil, myerrors.ErrWalletNotFound
+	}
+	if m.available(fromWallet) < conv.Debit.Amount {
+		return nil, myerrors.ErrInsufficientFunds
+	}
+	id := m.move(domain.ReversalType, from, to, conv)
+	m.transactions[id-1].ReversesID = transactionID
+	for _, e := range domain.NewTransferEvents(from, to, conv, id) {
+		m.outbox = append(m.outbox, outboxEvent{event: e})
+	}
+	reversal := m.transactions[id-1]
+	return &reversal, nil
+}
+
+// PlaceHold reserves amt of the wallet until expiresAt for capturing into payee, authorized with stepUp whose
+// confirmation is used up
+func (m *memoryDBInterface) PlaceHold(account, payee string, amt domain.Money, expiresAt time.Time, stepUp domain.StepUp) (*domain.Hold, error) {
+	if !amt.IsPositive() {
+		return nil, myerrors.ErrInvalidAmt
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	wallet, ok := m.byAccount[account]
+	if !ok {
+		return nil, myerrors.ErrWalletNotFound
+	}
+	if wallet.Ledger.Currency != amt.Currency {
+		return nil, myerrors.ErrCurrencyMismatch
+	}
+	if m.available(wallet) < amt.Amount {
+		return nil, myerrors.ErrInsufficientFunds
+	}
+	if err := m.useTransferConfirmation(stepUp.ConfirmationHash); err != nil {
+		return nil, err
+	}
+	m.holds = append(m.holds, domain.Hold{
+		ID:        len(m.holds) + 1,
+		Ts:        time.Now().Format(tsLayout),
+		AccountNo: account,
+		Payee:     payee,
+		Amount:    amt,
+		Captured:  domain.NewMoney(0, amt.Currency),
+		Status:    domain.HoldActive,
+		ExpiresAt: expiresAt,
+		StepUp:    stepUp.Decision,
+	})
+	hold := m.holds[len(m.holds)-1]
+	return &hold, nil
+}
+
+// GetHold retrieves hold by ID
+func (m *memoryDBInterface) GetHold(holdID int) (*domain.Hold, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if holdID < 1 || holdID > len(m.holds) {
+		return nil, myerrors.ErrHoldNotFound
+	}
+	hold := m.holds[holdID-1]
+	return &hold, nil
+}
+
+// CaptureHold transfers conv.Debit out of an active hold to its payee with the step-up decision it was placed with,
+// the rest of the hold is released
+func (m *memoryDBInterface) CaptureHold(holdID int, conv domain.Conversion) (*domain.Hold, error) {
+	if err := conv.Debit.Validate(); err != nil {
+		return nil, err
+	}
+	if err := conv.Credit.Validate(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if holdID < 1 || holdID > len(m.holds) {
+		return nil, myerrors.ErrHoldNotFound
+	}
+	hold := &m.holds[holdID-1]
+	if !hold.IsActive(time.Now()) {
+		return nil, myerrors.ErrHoldNotActive
+	}
+	if hold.Amount.Currency != conv.Debit.Currency {
+		return nil, myerrors.ErrCurrencyMismatch
+	}
+	if hold.Amount.Amount < conv.Debit.Amount {
+		return nil, myerrors.ErrCaptureTooLarge
+	}
+	to := hold.Payee
+	toWallet, ok := m.byAccount[to]
+	if !ok {
+		return nil, myerrors.ErrWalletNotFound
+	}
+	if toWallet.Ledger.Currency != conv.Credit.Currency {
+		return nil, myerrors.ErrCurrencyMismatch
+	}
+	hold.Status = domain.HoldCaptured
+	hold.Captured = conv.Debit
+	hold.TransactionID = m.move(domain.HoldType, hold.AccountNo, to, conv)
+	m.transactions[hold.TransactionID-1].StepUp = hold.StepUp
+	for _, e := range domain.NewTransferEvents(hold.AccountNo, to, conv, hold.TransactionID) {
+		m.outbox = append(m.outbox, outboxEvent{event: e})
+	}
+	captured := *hold
+	return &captured, nil
+}
+
+// ReleaseHold gives the whole amount of an active hold back to the available balance
+func (m *memoryDBInterface) ReleaseHold(holdID int) (*domain.Hold, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if holdID < 1 || holdID > len(m.holds) {
+		return nil, myerrors.ErrHoldNotFound
+	}
+	hold := &m.holds[holdID-1]
+	if !hold.IsActive(time.Now()) {
+		return nil, myerrors.ErrHoldNotActive
+	}
+	hold.Status = domain.HoldReleased
+	released := *hold
+	return &released, nil
+}
+
+// ExpireHolds marks active holds past their expiry as expired and returns how many there were
+func (m *memoryDBInterface) ExpireHolds(now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	expired := 0
+	for i := range m.holds {
+		if m.holds[i].Status == domain.HoldActive && !m.holds[i].ExpiresAt.After(now) {
+			m.holds[i].Status = domain.HoldExpired
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+// available returns ledger balance of wallet less its active holds, callers must hold the lock
+func (m *memoryDBInterface) available(wallet *domain.Wallet) int64 {
+	now := time.Now()
+	amount := wallet.Ledger.Amount
+	for _, hold := range m.holds {
+		if hold.AccountNo == wallet.AccountNo && hold.IsActive(now) {
+			amount -= hold.Amount.Amount
+		}
+	}
+	return amount
+}
+
+// move debits from and credits to wallets (the funding account has none) and records the transaction,
+// callers must hold the lock and check balances
+func (m *memoryDBInterface) move(transferType, from, to string, conv domain.Conversion) int {
+	now := time.Now().Format(tsLayout)
+	if fromWallet, ok := m.byAccount[from]; ok {
+		fromWallet.Ledger.Amount -= conv.Debit.Amount
+		fromWallet.UpdatedAt = now
+	}
+	if toWallet, ok := m.byAccount[to]; ok {
+		toWallet.Ledger.Amount += conv.Credit.Amount
+		toWallet.UpdatedAt = now
+	}
+	return m.insertTransaction(transferType, from, to, conv)
+}
+
+// InsertSchedule stores new active schedule made with stepUp, using up its confirmation
+func (m *memoryDBInterface) InsertSchedule(s domain.Schedule, stepUp domain.StepUp) (*domain.Schedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.useTransferConfirmation(stepUp.ConfirmationHash); err != nil {
+		return nil, err
+	}
+	s.ID = len(m.schedules) + 1
+	s.Ts = time.Now().Format(tsLayout)
+	s.Status = domain.ScheduleActive
+	s.Failures = 0
+	s.StepUp = stepUp.Decision
+	s.Runs = nil
+	m.schedules = append(m.schedules, s)
+	return &s, nil
+}
+
+// GetSchedule retrieves schedule by ID
+func (m *memoryDBInterface) GetSchedule(scheduleID int) (*domain.Schedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if scheduleID < 1 || scheduleID > len(m.schedules) {
+		return nil, myerrors.ErrScheduleNotFound
+	}
+	s := m.schedules[scheduleID-1]
+	return &s, nil
+}
+
+// GetSchedules retrieves schedules of the user
+func (m *memoryDBInterface) GetSchedules(IIN string) ([]domain.Schedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var schedules []domain.Schedule
+	for _, s := range m.schedules {
+		if s.IIN == IIN {
+			schedules = append(schedules, s)
+		}
+	}
+	return schedules, nil
+}
+
+// GetScheduleRuns retrieves runs of schedule, oldest first
+func (m *memoryDBInterface) GetScheduleRuns(scheduleID int) ([]domain.ScheduleRun, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var runs []domain.ScheduleRun
+	for _, run := range m.scheduleRuns {
+		if run.ScheduleID == scheduleID {
+			runs = append(runs, run)
+		}
+	}
+	return runs, nil
+}
+
+// CancelSchedule stops an active or paused schedule
+func (m *memoryDBInterface) CancelSchedule(scheduleID int) (*domain.Schedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if scheduleID < 1 || scheduleID > len(m.schedules) {
+		return nil, myerrors.ErrScheduleNotFound
+	}
+	s := &m.schedules[scheduleID-1]
+	if s.Status != domain.ScheduleActive && s.Status != domain.SchedulePaused {
+		return nil, myerrors.ErrScheduleNotActive
+	}
+	s.Status = domain.ScheduleCancelled
+	cancelled := *s
+	return &cancelled, nil
+}
+
+// GetDueSchedules retrieves active schedules whose next run is not after now, the most overdue first
+func (m *memoryDBInterface) GetDueSchedules(now time.Time) ([]domain.Schedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var due []domain.Schedule
+	for _, s := range m.schedules {
+		if s.Status == domain.ScheduleActive && !s.NextRun.After(now) {
+			due = append(due, s)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].NextRun.Before(due[j].NextRun) })
+	return due, nil
+}
+
+// RecordScheduleRun stores run and the next run, status and failures of s. A schedule cancelled while it was
+// running keeps its status, the run is still recorded
+func (m *memoryDBInterface) RecordScheduleRun(s domain.Schedule, run domain.ScheduleRun) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s.ID < 1 || s.ID > len(m.schedules) {
+		return myerrors.ErrScheduleNotFound
+	}
+	stored := &m.schedules[s.ID-1]
+	if stored.Status == domain.ScheduleActive {
+		stored.NextRun = s.NextRun
+		stored.Status = s.Status
+		stored.Failures = s.Failures
+	}
+	run.ID = len(m.scheduleRuns) + 1
+	run.ScheduleID = s.ID
+	m.scheduleRuns = append(m.scheduleRuns, run)
+	return nil
+}
+
+// InsertBatch stores new pending batch with its lines made with stepUp, using up its confirmation
+func (m *memoryDBInterface) InsertBatch(b domain.Batch, stepUp domain.StepUp) (*domain.Batch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.useTransferConfirmation(stepUp.ConfirmationHash); err != nil {
+		return nil, err
+	}
+	b.ID = len(m.batches) + 1
+	b.Ts = time.Now().Format(tsLayout)
+	b.Status = domain.BatchPending
+	b.StepUp = stepUp.Decision
+	b.Lines = append([]domain.BatchLine(nil), b.Lines...)
+	for i := range b.Lines {
+		b.Lines[i].Status = domain.LinePending
+	}
+	m.batches = append(m.batches, b)
+	return m.batch(b.ID, true), nil
+}
+
+// GetBatch retrieves batch by ID with its lines
+func (m *memoryDBInterface) GetBatch(batchID int) (*domain.Batch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if batchID < 1 || batchID > len(m.batches) {
+		return nil, myerrors.ErrBatchNotFound
+	}
+	return m.batch(batchID, true), nil
+}
+
+// GetPendingBatches retrieves batches waiting to be run without their lines, oldest first
+func (m *memoryDBInterface) GetPendingBatches() ([]domain.Batch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var batches []domain.Batch
+	for _, b := range m.batches {
+		if b.Status == domain.BatchPending {
+			batches = append(batches, *m.batch(b.ID, false))
+		}
+	}
+	return batches, nil
+}
+
+// ClaimBatch marks pending batch as running, false if another worker got to it first
+func (m *memoryDBInterface) ClaimBatch(batchID int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if batchID < 1 || batchID > len(m.batches) {
+		return false, myerrors.ErrBatchNotFound
+	}
+	b := &m.batches[batchID-1]
+	if b.Status != domain.BatchPending {
+		return false, nil
+	}
+	b.Status = domain.BatchRunning
+	return true, nil
+}
+
+// UpdateBatchLine stores status, transaction and error of line
+func (m *memoryDBInterface) UpdateBatchLine(batchID int, line domain.BatchLine) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if batchID < 1 || batchID > len(m.batches) {
+		return myerrors.ErrBatchNotFound
+	}
+	for i, stored := range m.batches[batchID-1].Lines {
+		if stored.Line == line.Line {
+			stored.Status, stored.TransactionID, stored.Error = line.Status, line.TransactionID, line.Error
+			m.batches[batchID-1].Lines[i] = stored
+		}
+	}
+	return nil
+}
+
+// FinishBatch stores final status of batch
+func (m *memoryDBInterface) FinishBatch(batchID int, status string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if batchID < 1 || batchID > len(m.batches) {
+		return myerrors.ErrBatchNotFound
+	}
+	m.batches[batchID-1].Status = status
+	return nil
+}
+
+// batch returns copy of stored batch, with a copy of its lines if withLines is set, callers must hold the lock
+func (m *memoryDBInterface) batch(batchID int, withLines bool) *domain.Batch {
+	b := m.batches[batchID-1]
+	b.Lines = nil
+	if withLines {
+		b.Lines = append([]domain.BatchLine(nil), m.batches[batchID-1].Lines...)
+	}
+	return &b
+}
+
+// InsertSubscription stores new webhook subscription
+func (m *memoryDBInterface) InsertSubscription(s domain.Subscription) (*domain.Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastSubscriptionID++
+	s.ID = m.lastSubscriptionID
+	s.Ts = time.Now().Format(tsLayout)
+	s.Events = append([]string(nil), s.Events...)
+	m.subscriptions = append(m.subscriptions, s)
+	return &s, nil
+}
+
+// GetSubscription retrieves webhook subscription by ID
+func (m *memoryDBInterface) GetSubscription(subscriptionID int) (*domain.Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.subscription(subscriptionID)
+	if !ok {
+		return nil, myerrors.ErrSubscriptionNotFound
+	}
+	return &s, nil
+}
+
+// GetSubscriptions retrieves webhook subscriptions of the user
+func (m *memoryDBInterface) GetSubscriptions(IIN string) ([]domain.Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var subscriptions []domain.Subscription
+	for _, s := range m.subscriptions {
+		if s.IIN == IIN {
+			subscriptions = append(subscriptions, s)
+		}
+	}
+	return subscriptions, nil
+}
+
+// DeleteSubscription deletes webhook subscription with its deliveries
+func (m *memoryDBInterface) DeleteSubscription(subscriptionID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.subscription(subscriptionID); !ok {
+		return myerrors.ErrSubscriptionNotFound
+	}
+	subscriptions := m.subscriptions[:0]
+	for _, s := range m.subscriptions {
+		if s.ID != subscriptionID {
+			subscriptions = append(subscriptions, s)
+		}
+	}
+	m.subscriptions = subscriptions
+	deliveries := m.deliveries[:0]
+	for _, d := range m.deliveries {
+		if d.SubscriptionID != subscriptionID {
+			deliveries = append(deliveries, d)
+		}
+	}
+	m.deliveries = deliveries
+	return nil
+}
+
+// EnqueueEvent queues delivery of event to every subscription of the owner of its account asking for its type
+// and returns how many were queued
+func (m *memoryDBInterface) EnqueueEvent(e domain.Event) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	wallet, ok := m.byAccount[e.Account]
+	if !ok {
+		return 0, nil
+	}
+	queued := 0
+	for _, s := range m.subscriptions {
+		if s.IIN != wallet.IIN || !s.Wants(e.Type) || m.enqueued(s.ID, e.ID) {
+			continue
+		}
+		m.lastDeliveryID++
+		m.deliveries = append(m.deliveries, domain.Delivery{
+			ID:             m.lastDeliveryID,
+			Ts:             time.Now().Format(tsLayout),
+			SubscriptionID: s.ID,
+			EventID:        e.ID,
+			EventType:      e.Type,
+			Payload:        e.Payload(),
+			Status:         domain.DeliveryPending,
+			NextAttempt:    e.Ts,
+		})
+		queued++
+	}
+	return queued, nil
+}
+
+// enqueued tells whether event was already queued for subscription, a republished event is not delivered twice
+func (m *memoryDBInterface) enqueued(subscriptionID int, eventID string) bool {
+	for _, d := range m.deliveries {
+		if d.SubscriptionID == subscriptionID && d.EventID == eventID {
+			return true
+		}
+	}
+	return false
+}
+
+// GetDueDeliveries retrieves at most limit pending deliveries whose next attempt is not after now, the most overdue first
+func (m *memoryDBInterface) GetDueDeliveries(now time.Time, limit int) ([]domain.Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var deliveries []domain.Delivery
+	for _, d := range m.deliveries {
+		if d.Status == domain.DeliveryPending && !d.NextAttempt.After(now) {
+			deliveries = append(deliveries, m.delivery(d))
+		}
+	}
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].NextAttempt.Before(deliveries[j].NextAttempt)
+	})
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries, nil
+}
+
+// RecordDelivery stores status, attempts, next attempt and last error of delivery
+func (m *memoryDBInterface) RecordDelivery(d domain.Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.deliveries {
+		if stored := &m.deliveries[i]; stored.ID == d.ID {
+			stored.Status, stored.Attempts, stored.NextAttempt, stored.LastError = d.Status, d.Attempts, d.NextAttempt, d.LastError
+		}
+	}
+	return nil
+}
+
+// GetDelivery retrieves webhook delivery by ID
+func (m *memoryDBInterface) GetDelivery(deliveryID int) (*domain.Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range m.deliveries {
+		if d.ID == deliveryID {
+			d = m.delivery(d)
+			return &d, nil
+		}
+	}
+	return nil, myerrors.ErrDeliveryNotFound
+}
+
+// GetDeadDeliveries retrieves deliveries to subscriptions of the user that ran out of attempts
+func (m *memoryDBInterface) GetDeadDeliveries(IIN string) ([]domain.Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var deliveries []domain.Delivery
+	for _, d := range m.deliveries {
+		if d = m.delivery(d); d.Status == domain.DeliveryDead && d.IIN == IIN {
+			deliveries = append(deliveries, d)
+		}
+	}
+	return deliveries, nil
+}
+
+// RequeueDelivery gives dead delivery a fresh set of attempts starting at now
+func (m *memoryDBInterface) RequeueDelivery(deliveryID int, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.deliveries {
+		if d := &m.deliveries[i]; d.ID == deliveryID && d.Status == domain.DeliveryDead {
+			d.Status, d.Attempts, d.NextAttempt = domain.DeliveryPending, 0, now
+			return nil
+		}
+	}
+	return myerrors.ErrDeliveryNotDead
+}
+
+// subscription returns copy of stored subscription, callers must hold the lock
+func (m *memoryDBInterface) subscription(subscriptionID int) (domain.Subscription, bool) {
+	for _, s := range m.subscriptions {
+		if s.ID == subscriptionID {
+			s.Events = append([]string(nil), s.Events...)
+			return s, true
+		}
+	}
+	return domain.Subscription{}, false
+}
+
+// delivery returns d with IIN, URL and secret of its subscription, callers must hold the lock
+func (m *memoryDBInterface) delivery(d domain.Delivery) domain.Delivery {
+	if s, ok := m.subscription(d.SubscriptionID); ok {
+		d.IIN, d.URL, d.Secret = s.IIN, s.URL, s.Secret
+	}
+	return d
+}
+
+// GetUnpublishedEvents retrieves at most limit events of the outbox not yet published, in the order they were written
+func (m *memoryDBInterface) GetUnpublishedEvents(limit int) ([]domain.Event, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var events []domain.Event
+	for _, o := range m.outbox {
+		if o.published {
+			continue
+		}
+		events = append(events, o.event)
+		if len(events) == limit {
+			break
+		}
+	}
+	return events, nil
+}
+
+// MarkEventPublished records that event of the outbox was published
+func (m *memoryDBInterface) MarkEventPublished(eventID string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.outbox {
+		if m.outbox[i].event.ID == eventID {
+			m.outbox[i].published = true
+		}
+	}
+	return nil
+}
+
+// GetEventsAfter retrieves at most limit events of wallets of the user written to the outbox after the event with
+// eventID, published or not, in the order they were written
+func (m *memoryDBInterface) GetEventsAfter(IIN, eventID string, limit int) ([]domain.Event, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	found := false
+	var events []domain.Event
+	for _, o := range m.outbox {
+		if !found {
+			found = o.event.ID == eventID
+			continue
+		}
+		if w, ok := m.byAccount[o.event.Account]; ok && w.IIN == IIN && len(events) < limit {
+			events = append(events, o.event)
+		}
+	}
+	if !found {
+		return nil, myerrors.ErrEventNotFound
+	}
+	return events, nil
+}
+
+// GetOutboxPosition retrieves position of the latest event of the outbox, 0 when it is empty
+func (m *memoryDBInterface) GetOutboxPosition() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return int64(len(m.outbox)), nil
+}
+
+// GetEventsSince retrieves at most limit events of every wallet written to the outbox after position, published or
+// not, in the order they were written along with the position of the last one
+func (m *memoryDBInterface) GetEventsSince(position int64, limit int) ([]domain.Event, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var events []domain.Event
+	for position < int64(len(m.outbox)) && len(events) < limit {
+		events = append(events, m.outbox[position].event)
+		position++
+	}
+	return events, position, nil
+}
+
+// InsertUser stores new user of the auth service, usernames and IINs are unique
+func (m *memoryDBInterface) InsertUser(u domain.User) (*domain.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, existing := range m.users {
+		if existing.Username == u.Username || existing.IIN == u.IIN {
+			return nil, myerrors.ErrUserExists
+		}
+	}
+	u.ID = len(m.users) + 1
+	u.Ts = time.Now().Format(tsLayout)
+	u.Roles = append([]domain.Role(nil), u.Roles...)
+	m.users = append(m.users, u)
+	return &u, nil
+}
+
+// GetUser retrieves user by ID
+func (m *memoryDBInterface) GetUser(userID int) (*domain.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if userID < 1 || userID > len(m.users) {
+		return nil, myerrors.ErrUserNotFound
+	}
+	u := m.users[userID-1]
+	return &u, nil
+}
+
+// GetUserByUsername retrieves user by username
+func (m *memoryDBInterface) GetUserByUsername(username string) (*domain.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		if u.Username == username {
+			return &u, nil
+		}
+	}
+	return nil, myerrors.ErrUserNotFound
+}
+
+// InsertRefreshToken stores refresh token starting a new family
+func (m *memoryDBInterface) InsertRefreshToken(t domain.RefreshToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t.Ts = time.Now().Format(tsLayout)
+	m.refreshTokens[t.Hash] = t
+	return nil
+}
+
+// GetRefreshToken retrieves refresh token by hash of its value
+func (m *memoryDBInterface) GetRefreshToken(hash string) (*domain.RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.refreshTokens[hash]
+	if !ok {
+		return nil, myerrors.ErrInvalidRefreshToken
+	}
+	return &t, nil
+}
+
+// RotateRefreshToken uses up active refresh token with hash and stores next of its family in its place, false if
+// the token was used or revoked already
+func (m *memoryDBInterface) RotateRefreshToken(hash string, next domain.RefreshToken) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.refreshTokens[hash]
+	if !ok || t.Status != domain.RefreshTokenActive {
+		return false, nil
+	}
+	t.Status = domain.RefreshTokenUsed
+	m.refreshTokens[hash] = t
+	next.Ts = time.Now().Format(tsLayout)
+	m.refreshTokens[next.Hash] = next
+	return true, nil
+}
+
+// RevokeRefreshTokens revokes active refresh tokens of the family
+func (m *memoryDBInterface) RevokeRefreshTokens(familyID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for hash, t := range m.refreshTokens {
+		if t.FamilyID == familyID && t.Status == domain.RefreshTokenActive {
+			t.Status = domain.RefreshTokenRevoked
+			m.refreshTokens[hash] = t
+		}
+	}
+	return nil
+}
+
+// GetSessions retrieves sessions of the user with an active refresh token not expired by now, oldest refreshed first
+func (m *memoryDBInterface) GetSessions(IIN string, now time.Time) ([]domain.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	userID := 0
+	for _, u := range m.users {
+		if u.IIN == IIN {
+			userID = u.ID
+		}
+	}
+	created := make(map[string]string)
+	for _, t := range m.refreshTokens {
+		if first, ok := created[t.FamilyID]; !ok || t.Ts < first {
+			created[t.FamilyID] = t.Ts
+		}
+	}
+	var sessions []domain.Session
+	for _, t := range m.refreshTokens {
+		if t.UserID == userID && t.Status == domain.RefreshTokenActive && t.ExpiresAt.After(now) {
+			sessions = append(sessions, domain.Session{ID: t.FamilyID, CreatedAt: created[t.FamilyID], RefreshedAt: t.Ts, ExpiresAt: t.ExpiresAt})
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].RefreshedAt != sessions[j].RefreshedAt {
+			return sessions[i].RefreshedAt < sessions[j].RefreshedAt
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions, nil
+}
+
+// InsertRevocation stores revocation, replacing an earlier one of the same kind and subject
+func (m *memoryDBInterface) InsertRevocation(r domain.Revocation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.revocations[r.Kind+"\x00"+r.Subject] = r
+	return nil
+}
+
+// GetRevocations retrieves revocations made since given time, in the order they were made
+func (m *memoryDBInterface) GetRevocations(since time.Time) ([]domain.Revocation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var revocations []domain.Revocation
+	for _, r := range m.revocations {
+		if !r.RevokedAt.Before(since) {
+			revocations = append(revocations, r)
+		}
+	}
+	sort.Slice(revocations, func(i, j int) bool {
+		return revocations[i].RevokedAt.Before(revocations[j].RevokedAt)
+	})
+	return revocations, nil
+}
+
+// DeleteExpiredRevocations deletes revocations past their expiry and returns how many there were
+func (m *memoryDBInterface) DeleteExpiredRevocations(now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deleted := 0
+	for key, r := range m.revocations {
+		if !r.ExpiresAt.After(now) {
+			delete(m.revocations, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// GetTOTP retrieves TOTP authenticator of IIN
+func (m *memoryDBInterface) GetTOTP(IIN string) (*domain.TOTP, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.totps[IIN]
+	if !ok {
+		return nil, myerrors.ErrTOTPNotEnrolled
+	}
+	return &t, nil
+}
+
+// SaveTOTP stores authenticator of t.IIN without failed attempts, replacing the one it had
+func (m *memoryDBInterface) SaveTOTP(t domain.TOTP) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t.FailedAttempts, t.LockedUntil = 0, time.Time{}
+	m.totps[t.IIN] = t
+	return nil
+}
+
+// UseTOTPStep records code of step accepted from IIN and clears its failed attempts, activating the authenticator if
+// activate is set. False if a code of step or a later one was accepted already, so that every code is used once
+func (m *memoryDBInterface) UseTOTPStep(IIN string, step int64, activate bool) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.totps[IIN]
+	if !ok || t.LastStep >= step {
+		return false, nil
+	}
+	t.LastStep, t.FailedAttempts, t.LockedUntil = step, 0, time.Time{}
+	t.Active = t.Active || activate
+	m.totps[IIN] = t
+	return true, nil
+}
+
+// FailTOTP counts a wrong code of IIN, locking codes out until lockedUntil from the maxAttempts-th wrong one in a row
+func (m *memoryDBInterface) FailTOTP(IIN string, maxAttempts int, lockedUntil time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.totps[IIN]
+	if !ok {
+		return nil
+	}
+	t.FailedAttempts++
+	if t.FailedAttempts >= maxAttempts {
+		t.LockedUntil = lockedUntil
+	}
+	m.totps[IIN] = t
+	return nil
+}
+
+// DeleteTOTP deletes authenticator of IIN
+func (m *memoryDBInterface) DeleteTOTP(IIN string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.totps, IIN)
+	return nil
+}
+
+// InsertTransferConfirmation stores confirmation of a transfer
+func (m *memoryDBInterface) InsertTransferConfirmation(c domain.TransferConfirmation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.confirmations[c.Hash] = transferConfirmation{confirmation: c}
+	return nil
+}
+
+// GetTransferConfirmation retrieves confirmation with hash that is not used and not expired by now
+func (m *memoryDBInterface) GetTransferConfirmation(hash string, now time.Time) (*domain.TransferConfirmation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.confirmations[hash]
+	if !ok || c.used || !c.confirmation.ExpiresAt.After(now) {
+		return nil, myerrors.ErrInvalidConfirmation
+	}
+	return &c.confirmation, nil
+}
+
+// useTransferConfirmation uses up confirmation with hash, if there is one, the caller must hold the lock
+func (m *memoryDBInterface) useTransferConfirmation(hash string) error {
+	if hash == "" {
+		return nil
+	}
+	c, ok := m.confirmations[hash]
+	if !ok || c.used || !c.confirmation.ExpiresAt.After(time.Now()) {
+		return myerrors.ErrInvalidConfirmation
+	}
+	c.used = true
+	m.confirmations[hash] = c
+	return nil
+}
+
+// GetIdempotencyKey retrieves a non-expired idempotency key of the user, nil if there is none
+func (m *memoryDBInterface) GetIdempotencyKey(IIN, key string) (*domain.IdempotencyKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	idem, ok := m.idempotencyKeys[IIN+"\x00"+key]
+	if !ok || !idem.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	return &idem, nil
+}
+
+// GetTrialBalance sums up postings per currency and reports unbalanced transactions and wallets whose balance differs from their postings
+func (m *memoryDBInterface) GetTrialBalance() (*domain.TrialBalance, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tb := domain.TrialBalance{Totals: make(map[string]int64), Postings: len(m.postings)}
+	byTransaction := make(map[int]map[string]int64)
+	byAccount := make(map[string]int64)
+	for _, posting := range m.postings {
+		tb.Totals[posting.Currency] += posting.Amount
+		if byTransaction[posting.TransactionID] == nil {
+			byTransaction[posting.TransactionID] = make(map[string]int64)
+		}
+		byTransaction[posting.TransactionID][posting.Currency] += posting.Amount
+		byAccount[posting.AccountNo] += posting.Amount
+	}
+	for id, sums := range byTransaction {
+		if !allZero(sums) {
+			tb.Unbalanced = append(tb.Unbalanced, id)
+		}
+	}
+	sort.Ints(tb.Unbalanced)
+	for _, wallet := range m.wallets {
+		if wallet.Ledger.Amount != byAccount[wallet.AccountNo] {
+			tb.Mismatched = append(tb.Mismatched, wallet.AccountNo)
+		}
+	}
+	tb.Balanced = allZero(tb.Totals) && len(tb.Unbalanced) == 0 && len(tb.Mismatched) == 0
+	return &tb, nil
+}
+
+// allZero reports whether every per-currency sum is zero
+func allZero(sums map[string]int64) bool {
+	for _, sum := range sums {
+		if sum != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// insertTransaction appends transaction with its balanced postings and returns its ID, callers must hold the lock
+func (m *memoryDBInterface) insertTransaction(transferType, debit, credit string, conv domain.Conversion) int {
+	id := len(m.transactions) + 1
+	m.transactions = append(m.transactions, domain.Transaction{
+		ID:       id,
+		Ts:       time.Now().Format(tsLayout),
+		Type:     transferType,
+		From:     debit,
+		To:       credit,
+		Amount:   conv.Debit,
+		Credited: conv.Credit,
+		Rate:     conv.Rate,
+	})
+	for _, posting := range conv.Postings(debit, credit) {
+		posting.ID = len(m.postings) + 1
+		posting.TransactionID = id
+		m.postings = append(m.postings, posting)
+	}
+	return id
+}
+
+// checkIdempotencyKey reports whether a non-expired key was stored concurrently by the same request, loading it into
+// key, and fails if it was stored by another one. Callers must hold the lock
+func (m *memoryDBInterface) checkIdempotencyKey(key *domain.IdempotencyKey) (bool, error) {
+	idem, ok := m.idempotencyKeys[key.IIN+"\x00"+key.Key]
+	if !ok || !idem.ExpiresAt.After(time.Now()) {
+		return false, nil
+	}
+	if idem.RequestHash != key.RequestHash {
+		return false, myerrors.ErrIdempotencyConflict
+	}
+	log.Printf("INFO|Replaying request with idempotency key %s stored concurrently by transaction %d\n", idem.Key, idem.TransactionID)
+	*key = idem
+	return true, nil
+}
+
+// saveIdempotencyKey links idempotency key to transaction, callers must hold the lock
+func (m *memoryDBInterface) saveIdempotencyKey(key *domain.IdempotencyKey, transactionID int) {
+	key.TransactionID = transactionID
+	m.idempotencyKeys[key.IIN+"\x00"+key.Key] = *key
+}
+
+// NewMemoryDBInterface returns a new in-memory DB holding only the initial account, like a fresh MySQL schema
+func NewMemoryDBInterface() repository.DBInterface {
+	m := &memoryDBInterface{
+		byAccount:       make(map[string]*domain.Wallet),
+		idempotencyKeys: make(map[string]domain.IdempotencyKey),
+		refreshTokens:   make(map[string]domain.RefreshToken),
+		revocations:     make(map[string]domain.Revocation),
+		totps:           make(map[string]domain.TOTP),
+		confirmations:   make(map[string]transferConfirmation),
+	}
+	m.InsertWallet("KZT0000000000", "account_init", domain.DefaultCurrency)
+	// the seed wallet is part of the schema rather than something that happened
+	m.outbox = nil
+	return m
+}
@@ -0,0 +1,13 @@
+package memory
+
+import (
+	"testing"
+	"wallet/wallet/repository"
+	"wallet/wallet/repository/repositorytest"
+)
+
+func TestConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repository.DBInterface {
+		return NewMemoryDBInterface()
+	})
+}
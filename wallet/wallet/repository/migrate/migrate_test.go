@@ -0,0 +1,102 @@
+package migrate
+
+import (
+	"database/sql"
+	"log"
+	"testing"
+	"testing/fstest"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	createTable = "CREATE TABLE IF NOT EXISTS schema_migrations (version bigint NOT NULL PRIMARY KEY, name varchar(255) NOT NULL, applied_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP)"
+	selectRows  = "SELECT version, applied_at FROM schema_migrations"
+)
+
+var files = fstest.MapFS{
+	"0001_create_wallets.up.sql":        {Data: []byte("-- wallets\nCREATE TABLE wallets (id bigint);\n\nINSERT INTO wallets VALUES (1);\n")},
+	"0001_create_wallets.down.sql":      {Data: []byte("DROP TABLE wallets;\n")},
+	"0002_create_transactions.up.sql":   {Data: []byte("CREATE TABLE transactions (id bigint);\n")},
+	"0002_create_transactions.down.sql": {Data: []byte("DROP TABLE transactions;\n")},
+	"README.md":                         {Data: []byte("not a migration")},
+}
+
+func NewMock() (*sql.DB, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		log.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	return db, mock
+}
+
+func TestNewRequiresDownFile(t *testing.T) {
+	db, _ := NewMock()
+	defer db.Close()
+
+	_, err := New(db, fstest.MapFS{"0001_create_wallets.up.sql": {Data: []byte("CREATE TABLE wallets (id bigint);")}}, MySQL)
+	assert.Error(t, err)
+}
+
+func TestUpAppliesPending(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	migrator, err := New(db, files, MySQL)
+	assert.NoError(t, err)
+
+	mock.ExpectExec(createTable).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(selectRows).WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).AddRow(1, "2022-01-18 14:36:28"))
+	mock.ExpectBegin()
+	mock.ExpectExec("CREATE TABLE transactions (id bigint)").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)").WithArgs(2, "create_transactions").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	applied, err := migrator.Up()
+	assert.NoError(t, err)
+	if assert.Len(t, applied, 1) {
+		assert.Equal(t, 2, applied[0].Version)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDownRollsBackLatest(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	migrator, err := New(db, files, Postgres)
+	assert.NoError(t, err)
+
+	mock.ExpectExec(createTable).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(selectRows).WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).AddRow(1, "2022-01-18 14:36:28"))
+	mock.ExpectBegin()
+	mock.ExpectExec("DROP TABLE wallets").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM schema_migrations WHERE version = $1").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	migration, err := migrator.Down()
+	assert.NoError(t, err)
+	if assert.NotNil(t, migration) {
+		assert.Equal(t, "create_wallets", migration.Name)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPending(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	migrator, err := New(db, files, MySQL)
+	assert.NoError(t, err)
+
+	mock.ExpectExec(createTable).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(selectRows).WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}))
+
+	pending, err := migrator.Pending()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, pending)
+}
+
+func TestSplitStatements(t *testing.T) {
+	stmts := splitStatements("-- comment\nCREATE TABLE a (id bigint);\n\nINSERT INTO a\nVALUES (1);\n")
+	assert.Equal(t, []string{"CREATE TABLE a (id bigint)", "INSERT INTO a\nVALUES (1)"}, stmts)
+}
@@ -0,0 +1,25 @@
+package mysql
+
+import (
+	"os"
+	"testing"
+	"wallet/wallet/repository"
+	"wallet/wallet/repository/repositorytest"
+)
+
+// TestConformance runs against a real MySQL given by WALLET_TEST_DSN (e.g. docker-compose mysqldb),
+// it includes concurrent transfers in both directions that must lose no updates
+func TestConformance(t *testing.T) {
+	dsn := os.Getenv("WALLET_TEST_DSN")
+	if dsn == "" {
+		t.Skip("WALLET_TEST_DSN not set")
+	}
+	repositorytest.Run(t, func(t *testing.T) repository.DBInterface {
+		repo, err := NewMySQLDBInterface(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(repo.Close)
+		return repo
+	})
+}
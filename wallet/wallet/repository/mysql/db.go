@@ -2,9 +2,12 @@ package mysql
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"time"
 	"wallet/domain"
 	"wallet/myerrors"
@@ -13,6 +16,33 @@ import (
 	"github.com/go-sql-driver/mysql"
 )
 
+// maxTransferAttempts limits how many times a transfer is retried after a deadlock
+const maxTransferAttempts = 3
+
+// tsLayout is the way MySQL renders TIMESTAMP columns
+const tsLayout = "2006-01-02 15:04:05"
+
+// heldSQL sums active holds of wallet w that have not expired at the time passed as its argument
+const heldSQL = "COALESCE((SELECT SUM(h.amount) FROM holds h WHERE h.accountno = w.accountno AND h.status = 'active' AND h.expires_at > ?), 0)"
+
+// holdColumns are the columns scanned by scanHold
+const holdColumns = "id, ts, accountno, payee, amount, currency, captured, status, COALESCE(transaction_id, 0), expires_at, step_up"
+
+// scheduleColumns are the columns scanned by scanSchedule
+const scheduleColumns = "id, ts, iin, from_acc, to_acc, amount, currency, recurrence, next_run, status, failures, step_up"
+
+// batchColumns are the columns scanned by scanBatch
+const batchColumns = "id, ts, iin, from_acc, mode, status, total, currency, step_up"
+
+// subscriptionColumns are the columns scanned by scanSubscription
+const subscriptionColumns = "id, ts, iin, url, secret, events"
+
+// userColumns are the columns scanned by scanUser
+const userColumns = "id, ts, iin, username, password_hash, roles"
+
+// deliveryColumns are the columns of deliveries d joined to their subscriptions s scanned by scanDelivery
+const deliveryColumns = "d.id, d.ts, d.subscription_id, s.iin, s.url, s.secret, d.event_id, d.event_type, d.payload, d.status, d.attempts, d.next_attempt, d.last_error"
+
 type mySQLDBInterface struct {
 	db *sql.DB
 }
@@ -24,19 +54,34 @@ func (m *mySQLDBInterface) GetLastAccountNo() (string, error) {
 		return "", err
 	}
 	if len(lastAccountNo) != 13 {
-		return "", fmt.Errorf("Invalid length of account retrieved")
+		return "", fmt.Errorf("%w: %q", myerrors.ErrGotInvalidAcc, lastAccountNo)
 	}
 	return lastAccountNo, nil
 }
 
-// InsertWallet inserts newly created wallet into DB
-func (m *mySQLDBInterface) InsertWallet(account, IIN string) error {
-	insForm, err := m.db.Prepare("insert into wallets (accountno, iin) values(?, ?)")
+// InsertWallet inserts newly created wallet of given currency into DB with its wallet.created event
+func (m *mySQLDBInterface) InsertWallet(account, IIN, currency string) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	insForm, err := tx.Prepare("insert into wallets (accountno, iin, currency) values(?, ?, ?)")
 	if err != nil {
 		log.Println(err.Error())
+		tx.Rollback()
+		return err
+	}
+	defer insForm.Close()
+	if _, err := insForm.Exec(account, IIN, currency); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := insertOutbox(tx, domain.NewEvent(domain.EventWalletCreated, account)); err != nil {
+		tx.Rollback()
 		return err
 	}
-	if _, err := insForm.Exec(account, IIN); err != nil {
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
 		return err
 	}
 	return nil
@@ -44,7 +89,7 @@ func (m *mySQLDBInterface) InsertWallet(account, IIN string) error {
 
 // GetWallets retrieves wallets by given IIN
 func (m *mySQLDBInterface) GetWallets(IIN string) ([]domain.Wallet, error) {
-	rows, err := m.db.Query("SELECT accountno, id, ts, updated_at, amount FROM wallets WHERE iin = ?", IIN)
+	rows, err := m.db.Query("SELECT w.accountno, w.id, w.ts, w.updated_at, w.amount, w.currency, "+heldSQL+" FROM wallets w WHERE w.iin = ?", time.Now(), IIN)
 	if err != nil {
 		return nil, err
 	}
@@ -53,9 +98,13 @@ func (m *mySQLDBInterface) GetWallets(IIN string) ([]domain.Wallet, error) {
 	// Loop through rows, using Scan to assign column data to struct fields.
 	for rows.Next() {
 		var wallet domain.Wallet
-		if err := rows.Scan(&wallet.AccountNo, &wallet.ID, &wallet.Ts, &wallet.UpdatedAt, &wallet.Amount); err != nil {
+		var amount, held int64
+		var currency string
+		if err := rows.Scan(&wallet.AccountNo, &wallet.ID, &wallet.Ts, &wallet.UpdatedAt, &amount, &currency, &held); err != nil {
 			return nil, err
 		}
+		wallet.Ledger = domain.NewMoney(amount, currency)
+		wallet.Available = domain.NewMoney(amount-held, currency)
 		wallets = append(wallets, wallet)
 	}
 	if err = rows.Err(); err != nil {
@@ -64,13 +113,17 @@ func (m *mySQLDBInterface) GetWallets(IIN string) ([]domain.Wallet, error) {
 	return wallets, nil
 }
 
-// TopUp implements account replenishment in DB
-func (m *mySQLDBInterface) TopUp(account string, amt int) error {
+// TopUp implements account replenishment in DB, storing the idempotency key (if any) and the wallet.topped_up event
+// in the same transaction. Wallet of another currency than amt is not updated
+func (m *mySQLDBInterface) TopUp(account string, amt domain.Money, key *domain.IdempotencyKey) error {
+	if err := amt.Validate(); err != nil {
+		return err
+	}
 	tx, err := m.db.Begin()
 	if err != nil {
 		return err
 	}
-	stmtWallet, err := tx.Prepare(`UPDATE wallets SET amount = amount + ? WHERE accountno = ?`)
+	stmtWallet, err := tx.Prepare(`UPDATE wallets SET amount = amount + ? WHERE accountno = ? AND currency = ?`)
 
 	if err != nil {
 		tx.Rollback()
@@ -79,7 +132,7 @@ func (m *mySQLDBInterface) TopUp(account string, amt int) error {
 
 	defer stmtWallet.Close()
 
-	res, err := stmtWallet.Exec(amt, account)
+	res, err := stmtWallet.Exec(amt.Amount, account, amt.Currency)
 	if err != nil {
 		tx.Rollback()
 		return err
@@ -91,23 +144,51 @@ func (m *mySQLDBInterface) TopUp(account string, amt int) error {
 		return err
 	}
 	if rows == 0 {
+		tx.Rollback()
 		log.Println("ERROR|TopUp DB rows=0", err)
 		return myerrors.ErrUpdateRows
 	}
 
-	stmtTx, err := tx.Prepare(`INSERT INTO transactions(transfer_type,from_acc,to_acc,amount) VALUES(?,?,?,?)`)
+	res, err = insertTransaction(tx, "topup", domain.FundingAccount, account, domain.NewConversion(amt), "")
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
 
-	defer stmtTx.Close()
+	if err := insertPostings(tx, res, domain.FundingAccount, account, domain.NewConversion(amt)); err != nil {
+		tx.Rollback()
+		return err
+	}
 
-	res, err = stmtTx.Exec("topup", "", account, amt)
+	transactionID, err := res.LastInsertId()
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
+	event := domain.NewEvent(domain.EventWalletToppedUp, account)
+	event.Amount, event.TransactionID = &amt, int(transactionID)
+	if err := insertOutbox(tx, event); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if key != nil {
+		var balance int64
+		if err := tx.QueryRow("SELECT amount FROM wallets WHERE accountno = ?", account).Scan(&balance); err != nil {
+			tx.Rollback()
+			return err
+		}
+		response, err := json.Marshal(domain.NewMoney(balance, amt.Currency))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		key.Response = string(response)
+		if err := saveIdempotencyKey(tx, res, key); err != nil {
+			tx.Rollback()
+			return m.replayIdempotencyKey(key, err)
+		}
+	}
 
 	err = tx.Commit()
 
@@ -119,44 +200,36 @@ func (m *mySQLDBInterface) TopUp(account string, amt int) error {
 }
 
 // GetAmount retrieves account amount
-func (m *mySQLDBInterface) GetAmount(account string) (string, error) {
-	var amount string
-	if err := m.db.QueryRow("SELECT amount FROM wallets WHERE accountno = ?", account).Scan(&amount); err != nil {
-		return "", err
-	}
-	return amount, nil
-}
-
-// SetZeroStatus sets transfer status back to status quo
-func (m *mySQLDBInterface) SetZeroStatus(from, to string) error {
-	res, err := m.db.Exec("UPDATE wallets SET transfer=0 WHERE accountno=? OR accountno=?", from, to)
-	if err != nil {
-		return err
+func (m *mySQLDBInterface) GetAmount(account string) (domain.Money, error) {
+	var amount int64
+	var currency string
+	err := m.db.QueryRow("SELECT amount, currency FROM wallets WHERE accountno = ?", account).Scan(&amount, &currency)
+	if errors.Is(err, sql.ErrNoRows) {
+		return domain.Money{}, myerrors.ErrWalletNotFound
 	}
-	rows, err := res.RowsAffected()
 	if err != nil {
-		return err
+		return domain.Money{}, err
 	}
-	if rows != 2 {
-		log.Println("ERROR|Failed to update both rows, updated only", rows)
-		return myerrors.ErrUpdateRows
-	}
-	return nil
+	return domain.NewMoney(amount, currency), nil
 }
 
 // ConfirmIIN checks against IIN for requested account in DB
 func (m *mySQLDBInterface) ConfirmIIN(IIN, account string) (bool, error) {
 	var DBIIN string
-	if err := m.db.QueryRow("SELECT iin FROM wallets WHERE accountno = ?", account).Scan(&DBIIN); err != nil {
+	err := m.db.QueryRow("SELECT iin FROM wallets WHERE accountno = ?", account).Scan(&DBIIN)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, myerrors.ErrWalletNotFound
+	}
+	if err != nil {
 		return false, err
 	}
 	return DBIIN == IIN, nil
 }
 
-// GetTransaction gets all transactions on given account
-func (m *mySQLDBInterface) GetTransactions(account string) ([]domain.Transaction, error) {
-	log.Println("ACCCCCC", account)
-	rows, err := m.db.Query("SELECT * FROM transactions WHERE from_acc = ? OR to_acc = ?", account, account)
+// GetTransactions gets transactions of an account matching filter ordered by ID
+func (m *mySQLDBInterface) GetTransactions(filter domain.TransactionFilter) ([]domain.Transaction, error) {
+	query, args := transactionsQuery(filter)
+	rows, err := m.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -165,115 +238,1578 @@ func (m *mySQLDBInterface) GetTransactions(account string) ([]domain.Transaction
 	// Loop through rows, using Scan to assign column data to struct fields.
 	for rows.Next() {
 		var transaction domain.Transaction
-		if err := rows.Scan(&transaction.ID, &transaction.Ts, &transaction.Type, &transaction.From, &transaction.To, &transaction.Amount); err != nil {
+		var amount, toAmount int64
+		var currency, toCurrency string
+		var reversesID sql.NullInt64
+		if err := rows.Scan(&transaction.ID, &transaction.Ts, &transaction.Type, &transaction.From, &transaction.To, &amount, &currency, &toAmount, &toCurrency, &transaction.Rate, &reversesID, &transaction.StepUp); err != nil {
 			return nil, err
 		}
+		transaction.Amount = domain.NewMoney(amount, currency)
+		transaction.Credited = domain.NewMoney(toAmount, toCurrency)
+		transaction.ReversesID = int(reversesID.Int64)
 		transactions = append(transactions, transaction)
 	}
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
-	log.Println("transactions", transactions)
 	return transactions, nil
 }
 
-// Transfer handles money transfer between accounts
-func (m *mySQLDBInterface) Transfer(from, to, amt string) error {
+// GetBalanceAt sums up ledger postings of account made by transactions before at
+func (m *mySQLDBInterface) GetBalanceAt(account string, at time.Time) (domain.Money, error) {
+	var amount int64
+	var currency string
+	err := m.db.QueryRow("SELECT w.currency, COALESCE((SELECT SUM(p.amount) FROM postings p JOIN transactions t ON t.id = p.transaction_id WHERE p.accountno = w.accountno AND t.ts < ?), 0) FROM wallets w WHERE w.accountno = ?", at, account).Scan(&currency, &amount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return domain.Money{}, myerrors.ErrWalletNotFound
+	}
+	if err != nil {
+		return domain.Money{}, err
+	}
+	return domain.NewMoney(amount, currency), nil
+}
+
+// transactionsQuery builds query selecting transactions matching filter. Restricting one direction lets the
+// query walk the (from_acc, id) or (to_acc, id) index, the amount is the account's side of each transaction
+func transactionsQuery(filter domain.TransactionFilter) (string, []interface{}) {
+	var args []interface{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return "?"
+	}
+	var where []string
+	switch filter.Direction {
+	case domain.DirectionOut:
+		where = append(where, "from_acc = "+arg(filter.Account))
+	case domain.DirectionIn:
+		where = append(where, "to_acc = "+arg(filter.Account))
+	default:
+		where = append(where, "(from_acc = "+arg(filter.Account)+" OR to_acc = "+arg(filter.Account)+")")
+	}
+	if filter.Type != "" {
+		where = append(where, "transfer_type = "+arg(filter.Type))
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "ts >= "+arg(filter.Since))
+	}
+	if !filter.Until.IsZero() {
+		where = append(where, "ts < "+arg(filter.Until))
+	}
+	if filter.Counterparty != "" {
+		where = append(where, "((from_acc = "+arg(filter.Account)+" AND to_acc = "+arg(filter.Counterparty)+") OR (to_acc = "+arg(filter.Account)+" AND from_acc = "+arg(filter.Counterparty)+"))")
+	}
+	if filter.MinAmount != nil {
+		where = append(where, "(CASE WHEN from_acc = "+arg(filter.Account)+" THEN amount ELSE to_amount END) >= "+arg(*filter.MinAmount))
+	}
+	if filter.MaxAmount != nil {
+		where = append(where, "(CASE WHEN from_acc = "+arg(filter.Account)+" THEN amount ELSE to_amount END) <= "+arg(*filter.MaxAmount))
+	}
+	order := "ASC"
+	if filter.Desc {
+		order = "DESC"
+	}
+	if filter.Cursor != 0 {
+		if filter.Desc {
+			where = append(where, "id < "+arg(filter.Cursor))
+		} else {
+			where = append(where, "id > "+arg(filter.Cursor))
+		}
+	}
+	query := "SELECT id, ts, transfer_type, from_acc, to_acc, amount, currency, to_amount, to_currency, fx_rate, reverses_id, step_up FROM transactions WHERE " + strings.Join(where, " AND ") + " ORDER BY id " + order
+	if filter.Limit > 0 {
+		query += " LIMIT " + arg(filter.Limit)
+	}
+	return query, args
+}
+
+// Transfer handles money transfer between accounts, retrying when MySQL picks it as a deadlock victim. It returns the
+// transaction made, or the one stored with key when another request stored it first
+func (m *mySQLDBInterface) Transfer(from, to string, conv domain.Conversion, key *domain.IdempotencyKey, stepUp domain.StepUp) (*domain.Transaction, error) {
+	var err error
+	for attempt := 1; attempt <= maxTransferAttempts; attempt++ {
+		var transfer *domain.Transaction
+		if transfer, err = m.transfer(from, to, conv, key, stepUp); !isRetryable(err) {
+			return transfer, err
+		}
+		log.Printf("WARN|Transfer %s->%s attempt %d failed, retrying: %v\n", from, to, attempt, err)
+	}
+	return nil, err
+}
+
+// transfer moves money in a single transaction, storing the idempotency key (if any) and the transfer events in the
+// same transaction.
+// Both wallets are locked in account order so that concurrent transfers between the same pair cannot deadlock
+// or overwrite each other's balance
+func (m *mySQLDBInterface) transfer(from, to string, conv domain.Conversion, key *domain.IdempotencyKey, stepUp domain.StepUp) (*domain.Transaction, error) {
+	if err := conv.Debit.Validate(); err != nil {
+		return nil, err
+	}
+	if err := conv.Credit.Validate(); err != nil {
+		return nil, err
+	}
+
 	tx, err := m.db.Begin()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	balances, err := lockWallets(tx, from, to)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if balances[from].Currency != conv.Debit.Currency || balances[to].Currency != conv.Credit.Currency {
+		tx.Rollback()
+		return nil, myerrors.ErrCurrencyMismatch
+	}
+	if balances[from].Amount < conv.Debit.Amount {
+		tx.Rollback()
+		return nil, myerrors.ErrInsufficientFunds
+	}
+	if err := useTransferConfirmation(tx, stepUp.ConfirmationHash); err != nil {
+		tx.Rollback()
+		return nil, err
 	}
 
-	stmtFrom, err := tx.Prepare(`UPDATE wallets SET amount = amount - ? WHERE accountno = ?`)
+	if err := moveMoney(tx, from, to, conv); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
 
+	res, err := insertTransaction(tx, "transfer", from, to, conv, stepUp.Decision)
 	if err != nil {
 		tx.Rollback()
-		return err
+		log.Println("ERROR|Inserting transaction:", err)
+		return nil, err
 	}
 
-	defer stmtFrom.Close()
+	if err := insertPostings(tx, res, from, to, conv); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
 
-	res, err := stmtFrom.Exec(amt, from)
+	transactionID, err := res.LastInsertId()
 	if err != nil {
 		tx.Rollback()
-		var mysqlErr *mysql.MySQLError
-		if errors.As(err, &mysqlErr) && mysqlErr.Number == 1690 {
-			return myerrors.ErrInsufficientFunds
+		return nil, err
+	}
+	if err := insertOutbox(tx, domain.NewTransferEvents(from, to, conv, int(transactionID))...); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	transfer := domain.NewTransfer(int(transactionID), from, to, conv, stepUp.Decision)
+	if key != nil {
+		response, err := json.Marshal(transfer)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
 		}
-		return err
+		key.Response = string(response)
+		if err := saveIdempotencyKey(tx, res, key); err != nil {
+			tx.Rollback()
+			if err := m.replayIdempotencyKey(key, err); err != nil {
+				return nil, err
+			}
+			return domain.DecodeTransfer(key.Response)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, err
 	}
+	return &transfer, nil
+}
 
-	stmtTo, err := tx.Prepare(`UPDATE wallets SET amount = amount + ? WHERE accountno = ?`)
+// Reverse refunds amt (everything left if nil) of transaction back to its sender. The original transaction row is
+// locked first so that concurrent reversals of it are serialized and can never refund more than was transferred
+func (m *mySQLDBInterface) Reverse(transactionID int, amt *domain.Money) (*domain.Transaction, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return nil, err
+	}
 
+	var original domain.Transaction
+	var amount, toAmount int64
+	var currency, toCurrency string
+	err = tx.QueryRow("SELECT id, transfer_type, from_acc, to_acc, amount, currency, to_amount, to_currency, fx_rate FROM transactions WHERE id = ? FOR UPDATE", transactionID).
+		Scan(&original.ID, &original.Type, &original.From, &original.To, &amount, &currency, &toAmount, &toCurrency, &original.Rate)
+	if errors.Is(err, sql.ErrNoRows) {
+		tx.Rollback()
+		return nil, myerrors.ErrTxNotFound
+	}
 	if err != nil {
 		tx.Rollback()
-		return err
+		return nil, err
 	}
+	original.Amount = domain.NewMoney(amount, currency)
+	original.Credited = domain.NewMoney(toAmount, toCurrency)
 
-	defer stmtTo.Close()
+	var refunded int64
+	if err := tx.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE reverses_id = ?", transactionID).Scan(&refunded); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	conv, err := original.Refund(refunded, amt)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
 
-	res, err = stmtTo.Exec(amt, to)
+	// money goes back from the receiver to the sender, the funding account of a top-up has no wallet
+	from, to := original.To, original.From
+	accounts := []string{from}
+	if to != domain.FundingAccount {
+		accounts = append(accounts, to)
+	}
+	balances, err := lockWallets(tx, accounts...)
 	if err != nil {
 		tx.Rollback()
-		return err
+		return nil, err
 	}
-	if rows, err := res.RowsAffected(); err != nil || rows == 0 {
+	if balances[from].Amount < conv.Debit.Amount {
 		tx.Rollback()
-		return err
+		return nil, myerrors.ErrInsufficientFunds
+	}
+
+	if err := moveMoney(tx, from, to, conv); err != nil {
+		tx.Rollback()
+		return nil, err
 	}
 
-	stmtTx, err := tx.Prepare(`INSERT INTO transactions(transfer_type,from_acc,to_acc,amount) VALUES(?,?,?,?)`)
+	res, err := tx.Exec(`INSERT INTO transactions(transfer_type,from_acc,to_acc,amount,currency,to_amount,to_currency,fx_rate,reverses_id) VALUES(?,?,?,?,?,?,?,?,?)`,
+		domain.ReversalType, from, to, conv.Debit.Amount, conv.Debit.Currency, conv.Credit.Amount, conv.Credit.Currency, conv.Rate, transactionID)
 	if err != nil {
 		tx.Rollback()
-		return err
+		log.Println("ERROR|Inserting reversal:", err)
+		return nil, err
+	}
+	if err := insertPostings(tx, res, from, to, conv); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := insertOutbox(tx, domain.NewTransferEvents(from, to, conv, int(id))...); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return &domain.Transaction{
+		ID:         int(id),
+		Ts:         time.Now().Format(tsLayout),
+		Type:       domain.ReversalType,
+		From:       from,
+		To:         to,
+		Amount:     conv.Debit,
+		Credited:   conv.Credit,
+		Rate:       conv.Rate,
+		ReversesID: transactionID,
+	}, nil
+}
+
+// PlaceHold reserves amt of the wallet until expiresAt for capturing into payee, authorized with stepUp whose
+// confirmation is used up. The wallet is locked so that a concurrent transfer cannot spend the money being held
+func (m *mySQLDBInterface) PlaceHold(account, payee string, amt domain.Money, expiresAt time.Time, stepUp domain.StepUp) (*domain.Hold, error) {
+	if err := amt.Validate(); err != nil {
+		return nil, err
+	}
+	tx, err := m.db.Begin()
+	if err != nil {
+		return nil, err
 	}
 
-	defer stmtTx.Close()
+	balances, err := lockWallets(tx, account)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if balances[account].Currency != amt.Currency {
+		tx.Rollback()
+		return nil, myerrors.ErrCurrencyMismatch
+	}
+	if balances[account].Amount < amt.Amount {
+		tx.Rollback()
+		return nil, myerrors.ErrInsufficientFunds
+	}
+	if err := useTransferConfirmation(tx, stepUp.ConfirmationHash); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
 
-	res, err = stmtTx.Exec("transfer", from, to, amt)
+	res, err := tx.Exec("INSERT INTO holds(accountno, payee, amount, currency, expires_at, step_up) VALUES(?,?,?,?,?,?)",
+		account, payee, amt.Amount, amt.Currency, expiresAt, stepUp.Decision)
 	if err != nil {
 		tx.Rollback()
-		fmt.Println("Error inserting transaction")
-		return err
+		log.Println("ERROR|Inserting hold:", err)
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
 	}
-	fmt.Println("record added to transaction table successfully")
-	fmt.Println(res)
 
 	if err = tx.Commit(); err != nil {
 		tx.Rollback()
-		return err
+		return nil, err
 	}
-	return nil
+	return &domain.Hold{
+		ID:        int(id),
+		Ts:        time.Now().Format(tsLayout),
+		AccountNo: account,
+		Payee:     payee,
+		Amount:    amt,
+		Captured:  domain.NewMoney(0, amt.Currency),
+		Status:    domain.HoldActive,
+		ExpiresAt: expiresAt,
+		StepUp:    stepUp.Decision,
+	}, nil
+}
+
+// GetHold retrieves hold by ID
+func (m *mySQLDBInterface) GetHold(holdID int) (*domain.Hold, error) {
+	return scanHold(m.db.QueryRow("SELECT "+holdColumns+" FROM holds WHERE id = ?", holdID))
 }
 
-// UpdateTransferStatus sets status to 1 when transfer starts
-func (m *mySQLDBInterface) UpdateTransferStatus(from, to string) error {
+// CaptureHold transfers conv.Debit out of an active hold to its payee with the step-up decision it was placed with,
+// the rest of the hold is released. The hold row is locked before the wallets so that it cannot be captured or
+// released twice
+func (m *mySQLDBInterface) CaptureHold(holdID int, conv domain.Conversion) (*domain.Hold, error) {
+	if err := conv.Debit.Validate(); err != nil {
+		return nil, err
+	}
+	if err := conv.Credit.Validate(); err != nil {
+		return nil, err
+	}
 	tx, err := m.db.Begin()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	res, err := tx.Exec("UPDATE wallets SET transfer=1 WHERE accountno=? OR accountno=? AND transfer=0", from, to)
+
+	hold, err := scanHold(tx.QueryRow("SELECT "+holdColumns+" FROM holds WHERE id = ? FOR UPDATE", holdID))
 	if err != nil {
 		tx.Rollback()
-		return err
+		return nil, err
 	}
-	rows, err := res.RowsAffected()
+	if !hold.IsActive(time.Now()) {
+		tx.Rollback()
+		return nil, myerrors.ErrHoldNotActive
+	}
+	if hold.Amount.Currency != conv.Debit.Currency {
+		tx.Rollback()
+		return nil, myerrors.ErrCurrencyMismatch
+	}
+	if hold.Amount.Amount < conv.Debit.Amount {
+		tx.Rollback()
+		return nil, myerrors.ErrCaptureTooLarge
+	}
+	// holds placed before payees were recorded have none and can only be released
+	to := hold.Payee
+	if to == "" {
+		tx.Rollback()
+		return nil, myerrors.ErrHoldPayeeMismatch
+	}
+
+	// the held money is already excluded from the available balance, so no funds check is needed
+	balances, err := lockWallets(tx, hold.AccountNo, to)
 	if err != nil {
 		tx.Rollback()
-		return err
+		return nil, err
 	}
-	fmt.Println(rows)
-	if rows != 2 {
+	if balances[to].Currency != conv.Credit.Currency {
 		tx.Rollback()
-		log.Println("UpdateTransferStatus DB rows != 2 but", rows)
-		return myerrors.ErrUpdateRows
+		return nil, myerrors.ErrCurrencyMismatch
+	}
+
+	if err := moveMoney(tx, hold.AccountNo, to, conv); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	res, err := insertTransaction(tx, domain.HoldType, hold.AccountNo, to, conv, hold.StepUp)
+	if err != nil {
+		tx.Rollback()
+		log.Println("ERROR|Inserting capture:", err)
+		return nil, err
+	}
+	if err := insertPostings(tx, res, hold.AccountNo, to, conv); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if _, err := tx.Exec("UPDATE holds SET status = ?, captured = ?, transaction_id = ? WHERE id = ?", domain.HoldCaptured, conv.Debit.Amount, id, holdID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := insertOutbox(tx, domain.NewTransferEvents(hold.AccountNo, to, conv, int(id))...); err != nil {
+		tx.Rollback()
+		return nil, err
 	}
 
 	if err = tx.Commit(); err != nil {
 		tx.Rollback()
-		return err
+		return nil, err
 	}
-	return nil
+	hold.Status = domain.HoldCaptured
+	hold.Captured = conv.Debit
+	hold.TransactionID = int(id)
+	return hold, nil
+}
+
+// ReleaseHold gives the whole amount of an active hold back to the available balance
+func (m *mySQLDBInterface) ReleaseHold(holdID int) (*domain.Hold, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	hold, err := scanHold(tx.QueryRow("SELECT "+holdColumns+" FROM holds WHERE id = ? FOR UPDATE", holdID))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if !hold.IsActive(time.Now()) {
+		tx.Rollback()
+		return nil, myerrors.ErrHoldNotActive
+	}
+	if _, err := tx.Exec("UPDATE holds SET status = ? WHERE id = ?", domain.HoldReleased, holdID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	hold.Status = domain.HoldReleased
+	return hold, nil
+}
+
+// ExpireHolds marks active holds past their expiry as expired and returns how many there were
+func (m *mySQLDBInterface) ExpireHolds(now time.Time) (int, error) {
+	res, err := m.db.Exec("UPDATE holds SET status = ? WHERE status = ? AND expires_at <= ?", domain.HoldExpired, domain.HoldActive, now)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(rows), nil
+}
+
+// scanHold scans holdColumns of row, ErrHoldNotFound if there is none. DATETIME columns come back
+// in the UTC the driver writes them in
+func scanHold(row *sql.Row) (*domain.Hold, error) {
+	var hold domain.Hold
+	var amount, captured int64
+	var currency, expiresAt string
+	err := row.Scan(&hold.ID, &hold.Ts, &hold.AccountNo, &hold.Payee, &amount, &currency, &captured, &hold.Status, &hold.TransactionID, &expiresAt, &hold.StepUp)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, myerrors.ErrHoldNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if hold.ExpiresAt, err = time.Parse(tsLayout, expiresAt); err != nil {
+		return nil, err
+	}
+	hold.Amount = domain.NewMoney(amount, currency)
+	hold.Captured = domain.NewMoney(captured, currency)
+	return &hold, nil
+}
+
+// InsertSchedule stores new active schedule made with stepUp, using up its confirmation in the same transaction
+func (m *mySQLDBInterface) InsertSchedule(s domain.Schedule, stepUp domain.StepUp) (*domain.Schedule, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if err := useTransferConfirmation(tx, stepUp.ConfirmationHash); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	res, err := tx.Exec("INSERT INTO schedules(iin, from_acc, to_acc, amount, currency, recurrence, next_run, step_up) VALUES(?,?,?,?,?,?,?,?)",
+		s.IIN, s.From, s.To, s.Amount.Amount, s.Amount.Currency, s.Recurrence, s.NextRun, stepUp.Decision)
+	if err != nil {
+		log.Println("ERROR|Inserting schedule:", err)
+		tx.Rollback()
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	s.ID = int(id)
+	s.Ts = time.Now().Format(tsLayout)
+	s.Status = domain.ScheduleActive
+	s.Failures = 0
+	s.StepUp = stepUp.Decision
+	return &s, nil
+}
+
+// GetSchedule retrieves schedule by ID
+func (m *mySQLDBInterface) GetSchedule(scheduleID int) (*domain.Schedule, error) {
+	s, err := scanSchedule(m.db.QueryRow("SELECT "+scheduleColumns+" FROM schedules WHERE id = ?", scheduleID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, myerrors.ErrScheduleNotFound
+	}
+	return s, err
+}
+
+// GetSchedules retrieves schedules of the user
+func (m *mySQLDBInterface) GetSchedules(IIN string) ([]domain.Schedule, error) {
+	return m.querySchedules("SELECT "+scheduleColumns+" FROM schedules WHERE iin = ? ORDER BY id", IIN)
+}
+
+// GetScheduleRuns retrieves runs of schedule, oldest first
+func (m *mySQLDBInterface) GetScheduleRuns(scheduleID int) ([]domain.ScheduleRun, error) {
+	rows, err := m.db.Query("SELECT id, schedule_id, ts, outcome, error FROM schedule_runs WHERE schedule_id = ? ORDER BY id", scheduleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var runs []domain.ScheduleRun
+	for rows.Next() {
+		var run domain.ScheduleRun
+		var ts string
+		if err := rows.Scan(&run.ID, &run.ScheduleID, &ts, &run.Outcome, &run.Error); err != nil {
+			return nil, err
+		}
+		if run.Ts, err = time.Parse(tsLayout, ts); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+// CancelSchedule stops an active or paused schedule
+func (m *mySQLDBInterface) CancelSchedule(scheduleID int) (*domain.Schedule, error) {
+	res, err := m.db.Exec("UPDATE schedules SET status = ? WHERE id = ? AND status IN (?, ?)", domain.ScheduleCancelled, scheduleID, domain.ScheduleActive, domain.SchedulePaused)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	s, err := m.GetSchedule(scheduleID)
+	if err != nil {
+		return nil, err
+	}
+	if rows == 0 {
+		return nil, myerrors.ErrScheduleNotActive
+	}
+	return s, nil
+}
+
+// GetDueSchedules retrieves active schedules whose next run is not after now, the most overdue first
+func (m *mySQLDBInterface) GetDueSchedules(now time.Time) ([]domain.Schedule, error) {
+	return m.querySchedules("SELECT "+scheduleColumns+" FROM schedules WHERE status = ? AND next_run <= ? ORDER BY next_run", domain.ScheduleActive, now)
+}
+
+// RecordScheduleRun stores run and the next run, status and failures of s. A schedule cancelled while it was
+// running keeps its status, the run is still recorded
+func (m *mySQLDBInterface) RecordScheduleRun(s domain.Schedule, run domain.ScheduleRun) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE schedules SET next_run = ?, status = ?, failures = ? WHERE id = ? AND status = ?",
+		s.NextRun, s.Status, s.Failures, s.ID, domain.ScheduleActive); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO schedule_runs(schedule_id, ts, outcome, error) VALUES(?,?,?,?)", s.ID, run.Ts, run.Outcome, run.Error); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// querySchedules runs query selecting scheduleColumns
+func (m *mySQLDBInterface) querySchedules(query string, args ...interface{}) ([]domain.Schedule, error) {
+	rows, err := m.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var schedules []domain.Schedule
+	for rows.Next() {
+		s, err := scanSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, *s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return schedules, nil
+}
+
+// scanSchedule scans scheduleColumns of *sql.Row or *sql.Rows
+func scanSchedule(row interface{ Scan(...interface{}) error }) (*domain.Schedule, error) {
+	var s domain.Schedule
+	var amount int64
+	var currency, nextRun string
+	if err := row.Scan(&s.ID, &s.Ts, &s.IIN, &s.From, &s.To, &amount, &currency, &s.Recurrence, &nextRun, &s.Status, &s.Failures, &s.StepUp); err != nil {
+		return nil, err
+	}
+	var err error
+	if s.NextRun, err = time.Parse(tsLayout, nextRun); err != nil {
+		return nil, err
+	}
+	s.Amount = domain.NewMoney(amount, currency)
+	return &s, nil
+}
+
+// InsertBatch stores new pending batch with its lines made with stepUp, using up its confirmation in the same
+// transaction
+func (m *mySQLDBInterface) InsertBatch(b domain.Batch, stepUp domain.StepUp) (*domain.Batch, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if err := useTransferConfirmation(tx, stepUp.ConfirmationHash); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	res, err := tx.Exec("INSERT INTO batches(iin, from_acc, mode, status, total, currency, step_up) VALUES(?,?,?,?,?,?,?)",
+		b.IIN, b.From, b.Mode, domain.BatchPending, b.Total.Amount, b.Total.Currency, stepUp.Decision)
+	if err != nil {
+		log.Println("ERROR|Inserting batch:", err)
+		tx.Rollback()
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	values := make([]string, 0, len(b.Lines))
+	args := make([]interface{}, 0, 6*len(b.Lines))
+	for i := range b.Lines {
+		line := &b.Lines[i]
+		line.Status = domain.LinePending
+		values = append(values, "(?,?,?,?,?,?)")
+		args = append(args, id, line.Line, line.To, line.Amount.Amount, line.Amount.Currency, line.Reference)
+	}
+	if _, err := tx.Exec("INSERT INTO batch_lines(batch_id, line, to_acc, amount, currency, reference) VALUES"+strings.Join(values, ","), args...); err != nil {
+		log.Println("ERROR|Inserting batch lines:", err)
+		tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	b.ID = int(id)
+	b.Ts = time.Now().Format(tsLayout)
+	b.Status = domain.BatchPending
+	b.StepUp = stepUp.Decision
+	return &b, nil
+}
+
+// GetBatch retrieves batch by ID with its lines
+func (m *mySQLDBInterface) GetBatch(batchID int) (*domain.Batch, error) {
+	b, err := scanBatch(m.db.QueryRow("SELECT "+batchColumns+" FROM batches WHERE id = ?", batchID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, myerrors.ErrBatchNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	rows, err := m.db.Query("SELECT line, to_acc, amount, currency, reference, status, COALESCE(transaction_id, 0), error FROM batch_lines WHERE batch_id = ? ORDER BY line", batchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var line domain.BatchLine
+		var amount int64
+		var currency string
+		if err := rows.Scan(&line.Line, &line.To, &amount, &currency, &line.Reference, &line.Status, &line.TransactionID, &line.Error); err != nil {
+			return nil, err
+		}
+		line.Amount = domain.NewMoney(amount, currency)
+		b.Lines = append(b.Lines, line)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// GetPendingBatches retrieves batches waiting to be run without their lines, oldest first
+func (m *mySQLDBInterface) GetPendingBatches() ([]domain.Batch, error) {
+	rows, err := m.db.Query("SELECT "+batchColumns+" FROM batches WHERE status = ? ORDER BY id", domain.BatchPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var batches []domain.Batch
+	for rows.Next() {
+		b, err := scanBatch(rows)
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, *b)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return batches, nil
+}
+
+// ClaimBatch marks pending batch as running, false if another worker got to it first
+func (m *mySQLDBInterface) ClaimBatch(batchID int) (bool, error) {
+	res, err := m.db.Exec("UPDATE batches SET status = ? WHERE id = ? AND status = ?", domain.BatchRunning, batchID, domain.BatchPending)
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows == 1, nil
+}
+
+// UpdateBatchLine stores status, transaction and error of line
+func (m *mySQLDBInterface) UpdateBatchLine(batchID int, line domain.BatchLine) error {
+	transactionID := sql.NullInt64{Int64: int64(line.TransactionID), Valid: line.TransactionID != 0}
+	_, err := m.db.Exec("UPDATE batch_lines SET status = ?, transaction_id = ?, error = ? WHERE batch_id = ? AND line = ?",
+		line.Status, transactionID, line.Error, batchID, line.Line)
+	return err
+}
+
+// FinishBatch stores final status of batch
+func (m *mySQLDBInterface) FinishBatch(batchID int, status string) error {
+	_, err := m.db.Exec("UPDATE batches SET status = ? WHERE id = ?", status, batchID)
+	return err
+}
+
+// scanBatch scans batchColumns of *sql.Row or *sql.Rows
+func scanBatch(row interface{ Scan(...interface{}) error }) (*domain.Batch, error) {
+	var b domain.Batch
+	var total int64
+	var currency string
+	if err := row.Scan(&b.ID, &b.Ts, &b.IIN, &b.From, &b.Mode, &b.Status, &total, &currency, &b.StepUp); err != nil {
+		return nil, err
+	}
+	b.Total = domain.NewMoney(total, currency)
+	return &b, nil
+}
+
+// InsertSubscription stores new webhook subscription
+func (m *mySQLDBInterface) InsertSubscription(s domain.Subscription) (*domain.Subscription, error) {
+	res, err := m.db.Exec("INSERT INTO webhook_subscriptions(iin, url, secret, events) VALUES(?,?,?,?)",
+		s.IIN, s.URL, s.Secret, strings.Join(s.Events, ","))
+	if err != nil {
+		log.Println("ERROR|Inserting webhook subscription:", err)
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	s.ID = int(id)
+	s.Ts = time.Now().Format(tsLayout)
+	return &s, nil
+}
+
+// GetSubscription retrieves webhook subscription by ID
+func (m *mySQLDBInterface) GetSubscription(subscriptionID int) (*domain.Subscription, error) {
+	s, err := scanSubscription(m.db.QueryRow("SELECT "+subscriptionColumns+" FROM webhook_subscriptions WHERE id = ?", subscriptionID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, myerrors.ErrSubscriptionNotFound
+	}
+	return s, err
+}
+
+// GetSubscriptions retrieves webhook subscriptions of the user
+func (m *mySQLDBInterface) GetSubscriptions(IIN string) ([]domain.Subscription, error) {
+	rows, err := m.db.Query("SELECT "+subscriptionColumns+" FROM webhook_subscriptions WHERE iin = ? ORDER BY id", IIN)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var subscriptions []domain.Subscription
+	for rows.Next() {
+		s, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, *s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+// DeleteSubscription deletes webhook subscription with its deliveries
+func (m *mySQLDBInterface) DeleteSubscription(subscriptionID int) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM webhook_deliveries WHERE subscription_id = ?", subscriptionID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	res, err := tx.Exec("DELETE FROM webhook_subscriptions WHERE id = ?", subscriptionID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if rows == 0 {
+		tx.Rollback()
+		return myerrors.ErrSubscriptionNotFound
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// EnqueueEvent queues delivery of event to every subscription of the owner of its account asking for its type
+// and returns how many were queued, an event already queued for a subscription is not queued again
+func (m *mySQLDBInterface) EnqueueEvent(e domain.Event) (int, error) {
+	res, err := m.db.Exec("INSERT INTO webhook_deliveries(subscription_id, event_id, event_type, payload, next_attempt) "+
+		"SELECT s.id, ?, ?, ?, ? FROM webhook_subscriptions s JOIN wallets w ON w.iin = s.iin WHERE w.accountno = ? AND FIND_IN_SET(?, s.events) > 0 "+
+		"ON DUPLICATE KEY UPDATE event_id = event_id",
+		e.ID, e.Type, e.Payload(), e.Ts, e.Account, e.Type)
+	if err != nil {
+		log.Println("ERROR|Enqueueing event:", err)
+		return 0, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(rows), nil
+}
+
+// GetDueDeliveries retrieves at most limit pending deliveries whose next attempt is not after now, the most overdue first
+func (m *mySQLDBInterface) GetDueDeliveries(now time.Time, limit int) ([]domain.Delivery, error) {
+	return m.queryDeliveries("SELECT "+deliveryColumns+" FROM webhook_deliveries d JOIN webhook_subscriptions s ON s.id = d.subscription_id "+
+		"WHERE d.status = ? AND d.next_attempt <= ? ORDER BY d.next_attempt LIMIT ?", domain.DeliveryPending, now, limit)
+}
+
+// RecordDelivery stores status, attempts, next attempt and last error of delivery
+func (m *mySQLDBInterface) RecordDelivery(d domain.Delivery) error {
+	_, err := m.db.Exec("UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt = ?, last_error = ? WHERE id = ?",
+		d.Status, d.Attempts, d.NextAttempt, d.LastError, d.ID)
+	return err
+}
+
+// GetDelivery retrieves webhook delivery by ID
+func (m *mySQLDBInterface) GetDelivery(deliveryID int) (*domain.Delivery, error) {
+	d, err := scanDelivery(m.db.QueryRow("SELECT "+deliveryColumns+" FROM webhook_deliveries d JOIN webhook_subscriptions s ON s.id = d.subscription_id WHERE d.id = ?", deliveryID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, myerrors.ErrDeliveryNotFound
+	}
+	return d, err
+}
+
+// GetDeadDeliveries retrieves deliveries to subscriptions of the user that ran out of attempts
+func (m *mySQLDBInterface) GetDeadDeliveries(IIN string) ([]domain.Delivery, error) {
+	return m.queryDeliveries("SELECT "+deliveryColumns+" FROM webhook_deliveries d JOIN webhook_subscriptions s ON s.id = d.subscription_id "+
+		"WHERE s.iin = ? AND d.status = ? ORDER BY d.id", IIN, domain.DeliveryDead)
+}
+
+// RequeueDelivery gives dead delivery a fresh set of attempts starting at now
+func (m *mySQLDBInterface) RequeueDelivery(deliveryID int, now time.Time) error {
+	res, err := m.db.Exec("UPDATE webhook_deliveries SET status = ?, attempts = 0, next_attempt = ? WHERE id = ? AND status = ?",
+		domain.DeliveryPending, now, deliveryID, domain.DeliveryDead)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return myerrors.ErrDeliveryNotDead
+	}
+	return nil
+}
+
+// queryDeliveries runs query selecting deliveryColumns
+func (m *mySQLDBInterface) queryDeliveries(query string, args ...interface{}) ([]domain.Delivery, error) {
+	rows, err := m.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var deliveries []domain.Delivery
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, *d)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// scanSubscription scans subscriptionColumns of *sql.Row or *sql.Rows
+func scanSubscription(row interface{ Scan(...interface{}) error }) (*domain.Subscription, error) {
+	var s domain.Subscription
+	var events string
+	if err := row.Scan(&s.ID, &s.Ts, &s.IIN, &s.URL, &s.Secret, &events); err != nil {
+		return nil, err
+	}
+	s.Events = strings.Split(events, ",")
+	return &s, nil
+}
+
+// scanDelivery scans deliveryColumns of *sql.Row or *sql.Rows
+func scanDelivery(row interface{ Scan(...interface{}) error }) (*domain.Delivery, error) {
+	var d domain.Delivery
+	var nextAttempt string
+	if err := row.Scan(&d.ID, &d.Ts, &d.SubscriptionID, &d.IIN, &d.URL, &d.Secret, &d.EventID, &d.EventType, &d.Payload, &d.Status, &d.Attempts, &nextAttempt, &d.LastError); err != nil {
+		return nil, err
+	}
+	var err error
+	if d.NextAttempt, err = time.Parse(tsLayout, nextAttempt); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// GetUnpublishedEvents retrieves at most limit events of the outbox not yet published, in the order they were written
+func (m *mySQLDBInterface) GetUnpublishedEvents(limit int) ([]domain.Event, error) {
+	rows, err := m.db.Query("SELECT payload FROM outbox WHERE published_at IS NULL ORDER BY id LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanEvents(rows)
+}
+
+// MarkEventPublished records that event of the outbox was published at given time
+func (m *mySQLDBInterface) MarkEventPublished(eventID string, at time.Time) error {
+	_, err := m.db.Exec("UPDATE outbox SET published_at = ? WHERE event_id = ?", at, eventID)
+	return err
+}
+
+// GetEventsAfter retrieves at most limit events of wallets of the user written to the outbox after the event with
+// eventID, published or not, in the order they were written
+func (m *mySQLDBInterface) GetEventsAfter(IIN, eventID string, limit int) ([]domain.Event, error) {
+	var id int64
+	err := m.db.QueryRow("SELECT id FROM outbox WHERE event_id = ?", eventID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, myerrors.ErrEventNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	rows, err := m.db.Query("SELECT o.payload FROM outbox o JOIN wallets w ON w.accountno = JSON_UNQUOTE(JSON_EXTRACT(o.payload, '$.account')) "+
+		"WHERE w.iin = ? AND o.id > ? ORDER BY o.id LIMIT ?", IIN, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanEvents(rows)
+}
+
+// GetOutboxPosition retrieves position of the latest event of the outbox, 0 when it is empty
+func (m *mySQLDBInterface) GetOutboxPosition() (int64, error) {
+	var position int64
+	err := m.db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM outbox").Scan(&position)
+	return position, err
+}
+
+// GetEventsSince retrieves at most limit events of every wallet written to the outbox after position, published or
+// not, in the order they were written along with the position of the last one
+func (m *mySQLDBInterface) GetEventsSince(position int64, limit int) ([]domain.Event, int64, error) {
+	rows, err := m.db.Query("SELECT id, payload FROM outbox WHERE id > ? ORDER BY id LIMIT ?", position, limit)
+	if err != nil {
+		return nil, position, err
+	}
+	defer rows.Close()
+	var events []domain.Event
+	for rows.Next() {
+		var payload string
+		if err := rows.Scan(&position, &payload); err != nil {
+			return nil, 0, err
+		}
+		var e domain.Event
+		if err := json.Unmarshal([]byte(payload), &e); err != nil {
+			return nil, 0, err
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return events, position, nil
+}
+
+// scanEvents reads events from payload rows and closes them
+func scanEvents(rows *sql.Rows) ([]domain.Event, error) {
+	defer rows.Close()
+	var events []domain.Event
+	for rows.Next() {
+		var payload string
+		if err := rows.Scan(&payload); err != nil {
+			return nil, err
+		}
+		var e domain.Event
+		if err := json.Unmarshal([]byte(payload), &e); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// InsertUser stores new user of the auth service, usernames and IINs are unique
+func (m *mySQLDBInterface) InsertUser(u domain.User) (*domain.User, error) {
+	res, err := m.db.Exec("INSERT INTO users(iin, username, password_hash, roles) VALUES(?,?,?,?)",
+		u.IIN, u.Username, u.PasswordHash, joinRoles(u.Roles))
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+		return nil, myerrors.ErrUserExists
+	}
+	if err != nil {
+		log.Println("ERROR|Inserting user:", err)
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	u.ID = int(id)
+	u.Ts = time.Now().Format(tsLayout)
+	return &u, nil
+}
+
+// GetUser retrieves user by ID
+func (m *mySQLDBInterface) GetUser(userID int) (*domain.User, error) {
+	u, err := scanUser(m.db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", userID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, myerrors.ErrUserNotFound
+	}
+	return u, err
+}
+
+// GetUserByUsername retrieves user by username
+func (m *mySQLDBInterface) GetUserByUsername(username string) (*domain.User, error) {
+	u, err := scanUser(m.db.QueryRow("SELECT "+userColumns+" FROM users WHERE username = ?", username))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, myerrors.ErrUserNotFound
+	}
+	return u, err
+}
+
+// scanUser scans userColumns of *sql.Row or *sql.Rows
+func scanUser(row interface{ Scan(...interface{}) error }) (*domain.User, error) {
+	var u domain.User
+	var roles string
+	if err := row.Scan(&u.ID, &u.Ts, &u.IIN, &u.Username, &u.PasswordHash, &roles); err != nil {
+		return nil, err
+	}
+	for _, role := range strings.Split(roles, ",") {
+		u.Roles = append(u.Roles, domain.Role(role))
+	}
+	return &u, nil
+}
+
+// joinRoles joins roles into comma separated list stored in users.roles
+func joinRoles(roles []domain.Role) string {
+	names := make([]string, len(roles))
+	for i, role := range roles {
+		names[i] = string(role)
+	}
+	return strings.Join(names, ",")
+}
+
+// InsertRefreshToken stores refresh token starting a new family
+func (m *mySQLDBInterface) InsertRefreshToken(t domain.RefreshToken) error {
+	_, err := m.db.Exec("INSERT INTO refresh_tokens(token_hash, family_id, user_id, status, expires_at) VALUES(?,?,?,?,?)",
+		t.Hash, t.FamilyID, t.UserID, t.Status, t.ExpiresAt)
+	return err
+}
+
+// GetRefreshToken retrieves refresh token by hash of its value
+func (m *mySQLDBInterface) GetRefreshToken(hash string) (*domain.RefreshToken, error) {
+	var t domain.RefreshToken
+	var expiresAt string
+	err := m.db.QueryRow("SELECT ts, token_hash, family_id, user_id, status, expires_at FROM refresh_tokens WHERE token_hash = ?", hash).
+		Scan(&t.Ts, &t.Hash, &t.FamilyID, &t.UserID, &t.Status, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, myerrors.ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t.ExpiresAt, err = time.Parse(tsLayout, expiresAt); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// RotateRefreshToken uses up active refresh token with hash and stores next of its family in its place, false if
+// the token was used or revoked already, so that of two requests refreshing with the same token only one succeeds
+func (m *mySQLDBInterface) RotateRefreshToken(hash string, next domain.RefreshToken) (bool, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	res, err := tx.Exec("UPDATE refresh_tokens SET status = ? WHERE token_hash = ? AND status = ?",
+		domain.RefreshTokenUsed, hash, domain.RefreshTokenActive)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if rows == 0 {
+		tx.Rollback()
+		return false, nil
+	}
+	if _, err := tx.Exec("INSERT INTO refresh_tokens(token_hash, family_id, user_id, status, expires_at) VALUES(?,?,?,?,?)",
+		next.Hash, next.FamilyID, next.UserID, next.Status, next.ExpiresAt); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	return true, nil
+}
+
+// RevokeRefreshTokens revokes active refresh tokens of the family
+func (m *mySQLDBInterface) RevokeRefreshTokens(familyID string) error {
+	_, err := m.db.Exec("UPDATE refresh_tokens SET status = ? WHERE family_id = ? AND status = ?",
+		domain.RefreshTokenRevoked, familyID, domain.RefreshTokenActive)
+	return err
+}
+
+// GetSessions retrieves sessions of the user with an active refresh token not expired by now, oldest refreshed first
+func (m *mySQLDBInterface) GetSessions(IIN string, now time.Time) ([]domain.Session, error) {
+	rows, err := m.db.Query("SELECT r.family_id, (SELECT MIN(f.ts) FROM refresh_tokens f WHERE f.family_id = r.family_id), r.ts, r.expires_at "+
+		"FROM refresh_tokens r JOIN users u ON u.id = r.user_id WHERE u.iin = ? AND r.status = ? AND r.expires_at > ? ORDER BY r.ts, r.family_id",
+		IIN, domain.RefreshTokenActive, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sessions []domain.Session
+	for rows.Next() {
+		var s domain.Session
+		var expiresAt string
+		if err := rows.Scan(&s.ID, &s.CreatedAt, &s.RefreshedAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		if s.ExpiresAt, err = time.Parse(tsLayout, expiresAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// InsertRevocation stores revocation, replacing an earlier one of the same kind and subject
+func (m *mySQLDBInterface) InsertRevocation(r domain.Revocation) error {
+	_, err := m.db.Exec("INSERT INTO revocations(kind, subject, revoked_at, expires_at) VALUES(?,?,?,?) "+
+		"ON DUPLICATE KEY UPDATE revoked_at = VALUES(revoked_at), expires_at = VALUES(expires_at)",
+		r.Kind, r.Subject, r.RevokedAt, r.ExpiresAt)
+	return err
+}
+
+// GetRevocations retrieves revocations made since given time, in the order they were made
+func (m *mySQLDBInterface) GetRevocations(since time.Time) ([]domain.Revocation, error) {
+	rows, err := m.db.Query("SELECT kind, subject, revoked_at, expires_at FROM revocations WHERE revoked_at >= ? ORDER BY revoked_at", since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var revocations []domain.Revocation
+	for rows.Next() {
+		var r domain.Revocation
+		var revokedAt, expiresAt string
+		if err := rows.Scan(&r.Kind, &r.Subject, &revokedAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		if r.RevokedAt, err = time.Parse(tsLayout, revokedAt); err != nil {
+			return nil, err
+		}
+		if r.ExpiresAt, err = time.Parse(tsLayout, expiresAt); err != nil {
+			return nil, err
+		}
+		revocations = append(revocations, r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return revocations, nil
+}
+
+// DeleteExpiredRevocations deletes revocations past their expiry and returns how many there were
+func (m *mySQLDBInterface) DeleteExpiredRevocations(now time.Time) (int, error) {
+	res, err := m.db.Exec("DELETE FROM revocations WHERE expires_at <= ?", now)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := res.RowsAffected()
+	return int(rows), err
+}
+
+// GetTOTP retrieves TOTP authenticator of IIN
+func (m *mySQLDBInterface) GetTOTP(IIN string) (*domain.TOTP, error) {
+	t := domain.TOTP{IIN: IIN}
+	var lockedUntil sql.NullString
+	err := m.db.QueryRow("SELECT secret, active, last_step, failed_attempts, locked_until FROM totp_authenticators WHERE iin = ?", IIN).
+		Scan(&t.Secret, &t.Active, &t.LastStep, &t.FailedAttempts, &lockedUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, myerrors.ErrTOTPNotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if lockedUntil.Valid {
+		if t.LockedUntil, err = time.Parse(tsLayout, lockedUntil.String); err != nil {
+			return nil, err
+		}
+	}
+	return &t, nil
+}
+
+// SaveTOTP stores authenticator of t.IIN without failed attempts, replacing the one it had
+func (m *mySQLDBInterface) SaveTOTP(t domain.TOTP) error {
+	_, err := m.db.Exec("INSERT INTO totp_authenticators(iin, secret, active, last_step) VALUES(?,?,?,?) "+
+		"ON DUPLICATE KEY UPDATE secret = VALUES(secret), active = VALUES(active), last_step = VALUES(last_step), failed_attempts = 0, locked_until = NULL",
+		t.IIN, t.Secret, t.Active, t.LastStep)
+	return err
+}
+
+// UseTOTPStep records code of step accepted from IIN and clears its failed attempts, activating the authenticator if
+// activate is set. False if a code of step or a later one was accepted already, so that every code is used once
+func (m *mySQLDBInterface) UseTOTPStep(IIN string, step int64, activate bool) (bool, error) {
+	res, err := m.db.Exec("UPDATE totp_authenticators SET last_step = ?, failed_attempts = 0, locked_until = NULL, active = active OR ? WHERE iin = ? AND last_step < ?",
+		step, activate, IIN, step)
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	return rows == 1, err
+}
+
+// FailTOTP counts a wrong code of IIN, locking codes out until lockedUntil from the maxAttempts-th wrong one in a row
+func (m *mySQLDBInterface) FailTOTP(IIN string, maxAttempts int, lockedUntil time.Time) error {
+	// MySQL assigns left to right, so locked_until is decided on before failed_attempts is incremented
+	_, err := m.db.Exec("UPDATE totp_authenticators SET locked_until = CASE WHEN failed_attempts + 1 >= ? THEN ? ELSE locked_until END, "+
+		"failed_attempts = failed_attempts + 1 WHERE iin = ?", maxAttempts, lockedUntil, IIN)
+	return err
+}
+
+// DeleteTOTP deletes authenticator of IIN
+func (m *mySQLDBInterface) DeleteTOTP(IIN string) error {
+	_, err := m.db.Exec("DELETE FROM totp_authenticators WHERE iin = ?", IIN)
+	return err
+}
+
+// InsertTransferConfirmation stores confirmation of a transfer
+func (m *mySQLDBInterface) InsertTransferConfirmation(c domain.TransferConfirmation) error {
+	_, err := m.db.Exec("INSERT INTO transfer_confirmations(token_hash, iin, from_acc, to_acc, amount, currency, expires_at) VALUES(?,?,?,?,?,?,?)",
+		c.Hash, c.IIN, c.From, c.To, c.Amount.Amount, c.Amount.Currency, c.ExpiresAt)
+	return err
+}
+
+// GetTransferConfirmation retrieves confirmation with hash that is not used and not expired by now
+func (m *mySQLDBInterface) GetTransferConfirmation(hash string, now time.Time) (*domain.TransferConfirmation, error) {
+	c := domain.TransferConfirmation{Hash: hash}
+	var amount int64
+	var currency, expiresAt string
+	err := m.db.QueryRow("SELECT iin, from_acc, to_acc, amount, currency, expires_at FROM transfer_confirmations WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?", hash, now).
+		Scan(&c.IIN, &c.From, &c.To, &amount, &currency, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, myerrors.ErrInvalidConfirmation
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.Amount = domain.NewMoney(amount, currency)
+	if c.ExpiresAt, err = time.Parse(tsLayout, expiresAt); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// useTransferConfirmation uses up confirmation with hash within tx, if there is one. Of two transactions using the
+// same confirmation only one gets it, the other fails with ErrInvalidConfirmation
+func useTransferConfirmation(tx *sql.Tx, hash string) error {
+	if hash == "" {
+		return nil
+	}
+	now := time.Now()
+	res, err := tx.Exec("UPDATE transfer_confirmations SET used_at = ? WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?", now, hash, now)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return myerrors.ErrInvalidConfirmation
+	}
+	return nil
+}
+
+// insertOutbox writes events to the outbox within tx, they are published by the relay once tx is committed
+func insertOutbox(tx *sql.Tx, events ...domain.Event) error {
+	for _, e := range events {
+		if _, err := tx.Exec("INSERT INTO outbox(event_id, event_type, payload) VALUES(?,?,?)", e.ID, e.Type, e.Payload()); err != nil {
+			log.Println("ERROR|Inserting outbox event:", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// moveMoney debits from and credits to wallets, the funding account has no wallet to update
+func moveMoney(tx *sql.Tx, from, to string, conv domain.Conversion) error {
+	if from != domain.FundingAccount {
+		if _, err := tx.Exec(`UPDATE wallets SET amount = amount - ? WHERE accountno = ?`, conv.Debit.Amount, from); err != nil {
+			return err
+		}
+	}
+	if to != domain.FundingAccount {
+		if _, err := tx.Exec(`UPDATE wallets SET amount = amount + ? WHERE accountno = ?`, conv.Credit.Amount, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertTransaction inserts transaction row of conversion from debit to credit account with step-up decision stepUp
+func insertTransaction(tx *sql.Tx, transferType, debit, credit string, conv domain.Conversion, stepUp string) (sql.Result, error) {
+	return tx.Exec(`INSERT INTO transactions(transfer_type,from_acc,to_acc,amount,currency,to_amount,to_currency,fx_rate,step_up) VALUES(?,?,?,?,?,?,?,?,?)`,
+		transferType, debit, credit, conv.Debit.Amount, conv.Debit.Currency, conv.Credit.Amount, conv.Credit.Currency, conv.Rate, stepUp)
+}
+
+// insertPostings writes balanced ledger entries of conversion for transaction row inserted by res
+func insertPostings(tx *sql.Tx, res sql.Result, debit, credit string, conv domain.Conversion) error {
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	postings := conv.Postings(debit, credit)
+	values := make([]string, 0, len(postings))
+	args := make([]interface{}, 0, 4*len(postings))
+	for _, posting := range postings {
+		values = append(values, "(?,?,?,?)")
+		args = append(args, id, posting.AccountNo, posting.Amount, posting.Currency)
+	}
+	_, err = tx.Exec("INSERT INTO postings(transaction_id, accountno, amount, currency) VALUES"+strings.Join(values, ","), args...)
+	return err
+}
+
+// GetTrialBalance sums up postings per currency and reports unbalanced transactions and wallets whose balance differs from their postings
+func (m *mySQLDBInterface) GetTrialBalance() (*domain.TrialBalance, error) {
+	tb := domain.TrialBalance{Totals: make(map[string]int64)}
+	totalRows, err := m.db.Query("SELECT currency, SUM(amount), COUNT(*) FROM postings GROUP BY currency")
+	if err != nil {
+		return nil, err
+	}
+	defer totalRows.Close()
+	balanced := true
+	for totalRows.Next() {
+		var currency string
+		var total int64
+		var count int
+		if err := totalRows.Scan(&currency, &total, &count); err != nil {
+			return nil, err
+		}
+		tb.Totals[currency] = total
+		tb.Postings += count
+		balanced = balanced && total == 0
+	}
+	if err = totalRows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err := m.db.Query("SELECT DISTINCT transaction_id FROM (SELECT transaction_id FROM postings GROUP BY transaction_id, currency HAVING SUM(amount) <> 0) AS unbalanced")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		tb.Unbalanced = append(tb.Unbalanced, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	walletRows, err := m.db.Query("SELECT w.accountno FROM wallets w LEFT JOIN postings p ON p.accountno = w.accountno GROUP BY w.accountno, w.amount HAVING w.amount <> COALESCE(SUM(p.amount), 0)")
+	if err != nil {
+		return nil, err
+	}
+	defer walletRows.Close()
+	for walletRows.Next() {
+		var account string
+		if err := walletRows.Scan(&account); err != nil {
+			return nil, err
+		}
+		tb.Mismatched = append(tb.Mismatched, account)
+	}
+	if err = walletRows.Err(); err != nil {
+		return nil, err
+	}
+
+	tb.Balanced = balanced && len(tb.Unbalanced) == 0 && len(tb.Mismatched) == 0
+	return &tb, nil
+}
+
+// lockWallets locks given wallets with SELECT ... FOR UPDATE in ascending account order and returns their available
+// balances, that is ledger balance less active holds
+func lockWallets(tx *sql.Tx, accounts ...string) (map[string]domain.Money, error) {
+	sorted := append([]string(nil), accounts...)
+	sort.Strings(sorted)
+	balances := make(map[string]domain.Money, len(sorted))
+	for _, account := range sorted {
+		if _, ok := balances[account]; ok {
+			continue
+		}
+		var amount int64
+		var currency string
+		err := tx.QueryRow("SELECT w.amount - "+heldSQL+", w.currency FROM wallets w WHERE w.accountno = ? FOR UPDATE", time.Now(), account).Scan(&amount, &currency)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, myerrors.ErrWalletNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		balances[account] = domain.NewMoney(amount, currency)
+	}
+	return balances, nil
+}
+
+// isRetryable reports whether transaction failed on deadlock or lock wait timeout and may be retried
+func isRetryable(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && (mysqlErr.Number == 1213 || mysqlErr.Number == 1205)
+}
+
+// GetIdempotencyKey retrieves a non-expired idempotency key of the user, nil if there is none
+func (m *mySQLDBInterface) GetIdempotencyKey(IIN, key string) (*domain.IdempotencyKey, error) {
+	var idem domain.IdempotencyKey
+	err := m.db.QueryRow("SELECT idem_key, iin, request_hash, response, transaction_id FROM idempotency_keys WHERE iin = ? AND idem_key = ? AND expires_at > ?", IIN, key, time.Now()).
+		Scan(&idem.Key, &idem.IIN, &idem.RequestHash, &idem.Response, &idem.TransactionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &idem, nil
+}
+
+// replayIdempotencyKey answers request whose key failed to save with err as a replay when the same request stored it
+// concurrently, loading the stored key into key. Requests with another payload keep failing on the conflict
+func (m *mySQLDBInterface) replayIdempotencyKey(key *domain.IdempotencyKey, err error) error {
+	if err != myerrors.ErrIdempotencyConflict {
+		return err
+	}
+	stored, err := m.GetIdempotencyKey(key.IIN, key.Key)
+	if err != nil {
+		return err
+	}
+	if stored == nil || stored.RequestHash != key.RequestHash {
+		return myerrors.ErrIdempotencyConflict
+	}
+	log.Printf("INFO|Replaying request with idempotency key %s stored concurrently by transaction %d\n", stored.Key, stored.TransactionID)
+	*key = *stored
+	return nil
+}
+
+// saveIdempotencyKey links idempotency key to the transaction row inserted by res, replacing an expired key if present
+func saveIdempotencyKey(tx *sql.Tx, res sql.Result, key *domain.IdempotencyKey) error {
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	key.TransactionID = int(id)
+	if _, err := tx.Exec("DELETE FROM idempotency_keys WHERE iin = ? AND idem_key = ? AND expires_at <= ?", key.IIN, key.Key, time.Now()); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO idempotency_keys(iin, idem_key, request_hash, response, transaction_id, expires_at) VALUES(?,?,?,?,?,?)",
+		key.IIN, key.Key, key.RequestHash, key.Response, key.TransactionID, key.ExpiresAt)
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+		// same key was stored concurrently by another request
+		return myerrors.ErrIdempotencyConflict
+	}
+	return err
+}
+
+// GetWallet retrieves wallet by account number
+func (m *mySQLDBInterface) GetWallet(account string) (*domain.Wallet, error) {
+	var wallet domain.Wallet
+	var amount, held int64
+	var currency string
+	err := m.db.QueryRow("SELECT w.accountno, w.id, w.iin, w.ts, w.updated_at, w.amount, w.currency, "+heldSQL+" FROM wallets w WHERE w.accountno = ?", time.Now(), account).
+		Scan(&wallet.AccountNo, &wallet.ID, &wallet.IIN, &wallet.Ts, &wallet.UpdatedAt, &amount, &currency, &held)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, myerrors.ErrWalletNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	wallet.Ledger = domain.NewMoney(amount, currency)
+	wallet.Available = domain.NewMoney(amount-held, currency)
+	return &wallet, nil
 }
 
 // GetWalletList gets all accounts under requested user and returns them in he form of string slice
@@ -4,9 +4,12 @@ import (
 	"database/sql"
 	"log"
 	"testing"
+	"time"
 	"wallet/domain"
+	"wallet/myerrors"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -16,10 +19,15 @@ var w = &domain.Wallet{
 	UpdatedAt: "",
 	AccountNo: "KZT0000000001",
 	IIN:       "910815450350",
-	Transfer:  0,
-	Amount:    0,
+	Ledger:    domain.NewMoney(0, domain.DefaultCurrency),
+	Available: domain.NewMoney(0, domain.DefaultCurrency),
 }
 
+// outbox is the insert of an event, whose ID and payload are not known up front
+const outbox = "INSERT INTO outbox(event_id, event_type, payload) VALUES(?,?,?)"
+
+const lock = "SELECT w.amount - " + heldSQL + ", w.currency FROM wallets w WHERE w.accountno = ? FOR UPDATE"
+
 func NewMock() (*sql.DB, sqlmock.Sqlmock) {
 	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
 	if err != nil {
@@ -74,15 +82,18 @@ func TestInsertWallet(t *testing.T) {
 	db, mock := NewMock()
 	defer db.Close()
 	repo := &mySQLDBInterface{db}
-	db.Begin()
 
-	query := "insert into wallets (accountno, iin) values(?, ?)"
+	query := "insert into wallets (accountno, iin, currency) values(?, ?, ?)"
 
+	mock.ExpectBegin()
 	prep := mock.ExpectPrepare(query)
-	prep.ExpectExec().WithArgs(w.AccountNo, w.IIN).WillReturnResult(sqlmock.NewResult(0, 1))
+	prep.ExpectExec().WithArgs(w.AccountNo, w.IIN, w.Ledger.Currency).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventWalletCreated, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
 
-	err := repo.InsertWallet(w.AccountNo, w.IIN)
+	err := repo.InsertWallet(w.AccountNo, w.IIN, w.Ledger.Currency)
 	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
 }
 
 func TestInsertWalletErr(t *testing.T) {
@@ -92,12 +103,12 @@ func TestInsertWalletErr(t *testing.T) {
 	repo := &mySQLDBInterface{db}
 	db.Begin()
 
-	query := "insert into wallets (accountno, iin) values(?, ?)"
+	query := "insert into wallets (accountno, iin, currency) values(?, ?, ?)"
 
 	prep := mock.ExpectPrepare(query)
-	prep.ExpectExec().WithArgs(w.AccountNo, w.IIN).WillReturnResult(sqlmock.NewResult(0, 1))
+	prep.ExpectExec().WithArgs(w.AccountNo, w.IIN, w.Ledger.Currency).WillReturnResult(sqlmock.NewResult(0, 1))
 
-	err := repo.InsertWallet(w.AccountNo, w.IIN)
+	err := repo.InsertWallet(w.AccountNo, w.IIN, w.Ledger.Currency)
 	assert.Error(t, err)
 }
 
@@ -106,29 +117,49 @@ func TestGetWallets(t *testing.T) {
 	defer db.Close()
 	repo := &mySQLDBInterface{db}
 
-	query := "SELECT accountno, id, ts, updated_at, amount FROM wallets WHERE iin = ?"
+	query := "SELECT w.accountno, w.id, w.ts, w.updated_at, w.amount, w.currency, " + heldSQL + " FROM wallets w WHERE w.iin = ?"
 
-	rows := sqlmock.NewRows([]string{"accountno", "id", "ts", "updated_at", "amount"}).
-		AddRow(w.AccountNo, w.ID, w.Ts, w.UpdatedAt, w.Amount)
+	rows := sqlmock.NewRows([]string{"accountno", "id", "ts", "updated_at", "amount", "currency", "held"}).
+		AddRow(w.AccountNo, w.ID, w.Ts, w.UpdatedAt, w.Ledger.Amount, w.Ledger.Currency, 0)
 
-	mock.ExpectQuery(query).WithArgs(w.IIN).WillReturnRows(rows)
+	mock.ExpectQuery(query).WithArgs(sqlmock.AnyArg(), w.IIN).WillReturnRows(rows)
 	wallets, err := repo.GetWallets(w.IIN)
 	assert.NotNil(t, wallets)
 	assert.NoError(t, err)
 }
 
+func TestGetWallet(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+
+	query := "SELECT w.accountno, w.id, w.iin, w.ts, w.updated_at, w.amount, w.currency, " + heldSQL + " FROM wallets w WHERE w.accountno = ?"
+
+	rows := sqlmock.NewRows([]string{"accountno", "id", "iin", "ts", "updated_at", "amount", "currency", "held"}).
+		AddRow(w.AccountNo, w.ID, w.IIN, w.Ts, w.UpdatedAt, 100, w.Ledger.Currency, 40)
+	mock.ExpectQuery(query).WithArgs(sqlmock.AnyArg(), w.AccountNo).WillReturnRows(rows)
+	mock.ExpectQuery(query).WithArgs(sqlmock.AnyArg(), "KZT0000000009").WillReturnError(sql.ErrNoRows)
+
+	wallet, err := repo.GetWallet(w.AccountNo)
+	assert.NoError(t, err)
+	assert.Equal(t, &domain.Wallet{ID: w.ID, Ts: w.Ts, UpdatedAt: w.UpdatedAt, AccountNo: w.AccountNo, IIN: w.IIN, Ledger: domain.NewMoney(100, "KZT"), Available: domain.NewMoney(60, "KZT")}, wallet)
+	_, err = repo.GetWallet("KZT0000000009")
+	assert.Equal(t, myerrors.ErrWalletNotFound, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestGetWalletsErr(t *testing.T) {
 	//closed DB
 	db, mock := NewMock()
 	db.Close()
 	repo := &mySQLDBInterface{db}
 
-	query := "SELECT accountno, id, ts, updated_at, amount FROM wallets WHERE iin = ?"
+	query := "SELECT w.accountno, w.id, w.ts, w.updated_at, w.amount, w.currency, " + heldSQL + " FROM wallets w WHERE w.iin = ?"
 
-	rows := sqlmock.NewRows([]string{"accountno", "id", "ts", "updated_at", "amount"}).
-		AddRow(w.AccountNo, w.ID, w.Ts, w.UpdatedAt, w.Amount)
+	rows := sqlmock.NewRows([]string{"accountno", "id", "ts", "updated_at", "amount", "currency", "held"}).
+		AddRow(w.AccountNo, w.ID, w.Ts, w.UpdatedAt, w.Ledger.Amount, w.Ledger.Currency, 0)
 
-	mock.ExpectQuery(query).WithArgs(w.IIN).WillReturnRows(rows)
+	mock.ExpectQuery(query).WithArgs(sqlmock.AnyArg(), w.IIN).WillReturnRows(rows)
 	wallets, err := repo.GetWallets(w.IIN)
 	assert.Nil(t, wallets)
 	assert.Error(t, err)
@@ -139,10 +170,10 @@ func TestGetAmount(t *testing.T) {
 	defer db.Close()
 	repo := &mySQLDBInterface{db}
 
-	query := "SELECT amount FROM wallets WHERE accountno = ?"
+	query := "SELECT amount, currency FROM wallets WHERE accountno = ?"
 
-	rows := sqlmock.NewRows([]string{"amount"}).
-		AddRow(w.Amount)
+	rows := sqlmock.NewRows([]string{"amount", "currency"}).
+		AddRow(w.Ledger.Amount, w.Ledger.Currency)
 
 	mock.ExpectQuery(query).WithArgs(w.AccountNo).WillReturnRows(rows)
 	amt, err := repo.GetAmount(w.AccountNo)
@@ -156,15 +187,15 @@ func TestGetAmountErr(t *testing.T) {
 	db.Close()
 	repo := &mySQLDBInterface{db}
 
-	query := "SELECT amount FROM wallets WHERE accountno = ?"
+	query := "SELECT amount, currency FROM wallets WHERE accountno = ?"
 
-	rows := sqlmock.NewRows([]string{"amount"}).
-		AddRow(w.Amount)
+	rows := sqlmock.NewRows([]string{"amount", "currency"}).
+		AddRow(w.Ledger.Amount, w.Ledger.Currency)
 
 	mock.ExpectQuery(query).WithArgs(w.AccountNo).WillReturnRows(rows)
 	amt, err := repo.GetAmount(w.AccountNo)
-	if amt != "" {
-		t.Errorf("Expected empty string, but got %s", amt)
+	if amt != (domain.Money{}) {
+		t.Errorf("Expected zero money, but got %s", amt)
 	}
 	assert.Error(t, err)
 }
@@ -250,7 +281,21 @@ var transaction = domain.Transaction{
 	Type:   "topup",
 	From:   "KZT0000000001",
 	To:     "KZT0000000002",
-	Amount: 123,
+	Amount: domain.NewMoney(123, domain.DefaultCurrency),
+}
+
+func TestGetBalanceAt(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+
+	query := "SELECT w.currency, COALESCE((SELECT SUM(p.amount) FROM postings p JOIN transactions t ON t.id = p.transaction_id WHERE p.accountno = w.accountno AND t.ts < ?), 0) FROM wallets w WHERE w.accountno = ?"
+	at := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery(query).WithArgs(at, "KZT0000000001").WillReturnRows(sqlmock.NewRows([]string{"currency", "amount"}).AddRow("KZT", 12345))
+	balance, err := repo.GetBalanceAt("KZT0000000001", at)
+	assert.NoError(t, err)
+	assert.Equal(t, domain.NewMoney(12345, "KZT"), balance)
 }
 
 func TestGetTransactions(t *testing.T) {
@@ -258,25 +303,902 @@ func TestGetTransactions(t *testing.T) {
 	defer db.Close()
 	repo := &mySQLDBInterface{db}
 
-	query := "SELECT * FROM transactions WHERE from_acc = ? OR to_acc = ?"
+	query := "SELECT id, ts, transfer_type, from_acc, to_acc, amount, currency, to_amount, to_currency, fx_rate, reverses_id, step_up FROM transactions WHERE (from_acc = ? OR to_acc = ?) ORDER BY id ASC"
 
-	rows := sqlmock.NewRows([]string{"id", "ts", "type", "from", "to", "amount"}).
-		AddRow(transaction.ID, transaction.Ts, transaction.Type, transaction.From, transaction.To, transaction.Amount)
+	rows := sqlmock.NewRows([]string{"id", "ts", "type", "from", "to", "amount", "currency", "to_amount", "to_currency", "fx_rate", "reverses_id", "step_up"}).
+		AddRow(transaction.ID, transaction.Ts, transaction.Type, transaction.From, transaction.To, transaction.Amount.Amount, "USD", 57841, "KZT", "470.25", nil, domain.StepUpTOTP).
+		AddRow(2, transaction.Ts, domain.ReversalType, transaction.To, transaction.From, 57841, "KZT", 123, "USD", "470.25", 1, "")
 
 	mock.ExpectQuery(query).WithArgs("KZT0000000001", "KZT0000000001").WillReturnRows(rows)
-	txs, err := repo.GetTransactions("KZT0000000001")
-	assert.NotNil(t, txs)
+	txs, err := repo.GetTransactions(domain.TransactionFilter{Account: "KZT0000000001"})
 	assert.NoError(t, err)
+	if assert.Len(t, txs, 2) {
+		assert.Equal(t, domain.NewMoney(123, "USD"), txs[0].Amount)
+		assert.Equal(t, domain.NewMoney(57841, "KZT"), txs[0].Credited)
+		assert.Equal(t, "470.25", txs[0].Rate)
+		assert.Zero(t, txs[0].ReversesID)
+		assert.Equal(t, domain.StepUpTOTP, txs[0].StepUp)
+		assert.Equal(t, 1, txs[1].ReversesID)
+	}
 }
 
-func TestZeroStatusErr(t *testing.T) {
+func TestGetTransactionsFiltered(t *testing.T) {
 	db, mock := NewMock()
 	defer db.Close()
 	repo := &mySQLDBInterface{db}
-	query := "UPDATE wallets SET transfer=0 WHERE accountno=? OR accountno=?"
 
-	mock.ExpectExec(query).WithArgs("KZT0000000001", "KZT0000000002").WillReturnResult(sqlmock.NewResult(0, 1))
+	query := "SELECT id, ts, transfer_type, from_acc, to_acc, amount, currency, to_amount, to_currency, fx_rate, reverses_id, step_up FROM transactions WHERE from_acc = ? AND transfer_type = ? AND ts >= ? AND ts < ? AND ((from_acc = ? AND to_acc = ?) OR (to_acc = ? AND from_acc = ?)) AND (CASE WHEN from_acc = ? THEN amount ELSE to_amount END) >= ? AND (CASE WHEN from_acc = ? THEN amount ELSE to_amount END) <= ? AND id < ? ORDER BY id DESC LIMIT ?"
+	since := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	until := since.AddDate(0, 1, 0)
+	min, max := int64(100), int64(500)
+
+	mock.ExpectQuery(query).
+		WithArgs("KZT0000000001", "transfer", since, until, "KZT0000000001", "KZT0000000002", "KZT0000000001", "KZT0000000002", "KZT0000000001", min, "KZT0000000001", max, 42, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "ts", "type", "from", "to", "amount", "currency", "to_amount", "to_currency", "fx_rate", "reverses_id", "step_up"}))
+	txs, err := repo.GetTransactions(domain.TransactionFilter{
+		Account:      "KZT0000000001",
+		Since:        since,
+		Until:        until,
+		Type:         "transfer",
+		Direction:    domain.DirectionOut,
+		Counterparty: "KZT0000000002",
+		MinAmount:    &min,
+		MaxAmount:    &max,
+		Cursor:       42,
+		Limit:        10,
+		Desc:         true,
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, txs)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
 
-	err := repo.SetZeroStatus("KZT0000000001", "KZT0000000002")
-	assert.Error(t, err)
+func TestTransferLocksInAccountOrder(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+
+	// wallets are locked in ascending order regardless of transfer direction
+	mock.ExpectBegin()
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000001").WillReturnRows(sqlmock.NewRows([]string{"amount", "currency"}).AddRow(10, "KZT"))
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000002").WillReturnRows(sqlmock.NewRows([]string{"amount", "currency"}).AddRow(500, "KZT"))
+	mock.ExpectExec("UPDATE wallets SET amount = amount - ? WHERE accountno = ?").WithArgs(123, "KZT0000000002").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE wallets SET amount = amount + ? WHERE accountno = ?").WithArgs(123, "KZT0000000001").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO transactions(transfer_type,from_acc,to_acc,amount,currency,to_amount,to_currency,fx_rate,step_up) VALUES(?,?,?,?,?,?,?,?,?)").
+		WithArgs("transfer", "KZT0000000002", "KZT0000000001", 123, "KZT", 123, "KZT", "", domain.StepUpNotRequired).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO postings(transaction_id, accountno, amount, currency) VALUES(?,?,?,?),(?,?,?,?)").
+		WithArgs(1, "KZT0000000002", -123, "KZT", 1, "KZT0000000001", 123, "KZT").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventTransferSent, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventTransferReceived, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	conv := domain.NewConversion(domain.NewMoney(123, domain.DefaultCurrency))
+	transfer, err := repo.Transfer("KZT0000000002", "KZT0000000001", conv, nil, domain.StepUp{Decision: domain.StepUpNotRequired})
+	assert.NoError(t, err)
+	assert.Equal(t, &domain.Transaction{ID: 1, Type: "transfer", From: "KZT0000000002", To: "KZT0000000001", Amount: conv.Debit,
+		Credited: conv.Credit, StepUp: domain.StepUpNotRequired}, transfer)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTransferInsufficientFunds(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000001").WillReturnRows(sqlmock.NewRows([]string{"amount", "currency"}).AddRow(100, "KZT"))
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000002").WillReturnRows(sqlmock.NewRows([]string{"amount", "currency"}).AddRow(0, "KZT"))
+	mock.ExpectRollback()
+
+	_, err := repo.Transfer("KZT0000000001", "KZT0000000002", domain.NewConversion(domain.NewMoney(123, domain.DefaultCurrency)), nil, domain.StepUp{Decision: domain.StepUpNotRequired})
+	assert.Equal(t, myerrors.ErrInsufficientFunds, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	_, err = repo.Transfer("KZT0000000001", "KZT0000000002", domain.NewConversion(domain.NewMoney(-123, domain.DefaultCurrency)), nil, domain.StepUp{Decision: domain.StepUpNotRequired})
+	assert.Equal(t, myerrors.ErrInvalidAmt, err)
+}
+
+func TestTransferRetriesDeadlock(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+	deadlock := &mysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000001").WillReturnError(deadlock)
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000001").WillReturnRows(sqlmock.NewRows([]string{"amount", "currency"}).AddRow(500, "KZT"))
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000002").WillReturnRows(sqlmock.NewRows([]string{"amount", "currency"}).AddRow(0, "KZT"))
+	mock.ExpectExec("UPDATE wallets SET amount = amount - ? WHERE accountno = ?").WithArgs(123, "KZT0000000001").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE wallets SET amount = amount + ? WHERE accountno = ?").WithArgs(123, "KZT0000000002").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO transactions(transfer_type,from_acc,to_acc,amount,currency,to_amount,to_currency,fx_rate,step_up) VALUES(?,?,?,?,?,?,?,?,?)").
+		WithArgs("transfer", "KZT0000000001", "KZT0000000002", 123, "KZT", 123, "KZT", "", domain.StepUpNotRequired).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO postings(transaction_id, accountno, amount, currency) VALUES(?,?,?,?),(?,?,?,?)").
+		WithArgs(1, "KZT0000000001", -123, "KZT", 1, "KZT0000000002", 123, "KZT").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventTransferSent, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventTransferReceived, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	_, err := repo.Transfer("KZT0000000001", "KZT0000000002", domain.NewConversion(domain.NewMoney(123, domain.DefaultCurrency)), nil, domain.StepUp{Decision: domain.StepUpNotRequired})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTransferRetriesDeadlockOnUpdate(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+	key := idem
+	deadlock := &mysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"}
+	expectLocks := func() {
+		mock.ExpectBegin()
+		mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000001").WillReturnRows(sqlmock.NewRows([]string{"amount", "currency"}).AddRow(500, "KZT"))
+		mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000002").WillReturnRows(sqlmock.NewRows([]string{"amount", "currency"}).AddRow(0, "KZT"))
+	}
+
+	// the first attempt is picked as deadlock victim after locking, the retry moves money and stores the key once
+	expectLocks()
+	mock.ExpectExec("UPDATE wallets SET amount = amount - ? WHERE accountno = ?").WithArgs(123, "KZT0000000001").WillReturnError(deadlock)
+	mock.ExpectRollback()
+	expectLocks()
+	mock.ExpectExec("UPDATE wallets SET amount = amount - ? WHERE accountno = ?").WithArgs(123, "KZT0000000001").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE wallets SET amount = amount + ? WHERE accountno = ?").WithArgs(123, "KZT0000000002").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO transactions(transfer_type,from_acc,to_acc,amount,currency,to_amount,to_currency,fx_rate,step_up) VALUES(?,?,?,?,?,?,?,?,?)").
+		WithArgs("transfer", "KZT0000000001", "KZT0000000002", 123, "KZT", 123, "KZT", "", domain.StepUpNotRequired).WillReturnResult(sqlmock.NewResult(4, 1))
+	mock.ExpectExec("INSERT INTO postings(transaction_id, accountno, amount, currency) VALUES(?,?,?,?),(?,?,?,?)").
+		WithArgs(4, "KZT0000000001", -123, "KZT", 4, "KZT0000000002", 123, "KZT").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventTransferSent, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventTransferReceived, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM idempotency_keys WHERE iin = ? AND idem_key = ? AND expires_at <= ?").
+		WithArgs(key.IIN, key.Key, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO idempotency_keys(iin, idem_key, request_hash, response, transaction_id, expires_at) VALUES(?,?,?,?,?,?)").
+		WithArgs(key.IIN, key.Key, key.RequestHash, sqlmock.AnyArg(), 4, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	transfer, err := repo.Transfer("KZT0000000001", "KZT0000000002", domain.NewConversion(domain.NewMoney(123, domain.DefaultCurrency)), &key, domain.StepUp{Decision: domain.StepUpNotRequired})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, key.TransactionID)
+	if assert.NotNil(t, transfer) {
+		assert.Equal(t, 4, transfer.ID)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTransferDeadlockAttemptsExhausted(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+	timeout := &mysql.MySQLError{Number: 1205, Message: "Lock wait timeout exceeded; try restarting transaction"}
+
+	for attempt := 0; attempt < maxTransferAttempts; attempt++ {
+		mock.ExpectBegin()
+		mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000001").WillReturnError(timeout)
+		mock.ExpectRollback()
+	}
+
+	_, err := repo.Transfer("KZT0000000001", "KZT0000000002", domain.NewConversion(domain.NewMoney(123, domain.DefaultCurrency)), nil, domain.StepUp{Decision: domain.StepUpNotRequired})
+	assert.Equal(t, timeout, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTransferCrossCurrency(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+	conv := domain.Conversion{Debit: domain.NewMoney(1000, "USD"), Credit: domain.NewMoney(470250, "KZT"), Rate: "470.25"}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000002").WillReturnRows(sqlmock.NewRows([]string{"amount", "currency"}).AddRow(0, "KZT"))
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "USD0000000001").WillReturnRows(sqlmock.NewRows([]string{"amount", "currency"}).AddRow(5000, "USD"))
+	mock.ExpectExec("UPDATE wallets SET amount = amount - ? WHERE accountno = ?").WithArgs(1000, "USD0000000001").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE wallets SET amount = amount + ? WHERE accountno = ?").WithArgs(470250, "KZT0000000002").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO transactions(transfer_type,from_acc,to_acc,amount,currency,to_amount,to_currency,fx_rate,step_up) VALUES(?,?,?,?,?,?,?,?,?)").
+		WithArgs("transfer", "USD0000000001", "KZT0000000002", 1000, "USD", 470250, "KZT", "470.25", domain.StepUpNotRequired).WillReturnResult(sqlmock.NewResult(3, 1))
+	mock.ExpectExec("INSERT INTO postings(transaction_id, accountno, amount, currency) VALUES(?,?,?,?),(?,?,?,?),(?,?,?,?),(?,?,?,?)").
+		WithArgs(3, "USD0000000001", -1000, "USD", 3, "SYSTEM_FX_USD", 1000, "USD", 3, "SYSTEM_FX_KZT", -470250, "KZT", 3, "KZT0000000002", 470250, "KZT").
+		WillReturnResult(sqlmock.NewResult(0, 4))
+	mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventTransferSent, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventTransferReceived, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	_, err := repo.Transfer("USD0000000001", "KZT0000000002", conv, nil, domain.StepUp{Decision: domain.StepUpNotRequired})
+	assert.NoError(t, err)
+
+	// credit currency has to match the receiving wallet
+	mock.ExpectBegin()
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000002").WillReturnRows(sqlmock.NewRows([]string{"amount", "currency"}).AddRow(0, "KZT"))
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "USD0000000001").WillReturnRows(sqlmock.NewRows([]string{"amount", "currency"}).AddRow(4000, "USD"))
+	mock.ExpectRollback()
+
+	_, err = repo.Transfer("USD0000000001", "KZT0000000002", domain.NewConversion(domain.NewMoney(1000, "USD")), nil, domain.StepUp{Decision: domain.StepUpNotRequired})
+	assert.Equal(t, myerrors.ErrCurrencyMismatch, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+var idem = domain.IdempotencyKey{
+	Key:         "2f1c7a52",
+	IIN:         "910815450350",
+	RequestHash: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+}
+
+func TestGetIdempotencyKey(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+
+	query := "SELECT idem_key, iin, request_hash, response, transaction_id FROM idempotency_keys WHERE iin = ? AND idem_key = ? AND expires_at > ?"
+
+	rows := sqlmock.NewRows([]string{"idem_key", "iin", "request_hash", "response", "transaction_id"}).
+		AddRow(idem.Key, idem.IIN, idem.RequestHash, `{"amount":"1.00","currency":"KZT"}`, 7)
+
+	mock.ExpectQuery(query).WithArgs(idem.IIN, idem.Key, sqlmock.AnyArg()).WillReturnRows(rows)
+	key, err := repo.GetIdempotencyKey(idem.IIN, idem.Key)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, key.TransactionID)
+	assert.Equal(t, `{"amount":"1.00","currency":"KZT"}`, key.Response)
+
+	// expired or unknown key
+	mock.ExpectQuery(query).WithArgs(idem.IIN, idem.Key, sqlmock.AnyArg()).WillReturnError(sql.ErrNoRows)
+	key, err = repo.GetIdempotencyKey(idem.IIN, idem.Key)
+	assert.NoError(t, err)
+	assert.Nil(t, key)
+}
+
+func TestTopUpIdempotent(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+	key := idem
+
+	mock.ExpectBegin()
+	mock.ExpectPrepare("UPDATE wallets SET amount = amount + ? WHERE accountno = ? AND currency = ?").
+		ExpectExec().WithArgs(100, w.AccountNo, "KZT").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO transactions(transfer_type,from_acc,to_acc,amount,currency,to_amount,to_currency,fx_rate,step_up) VALUES(?,?,?,?,?,?,?,?,?)").
+		WithArgs("topup", domain.FundingAccount, w.AccountNo, 100, "KZT", 100, "KZT", "", "").WillReturnResult(sqlmock.NewResult(7, 1))
+	mock.ExpectExec("INSERT INTO postings(transaction_id, accountno, amount, currency) VALUES(?,?,?,?),(?,?,?,?)").
+		WithArgs(7, domain.FundingAccount, -100, "KZT", 7, w.AccountNo, 100, "KZT").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventWalletToppedUp, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT amount FROM wallets WHERE accountno = ?").WithArgs(w.AccountNo).
+		WillReturnRows(sqlmock.NewRows([]string{"amount"}).AddRow("100"))
+	mock.ExpectExec("DELETE FROM idempotency_keys WHERE iin = ? AND idem_key = ? AND expires_at <= ?").
+		WithArgs(key.IIN, key.Key, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO idempotency_keys(iin, idem_key, request_hash, response, transaction_id, expires_at) VALUES(?,?,?,?,?,?)").
+		WithArgs(key.IIN, key.Key, key.RequestHash, `{"amount":"1.00","currency":"KZT"}`, 7, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := repo.TopUp(w.AccountNo, domain.NewMoney(100, domain.DefaultCurrency), &key)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, key.TransactionID)
+	assert.Equal(t, `{"amount":"1.00","currency":"KZT"}`, key.Response)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTopUpIdempotentConcurrent(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+	columns := []string{"idem_key", "iin", "request_hash", "response", "transaction_id"}
+
+	// the same key is stored by a concurrent request before this one commits
+	expectTopUp := func() {
+		mock.ExpectBegin()
+		mock.ExpectPrepare("UPDATE wallets SET amount = amount + ? WHERE accountno = ? AND currency = ?").
+			ExpectExec().WithArgs(100, w.AccountNo, "KZT").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO transactions(transfer_type,from_acc,to_acc,amount,currency,to_amount,to_currency,fx_rate,step_up) VALUES(?,?,?,?,?,?,?,?,?)").
+			WithArgs("topup", domain.FundingAccount, w.AccountNo, 100, "KZT", 100, "KZT", "", "").WillReturnResult(sqlmock.NewResult(8, 1))
+		mock.ExpectExec("INSERT INTO postings(transaction_id, accountno, amount, currency) VALUES(?,?,?,?),(?,?,?,?)").
+			WithArgs(8, domain.FundingAccount, -100, "KZT", 8, w.AccountNo, 100, "KZT").WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventWalletToppedUp, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery("SELECT amount FROM wallets WHERE accountno = ?").WithArgs(w.AccountNo).
+			WillReturnRows(sqlmock.NewRows([]string{"amount"}).AddRow("200"))
+		mock.ExpectExec("DELETE FROM idempotency_keys WHERE iin = ? AND idem_key = ? AND expires_at <= ?").
+			WithArgs(idem.IIN, idem.Key, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("INSERT INTO idempotency_keys(iin, idem_key, request_hash, response, transaction_id, expires_at) VALUES(?,?,?,?,?,?)").
+			WithArgs(idem.IIN, idem.Key, sqlmock.AnyArg(), `{"amount":"2.00","currency":"KZT"}`, 8, sqlmock.AnyArg()).
+			WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry for key 'PRIMARY'"})
+		mock.ExpectRollback()
+	}
+
+	// same request is answered as a replay of the stored one
+	expectTopUp()
+	mock.ExpectQuery("SELECT idem_key, iin, request_hash, response, transaction_id FROM idempotency_keys WHERE iin = ? AND idem_key = ? AND expires_at > ?").
+		WithArgs(idem.IIN, idem.Key, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(idem.Key, idem.IIN, idem.RequestHash, `{"amount":"1.00","currency":"KZT"}`, 7))
+	key := idem
+	assert.NoError(t, repo.TopUp(w.AccountNo, domain.NewMoney(100, domain.DefaultCurrency), &key))
+	assert.Equal(t, 7, key.TransactionID)
+	assert.Equal(t, `{"amount":"1.00","currency":"KZT"}`, key.Response)
+
+	// another request with the same key conflicts
+	expectTopUp()
+	mock.ExpectQuery("SELECT idem_key, iin, request_hash, response, transaction_id FROM idempotency_keys WHERE iin = ? AND idem_key = ? AND expires_at > ?").
+		WithArgs(idem.IIN, idem.Key, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(idem.Key, idem.IIN, "other", `{"amount":"1.00","currency":"KZT"}`, 7))
+	key = idem
+	assert.Equal(t, myerrors.ErrIdempotencyConflict, repo.TopUp(w.AccountNo, domain.NewMoney(100, domain.DefaultCurrency), &key))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetTrialBalance(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+
+	mock.ExpectQuery("SELECT currency, SUM(amount), COUNT(*) FROM postings GROUP BY currency").
+		WillReturnRows(sqlmock.NewRows([]string{"currency", "total", "count"}).AddRow("KZT", 0, 4).AddRow("USD", 0, 2))
+	mock.ExpectQuery("SELECT DISTINCT transaction_id FROM (SELECT transaction_id FROM postings GROUP BY transaction_id, currency HAVING SUM(amount) <> 0) AS unbalanced").
+		WillReturnRows(sqlmock.NewRows([]string{"transaction_id"}))
+	mock.ExpectQuery("SELECT w.accountno FROM wallets w LEFT JOIN postings p ON p.accountno = w.accountno GROUP BY w.accountno, w.amount HAVING w.amount <> COALESCE(SUM(p.amount), 0)").
+		WillReturnRows(sqlmock.NewRows([]string{"accountno"}).AddRow(w.AccountNo))
+
+	tb, err := repo.GetTrialBalance()
+	assert.NoError(t, err)
+	assert.False(t, tb.Balanced, "a wallet whose balance differs from its postings leaves the ledger unbalanced")
+	assert.Equal(t, 6, tb.Postings)
+	assert.Equal(t, map[string]int64{"KZT": 0, "USD": 0}, tb.Totals)
+	assert.Equal(t, []string{w.AccountNo}, tb.Mismatched)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReverse(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+	selectTx := "SELECT id, transfer_type, from_acc, to_acc, amount, currency, to_amount, to_currency, fx_rate FROM transactions WHERE id = ? FOR UPDATE"
+	refunded := "SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE reverses_id = ?"
+	txColumns := []string{"id", "transfer_type", "from_acc", "to_acc", "amount", "currency", "to_amount", "to_currency", "fx_rate"}
+
+	// 0.50 of 1.23 was already refunded, the rest goes back from receiver to sender
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectTx).WithArgs(5).
+		WillReturnRows(sqlmock.NewRows(txColumns).AddRow(5, "transfer", "KZT0000000001", "KZT0000000002", 123, "KZT", 123, "KZT", ""))
+	mock.ExpectQuery(refunded).WithArgs(5).WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(50))
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000001").WillReturnRows(sqlmock.NewRows([]string{"amount", "currency"}).AddRow(0, "KZT"))
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000002").WillReturnRows(sqlmock.NewRows([]string{"amount", "currency"}).AddRow(100, "KZT"))
+	mock.ExpectExec("UPDATE wallets SET amount = amount - ? WHERE accountno = ?").WithArgs(73, "KZT0000000002").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE wallets SET amount = amount + ? WHERE accountno = ?").WithArgs(73, "KZT0000000001").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO transactions(transfer_type,from_acc,to_acc,amount,currency,to_amount,to_currency,fx_rate,reverses_id) VALUES(?,?,?,?,?,?,?,?,?)").
+		WithArgs(domain.ReversalType, "KZT0000000002", "KZT0000000001", 73, "KZT", 73, "KZT", "", 5).WillReturnResult(sqlmock.NewResult(6, 1))
+	mock.ExpectExec("INSERT INTO postings(transaction_id, accountno, amount, currency) VALUES(?,?,?,?),(?,?,?,?)").
+		WithArgs(6, "KZT0000000002", -73, "KZT", 6, "KZT0000000001", 73, "KZT").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventTransferSent, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventTransferReceived, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	reversal, err := repo.Reverse(5, nil)
+	assert.NoError(t, err)
+	if assert.NotNil(t, reversal) {
+		assert.Equal(t, 6, reversal.ID)
+		assert.Equal(t, 5, reversal.ReversesID)
+		assert.Equal(t, domain.NewMoney(73, "KZT"), reversal.Amount)
+	}
+
+	// receiver no longer holds the money
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectTx).WithArgs(5).
+		WillReturnRows(sqlmock.NewRows(txColumns).AddRow(5, "transfer", "KZT0000000001", "KZT0000000002", 123, "KZT", 123, "KZT", ""))
+	mock.ExpectQuery(refunded).WithArgs(5).WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(0))
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000001").WillReturnRows(sqlmock.NewRows([]string{"amount", "currency"}).AddRow(0, "KZT"))
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000002").WillReturnRows(sqlmock.NewRows([]string{"amount", "currency"}).AddRow(100, "KZT"))
+	mock.ExpectRollback()
+
+	_, err = repo.Reverse(5, nil)
+	assert.Equal(t, myerrors.ErrInsufficientFunds, err)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectTx).WithArgs(7).WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	_, err = repo.Reverse(7, nil)
+	assert.Equal(t, myerrors.ErrTxNotFound, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPlaceHold(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+	expiresAt := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// 1.00 of the 1.50 available is held
+	mock.ExpectBegin()
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000001").WillReturnRows(sqlmock.NewRows([]string{"available", "currency"}).AddRow(150, "KZT"))
+	mock.ExpectExec("INSERT INTO holds(accountno, payee, amount, currency, expires_at, step_up) VALUES(?,?,?,?,?,?)").
+		WithArgs("KZT0000000001", "KZT0000000002", 100, "KZT", expiresAt, domain.StepUpTOTP).WillReturnResult(sqlmock.NewResult(4, 1))
+	mock.ExpectCommit()
+
+	hold, err := repo.PlaceHold("KZT0000000001", "KZT0000000002", domain.NewMoney(100, "KZT"), expiresAt, domain.StepUp{Decision: domain.StepUpTOTP})
+	assert.NoError(t, err)
+	if assert.NotNil(t, hold) {
+		assert.Equal(t, 4, hold.ID)
+		assert.Equal(t, domain.HoldActive, hold.Status)
+		assert.Equal(t, "KZT0000000002", hold.Payee)
+		assert.Equal(t, domain.StepUpTOTP, hold.StepUp)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000001").WillReturnRows(sqlmock.NewRows([]string{"available", "currency"}).AddRow(50, "KZT"))
+	mock.ExpectRollback()
+
+	_, err = repo.PlaceHold("KZT0000000001", "KZT0000000002", domain.NewMoney(100, "KZT"), expiresAt, domain.StepUp{Decision: domain.StepUpNotRequired})
+	assert.Equal(t, myerrors.ErrInsufficientFunds, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCaptureHold(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+	selectHold := "SELECT " + holdColumns + " FROM holds WHERE id = ? FOR UPDATE"
+	holdRows := func(status, payee string) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "ts", "accountno", "payee", "amount", "currency", "captured", "status", "transaction_id", "expires_at", "step_up"}).
+			AddRow(4, "2021-12-31 19:36:36", "KZT0000000002", payee, 100, "KZT", 0, status, 0, "2030-01-01 00:00:00", domain.StepUpTOTP)
+	}
+
+	// 0.60 of the 1.00 held is captured into the payee with the step-up decision of the hold, the rest is released
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectHold).WithArgs(4).WillReturnRows(holdRows(domain.HoldActive, "KZT0000000001"))
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000001").WillReturnRows(sqlmock.NewRows([]string{"available", "currency"}).AddRow(0, "KZT"))
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000002").WillReturnRows(sqlmock.NewRows([]string{"available", "currency"}).AddRow(0, "KZT"))
+	mock.ExpectExec("UPDATE wallets SET amount = amount - ? WHERE accountno = ?").WithArgs(60, "KZT0000000002").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE wallets SET amount = amount + ? WHERE accountno = ?").WithArgs(60, "KZT0000000001").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO transactions(transfer_type,from_acc,to_acc,amount,currency,to_amount,to_currency,fx_rate,step_up) VALUES(?,?,?,?,?,?,?,?,?)").
+		WithArgs(domain.HoldType, "KZT0000000002", "KZT0000000001", 60, "KZT", 60, "KZT", "", domain.StepUpTOTP).WillReturnResult(sqlmock.NewResult(9, 1))
+	mock.ExpectExec("INSERT INTO postings(transaction_id, accountno, amount, currency) VALUES(?,?,?,?),(?,?,?,?)").
+		WithArgs(9, "KZT0000000002", -60, "KZT", 9, "KZT0000000001", 60, "KZT").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("UPDATE holds SET status = ?, captured = ?, transaction_id = ? WHERE id = ?").
+		WithArgs(domain.HoldCaptured, 60, 9, 4).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventTransferSent, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventTransferReceived, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	hold, err := repo.CaptureHold(4, domain.NewConversion(domain.NewMoney(60, "KZT")))
+	assert.NoError(t, err)
+	if assert.NotNil(t, hold) {
+		assert.Equal(t, domain.HoldCaptured, hold.Status)
+		assert.Equal(t, domain.NewMoney(60, "KZT"), hold.Captured)
+		assert.Equal(t, 9, hold.TransactionID)
+		assert.Equal(t, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), hold.ExpiresAt)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectHold).WithArgs(4).WillReturnRows(holdRows(domain.HoldActive, "KZT0000000001"))
+	mock.ExpectRollback()
+
+	_, err = repo.CaptureHold(4, domain.NewConversion(domain.NewMoney(101, "KZT")))
+	assert.Equal(t, myerrors.ErrCaptureTooLarge, err)
+
+	// holds placed before payees were recorded can't be captured
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectHold).WithArgs(4).WillReturnRows(holdRows(domain.HoldActive, ""))
+	mock.ExpectRollback()
+
+	_, err = repo.CaptureHold(4, domain.NewConversion(domain.NewMoney(60, "KZT")))
+	assert.Equal(t, myerrors.ErrHoldPayeeMismatch, err)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectHold).WithArgs(4).WillReturnRows(holdRows(domain.HoldReleased, "KZT0000000001"))
+	mock.ExpectRollback()
+
+	_, err = repo.CaptureHold(4, domain.NewConversion(domain.NewMoney(60, "KZT")))
+	assert.Equal(t, myerrors.ErrHoldNotActive, err)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectHold).WithArgs(5).WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	_, err = repo.CaptureHold(5, domain.NewConversion(domain.NewMoney(60, "KZT")))
+	assert.Equal(t, myerrors.ErrHoldNotFound, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestExpireHolds(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+	now := time.Now()
+
+	mock.ExpectExec("UPDATE holds SET status = ? WHERE status = ? AND expires_at <= ?").
+		WithArgs(domain.HoldExpired, domain.HoldActive, now).WillReturnResult(sqlmock.NewResult(0, 3))
+
+	expired, err := repo.ExpireHolds(now)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, expired)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetDueSchedules(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+	now := time.Now()
+
+	mock.ExpectQuery("SELECT "+scheduleColumns+" FROM schedules WHERE status = ? AND next_run <= ? ORDER BY next_run").WithArgs(domain.ScheduleActive, now).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "ts", "iin", "from_acc", "to_acc", "amount", "currency", "recurrence", "next_run", "status", "failures", "step_up"}).
+			AddRow(3, "2021-12-31 19:36:36", w.IIN, "KZT0000000001", "KZT0000000002", 15000000, "KZT", "0 9 1 * *", "2022-01-01 09:00:00", domain.ScheduleActive, 0, domain.StepUpTOTP))
+
+	schedules, err := repo.GetDueSchedules(now)
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Schedule{{ID: 3, Ts: "2021-12-31 19:36:36", IIN: w.IIN, From: "KZT0000000001", To: "KZT0000000002", Amount: domain.NewMoney(15000000, "KZT"),
+		Recurrence: "0 9 1 * *", NextRun: time.Date(2022, 1, 1, 9, 0, 0, 0, time.UTC), Status: domain.ScheduleActive, StepUp: domain.StepUpTOTP}}, schedules)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRecordScheduleRun(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+	s := domain.Schedule{ID: 3, NextRun: time.Date(2022, 2, 1, 9, 0, 0, 0, time.UTC), Status: domain.ScheduleActive}
+	run := domain.ScheduleRun{Ts: time.Date(2022, 1, 1, 9, 0, 5, 0, time.UTC), Outcome: domain.RunSucceeded}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE schedules SET next_run = ?, status = ?, failures = ? WHERE id = ? AND status = ?").
+		WithArgs(s.NextRun, domain.ScheduleActive, 0, 3, domain.ScheduleActive).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO schedule_runs(schedule_id, ts, outcome, error) VALUES(?,?,?,?)").
+		WithArgs(3, run.Ts, domain.RunSucceeded, "").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, repo.RecordScheduleRun(s, run))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCancelSchedule(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+	cancel := "UPDATE schedules SET status = ? WHERE id = ? AND status IN (?, ?)"
+	selectSchedule := "SELECT " + scheduleColumns + " FROM schedules WHERE id = ?"
+	scheduleRows := func(status string) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "ts", "iin", "from_acc", "to_acc", "amount", "currency", "recurrence", "next_run", "status", "failures", "step_up"}).
+			AddRow(3, "2021-12-31 19:36:36", w.IIN, "KZT0000000001", "KZT0000000002", 100, "KZT", "", "2022-01-01 09:00:00", status, 0, domain.StepUpNotRequired)
+	}
+
+	mock.ExpectExec(cancel).WithArgs(domain.ScheduleCancelled, 3, domain.ScheduleActive, domain.SchedulePaused).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(selectSchedule).WithArgs(3).WillReturnRows(scheduleRows(domain.ScheduleCancelled))
+	s, err := repo.CancelSchedule(3)
+	assert.NoError(t, err)
+	if assert.NotNil(t, s) {
+		assert.Equal(t, domain.ScheduleCancelled, s.Status)
+	}
+
+	mock.ExpectExec(cancel).WithArgs(domain.ScheduleCancelled, 3, domain.ScheduleActive, domain.SchedulePaused).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(selectSchedule).WithArgs(3).WillReturnRows(scheduleRows(domain.ScheduleDone))
+	_, err = repo.CancelSchedule(3)
+	assert.Equal(t, myerrors.ErrScheduleNotActive, err)
+
+	mock.ExpectExec(cancel).WithArgs(domain.ScheduleCancelled, 4, domain.ScheduleActive, domain.SchedulePaused).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(selectSchedule).WithArgs(4).WillReturnError(sql.ErrNoRows)
+	_, err = repo.CancelSchedule(4)
+	assert.Equal(t, myerrors.ErrScheduleNotFound, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestInsertBatch(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+	b := domain.Batch{IIN: "910815450350", From: "KZT0000000001", Mode: domain.BatchAllOrNothing, Total: domain.NewMoney(300, "KZT"), Lines: []domain.BatchLine{
+		{Line: 1, To: "KZT0000000002", Amount: domain.NewMoney(100, "KZT"), Reference: "salary"},
+		{Line: 2, To: "KZT0000000003", Amount: domain.NewMoney(200, "KZT")},
+	}}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE transfer_confirmations SET used_at = ? WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?").
+		WithArgs(sqlmock.AnyArg(), "hash", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO batches(iin, from_acc, mode, status, total, currency, step_up) VALUES(?,?,?,?,?,?,?)").
+		WithArgs("910815450350", "KZT0000000001", domain.BatchAllOrNothing, domain.BatchPending, 300, "KZT", domain.StepUpConfirmation).
+		WillReturnResult(sqlmock.NewResult(4, 1))
+	mock.ExpectExec("INSERT INTO batch_lines(batch_id, line, to_acc, amount, currency, reference) VALUES(?,?,?,?,?,?),(?,?,?,?,?,?)").
+		WithArgs(4, 1, "KZT0000000002", 100, "KZT", "salary", 4, 2, "KZT0000000003", 200, "KZT", "").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	stored, err := repo.InsertBatch(b, domain.StepUp{Decision: domain.StepUpConfirmation, ConfirmationHash: "hash"})
+	assert.NoError(t, err)
+	if assert.NotNil(t, stored) {
+		assert.Equal(t, 4, stored.ID)
+		assert.Equal(t, domain.BatchPending, stored.Status)
+		assert.Equal(t, domain.StepUpConfirmation, stored.StepUp)
+		assert.Equal(t, domain.LinePending, stored.Lines[0].Status)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetBatch(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+
+	mock.ExpectQuery("SELECT " + batchColumns + " FROM batches WHERE id = ?").WithArgs(4).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "ts", "iin", "from_acc", "mode", "status", "total", "currency", "step_up"}).
+			AddRow(4, "2021-12-31 19:36:36", "910815450350", "KZT0000000001", domain.BatchBestEffort, domain.BatchPartial, 300, "KZT", domain.StepUpTOTP))
+	mock.ExpectQuery("SELECT line, to_acc, amount, currency, reference, status, COALESCE(transaction_id, 0), error FROM batch_lines WHERE batch_id = ? ORDER BY line").WithArgs(4).
+		WillReturnRows(sqlmock.NewRows([]string{"line", "to_acc", "amount", "currency", "reference", "status", "transaction_id", "error"}).
+			AddRow(1, "KZT0000000002", 100, "KZT", "salary", domain.LineSucceeded, 7, "").
+			AddRow(2, "KZT0000000003", 200, "KZT", "", domain.LineFailed, 0, "insufficient funds"))
+
+	b, err := repo.GetBatch(4)
+	assert.NoError(t, err)
+	if assert.NotNil(t, b) && assert.Len(t, b.Lines, 2) {
+		assert.Equal(t, domain.NewMoney(300, "KZT"), b.Total)
+		assert.Equal(t, 7, b.Lines[0].TransactionID)
+		assert.Equal(t, "insufficient funds", b.Lines[1].Error)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateBatchLine(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+	update := "UPDATE batch_lines SET status = ?, transaction_id = ?, error = ? WHERE batch_id = ? AND line = ?"
+
+	// lines without a transaction leave it NULL
+	mock.ExpectExec(update).WithArgs(domain.LineSucceeded, 7, "", 4, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(update).WithArgs(domain.LineFailed, nil, "insufficient funds", 4, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(t, repo.UpdateBatchLine(4, domain.BatchLine{Line: 1, Status: domain.LineSucceeded, TransactionID: 7}))
+	assert.NoError(t, repo.UpdateBatchLine(4, domain.BatchLine{Line: 2, Status: domain.LineFailed, Error: "insufficient funds"}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestEnqueueEvent(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+	now := time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC)
+	e := domain.Event{ID: "4f1e", Type: domain.EventWalletCreated, Ts: now, Account: "KZT0000000001"}
+
+	mock.ExpectExec("INSERT INTO webhook_deliveries(subscription_id, event_id, event_type, payload, next_attempt) "+
+		"SELECT s.id, ?, ?, ?, ? FROM webhook_subscriptions s JOIN wallets w ON w.iin = s.iin WHERE w.accountno = ? AND FIND_IN_SET(?, s.events) > 0 "+
+		"ON DUPLICATE KEY UPDATE event_id = event_id").
+		WithArgs("4f1e", domain.EventWalletCreated, e.Payload(), now, "KZT0000000001", domain.EventWalletCreated).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	queued, err := repo.EnqueueEvent(e)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, queued)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetDueDeliveries(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+	now := time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	rows := sqlmock.NewRows([]string{"id", "ts", "subscription_id", "iin", "url", "secret", "event_id", "event_type", "payload", "status", "attempts", "next_attempt", "last_error"}).
+		AddRow(3, "2022-01-10 11:00:00", 2, "910815450350", "http://localhost/hook", "secret", "4f1e", domain.EventWalletCreated, "{}", domain.DeliveryPending, 1, "2022-01-10 11:30:00", "status 500")
+	mock.ExpectQuery("SELECT "+deliveryColumns+" FROM webhook_deliveries d JOIN webhook_subscriptions s ON s.id = d.subscription_id "+
+		"WHERE d.status = ? AND d.next_attempt <= ? ORDER BY d.next_attempt LIMIT ?").
+		WithArgs(domain.DeliveryPending, now, 10).WillReturnRows(rows)
+	due, err := repo.GetDueDeliveries(now, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, due, 1) {
+		assert.Equal(t, "http://localhost/hook", due[0].URL)
+		assert.Equal(t, time.Date(2022, 1, 10, 11, 30, 0, 0, time.UTC), due[0].NextAttempt)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDeleteSubscription(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM webhook_deliveries WHERE subscription_id = ?").WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec("DELETE FROM webhook_subscriptions WHERE id = ?").WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	assert.Equal(t, myerrors.ErrSubscriptionNotFound, repo.DeleteSubscription(2))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetUnpublishedEvents(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+	now := time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC)
+	amount := domain.NewMoney(100, domain.DefaultCurrency)
+	e := domain.Event{ID: "4f1e", Type: domain.EventWalletToppedUp, Ts: now, Account: "KZT0000000001", Amount: &amount, TransactionID: 7}
+
+	mock.ExpectQuery("SELECT payload FROM outbox WHERE published_at IS NULL ORDER BY id LIMIT ?").WithArgs(10).
+		WillReturnRows(sqlmock.NewRows([]string{"payload"}).AddRow(e.Payload()))
+	mock.ExpectExec("UPDATE outbox SET published_at = ? WHERE event_id = ?").WithArgs(now, "4f1e").WillReturnResult(sqlmock.NewResult(0, 1))
+	events, err := repo.GetUnpublishedEvents(10)
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Event{e}, events)
+	assert.NoError(t, repo.MarkEventPublished("4f1e", now))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetEventsAfter(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+	e := domain.Event{ID: "6c3d", Type: domain.EventWalletCreated, Ts: time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC), Account: "KZT0000000003"}
+
+	mock.ExpectQuery("SELECT id FROM outbox WHERE event_id = ?").WithArgs("4f1e").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(41))
+	mock.ExpectQuery("SELECT o.payload FROM outbox o JOIN wallets w ON w.accountno = JSON_UNQUOTE(JSON_EXTRACT(o.payload, '$.account')) WHERE w.iin = ? AND o.id > ? ORDER BY o.id LIMIT ?").WithArgs("910815450350", 41, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"payload"}).AddRow(e.Payload()))
+	mock.ExpectQuery("SELECT id FROM outbox WHERE event_id = ?").WithArgs("unknown").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	events, err := repo.GetEventsAfter("910815450350", "4f1e", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Event{e}, events)
+	_, err = repo.GetEventsAfter("910815450350", "unknown", 10)
+	assert.Equal(t, myerrors.ErrEventNotFound, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetEventsSince(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+	e := domain.Event{ID: "6c3d", Type: domain.EventWalletCreated, Ts: time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC), Account: "KZT0000000003"}
+
+	mock.ExpectQuery("SELECT COALESCE(MAX(id), 0) FROM outbox").WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(41))
+	mock.ExpectQuery("SELECT id, payload FROM outbox WHERE id > ? ORDER BY id LIMIT ?").WithArgs(41, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payload"}).AddRow(43, e.Payload()))
+	mock.ExpectQuery("SELECT id, payload FROM outbox WHERE id > ? ORDER BY id LIMIT ?").WithArgs(43, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payload"}))
+	position, err := repo.GetOutboxPosition()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(41), position)
+	events, position, err := repo.GetEventsSince(position, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Event{e}, events)
+	assert.Equal(t, int64(43), position)
+	events, position, err = repo.GetEventsSince(position, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+	assert.Equal(t, int64(43), position)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestInsertUser(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+	u := domain.User{IIN: "910815450350", Username: "sth", PasswordHash: "hash", Roles: []domain.Role{domain.RoleSupport, domain.RoleAuditor}}
+
+	query := "INSERT INTO users(iin, username, password_hash, roles) VALUES(?,?,?,?)"
+	mock.ExpectExec(query).WithArgs(u.IIN, u.Username, u.PasswordHash, "support,auditor").WillReturnResult(sqlmock.NewResult(4, 1))
+	mock.ExpectExec(query).WithArgs(u.IIN, u.Username, u.PasswordHash, "support,auditor").
+		WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'sth' for key 'users_username'"})
+	stored, err := repo.InsertUser(u)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, stored.ID)
+	_, err = repo.InsertUser(u)
+	assert.Equal(t, myerrors.ErrUserExists, err)
+
+	mock.ExpectQuery("SELECT " + userColumns + " FROM users WHERE username = ?").WithArgs("sth").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "ts", "iin", "username", "password_hash", "roles"}).
+			AddRow(4, "2022-01-10 12:00:00", u.IIN, u.Username, u.PasswordHash, "support,auditor"))
+	got, err := repo.GetUserByUsername("sth")
+	assert.NoError(t, err)
+	assert.Equal(t, u.Roles, got.Roles)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+	expiresAt := time.Date(2022, 2, 10, 12, 0, 0, 0, time.UTC)
+	next := domain.RefreshToken{Hash: "next", FamilyID: "family", UserID: 4, Status: domain.RefreshTokenActive, ExpiresAt: expiresAt}
+
+	use := "UPDATE refresh_tokens SET status = ? WHERE token_hash = ? AND status = ?"
+	mock.ExpectBegin()
+	mock.ExpectExec(use).WithArgs(domain.RefreshTokenUsed, "first", domain.RefreshTokenActive).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO refresh_tokens(token_hash, family_id, user_id, status, expires_at) VALUES(?,?,?,?,?)").
+		WithArgs("next", "family", 4, domain.RefreshTokenActive, expiresAt).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	rotated, err := repo.RotateRefreshToken("first", next)
+	assert.NoError(t, err)
+	assert.True(t, rotated)
+
+	// the token was used by a concurrent refresh
+	mock.ExpectBegin()
+	mock.ExpectExec(use).WithArgs(domain.RefreshTokenUsed, "first", domain.RefreshTokenActive).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	rotated, err = repo.RotateRefreshToken("first", next)
+	assert.NoError(t, err)
+	assert.False(t, rotated)
+
+	mock.ExpectQuery("SELECT ts, token_hash, family_id, user_id, status, expires_at FROM refresh_tokens WHERE token_hash = ?").WithArgs("next").
+		WillReturnRows(sqlmock.NewRows([]string{"ts", "token_hash", "family_id", "user_id", "status", "expires_at"}).
+			AddRow("2022-01-10 12:00:00", "next", "family", 4, domain.RefreshTokenActive, "2022-02-10 12:00:00"))
+	got, err := repo.GetRefreshToken("next")
+	assert.NoError(t, err)
+	next.Ts = "2022-01-10 12:00:00"
+	assert.Equal(t, next, *got)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRevocations(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+	revokedAt := time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC)
+	r := domain.Revocation{Kind: domain.RevokedSession, Subject: "family", RevokedAt: revokedAt, ExpiresAt: revokedAt.Add(time.Hour)}
+
+	mock.ExpectExec("INSERT INTO revocations(kind, subject, revoked_at, expires_at) VALUES(?,?,?,?) "+
+		"ON DUPLICATE KEY UPDATE revoked_at = VALUES(revoked_at), expires_at = VALUES(expires_at)").
+		WithArgs(r.Kind, r.Subject, r.RevokedAt, r.ExpiresAt).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT kind, subject, revoked_at, expires_at FROM revocations WHERE revoked_at >= ? ORDER BY revoked_at").WithArgs(revokedAt).
+		WillReturnRows(sqlmock.NewRows([]string{"kind", "subject", "revoked_at", "expires_at"}).
+			AddRow(r.Kind, r.Subject, "2022-01-10 12:00:00", "2022-01-10 13:00:00"))
+	mock.ExpectExec("DELETE FROM revocations WHERE expires_at <= ?").WithArgs(revokedAt.Add(time.Hour)).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(t, repo.InsertRevocation(r))
+	revocations, err := repo.GetRevocations(revokedAt)
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Revocation{r}, revocations)
+	deleted, err := repo.DeleteExpiredRevocations(revokedAt.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTOTP(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+	lockedUntil := time.Date(2022, 1, 10, 12, 15, 0, 0, time.UTC)
+
+	mock.ExpectQuery("SELECT secret, active, last_step, failed_attempts, locked_until FROM totp_authenticators WHERE iin = ?").WithArgs("910815450350").
+		WillReturnRows(sqlmock.NewRows([]string{"secret", "active", "last_step", "failed_attempts", "locked_until"}).
+			AddRow("SECRET", true, 100, 5, "2022-01-10 12:15:00"))
+	mock.ExpectExec("UPDATE totp_authenticators SET locked_until = CASE WHEN failed_attempts + 1 >= ? THEN ? ELSE locked_until END, "+
+		"failed_attempts = failed_attempts + 1 WHERE iin = ?").WithArgs(5, lockedUntil, "910815450350").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE totp_authenticators SET last_step = ?, failed_attempts = 0, locked_until = NULL, active = active OR ? WHERE iin = ? AND last_step < ?").
+		WithArgs(101, false, "910815450350", 101).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	stored, err := repo.GetTOTP("910815450350")
+	assert.NoError(t, err)
+	assert.Equal(t, domain.TOTP{IIN: "910815450350", Secret: "SECRET", Active: true, LastStep: 100, FailedAttempts: 5, LockedUntil: lockedUntil}, *stored)
+	assert.NoError(t, repo.FailTOTP("910815450350", 5, lockedUntil))
+	used, err := repo.UseTOTPStep("910815450350", 101, false)
+	assert.NoError(t, err)
+	assert.False(t, used)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetTransferConfirmation(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+	now := time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC)
+	query := "SELECT iin, from_acc, to_acc, amount, currency, expires_at FROM transfer_confirmations WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?"
+	columns := []string{"iin", "from_acc", "to_acc", "amount", "currency", "expires_at"}
+
+	mock.ExpectQuery(query).WithArgs("hash", now).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("910815450350", "KZT0000000001", "KZT0000000002", 100, "KZT", "2022-01-10 12:05:00"))
+	mock.ExpectQuery(query).WithArgs("used", now).WillReturnRows(sqlmock.NewRows(columns))
+
+	c, err := repo.GetTransferConfirmation("hash", now)
+	assert.NoError(t, err)
+	assert.Equal(t, domain.TransferConfirmation{Hash: "hash", IIN: "910815450350", From: "KZT0000000001", To: "KZT0000000002",
+		Amount: domain.NewMoney(100, "KZT"), ExpiresAt: now.Add(5 * time.Minute)}, *c)
+	_, err = repo.GetTransferConfirmation("used", now)
+	assert.Equal(t, myerrors.ErrInvalidConfirmation, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTransferWithUsedConfirmation(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &mySQLDBInterface{db}
+
+	// the confirmation is used up in the transaction of the transfer, which is rolled back if it is used already
+	mock.ExpectBegin()
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000001").WillReturnRows(sqlmock.NewRows([]string{"amount", "currency"}).AddRow(500, "KZT"))
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000002").WillReturnRows(sqlmock.NewRows([]string{"amount", "currency"}).AddRow(10, "KZT"))
+	mock.ExpectExec("UPDATE transfer_confirmations SET used_at = ? WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?").
+		WithArgs(sqlmock.AnyArg(), "hash", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	stepUp := domain.StepUp{Decision: domain.StepUpConfirmation, ConfirmationHash: "hash"}
+	_, err := repo.Transfer("KZT0000000001", "KZT0000000002", domain.NewConversion(domain.NewMoney(123, domain.DefaultCurrency)), nil, stepUp)
+	assert.Equal(t, myerrors.ErrInvalidConfirmation, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
 }
@@ -1,21 +1,5 @@
-CREATE DATABASE IF NOT EXISTS `test`;
-
-USE `test`;
-
-CREATE TABLE IF NOT EXISTS `wallets`
-(
-    id bigint auto_increment,
-    ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
-    iin varchar(255) NOT NULL,
-    accountno varchar(255) NOT NULL UNIQUE,
-    amount bigint UNSIGNED DEFAULT 0,
-    transfer tinyint DEFAULT 0,
-    PRIMARY KEY (`id`)
-);
-
-INSERT INTO `wallets` (`accountno`, `iin`)
-VALUES ('KZT0000000000', 'account_init');
+-- Demo wallets and transactions for local development, amounts are in tiyn. Load into a freshly migrated DB after `main migrate up`:
+--   mysql -u tester -p test < demo_data.sql
 
 INSERT INTO `wallets` (`iin`, `accountno`, `amount`, `updated_at`, `ts`) 
 VALUES
@@ -57,18 +41,6 @@ VALUES
     ('601119400567', 'KZT0000000036', 401, '2022-01-16 16:26:16', '2022-01-16 16:19:12'),
     ('980124450072', 'KZT0000000037', 0, '2022-01-13 19:45:23', '2022-01-13 19:45:23');
 
-CREATE TABLE IF NOT EXISTS `transactions`
-(
-    id  bigint auto_increment,
-    ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
-    transfer_type varchar(255) NOT NULL,
-    from_acc varchar(255) DEFAULT '',
-    to_acc varchar(255) NOT NULL,
-    amount bigint UNSIGNED NOT NULL,
-    PRIMARY KEY (`id`)
-);
-
-
 INSERT INTO `transactions` (`ts`, `transfer_type`, `from_acc`, `to_acc`, `amount`) 
 VALUES
     ('2021-12-07 19:54:06', 'transfer', 'KZT0000000001', 'KZT0000000002', 100),
@@ -186,4 +158,10 @@ VALUES
     ('2022-01-16 17:02:30', 'transfer', 'KZT0000000001', 'KZT0000000005', 12222),
     ('2022-01-18 14:36:28', 'topup', '', 'KZT0000000001', 1221);
 
+INSERT INTO `postings` (`transaction_id`, `accountno`, `amount`)
+SELECT id, IF(from_acc = '', 'SYSTEM_FUNDING', from_acc), -CAST(amount AS SIGNED) FROM `transactions`;
+
+INSERT INTO `postings` (`transaction_id`, `accountno`, `amount`)
+SELECT id, to_acc, amount FROM `transactions`;
 
+UPDATE `transactions` SET from_acc = 'SYSTEM_FUNDING' WHERE transfer_type = 'topup' AND from_acc = '';
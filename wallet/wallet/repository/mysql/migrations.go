@@ -0,0 +1,30 @@
+package mysql
+
+import (
+	"database/sql"
+	"embed"
+	"io/fs"
+	"wallet/wallet/repository/migrate"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// NewMigrator returns migrator of MySQL schema embedded in the binary
+func NewMigrator(dbURL string) (*migrate.Migrator, error) {
+	db, err := sql.Open("mysql", dbURL)
+	if err != nil {
+		return nil, err
+	}
+	files, err := fs.Sub(migrations, "migrations")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	migrator, err := migrate.New(db, files, migrate.MySQL)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return migrator, nil
+}
@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS `wallets`
+(
+    id bigint auto_increment,
+    ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    iin varchar(255) NOT NULL,
+    accountno varchar(255) NOT NULL UNIQUE,
+    amount bigint UNSIGNED DEFAULT 0,
+    PRIMARY KEY (`id`)
+);
+
+INSERT IGNORE INTO `wallets` (`accountno`, `iin`)
+VALUES ('KZT0000000000', 'account_init');
+
+CREATE TABLE IF NOT EXISTS `transactions`
+(
+    id  bigint auto_increment,
+    ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    transfer_type varchar(255) NOT NULL,
+    from_acc varchar(255) DEFAULT '',
+    to_acc varchar(255) NOT NULL,
+    amount bigint UNSIGNED NOT NULL,
+    PRIMARY KEY (`id`)
+);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS `idempotency_keys`
+(
+    iin varchar(255) NOT NULL,
+    idem_key varchar(255) NOT NULL,
+    request_hash char(64) NOT NULL,
+    response varchar(255) NOT NULL DEFAULT '',
+    transaction_id bigint NOT NULL,
+    ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (`iin`, `idem_key`)
+);
@@ -0,0 +1,3 @@
+UPDATE `transactions` SET from_acc = '' WHERE transfer_type = 'topup' AND from_acc = 'SYSTEM_FUNDING';
+
+DROP TABLE IF EXISTS `postings`;
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS `postings`
+(
+    id bigint auto_increment,
+    transaction_id bigint NOT NULL,
+    accountno varchar(255) NOT NULL,
+    amount bigint NOT NULL,
+    PRIMARY KEY (`id`),
+    INDEX `postings_transaction_id` (`transaction_id`),
+    INDEX `postings_accountno` (`accountno`)
+);
+
+-- postings for transactions recorded before the ledger existed, top-ups are debited from the funding account
+INSERT INTO `postings` (`transaction_id`, `accountno`, `amount`)
+SELECT id, IF(from_acc = '', 'SYSTEM_FUNDING', from_acc), -CAST(amount AS SIGNED) FROM `transactions`;
+
+INSERT INTO `postings` (`transaction_id`, `accountno`, `amount`)
+SELECT id, to_acc, amount FROM `transactions`;
+
+UPDATE `transactions` SET from_acc = 'SYSTEM_FUNDING' WHERE transfer_type = 'topup' AND from_acc = '';
@@ -0,0 +1,18 @@
+UPDATE idempotency_keys SET response = SUBSTRING_INDEX(SUBSTRING_INDEX(response, '"amount":"', -1), '.', 1)
+WHERE response LIKE '{"amount":"%';
+
+UPDATE idempotency_keys k JOIN transactions t ON t.id = k.transaction_id
+SET k.request_hash = SHA2(CONCAT_WS(CHAR(0), 'topup', t.to_acc, t.amount DIV 100), 256)
+WHERE t.transfer_type = 'topup' AND t.amount MOD 100 = 0
+  AND k.request_hash = SHA2(CONCAT_WS(CHAR(0), 'topup', t.to_acc, CONCAT(t.amount DIV 100, '.00 KZT')), 256);
+
+UPDATE idempotency_keys k JOIN transactions t ON t.id = k.transaction_id
+SET k.request_hash = SHA2(CONCAT_WS(CHAR(0), 'transfer', t.from_acc, t.to_acc, t.amount DIV 100), 256)
+WHERE t.transfer_type = 'transfer' AND t.amount MOD 100 = 0
+  AND k.request_hash = SHA2(CONCAT_WS(CHAR(0), 'transfer', t.from_acc, t.to_acc, CONCAT(t.amount DIV 100, '.00 KZT')), 256);
+
+UPDATE wallets SET amount = amount DIV 100;
+
+UPDATE transactions SET amount = amount DIV 100;
+
+UPDATE postings SET amount = amount DIV 100;
@@ -0,0 +1,21 @@
+-- stored requests and responses of idempotency keys are rewritten into the new amount format, so that requests made
+-- before the upgrade are still replayed when retried. Top-ups stored the balance as a plain number, transfers stored
+-- nothing. A key whose hash doesn't match its transaction, say of an amount sent as "0100", keeps its hash
+UPDATE idempotency_keys SET response = CONCAT('{"amount":"', response, '.00","currency":"KZT"}')
+WHERE response REGEXP '^[0-9]+$';
+
+UPDATE idempotency_keys k JOIN transactions t ON t.id = k.transaction_id
+SET k.request_hash = SHA2(CONCAT_WS(CHAR(0), 'topup', t.to_acc, CONCAT(t.amount, '.00 KZT')), 256)
+WHERE t.transfer_type = 'topup' AND k.request_hash = SHA2(CONCAT_WS(CHAR(0), 'topup', t.to_acc, t.amount), 256);
+
+UPDATE idempotency_keys k JOIN transactions t ON t.id = k.transaction_id
+SET k.request_hash = SHA2(CONCAT_WS(CHAR(0), 'transfer', t.from_acc, t.to_acc, CONCAT(t.amount, '.00 KZT')), 256)
+WHERE t.transfer_type = 'transfer'
+  AND k.request_hash = SHA2(CONCAT_WS(CHAR(0), 'transfer', t.from_acc, t.to_acc, t.amount), 256);
+
+-- amounts were stored in whole tenge, from now on they are in tiyn
+UPDATE wallets SET amount = amount * 100;
+
+UPDATE transactions SET amount = amount * 100;
+
+UPDATE postings SET amount = amount * 100;
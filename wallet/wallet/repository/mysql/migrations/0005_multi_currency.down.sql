@@ -0,0 +1,9 @@
+ALTER TABLE `postings` DROP COLUMN `currency`;
+
+ALTER TABLE `transactions`
+    DROP COLUMN `fx_rate`,
+    DROP COLUMN `to_currency`,
+    DROP COLUMN `to_amount`,
+    DROP COLUMN `currency`;
+
+ALTER TABLE `wallets` DROP COLUMN `currency`;
@@ -0,0 +1,3 @@
+ALTER TABLE `transactions`
+    DROP INDEX `transactions_reverses_id`,
+    DROP COLUMN `reverses_id`;
@@ -0,0 +1,4 @@
+-- reversal transactions point at the transaction they (partially) refund
+ALTER TABLE `transactions`
+    ADD COLUMN `reverses_id` bigint NULL DEFAULT NULL,
+    ADD INDEX `transactions_reverses_id` (`reverses_id`);
@@ -0,0 +1,16 @@
+-- holds reserve wallet money, only active holds that have not expired reduce the available balance
+CREATE TABLE IF NOT EXISTS `holds`
+(
+    id bigint auto_increment,
+    ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    accountno varchar(255) NOT NULL,
+    amount bigint UNSIGNED NOT NULL,
+    currency char(3) NOT NULL,
+    status varchar(16) NOT NULL DEFAULT 'active',
+    captured bigint UNSIGNED NOT NULL DEFAULT 0,
+    transaction_id bigint NULL DEFAULT NULL,
+    expires_at DATETIME NOT NULL,
+    PRIMARY KEY (`id`),
+    INDEX `holds_accountno_status` (`accountno`, `status`),
+    INDEX `holds_status_expires_at` (`status`, `expires_at`)
+);
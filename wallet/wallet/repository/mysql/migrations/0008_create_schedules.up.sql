@@ -0,0 +1,29 @@
+-- schedules are executed by the worker once next_run has passed, schedule_runs keeps the outcome of every execution
+CREATE TABLE IF NOT EXISTS `schedules`
+(
+    id bigint auto_increment,
+    ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    iin varchar(255) NOT NULL,
+    from_acc varchar(255) NOT NULL,
+    to_acc varchar(255) NOT NULL,
+    amount bigint UNSIGNED NOT NULL,
+    currency char(3) NOT NULL,
+    recurrence varchar(255) NOT NULL DEFAULT '',
+    next_run DATETIME NOT NULL,
+    status varchar(16) NOT NULL DEFAULT 'active',
+    failures int NOT NULL DEFAULT 0,
+    PRIMARY KEY (`id`),
+    INDEX `schedules_iin` (`iin`),
+    INDEX `schedules_status_next_run` (`status`, `next_run`)
+);
+
+CREATE TABLE IF NOT EXISTS `schedule_runs`
+(
+    id bigint auto_increment,
+    schedule_id bigint NOT NULL,
+    ts DATETIME NOT NULL,
+    outcome varchar(16) NOT NULL,
+    error varchar(255) NOT NULL DEFAULT '',
+    PRIMARY KEY (`id`),
+    INDEX `schedule_runs_schedule_id` (`schedule_id`)
+);
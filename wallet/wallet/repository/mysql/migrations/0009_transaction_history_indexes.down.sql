@@ -0,0 +1,3 @@
+ALTER TABLE `transactions`
+    DROP INDEX `transactions_from_acc_id`,
+    DROP INDEX `transactions_to_acc_id`;
@@ -0,0 +1,4 @@
+-- transaction history is read per account in id order, one direction at a time
+ALTER TABLE `transactions`
+    ADD INDEX `transactions_from_acc_id` (`from_acc`, `id`),
+    ADD INDEX `transactions_to_acc_id` (`to_acc`, `id`);
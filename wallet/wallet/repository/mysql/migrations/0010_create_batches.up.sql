@@ -0,0 +1,30 @@
+-- batches are run by the worker once uploaded, batch_lines keeps every transfer of a batch with its outcome
+CREATE TABLE IF NOT EXISTS `batches`
+(
+    id bigint auto_increment,
+    ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    iin varchar(255) NOT NULL,
+    from_acc varchar(255) NOT NULL,
+    mode varchar(16) NOT NULL,
+    status varchar(16) NOT NULL DEFAULT 'pending',
+    total bigint UNSIGNED NOT NULL,
+    currency char(3) NOT NULL,
+    PRIMARY KEY (`id`),
+    INDEX `batches_status` (`status`)
+);
+
+CREATE TABLE IF NOT EXISTS `batch_lines`
+(
+    id bigint auto_increment,
+    batch_id bigint NOT NULL,
+    line int NOT NULL,
+    to_acc varchar(255) NOT NULL,
+    amount bigint UNSIGNED NOT NULL,
+    currency char(3) NOT NULL,
+    reference varchar(255) NOT NULL DEFAULT '',
+    status varchar(16) NOT NULL DEFAULT 'pending',
+    transaction_id bigint NULL DEFAULT NULL,
+    error varchar(255) NOT NULL DEFAULT '',
+    PRIMARY KEY (`id`),
+    UNIQUE INDEX `batch_lines_batch_id_line` (`batch_id`, `line`)
+);
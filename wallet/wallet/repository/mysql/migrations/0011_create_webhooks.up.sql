@@ -0,0 +1,29 @@
+-- webhook_subscriptions are matched to events by the IIN owning the wallet, events is a comma separated list of types.
+-- webhook_deliveries queues every event for every matching subscription until it is delivered or dead
+CREATE TABLE IF NOT EXISTS `webhook_subscriptions`
+(
+    id bigint auto_increment,
+    ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    iin varchar(255) NOT NULL,
+    url varchar(2048) NOT NULL,
+    secret varchar(255) NOT NULL,
+    events varchar(255) NOT NULL,
+    PRIMARY KEY (`id`),
+    INDEX `webhook_subscriptions_iin` (`iin`)
+);
+
+CREATE TABLE IF NOT EXISTS `webhook_deliveries`
+(
+    id bigint auto_increment,
+    ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    subscription_id bigint NOT NULL,
+    event_type varchar(64) NOT NULL,
+    payload text NOT NULL,
+    status varchar(16) NOT NULL DEFAULT 'pending',
+    attempts int NOT NULL DEFAULT 0,
+    next_attempt DATETIME NOT NULL,
+    last_error varchar(255) NOT NULL DEFAULT '',
+    PRIMARY KEY (`id`),
+    INDEX `webhook_deliveries_subscription_id` (`subscription_id`),
+    INDEX `webhook_deliveries_status_next_attempt` (`status`, `next_attempt`)
+);
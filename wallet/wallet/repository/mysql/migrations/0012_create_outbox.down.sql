@@ -0,0 +1,5 @@
+ALTER TABLE `webhook_deliveries`
+    DROP INDEX `webhook_deliveries_subscription_id_event_id`,
+    DROP COLUMN event_id;
+
+DROP TABLE IF EXISTS `outbox`;
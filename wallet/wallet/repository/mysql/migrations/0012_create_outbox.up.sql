@@ -0,0 +1,22 @@
+-- outbox keeps events written in the same transaction as the change they report until the relay has published them.
+-- Deliveries of an event to a subscription are kept unique by event_id so that republished events are dropped
+CREATE TABLE IF NOT EXISTS `outbox`
+(
+    id bigint auto_increment,
+    ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    event_id varchar(64) NOT NULL,
+    event_type varchar(64) NOT NULL,
+    payload text NOT NULL,
+    published_at DATETIME NULL DEFAULT NULL,
+    PRIMARY KEY (`id`),
+    UNIQUE INDEX `outbox_event_id` (`event_id`),
+    INDEX `outbox_published_at_id` (`published_at`, `id`)
+);
+
+ALTER TABLE `webhook_deliveries`
+    ADD COLUMN event_id varchar(64) NOT NULL DEFAULT '';
+
+UPDATE `webhook_deliveries` SET event_id = CONCAT('delivery-', id);
+
+ALTER TABLE `webhook_deliveries`
+    ADD UNIQUE INDEX `webhook_deliveries_subscription_id_event_id` (`subscription_id`, `event_id`);
@@ -0,0 +1,26 @@
+-- users of the built-in auth service, roles is a comma separated list.
+-- refresh_tokens are stored by SHA-256 of the token, tokens rotated from one login share family_id
+CREATE TABLE IF NOT EXISTS `users`
+(
+    id bigint auto_increment,
+    ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    iin varchar(255) NOT NULL,
+    username varchar(64) NOT NULL,
+    password_hash varchar(255) NOT NULL,
+    roles varchar(255) NOT NULL DEFAULT 'customer',
+    PRIMARY KEY (`id`),
+    UNIQUE INDEX `users_iin` (`iin`),
+    UNIQUE INDEX `users_username` (`username`)
+);
+
+CREATE TABLE IF NOT EXISTS `refresh_tokens`
+(
+    token_hash char(64) NOT NULL,
+    ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    family_id varchar(64) NOT NULL,
+    user_id bigint NOT NULL,
+    status varchar(16) NOT NULL DEFAULT 'active',
+    expires_at DATETIME NOT NULL,
+    PRIMARY KEY (`token_hash`),
+    INDEX `refresh_tokens_family_id` (`family_id`)
+);
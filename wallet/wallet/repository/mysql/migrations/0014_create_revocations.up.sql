@@ -0,0 +1,12 @@
+-- revocations of tokens by jti, sessions by sid and users by IIN, kept until every token they revoke has expired.
+-- Instances keep them in memory and poll for ones revoked since, so that checking a token needs no query
+CREATE TABLE IF NOT EXISTS `revocations`
+(
+    kind varchar(16) NOT NULL,
+    subject varchar(255) NOT NULL,
+    revoked_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    PRIMARY KEY (`kind`, `subject`),
+    INDEX `revocations_revoked_at` (`revoked_at`),
+    INDEX `revocations_expires_at` (`expires_at`)
+);
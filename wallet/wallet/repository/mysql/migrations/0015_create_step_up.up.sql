@@ -0,0 +1,29 @@
+-- step_up is how the second factor of a transfer was decided on, empty for transactions that are not transfers
+ALTER TABLE `transactions` ADD COLUMN `step_up` varchar(16) NOT NULL DEFAULT '';
+
+-- TOTP authenticators of users by IIN, pending until activated with a code. last_step is the time step of the last
+-- accepted code, so that a code is accepted once
+CREATE TABLE IF NOT EXISTS `totp_authenticators`
+(
+    iin varchar(255) NOT NULL,
+    secret varchar(64) NOT NULL,
+    active boolean NOT NULL DEFAULT false,
+    last_step bigint NOT NULL DEFAULT 0,
+    failed_attempts int NOT NULL DEFAULT 0,
+    locked_until DATETIME NULL DEFAULT NULL,
+    PRIMARY KEY (`iin`)
+);
+
+-- transfer_confirmations are stored by SHA-256 of the token and let the transfer they were made for go through once
+CREATE TABLE IF NOT EXISTS `transfer_confirmations`
+(
+    token_hash char(64) NOT NULL,
+    iin varchar(255) NOT NULL,
+    from_acc varchar(255) NOT NULL,
+    to_acc varchar(255) NOT NULL,
+    amount bigint UNSIGNED NOT NULL,
+    currency char(3) NOT NULL,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME NULL DEFAULT NULL,
+    PRIMARY KEY (`token_hash`)
+);
@@ -0,0 +1,2 @@
+ALTER TABLE `batches` DROP COLUMN `step_up`;
+ALTER TABLE `schedules` DROP COLUMN `step_up`;
@@ -0,0 +1,2 @@
+ALTER TABLE `holds` DROP COLUMN `step_up`;
+ALTER TABLE `holds` DROP COLUMN `payee`;
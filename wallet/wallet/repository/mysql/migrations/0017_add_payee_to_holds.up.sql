@@ -0,0 +1,5 @@
+-- payee is the account a hold may only be captured into, its owner being the merchant the hold was placed for.
+-- Holds placed before have none and can only be released or expire. step_up is how the owner of the held wallet
+-- authorized the hold when placing it, its capture is made with that decision
+ALTER TABLE `holds` ADD COLUMN `payee` varchar(255) NOT NULL DEFAULT '';
+ALTER TABLE `holds` ADD COLUMN `step_up` varchar(16) NOT NULL DEFAULT '';
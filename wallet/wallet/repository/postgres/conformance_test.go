@@ -0,0 +1,24 @@
+package postgres
+
+import (
+	"os"
+	"testing"
+	"wallet/wallet/repository"
+	"wallet/wallet/repository/repositorytest"
+)
+
+// TestConformance runs against a real PostgreSQL given by WALLET_TEST_POSTGRES_DSN, migrated with `main migrate up`
+func TestConformance(t *testing.T) {
+	dsn := os.Getenv("WALLET_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("WALLET_TEST_POSTGRES_DSN not set")
+	}
+	repositorytest.Run(t, func(t *testing.T) repository.DBInterface {
+		repo, err := NewPostgresDBInterface(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(repo.Close)
+		return repo
+	})
+}
@@ -0,0 +1,1700 @@
+package postgres
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"wallet/domain"
+	"wallet/myerrors"
+	"wallet/wallet/repository"
+
+	"github.com/lib/pq"
+)
+
+// maxTransferAttempts limits how many times a transfer is retried after a deadlock or serialization failure
+const maxTransferAttempts = 3
+
+// tsFormat renders timestamps the way MySQL backend returns them
+const tsFormat = "'YYYY-MM-DD HH24:MI:SS'"
+
+// heldSQL sums active holds of wallet w that have not expired at the time passed as $1
+const heldSQL = "COALESCE((SELECT SUM(h.amount) FROM holds h WHERE h.accountno = w.accountno AND h.status = 'active' AND h.expires_at > $1), 0)"
+
+// holdColumns are the columns scanned by scanHold
+const holdColumns = "id, to_char(ts, " + tsFormat + "), accountno, payee, amount, currency, captured, status, COALESCE(transaction_id, 0), expires_at, step_up"
+
+// scheduleColumns are the columns scanned by scanSchedule
+const scheduleColumns = "id, to_char(ts, " + tsFormat + "), iin, from_acc, to_acc, amount, currency, recurrence, next_run, status, failures, step_up"
+
+// batchColumns are the columns scanned by scanBatch
+const batchColumns = "id, to_char(ts, " + tsFormat + "), iin, from_acc, mode, status, total, currency, step_up"
+
+// subscriptionColumns are the columns scanned by scanSubscription
+const subscriptionColumns = "id, to_char(ts, " + tsFormat + "), iin, url, secret, events"
+
+// userColumns are the columns scanned by scanUser
+const userColumns = "id, to_char(ts, " + tsFormat + "), iin, username, password_hash, roles"
+
+// deliveryColumns are the columns of deliveries d joined to their subscriptions s scanned by scanDelivery
+const deliveryColumns = "d.id, to_char(d.ts, " + tsFormat + "), d.subscription_id, s.iin, s.url, s.secret, d.event_id, d.event_type, d.payload, d.status, d.attempts, d.next_attempt, d.last_error"
+
+type postgresDBInterface struct {
+	db *sql.DB
+}
+
+// GetLastAccountNo retrieves most recent account from DB
+func (p *postgresDBInterface) GetLastAccountNo() (string, error) {
+	var lastAccountNo string
+	if err := p.db.QueryRow("SELECT accountno FROM wallets ORDER BY id DESC LIMIT 1").Scan(&lastAccountNo); err != nil {
+		return "", err
+	}
+	if len(lastAccountNo) != 13 {
+		return "", fmt.Errorf("%w: %q", myerrors.ErrGotInvalidAcc, lastAccountNo)
+	}
+	return lastAccountNo, nil
+}
+
+// InsertWallet inserts newly created wallet of given currency into DB with its wallet.created event
+func (p *postgresDBInterface) InsertWallet(account, IIN, currency string) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO wallets (accountno, iin, currency) VALUES ($1, $2, $3)", account, IIN, currency); err != nil {
+		log.Println("ERROR|InsertWallet:", err)
+		tx.Rollback()
+		return err
+	}
+	if err := insertOutbox(tx, domain.NewEvent(domain.EventWalletCreated, account)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// GetWallets retrieves wallets by given IIN
+func (p *postgresDBInterface) GetWallets(IIN string) ([]domain.Wallet, error) {
+	rows, err := p.db.Query("SELECT w.accountno, w.id, to_char(w.ts, "+tsFormat+"), to_char(w.updated_at, "+tsFormat+"), w.amount, w.currency, "+heldSQL+" FROM wallets w WHERE w.iin = $2 ORDER BY w.id", time.Now(), IIN)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var wallets []domain.Wallet
+	for rows.Next() {
+		var wallet domain.Wallet
+		var amount, held int64
+		var currency string
+		if err := rows.Scan(&wallet.AccountNo, &wallet.ID, &wallet.Ts, &wallet.UpdatedAt, &amount, &currency, &held); err != nil {
+			return nil, err
+		}
+		wallet.Ledger = domain.NewMoney(amount, currency)
+		wallet.Available = domain.NewMoney(amount-held, currency)
+		wallets = append(wallets, wallet)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return wallets, nil
+}
+
+// GetWallet retrieves wallet by account number
+func (p *postgresDBInterface) GetWallet(account string) (*domain.Wallet, error) {
+	var wallet domain.Wallet
+	var amount, held int64
+	var currency string
+	err := p.db.QueryRow("SELECT w.accountno, w.id, w.iin, to_char(w.ts, "+tsFormat+"), to_char(w.updated_at, "+tsFormat+"), w.amount, w.currency, "+heldSQL+" FROM wallets w WHERE w.accountno = $2", time.Now(), account).
+		Scan(&wallet.AccountNo, &wallet.ID, &wallet.IIN, &wallet.Ts, &wallet.UpdatedAt, &amount, &currency, &held)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, myerrors.ErrWalletNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	wallet.Ledger = domain.NewMoney(amount, currency)
+	wallet.Available = domain.NewMoney(amount-held, currency)
+	return &wallet, nil
+}
+
+// GetWalletList gets all accounts under requested user
+func (p *postgresDBInterface) GetWalletList(IIN string) ([]string, error) {
+	rows, err := p.db.Query("SELECT accountno FROM wallets WHERE iin = $1 ORDER BY id", IIN)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var wallets []string
+	for rows.Next() {
+		var wallet string
+		if err := rows.Scan(&wallet); err != nil {
+			return nil, err
+		}
+		wallets = append(wallets, wallet)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return wallets, nil
+}
+
+// GetAmount retrieves account amount
+func (p *postgresDBInterface) GetAmount(account string) (domain.Money, error) {
+	var amount int64
+	var currency string
+	err := p.db.QueryRow("SELECT amount, currency FROM wallets WHERE accountno = $1", account).Scan(&amount, &currency)
+	if errors.Is(err, sql.ErrNoRows) {
+		return domain.Money{}, myerrors.ErrWalletNotFound
+	}
+	if err != nil {
+		return domain.Money{}, err
+	}
+	return domain.NewMoney(amount, currency), nil
+}
+
+// ConfirmIIN checks against IIN for requested account in DB
+func (p *postgresDBInterface) ConfirmIIN(IIN, account string) (bool, error) {
+	var DBIIN string
+	err := p.db.QueryRow("SELECT iin FROM wallets WHERE accountno = $1", account).Scan(&DBIIN)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, myerrors.ErrWalletNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+	return DBIIN == IIN, nil
+}
+
+// GetTransactions gets transactions of an account matching filter ordered by ID
+func (p *postgresDBInterface) GetTransactions(filter domain.TransactionFilter) ([]domain.Transaction, error) {
+	query, args := transactionsQuery(filter)
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var transactions []domain.Transaction
+	for rows.Next() {
+		var transaction domain.Transaction
+		var amount, toAmount int64
+		var currency, toCurrency string
+		var reversesID sql.NullInt64
+		if err := rows.Scan(&transaction.ID, &transaction.Ts, &transaction.Type, &transaction.From, &transaction.To, &amount, &currency, &toAmount, &toCurrency, &transaction.Rate, &reversesID, &transaction.StepUp); err != nil {
+			return nil, err
+		}
+		transaction.Amount = domain.NewMoney(amount, currency)
+		transaction.Credited = domain.NewMoney(toAmount, toCurrency)
+		transaction.ReversesID = int(reversesID.Int64)
+		transactions = append(transactions, transaction)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return transactions, nil
+}
+
+// GetBalanceAt sums up ledger postings of account made by transactions before at
+func (p *postgresDBInterface) GetBalanceAt(account string, at time.Time) (domain.Money, error) {
+	var amount int64
+	var currency string
+	err := p.db.QueryRow("SELECT w.currency, COALESCE((SELECT SUM(p.amount) FROM postings p JOIN transactions t ON t.id = p.transaction_id WHERE p.accountno = w.accountno AND t.ts < $1), 0) FROM wallets w WHERE w.accountno = $2", at, account).Scan(&currency, &amount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return domain.Money{}, myerrors.ErrWalletNotFound
+	}
+	if err != nil {
+		return domain.Money{}, err
+	}
+	return domain.NewMoney(amount, currency), nil
+}
+
+// transactionsQuery builds query selecting transactions matching filter. Restricting one direction lets the
+// query walk the (from_acc, id) or (to_acc, id) index, the amount is the account's side of each transaction
+func transactionsQuery(filter domain.TransactionFilter) (string, []interface{}) {
+	var args []interface{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+	var where []string
+	switch filter.Direction {
+	case domain.DirectionOut:
+		where = append(where, "from_acc = "+arg(filter.Account))
+	case domain.DirectionIn:
+		where = append(where, "to_acc = "+arg(filter.Account))
+	default:
+		where = append(where, "(from_acc = "+arg(filter.Account)+" OR to_acc = "+arg(filter.Account)+")")
+	}
+	if filter.Type != "" {
+		where = append(where, "transfer_type = "+arg(filter.Type))
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "ts >= "+arg(filter.Since))
+	}
+	if !filter.Until.IsZero() {
+		where = append(where, "ts < "+arg(filter.Until))
+	}
+	if filter.Counterparty != "" {
+		where = append(where, "((from_acc = "+arg(filter.Account)+" AND to_acc = "+arg(filter.Counterparty)+") OR (to_acc = "+arg(filter.Account)+" AND from_acc = "+arg(filter.Counterparty)+"))")
+	}
+	if filter.MinAmount != nil {
+		where = append(where, "(CASE WHEN from_acc = "+arg(filter.Account)+" THEN amount ELSE to_amount END) >= "+arg(*filter.MinAmount))
+	}
+	if filter.MaxAmount != nil {
+		where = append(where, "(CASE WHEN from_acc = "+arg(filter.Account)+" THEN amount ELSE to_amount END) <= "+arg(*filter.MaxAmount))
+	}
+	order := "ASC"
+	if filter.Desc {
+		order = "DESC"
+	}
+	if filter.Cursor != 0 {
+		if filter.Desc {
+			where = append(where, "id < "+arg(filter.Cursor))
+		} else {
+			where = append(where, "id > "+arg(filter.Cursor))
+		}
+	}
+	query := "SELECT id, to_char(ts, " + tsFormat + "), transfer_type, from_acc, to_acc, amount, currency, to_amount, to_currency, fx_rate, reverses_id, step_up FROM transactions WHERE " + strings.Join(where, " AND ") + " ORDER BY id " + order
+	if filter.Limit > 0 {
+		query += " LIMIT " + arg(filter.Limit)
+	}
+	return query, args
+}
+
+// TopUp implements account replenishment in DB, storing the idempotency key (if any) and the wallet.topped_up event
+// in the same transaction. Wallet of another currency than amt is not updated
+func (p *postgresDBInterface) TopUp(account string, amt domain.Money, key *domain.IdempotencyKey) error {
+	if err := amt.Validate(); err != nil {
+		return err
+	}
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var balance int64
+	err = tx.QueryRow("UPDATE wallets SET amount = amount + $1, updated_at = now() WHERE accountno = $2 AND currency = $3 RETURNING amount", amt.Amount, account, amt.Currency).Scan(&balance)
+	if errors.Is(err, sql.ErrNoRows) {
+		tx.Rollback()
+		log.Println("ERROR|TopUp DB rows=0")
+		return myerrors.ErrUpdateRows
+	}
+	if err != nil {
+		tx.Rollback()
+		return mapError(err)
+	}
+
+	id, err := insertTransaction(tx, "topup", domain.FundingAccount, account, domain.NewConversion(amt), "")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	event := domain.NewEvent(domain.EventWalletToppedUp, account)
+	event.Amount, event.TransactionID = &amt, int(id)
+	if err := insertOutbox(tx, event); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if key != nil {
+		response, err := json.Marshal(domain.NewMoney(balance, amt.Currency))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		key.Response = string(response)
+		if err := saveIdempotencyKey(tx, id, key); err != nil {
+			tx.Rollback()
+			return p.replayIdempotencyKey(key, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// Transfer handles money transfer between accounts, retrying on deadlock or serialization failure. It returns the
+// transaction made, or the one stored with key when another request stored it first
+func (p *postgresDBInterface) Transfer(from, to string, conv domain.Conversion, key *domain.IdempotencyKey, stepUp domain.StepUp) (*domain.Transaction, error) {
+	var err error
+	for attempt := 1; attempt <= maxTransferAttempts; attempt++ {
+		var transfer *domain.Transaction
+		if transfer, err = p.transfer(from, to, conv, key, stepUp); !isRetryable(err) {
+			return transfer, err
+		}
+		log.Printf("WARN|Transfer %s->%s attempt %d failed, retrying: %v\n", from, to, attempt, err)
+	}
+	return nil, err
+}
+
+// transfer moves money in a single transaction with both wallets locked in account order, writing the transfer
+// events in the same transaction. The non-negative balance CHECK constraint backs up the available balance check
+func (p *postgresDBInterface) transfer(from, to string, conv domain.Conversion, key *domain.IdempotencyKey, stepUp domain.StepUp) (*domain.Transaction, error) {
+	if err := conv.Debit.Validate(); err != nil {
+		return nil, err
+	}
+	if err := conv.Credit.Validate(); err != nil {
+		return nil, err
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	balances, err := lockWallets(tx, from, to)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if balances[from].Currency != conv.Debit.Currency || balances[to].Currency != conv.Credit.Currency {
+		tx.Rollback()
+		return nil, myerrors.ErrCurrencyMismatch
+	}
+	if balances[from].Amount < conv.Debit.Amount {
+		tx.Rollback()
+		return nil, myerrors.ErrInsufficientFunds
+	}
+	if err := useTransferConfirmation(tx, stepUp.ConfirmationHash); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := moveMoney(tx, from, to, conv); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	id, err := insertTransaction(tx, "transfer", from, to, conv, stepUp.Decision)
+	if err != nil {
+		tx.Rollback()
+		log.Println("ERROR|Inserting transaction:", err)
+		return nil, err
+	}
+
+	if err := insertOutbox(tx, domain.NewTransferEvents(from, to, conv, int(id))...); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	transfer := domain.NewTransfer(int(id), from, to, conv, stepUp.Decision)
+	if key != nil {
+		response, err := json.Marshal(transfer)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		key.Response = string(response)
+		if err := saveIdempotencyKey(tx, id, key); err != nil {
+			tx.Rollback()
+			if err := p.replayIdempotencyKey(key, err); err != nil {
+				return nil, err
+			}
+			return domain.DecodeTransfer(key.Response)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, mapError(err)
+	}
+	return &transfer, nil
+}
+
+// Reverse refunds amt (everything left if nil) of transaction back to its sender. The original transaction row is
+// locked first so that concurrent reversals of it are serialized and can never refund more than was transferred
+func (p *postgresDBInterface) Reverse(transactionID int, amt *domain.Money) (*domain.Transaction, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	var original domain.Transaction
+	var amount, toAmount int64
+	var currency, toCurrency string
+	err = tx.QueryRow("SELECT id, transfer_type, from_acc, to_acc, amount, currency, to_amount, to_currency, fx_rate FROM transactions WHERE id = $1 FOR UPDATE", transactionID).
+		Scan(&original.ID, &original.Type, &original.From, &original.To, &amount, &currency, &toAmount, &toCurrency, &original.Rate)
+	if errors.Is(err, sql.ErrNoRows) {
+		tx.Rollback()
+		return nil, myerrors.ErrTxNotFound
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	original.Amount = domain.NewMoney(amount, currency)
+	original.Credited = domain.NewMoney(toAmount, toCurrency)
+
+	var refunded int64
+	if err := tx.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE reverses_id = $1", transactionID).Scan(&refunded); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	conv, err := original.Refund(refunded, amt)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	// money goes back from the receiver to the sender, the funding account of a top-up has no wallet
+	from, to := original.To, original.From
+	accounts := []string{from}
+	if to != domain.FundingAccount {
+		accounts = append(accounts, to)
+	}
+	balances, err := lockWallets(tx, accounts...)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if balances[from].Amount < conv.Debit.Amount {
+		tx.Rollback()
+		return nil, myerrors.ErrInsufficientFunds
+	}
+
+	if err := moveMoney(tx, from, to, conv); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	id, err := insertTransaction(tx, domain.ReversalType, from, to, conv, "")
+	if err != nil {
+		tx.Rollback()
+		log.Println("ERROR|Inserting reversal:", err)
+		return nil, err
+	}
+	reversal := domain.Transaction{
+		ID:         int(id),
+		Type:       domain.ReversalType,
+		From:       from,
+		To:         to,
+		Amount:     conv.Debit,
+		Credited:   conv.Credit,
+		Rate:       conv.Rate,
+		ReversesID: transactionID,
+	}
+	if err := tx.QueryRow("UPDATE transactions SET reverses_id = $1 WHERE id = $2 RETURNING to_char(ts, "+tsFormat+")", transactionID, id).Scan(&reversal.Ts); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := insertOutbox(tx, domain.NewTransferEvents(from, to, conv, int(id))...); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, mapError(err)
+	}
+	return &reversal, nil
+}
+
+// PlaceHold reserves amt of the wallet until expiresAt for capturing into payee, authorized with stepUp whose
+// confirmation is used up. The wallet is locked so that a concurrent transfer cannot spend the money being held
+func (p *postgresDBInterface) PlaceHold(account, payee string, amt domain.Money, expiresAt time.Time, stepUp domain.StepUp) (*domain.Hold, error) {
+	if err := amt.Validate(); err != nil {
+		return nil, err
+	}
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	balances, err := lockWallets(tx, account)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if balances[account].Currency != amt.Currency {
+		tx.Rollback()
+		return nil, myerrors.ErrCurrencyMismatch
+	}
+	if balances[account].Amount < amt.Amount {
+		tx.Rollback()
+		return nil, myerrors.ErrInsufficientFunds
+	}
+	if err := useTransferConfirmation(tx, stepUp.ConfirmationHash); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	hold, err := scanHold(tx.QueryRow("INSERT INTO holds(accountno, payee, amount, currency, expires_at, step_up) VALUES($1, $2, $3, $4, $5, $6) RETURNING "+holdColumns,
+		account, payee, amt.Amount, amt.Currency, expiresAt, stepUp.Decision))
+	if err != nil {
+		tx.Rollback()
+		log.Println("ERROR|Inserting hold:", err)
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return hold, nil
+}
+
+// GetHold retrieves hold by ID
+func (p *postgresDBInterface) GetHold(holdID int) (*domain.Hold, error) {
+	return scanHold(p.db.QueryRow("SELECT "+holdColumns+" FROM holds WHERE id = $1", holdID))
+}
+
+// CaptureHold transfers conv.Debit out of an active hold to its payee with the step-up decision it was placed with,
+// the rest of the hold is released. The hold row is locked before the wallets so that it cannot be captured or
+// released twice
+func (p *postgresDBInterface) CaptureHold(holdID int, conv domain.Conversion) (*domain.Hold, error) {
+	if err := conv.Debit.Validate(); err != nil {
+		return nil, err
+	}
+	if err := conv.Credit.Validate(); err != nil {
+		return nil, err
+	}
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	hold, err := scanHold(tx.QueryRow("SELECT "+holdColumns+" FROM holds WHERE id = $1 FOR UPDATE", holdID))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if !hold.IsActive(time.Now()) {
+		tx.Rollback()
+		return nil, myerrors.ErrHoldNotActive
+	}
+	if hold.Amount.Currency != conv.Debit.Currency {
+		tx.Rollback()
+		return nil, myerrors.ErrCurrencyMismatch
+	}
+	if hold.Amount.Amount < conv.Debit.Amount {
+		tx.Rollback()
+		return nil, myerrors.ErrCaptureTooLarge
+	}
+	// holds placed before payees were recorded have none and can only be released
+	to := hold.Payee
+	if to == "" {
+		tx.Rollback()
+		return nil, myerrors.ErrHoldPayeeMismatch
+	}
+
+	// the held money is already excluded from the available balance, so no funds check is needed
+	balances, err := lockWallets(tx, hold.AccountNo, to)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if balances[to].Currency != conv.Credit.Currency {
+		tx.Rollback()
+		return nil, myerrors.ErrCurrencyMismatch
+	}
+
+	if err := moveMoney(tx, hold.AccountNo, to, conv); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	id, err := insertTransaction(tx, domain.HoldType, hold.AccountNo, to, conv, hold.StepUp)
+	if err != nil {
+		tx.Rollback()
+		log.Println("ERROR|Inserting capture:", err)
+		return nil, err
+	}
+	if _, err := tx.Exec("UPDATE holds SET status = $1, captured = $2, transaction_id = $3 WHERE id = $4", domain.HoldCaptured, conv.Debit.Amount, id, holdID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := insertOutbox(tx, domain.NewTransferEvents(hold.AccountNo, to, conv, int(id))...); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, mapError(err)
+	}
+	hold.Status = domain.HoldCaptured
+	hold.Captured = conv.Debit
+	hold.TransactionID = int(id)
+	return hold, nil
+}
+
+// ReleaseHold gives the whole amount of an active hold back to the available balance
+func (p *postgresDBInterface) ReleaseHold(holdID int) (*domain.Hold, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	hold, err := scanHold(tx.QueryRow("SELECT "+holdColumns+" FROM holds WHERE id = $1 FOR UPDATE", holdID))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if !hold.IsActive(time.Now()) {
+		tx.Rollback()
+		return nil, myerrors.ErrHoldNotActive
+	}
+	if _, err := tx.Exec("UPDATE holds SET status = $1 WHERE id = $2", domain.HoldReleased, holdID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	hold.Status = domain.HoldReleased
+	return hold, nil
+}
+
+// ExpireHolds marks active holds past their expiry as expired and returns how many there were
+func (p *postgresDBInterface) ExpireHolds(now time.Time) (int, error) {
+	res, err := p.db.Exec("UPDATE holds SET status = $1 WHERE status = $2 AND expires_at <= $3", domain.HoldExpired, domain.HoldActive, now)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(rows), nil
+}
+
+// scanHold scans holdColumns of row, ErrHoldNotFound if there is none
+func scanHold(row *sql.Row) (*domain.Hold, error) {
+	var hold domain.Hold
+	var amount, captured int64
+	var currency string
+	err := row.Scan(&hold.ID, &hold.Ts, &hold.AccountNo, &hold.Payee, &amount, &currency, &captured, &hold.Status, &hold.TransactionID, &hold.ExpiresAt, &hold.StepUp)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, myerrors.ErrHoldNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	hold.Amount = domain.NewMoney(amount, currency)
+	hold.Captured = domain.NewMoney(captured, currency)
+	return &hold, nil
+}
+
+// InsertSchedule stores new active schedule made with stepUp, using up its confirmation in the same transaction
+func (p *postgresDBInterface) InsertSchedule(s domain.Schedule, stepUp domain.StepUp) (*domain.Schedule, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if err := useTransferConfirmation(tx, stepUp.ConfirmationHash); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	stored, err := scanSchedule(tx.QueryRow("INSERT INTO schedules(iin, from_acc, to_acc, amount, currency, recurrence, next_run, step_up) VALUES($1, $2, $3, $4, $5, $6, $7, $8) RETURNING "+scheduleColumns,
+		s.IIN, s.From, s.To, s.Amount.Amount, s.Amount.Currency, s.Recurrence, s.NextRun, stepUp.Decision))
+	if err != nil {
+		log.Println("ERROR|Inserting schedule:", err)
+		tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return stored, nil
+}
+
+// GetSchedule retrieves schedule by ID
+func (p *postgresDBInterface) GetSchedule(scheduleID int) (*domain.Schedule, error) {
+	s, err := scanSchedule(p.db.QueryRow("SELECT "+scheduleColumns+" FROM schedules WHERE id = $1", scheduleID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, myerrors.ErrScheduleNotFound
+	}
+	return s, err
+}
+
+// GetSchedules retrieves schedules of the user
+func (p *postgresDBInterface) GetSchedules(IIN string) ([]domain.Schedule, error) {
+	return p.querySchedules("SELECT "+scheduleColumns+" FROM schedules WHERE iin = $1 ORDER BY id", IIN)
+}
+
+// GetScheduleRuns retrieves runs of schedule, oldest first
+func (p *postgresDBInterface) GetScheduleRuns(scheduleID int) ([]domain.ScheduleRun, error) {
+	rows, err := p.db.Query("SELECT id, schedule_id, ts, outcome, error FROM schedule_runs WHERE schedule_id = $1 ORDER BY id", scheduleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var runs []domain.ScheduleRun
+	for rows.Next() {
+		var run domain.ScheduleRun
+		if err := rows.Scan(&run.ID, &run.ScheduleID, &run.Ts, &run.Outcome, &run.Error); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+// CancelSchedule stops an active or paused schedule
+func (p *postgresDBInterface) CancelSchedule(scheduleID int) (*domain.Schedule, error) {
+	s, err := scanSchedule(p.db.QueryRow("UPDATE schedules SET status = $1 WHERE id = $2 AND status IN ($3, $4) RETURNING "+scheduleColumns,
+		domain.ScheduleCancelled, scheduleID, domain.ScheduleActive, domain.SchedulePaused))
+	if errors.Is(err, sql.ErrNoRows) {
+		// tell a missing schedule from one that already stopped
+		if _, err := p.GetSchedule(scheduleID); err != nil {
+			return nil, err
+		}
+		return nil, myerrors.ErrScheduleNotActive
+	}
+	return s, err
+}
+
+// GetDueSchedules retrieves active schedules whose next run is not after now, the most overdue first
+func (p *postgresDBInterface) GetDueSchedules(now time.Time) ([]domain.Schedule, error) {
+	return p.querySchedules("SELECT "+scheduleColumns+" FROM schedules WHERE status = $1 AND next_run <= $2 ORDER BY next_run", domain.ScheduleActive, now)
+}
+
+// RecordScheduleRun stores run and the next run, status and failures of s. A schedule cancelled while it was
+// running keeps its status, the run is still recorded
+func (p *postgresDBInterface) RecordScheduleRun(s domain.Schedule, run domain.ScheduleRun) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE schedules SET next_run = $1, status = $2, failures = $3 WHERE id = $4 AND status = $5",
+		s.NextRun, s.Status, s.Failures, s.ID, domain.ScheduleActive); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO schedule_runs(schedule_id, ts, outcome, error) VALUES($1, $2, $3, $4)", s.ID, run.Ts, run.Outcome, run.Error); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// querySchedules runs query selecting scheduleColumns
+func (p *postgresDBInterface) querySchedules(query string, args ...interface{}) ([]domain.Schedule, error) {
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var schedules []domain.Schedule
+	for rows.Next() {
+		s, err := scanSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, *s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return schedules, nil
+}
+
+// scanSchedule scans scheduleColumns of *sql.Row or *sql.Rows
+func scanSchedule(row interface{ Scan(...interface{}) error }) (*domain.Schedule, error) {
+	var s domain.Schedule
+	var amount int64
+	var currency string
+	if err := row.Scan(&s.ID, &s.Ts, &s.IIN, &s.From, &s.To, &amount, &currency, &s.Recurrence, &s.NextRun, &s.Status, &s.Failures, &s.StepUp); err != nil {
+		return nil, err
+	}
+	s.Amount = domain.NewMoney(amount, currency)
+	return &s, nil
+}
+
+// InsertBatch stores new pending batch with its lines made with stepUp, using up its confirmation in the same
+// transaction
+func (p *postgresDBInterface) InsertBatch(b domain.Batch, stepUp domain.StepUp) (*domain.Batch, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if err := useTransferConfirmation(tx, stepUp.ConfirmationHash); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	stored, err := scanBatch(tx.QueryRow("INSERT INTO batches(iin, from_acc, mode, status, total, currency, step_up) VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING "+batchColumns,
+		b.IIN, b.From, b.Mode, domain.BatchPending, b.Total.Amount, b.Total.Currency, stepUp.Decision))
+	if err != nil {
+		log.Println("ERROR|Inserting batch:", err)
+		tx.Rollback()
+		return nil, err
+	}
+	values := make([]string, 0, len(b.Lines))
+	args := make([]interface{}, 0, 6*len(b.Lines))
+	for i := range b.Lines {
+		line := &b.Lines[i]
+		line.Status = domain.LinePending
+		n := len(args)
+		values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5, n+6))
+		args = append(args, stored.ID, line.Line, line.To, line.Amount.Amount, line.Amount.Currency, line.Reference)
+	}
+	if _, err := tx.Exec("INSERT INTO batch_lines(batch_id, line, to_acc, amount, currency, reference) VALUES "+strings.Join(values, ", "), args...); err != nil {
+		log.Println("ERROR|Inserting batch lines:", err)
+		tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	stored.Lines = b.Lines
+	return stored, nil
+}
+
+// GetBatch retrieves batch by ID with its lines
+func (p *postgresDBInterface) GetBatch(batchID int) (*domain.Batch, error) {
+	b, err := scanBatch(p.db.QueryRow("SELECT "+batchColumns+" FROM batches WHERE id = $1", batchID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, myerrors.ErrBatchNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	rows, err := p.db.Query("SELECT line, to_acc, amount, currency, reference, status, COALESCE(transaction_id, 0), error FROM batch_lines WHERE batch_id = $1 ORDER BY line", batchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var line domain.BatchLine
+		var amount int64
+		var currency string
+		if err := rows.Scan(&line.Line, &line.To, &amount, &currency, &line.Reference, &line.Status, &line.TransactionID, &line.Error); err != nil {
+			return nil, err
+		}
+		line.Amount = domain.NewMoney(amount, currency)
+		b.Lines = append(b.Lines, line)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// GetPendingBatches retrieves batches waiting to be run without their lines, oldest first
+func (p *postgresDBInterface) GetPendingBatches() ([]domain.Batch, error) {
+	rows, err := p.db.Query("SELECT "+batchColumns+" FROM batches WHERE status = $1 ORDER BY id", domain.BatchPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var batches []domain.Batch
+	for rows.Next() {
+		b, err := scanBatch(rows)
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, *b)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return batches, nil
+}
+
+// ClaimBatch marks pending batch as running, false if another worker got to it first
+func (p *postgresDBInterface) ClaimBatch(batchID int) (bool, error) {
+	res, err := p.db.Exec("UPDATE batches SET status = $1 WHERE id = $2 AND status = $3", domain.BatchRunning, batchID, domain.BatchPending)
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows == 1, nil
+}
+
+// UpdateBatchLine stores status, transaction and error of line
+func (p *postgresDBInterface) UpdateBatchLine(batchID int, line domain.BatchLine) error {
+	transactionID := sql.NullInt64{Int64: int64(line.TransactionID), Valid: line.TransactionID != 0}
+	_, err := p.db.Exec("UPDATE batch_lines SET status = $1, transaction_id = $2, error = $3 WHERE batch_id = $4 AND line = $5",
+		line.Status, transactionID, line.Error, batchID, line.Line)
+	return err
+}
+
+// FinishBatch stores final status of batch
+func (p *postgresDBInterface) FinishBatch(batchID int, status string) error {
+	_, err := p.db.Exec("UPDATE batches SET status = $1 WHERE id = $2", status, batchID)
+	return err
+}
+
+// scanBatch scans batchColumns of *sql.Row or *sql.Rows
+func scanBatch(row interface{ Scan(...interface{}) error }) (*domain.Batch, error) {
+	var b domain.Batch
+	var total int64
+	var currency string
+	if err := row.Scan(&b.ID, &b.Ts, &b.IIN, &b.From, &b.Mode, &b.Status, &total, &currency, &b.StepUp); err != nil {
+		return nil, err
+	}
+	b.Total = domain.NewMoney(total, currency)
+	return &b, nil
+}
+
+// InsertSubscription stores new webhook subscription
+func (p *postgresDBInterface) InsertSubscription(s domain.Subscription) (*domain.Subscription, error) {
+	stored, err := scanSubscription(p.db.QueryRow("INSERT INTO webhook_subscriptions(iin, url, secret, events) VALUES($1, $2, $3, $4) RETURNING "+subscriptionColumns,
+		s.IIN, s.URL, s.Secret, strings.Join(s.Events, ",")))
+	if err != nil {
+		log.Println("ERROR|Inserting webhook subscription:", err)
+		return nil, err
+	}
+	return stored, nil
+}
+
+// GetSubscription retrieves webhook subscription by ID
+func (p *postgresDBInterface) GetSubscription(subscriptionID int) (*domain.Subscription, error) {
+	s, err := scanSubscription(p.db.QueryRow("SELECT "+subscriptionColumns+" FROM webhook_subscriptions WHERE id = $1", subscriptionID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, myerrors.ErrSubscriptionNotFound
+	}
+	return s, err
+}
+
+// GetSubscriptions retrieves webhook subscriptions of the user
+func (p *postgresDBInterface) GetSubscriptions(IIN string) ([]domain.Subscription, error) {
+	rows, err := p.db.Query("SELECT "+subscriptionColumns+" FROM webhook_subscriptions WHERE iin = $1 ORDER BY id", IIN)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var subscriptions []domain.Subscription
+	for rows.Next() {
+		s, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, *s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+// DeleteSubscription deletes webhook subscription, its deliveries go with it
+func (p *postgresDBInterface) DeleteSubscription(subscriptionID int) error {
+	res, err := p.db.Exec("DELETE FROM webhook_subscriptions WHERE id = $1", subscriptionID)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return myerrors.ErrSubscriptionNotFound
+	}
+	return nil
+}
+
+// EnqueueEvent queues delivery of event to every subscription of the owner of its account asking for its type
+// and returns how many were queued, an event already queued for a subscription is not queued again
+func (p *postgresDBInterface) EnqueueEvent(e domain.Event) (int, error) {
+	res, err := p.db.Exec("INSERT INTO webhook_deliveries(subscription_id, event_id, event_type, payload, next_attempt) "+
+		"SELECT s.id, $1, $2, $3, $4 FROM webhook_subscriptions s JOIN wallets w ON w.iin = s.iin WHERE w.accountno = $5 AND $2 = ANY(string_to_array(s.events, ',')) "+
+		"ON CONFLICT (subscription_id, event_id) DO NOTHING",
+		e.ID, e.Type, e.Payload(), e.Ts, e.Account)
+	if err != nil {
+		log.Println("ERROR|Enqueueing event:", err)
+		return 0, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(rows), nil
+}
+
+// GetDueDeliveries retrieves at most limit pending deliveries whose next attempt is not after now, the most overdue first
+func (p *postgresDBInterface) GetDueDeliveries(now time.Time, limit int) ([]domain.Delivery, error) {
+	return p.queryDeliveries("SELECT "+deliveryColumns+" FROM webhook_deliveries d JOIN webhook_subscriptions s ON s.id = d.subscription_id "+
+		"WHERE d.status = $1 AND d.next_attempt <= $2 ORDER BY d.next_attempt LIMIT $3", domain.DeliveryPending, now, limit)
+}
+
+// RecordDelivery stores status, attempts, next attempt and last error of delivery
+func (p *postgresDBInterface) RecordDelivery(d domain.Delivery) error {
+	_, err := p.db.Exec("UPDATE webhook_deliveries SET status = $1, attempts = $2, next_attempt = $3, last_error = $4 WHERE id = $5",
+		d.Status, d.Attempts, d.NextAttempt, d.LastError, d.ID)
+	return err
+}
+
+// GetDelivery retrieves webhook delivery by ID
+func (p *postgresDBInterface) GetDelivery(deliveryID int) (*domain.Delivery, error) {
+	d, err := scanDelivery(p.db.QueryRow("SELECT "+deliveryColumns+" FROM webhook_deliveries d JOIN webhook_subscriptions s ON s.id = d.subscription_id WHERE d.id = $1", deliveryID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, myerrors.ErrDeliveryNotFound
+	}
+	return d, err
+}
+
+// GetDeadDeliveries retrieves deliveries to subscriptions of the user that ran out of attempts
+func (p *postgresDBInterface) GetDeadDeliveries(IIN string) ([]domain.Delivery, error) {
+	return p.queryDeliveries("SELECT "+deliveryColumns+" FROM webhook_deliveries d JOIN webhook_subscriptions s ON s.id = d.subscription_id "+
+		"WHERE s.iin = $1 AND d.status = $2 ORDER BY d.id", IIN, domain.DeliveryDead)
+}
+
+// RequeueDelivery gives dead delivery a fresh set of attempts starting at now
+func (p *postgresDBInterface) RequeueDelivery(deliveryID int, now time.Time) error {
+	res, err := p.db.Exec("UPDATE webhook_deliveries SET status = $1, attempts = 0, next_attempt = $2 WHERE id = $3 AND status = $4",
+		domain.DeliveryPending, now, deliveryID, domain.DeliveryDead)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return myerrors.ErrDeliveryNotDead
+	}
+	return nil
+}
+
+// queryDeliveries runs query selecting deliveryColumns
+func (p *postgresDBInterface) queryDeliveries(query string, args ...interface{}) ([]domain.Delivery, error) {
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var deliveries []domain.Delivery
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, *d)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// scanSubscription scans subscriptionColumns of *sql.Row or *sql.Rows
+func scanSubscription(row interface{ Scan(...interface{}) error }) (*domain.Subscription, error) {
+	var s domain.Subscription
+	var events string
+	if err := row.Scan(&s.ID, &s.Ts, &s.IIN, &s.URL, &s.Secret, &events); err != nil {
+		return nil, err
+	}
+	s.Events = strings.Split(events, ",")
+	return &s, nil
+}
+
+// scanDelivery scans deliveryColumns of *sql.Row or *sql.Rows
+func scanDelivery(row interface{ Scan(...interface{}) error }) (*domain.Delivery, error) {
+	var d domain.Delivery
+	if err := row.Scan(&d.ID, &d.Ts, &d.SubscriptionID, &d.IIN, &d.URL, &d.Secret, &d.EventID, &d.EventType, &d.Payload, &d.Status, &d.Attempts, &d.NextAttempt, &d.LastError); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// GetUnpublishedEvents retrieves at most limit events of the outbox not yet published, in the order they were written
+func (p *postgresDBInterface) GetUnpublishedEvents(limit int) ([]domain.Event, error) {
+	rows, err := p.db.Query("SELECT payload FROM outbox WHERE published_at IS NULL ORDER BY id LIMIT $1", limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanEvents(rows)
+}
+
+// MarkEventPublished records that event of the outbox was published at given time
+func (p *postgresDBInterface) MarkEventPublished(eventID string, at time.Time) error {
+	_, err := p.db.Exec("UPDATE outbox SET published_at = $1 WHERE event_id = $2", at, eventID)
+	return err
+}
+
+// GetEventsAfter retrieves at most limit events of wallets of the user written to the outbox after the event with
+// eventID, published or not, in the order they were written
+func (p *postgresDBInterface) GetEventsAfter(IIN, eventID string, limit int) ([]domain.Event, error) {
+	var id int64
+	err := p.db.QueryRow("SELECT id FROM outbox WHERE event_id = $1", eventID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, myerrors.ErrEventNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	rows, err := p.db.Query("SELECT o.payload FROM outbox o JOIN wallets w ON w.accountno = o.payload::json->>'account' "+
+		"WHERE w.iin = $1 AND o.id > $2 ORDER BY o.id LIMIT $3", IIN, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanEvents(rows)
+}
+
+// GetOutboxPosition retrieves position of the latest event of the outbox, 0 when it is empty
+func (p *postgresDBInterface) GetOutboxPosition() (int64, error) {
+	var position int64
+	err := p.db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM outbox").Scan(&position)
+	return position, err
+}
+
+// GetEventsSince retrieves at most limit events of every wallet written to the outbox after position, published or
+// not, in the order they were written along with the position of the last one
+func (p *postgresDBInterface) GetEventsSince(position int64, limit int) ([]domain.Event, int64, error) {
+	rows, err := p.db.Query("SELECT id, payload FROM outbox WHERE id > $1 ORDER BY id LIMIT $2", position, limit)
+	if err != nil {
+		return nil, position, err
+	}
+	defer rows.Close()
+	var events []domain.Event
+	for rows.Next() {
+		var payload string
+		if err := rows.Scan(&position, &payload); err != nil {
+			return nil, 0, err
+		}
+		var e domain.Event
+		if err := json.Unmarshal([]byte(payload), &e); err != nil {
+			return nil, 0, err
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return events, position, nil
+}
+
+// scanEvents reads events from payload rows and closes them
+func scanEvents(rows *sql.Rows) ([]domain.Event, error) {
+	defer rows.Close()
+	var events []domain.Event
+	for rows.Next() {
+		var payload string
+		if err := rows.Scan(&payload); err != nil {
+			return nil, err
+		}
+		var e domain.Event
+		if err := json.Unmarshal([]byte(payload), &e); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// insertOutbox writes events to the outbox within tx, they are published by the relay once tx is committed
+func insertOutbox(tx *sql.Tx, events ...domain.Event) error {
+	for _, e := range events {
+		if _, err := tx.Exec("INSERT INTO outbox(event_id, event_type, payload) VALUES($1, $2, $3)", e.ID, e.Type, e.Payload()); err != nil {
+			log.Println("ERROR|Inserting outbox event:", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// moveMoney debits from and credits to wallets, the funding account has no wallet to update
+func moveMoney(tx *sql.Tx, from, to string, conv domain.Conversion) error {
+	if from != domain.FundingAccount {
+		if _, err := tx.Exec("UPDATE wallets SET amount = amount - $1, updated_at = now() WHERE accountno = $2", conv.Debit.Amount, from); err != nil {
+			return mapError(err)
+		}
+	}
+	if to != domain.FundingAccount {
+		if _, err := tx.Exec("UPDATE wallets SET amount = amount + $1, updated_at = now() WHERE accountno = $2", conv.Credit.Amount, to); err != nil {
+			return mapError(err)
+		}
+	}
+	return nil
+}
+
+// GetIdempotencyKey retrieves a non-expired idempotency key of the user, nil if there is none
+func (p *postgresDBInterface) GetIdempotencyKey(IIN, key string) (*domain.IdempotencyKey, error) {
+	var idem domain.IdempotencyKey
+	err := p.db.QueryRow("SELECT idem_key, iin, request_hash, response, transaction_id FROM idempotency_keys WHERE iin = $1 AND idem_key = $2 AND expires_at > $3", IIN, key, time.Now()).
+		Scan(&idem.Key, &idem.IIN, &idem.RequestHash, &idem.Response, &idem.TransactionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &idem, nil
+}
+
+// GetTrialBalance sums up postings per currency and reports unbalanced transactions and wallets whose balance differs from their postings
+func (p *postgresDBInterface) GetTrialBalance() (*domain.TrialBalance, error) {
+	tb := domain.TrialBalance{Totals: make(map[string]int64)}
+	totalRows, err := p.db.Query("SELECT currency, SUM(amount), COUNT(*) FROM postings GROUP BY currency")
+	if err != nil {
+		return nil, err
+	}
+	defer totalRows.Close()
+	balanced := true
+	for totalRows.Next() {
+		var currency string
+		var total int64
+		var count int
+		if err := totalRows.Scan(&currency, &total, &count); err != nil {
+			return nil, err
+		}
+		tb.Totals[currency] = total
+		tb.Postings += count
+		balanced = balanced && total == 0
+	}
+	if err = totalRows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err := p.db.Query("SELECT DISTINCT transaction_id FROM postings GROUP BY transaction_id, currency HAVING SUM(amount) <> 0 ORDER BY transaction_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		tb.Unbalanced = append(tb.Unbalanced, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	walletRows, err := p.db.Query("SELECT w.accountno FROM wallets w LEFT JOIN postings p ON p.accountno = w.accountno GROUP BY w.accountno, w.amount HAVING w.amount <> COALESCE(SUM(p.amount), 0)")
+	if err != nil {
+		return nil, err
+	}
+	defer walletRows.Close()
+	for walletRows.Next() {
+		var account string
+		if err := walletRows.Scan(&account); err != nil {
+			return nil, err
+		}
+		tb.Mismatched = append(tb.Mismatched, account)
+	}
+	if err = walletRows.Err(); err != nil {
+		return nil, err
+	}
+
+	tb.Balanced = balanced && len(tb.Unbalanced) == 0 && len(tb.Mismatched) == 0
+	return &tb, nil
+}
+
+// insertTransaction inserts transaction row of conversion with step-up decision stepUp and its balanced postings and
+// returns its ID
+func insertTransaction(tx *sql.Tx, transferType, debit, credit string, conv domain.Conversion, stepUp string) (int64, error) {
+	var id int64
+	if err := tx.QueryRow("INSERT INTO transactions(transfer_type, from_acc, to_acc, amount, currency, to_amount, to_currency, fx_rate, step_up) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id",
+		transferType, debit, credit, conv.Debit.Amount, conv.Debit.Currency, conv.Credit.Amount, conv.Credit.Currency, conv.Rate, stepUp).Scan(&id); err != nil {
+		return 0, err
+	}
+	postings := conv.Postings(debit, credit)
+	values := make([]string, 0, len(postings))
+	args := []interface{}{id}
+	for _, posting := range postings {
+		n := len(args)
+		values = append(values, fmt.Sprintf("($1, $%d, $%d, $%d)", n+1, n+2, n+3))
+		args = append(args, posting.AccountNo, posting.Amount, posting.Currency)
+	}
+	if _, err := tx.Exec("INSERT INTO postings(transaction_id, accountno, amount, currency) VALUES"+strings.Join(values, ", "), args...); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// replayIdempotencyKey answers request whose key failed to save with err as a replay when the same request stored it
+// concurrently, loading the stored key into key. Requests with another payload keep failing on the conflict
+func (p *postgresDBInterface) replayIdempotencyKey(key *domain.IdempotencyKey, err error) error {
+	if err != myerrors.ErrIdempotencyConflict {
+		return err
+	}
+	stored, err := p.GetIdempotencyKey(key.IIN, key.Key)
+	if err != nil {
+		return err
+	}
+	if stored == nil || stored.RequestHash != key.RequestHash {
+		return myerrors.ErrIdempotencyConflict
+	}
+	log.Printf("INFO|Replaying request with idempotency key %s stored concurrently by transaction %d\n", stored.Key, stored.TransactionID)
+	*key = *stored
+	return nil
+}
+
+// saveIdempotencyKey links idempotency key to the transaction, replacing an expired key if present
+func saveIdempotencyKey(tx *sql.Tx, transactionID int64, key *domain.IdempotencyKey) error {
+	key.TransactionID = int(transactionID)
+	if _, err := tx.Exec("DELETE FROM idempotency_keys WHERE iin = $1 AND idem_key = $2 AND expires_at <= $3", key.IIN, key.Key, time.Now()); err != nil {
+		return err
+	}
+	_, err := tx.Exec("INSERT INTO idempotency_keys(iin, idem_key, request_hash, response, transaction_id, expires_at) VALUES($1, $2, $3, $4, $5, $6)",
+		key.IIN, key.Key, key.RequestHash, key.Response, key.TransactionID, key.ExpiresAt)
+	return mapError(err)
+}
+
+// lockWallets locks given wallets with SELECT ... FOR UPDATE in ascending account order and returns their available
+// balances, that is ledger balance less active holds
+func lockWallets(tx *sql.Tx, accounts ...string) (map[string]domain.Money, error) {
+	sorted := append([]string(nil), accounts...)
+	sort.Strings(sorted)
+	balances := make(map[string]domain.Money, len(sorted))
+	for _, account := range sorted {
+		if _, ok := balances[account]; ok {
+			continue
+		}
+		var amount int64
+		var currency string
+		err := tx.QueryRow("SELECT w.amount - "+heldSQL+", w.currency FROM wallets w WHERE w.accountno = $2 FOR UPDATE OF w", time.Now(), account).Scan(&amount, &currency)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, myerrors.ErrWalletNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		balances[account] = domain.NewMoney(amount, currency)
+	}
+	return balances, nil
+}
+
+// InsertUser stores new user of the auth service, usernames and IINs are unique
+func (p *postgresDBInterface) InsertUser(u domain.User) (*domain.User, error) {
+	stored, err := scanUser(p.db.QueryRow("INSERT INTO users(iin, username, password_hash, roles) VALUES($1, $2, $3, $4) RETURNING "+userColumns,
+		u.IIN, u.Username, u.PasswordHash, joinRoles(u.Roles)))
+	if err != nil {
+		log.Println("ERROR|Inserting user:", err)
+		return nil, mapError(err)
+	}
+	return stored, nil
+}
+
+// GetUser retrieves user by ID
+func (p *postgresDBInterface) GetUser(userID int) (*domain.User, error) {
+	u, err := scanUser(p.db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1", userID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, myerrors.ErrUserNotFound
+	}
+	return u, err
+}
+
+// GetUserByUsername retrieves user by username
+func (p *postgresDBInterface) GetUserByUsername(username string) (*domain.User, error) {
+	u, err := scanUser(p.db.QueryRow("SELECT "+userColumns+" FROM users WHERE username = $1", username))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, myerrors.ErrUserNotFound
+	}
+	return u, err
+}
+
+// scanUser scans userColumns of *sql.Row or *sql.Rows
+func scanUser(row interface{ Scan(...interface{}) error }) (*domain.User, error) {
+	var u domain.User
+	var roles string
+	if err := row.Scan(&u.ID, &u.Ts, &u.IIN, &u.Username, &u.PasswordHash, &roles); err != nil {
+		return nil, err
+	}
+	for _, role := range strings.Split(roles, ",") {
+		u.Roles = append(u.Roles, domain.Role(role))
+	}
+	return &u, nil
+}
+
+// joinRoles joins roles into comma separated list stored in users.roles
+func joinRoles(roles []domain.Role) string {
+	names := make([]string, len(roles))
+	for i, role := range roles {
+		names[i] = string(role)
+	}
+	return strings.Join(names, ",")
+}
+
+// InsertRefreshToken stores refresh token starting a new family
+func (p *postgresDBInterface) InsertRefreshToken(t domain.RefreshToken) error {
+	_, err := p.db.Exec("INSERT INTO refresh_tokens(token_hash, family_id, user_id, status, expires_at) VALUES($1, $2, $3, $4, $5)",
+		t.Hash, t.FamilyID, t.UserID, t.Status, t.ExpiresAt)
+	return err
+}
+
+// GetRefreshToken retrieves refresh token by hash of its value
+func (p *postgresDBInterface) GetRefreshToken(hash string) (*domain.RefreshToken, error) {
+	var t domain.RefreshToken
+	err := p.db.QueryRow("SELECT to_char(ts, "+tsFormat+"), token_hash, family_id, user_id, status, expires_at FROM refresh_tokens WHERE token_hash = $1", hash).
+		Scan(&t.Ts, &t.Hash, &t.FamilyID, &t.UserID, &t.Status, &t.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, myerrors.ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// RotateRefreshToken uses up active refresh token with hash and stores next of its family in its place, false if
+// the token was used or revoked already, so that of two requests refreshing with the same token only one succeeds
+func (p *postgresDBInterface) RotateRefreshToken(hash string, next domain.RefreshToken) (bool, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	res, err := tx.Exec("UPDATE refresh_tokens SET status = $1 WHERE token_hash = $2 AND status = $3",
+		domain.RefreshTokenUsed, hash, domain.RefreshTokenActive)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if rows == 0 {
+		tx.Rollback()
+		return false, nil
+	}
+	if _, err := tx.Exec("INSERT INTO refresh_tokens(token_hash, family_id, user_id, status, expires_at) VALUES($1, $2, $3, $4, $5)",
+		next.Hash, next.FamilyID, next.UserID, next.Status, next.ExpiresAt); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	return true, nil
+}
+
+// RevokeRefreshTokens revokes active refresh tokens of the family
+func (p *postgresDBInterface) RevokeRefreshTokens(familyID string) error {
+	_, err := p.db.Exec("UPDATE refresh_tokens SET status = $1 WHERE family_id = $2 AND status = $3",
+		domain.RefreshTokenRevoked, familyID, domain.RefreshTokenActive)
+	return err
+}
+
+// GetSessions retrieves sessions of the user with an active refresh token not expired by now, oldest refreshed first
+func (p *postgresDBInterface) GetSessions(IIN string, now time.Time) ([]domain.Session, error) {
+	rows, err := p.db.Query("SELECT r.family_id, to_char((SELECT MIN(f.ts) FROM refresh_tokens f WHERE f.family_id = r.family_id), "+tsFormat+"), "+
+		"to_char(r.ts, "+tsFormat+"), r.expires_at FROM refresh_tokens r JOIN users u ON u.id = r.user_id "+
+		"WHERE u.iin = $1 AND r.status = $2 AND r.expires_at > $3 ORDER BY r.ts, r.family_id",
+		IIN, domain.RefreshTokenActive, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sessions []domain.Session
+	for rows.Next() {
+		var s domain.Session
+		if err := rows.Scan(&s.ID, &s.CreatedAt, &s.RefreshedAt, &s.ExpiresAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// InsertRevocation stores revocation, replacing an earlier one of the same kind and subject
+func (p *postgresDBInterface) InsertRevocation(r domain.Revocation) error {
+	_, err := p.db.Exec("INSERT INTO revocations(kind, subject, revoked_at, expires_at) VALUES($1, $2, $3, $4) "+
+		"ON CONFLICT (kind, subject) DO UPDATE SET revoked_at = EXCLUDED.revoked_at, expires_at = EXCLUDED.expires_at",
+		r.Kind, r.Subject, r.RevokedAt, r.ExpiresAt)
+	return err
+}
+
+// GetRevocations retrieves revocations made since given time, in the order they were made
+func (p *postgresDBInterface) GetRevocations(since time.Time) ([]domain.Revocation, error) {
+	rows, err := p.db.Query("SELECT kind, subject, revoked_at, expires_at FROM revocations WHERE revoked_at >= $1 ORDER BY revoked_at", since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var revocations []domain.Revocation
+	for rows.Next() {
+		var r domain.Revocation
+		if err := rows.Scan(&r.Kind, &r.Subject, &r.RevokedAt, &r.ExpiresAt); err != nil {
+			return nil, err
+		}
+		revocations = append(revocations, r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return revocations, nil
+}
+
+// DeleteExpiredRevocations deletes revocations past their expiry and returns how many there were
+func (p *postgresDBInterface) DeleteExpiredRevocations(now time.Time) (int, error) {
+	res, err := p.db.Exec("DELETE FROM revocations WHERE expires_at <= $1", now)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := res.RowsAffected()
+	return int(rows), err
+}
+
+// GetTOTP retrieves TOTP authenticator of IIN
+func (p *postgresDBInterface) GetTOTP(IIN string) (*domain.TOTP, error) {
+	t := domain.TOTP{IIN: IIN}
+	var lockedUntil sql.NullTime
+	err := p.db.QueryRow("SELECT secret, active, last_step, failed_attempts, locked_until FROM totp_authenticators WHERE iin = $1", IIN).
+		Scan(&t.Secret, &t.Active, &t.LastStep, &t.FailedAttempts, &lockedUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, myerrors.ErrTOTPNotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.LockedUntil = lockedUntil.Time
+	return &t, nil
+}
+
+// SaveTOTP stores authenticator of t.IIN without failed attempts, replacing the one it had
+func (p *postgresDBInterface) SaveTOTP(t domain.TOTP) error {
+	_, err := p.db.Exec("INSERT INTO totp_authenticators(iin, secret, active, last_step) VALUES($1, $2, $3, $4) "+
+		"ON CONFLICT (iin) DO UPDATE SET secret = EXCLUDED.secret, active = EXCLUDED.active, last_step = EXCLUDED.last_step, failed_attempts = 0, locked_until = NULL",
+		t.IIN, t.Secret, t.Active, t.LastStep)
+	return err
+}
+
+// UseTOTPStep records code of step accepted from IIN and clears its failed attempts, activating the authenticator if
+// activate is set. False if a code of step or a later one was accepted already, so that every code is used once
+func (p *postgresDBInterface) UseTOTPStep(IIN string, step int64, activate bool) (bool, error) {
+	res, err := p.db.Exec("UPDATE totp_authenticators SET last_step = $1, failed_attempts = 0, locked_until = NULL, active = active OR $2 WHERE iin = $3 AND last_step < $1",
+		step, activate, IIN)
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	return rows == 1, err
+}
+
+// FailTOTP counts a wrong code of IIN, locking codes out until lockedUntil from the maxAttempts-th wrong one in a row
+func (p *postgresDBInterface) FailTOTP(IIN string, maxAttempts int, lockedUntil time.Time) error {
+	_, err := p.db.Exec("UPDATE totp_authenticators SET locked_until = CASE WHEN failed_attempts + 1 >= $1 THEN $2 ELSE locked_until END, "+
+		"failed_attempts = failed_attempts + 1 WHERE iin = $3", maxAttempts, lockedUntil, IIN)
+	return err
+}
+
+// DeleteTOTP deletes authenticator of IIN
+func (p *postgresDBInterface) DeleteTOTP(IIN string) error {
+	_, err := p.db.Exec("DELETE FROM totp_authenticators WHERE iin = $1", IIN)
+	return err
+}
+
+// InsertTransferConfirmation stores confirmation of a transfer
+func (p *postgresDBInterface) InsertTransferConfirmation(c domain.TransferConfirmation) error {
+	_, err := p.db.Exec("INSERT INTO transfer_confirmations(token_hash, iin, from_acc, to_acc, amount, currency, expires_at) VALUES($1, $2, $3, $4, $5, $6, $7)",
+		c.Hash, c.IIN, c.From, c.To, c.Amount.Amount, c.Amount.Currency, c.ExpiresAt)
+	return err
+}
+
+// GetTransferConfirmation retrieves confirmation with hash that is not used and not expired by now
+func (p *postgresDBInterface) GetTransferConfirmation(hash string, now time.Time) (*domain.TransferConfirmation, error) {
+	c := domain.TransferConfirmation{Hash: hash}
+	var amount int64
+	var currency string
+	err := p.db.QueryRow("SELECT iin, from_acc, to_acc, amount, currency, expires_at FROM transfer_confirmations WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2", hash, now).
+		Scan(&c.IIN, &c.From, &c.To, &amount, &currency, &c.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, myerrors.ErrInvalidConfirmation
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.Amount = domain.NewMoney(amount, currency)
+	return &c, nil
+}
+
+// useTransferConfirmation uses up confirmation with hash within tx, if there is one. Of two transactions using the
+// same confirmation only one gets it, the other fails with ErrInvalidConfirmation
+func useTransferConfirmation(tx *sql.Tx, hash string) error {
+	if hash == "" {
+		return nil
+	}
+	now := time.Now()
+	res, err := tx.Exec("UPDATE transfer_confirmations SET used_at = $1 WHERE token_hash = $2 AND used_at IS NULL AND expires_at > $1", now, hash)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return myerrors.ErrInvalidConfirmation
+	}
+	return nil
+}
+
+// mapError translates constraint violations into domain errors
+func mapError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+	switch pqErr.Code {
+	case "23514": // check_violation, wallets_amount_non_negative
+		return myerrors.ErrInsufficientFunds
+	case "23505": // unique_violation, same idempotency key stored concurrently or username or IIN taken
+		switch pqErr.Table {
+		case "idempotency_keys":
+			return myerrors.ErrIdempotencyConflict
+		case "users":
+			return myerrors.ErrUserExists
+		}
+	}
+	return err
+}
+
+// isRetryable reports whether transaction failed on deadlock or serialization failure and may be retried
+func isRetryable(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && (pqErr.Code == "40P01" || pqErr.Code == "40001")
+}
+
+// NewPostgresDBInterface returns a new DB
+func NewPostgresDBInterface(dbURL string) (repository.DBInterface, error) {
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		log.Println("ERROR|Error while opening DB:", err)
+		return nil, err
+	}
+	db.SetMaxOpenConns(25)
+	db.SetMaxIdleConns(25)
+	db.SetConnMaxLifetime(time.Minute * 5)
+	db.SetConnMaxIdleTime(time.Minute * 2)
+	start := time.Now()
+	for db.Ping() != nil {
+		if time.Now().After(start.Add(time.Minute * 20)) {
+			log.Println("ERROR|Failed to connect after 20 minutes")
+			return nil, db.Ping()
+		}
+	}
+	log.Println("DB Pong", db.Ping() == nil)
+
+	return &postgresDBInterface{db: db}, nil
+}
+
+// Close closes DB
+func (p *postgresDBInterface) Close() {
+	p.db.Close()
+}
@@ -0,0 +1,838 @@
+package postgres
+
+import (
+	"database/sql"
+	"log"
+	"testing"
+	"time"
+	"wallet/domain"
+	"wallet/myerrors"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+var w = &domain.Wallet{
+	ID:        1,
+	Ts:        "2021-12-31 19:36:36",
+	UpdatedAt: "",
+	AccountNo: "KZT0000000001",
+	IIN:       "910815450350",
+	Ledger:    domain.NewMoney(0, domain.DefaultCurrency),
+	Available: domain.NewMoney(0, domain.DefaultCurrency),
+}
+
+// outbox is the insert of an event, whose ID and payload are not known up front
+const outbox = "INSERT INTO outbox(event_id, event_type, payload) VALUES($1, $2, $3)"
+
+const lock = "SELECT w.amount - " + heldSQL + ", w.currency FROM wallets w WHERE w.accountno = $2 FOR UPDATE OF w"
+
+func NewMock() (*sql.DB, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		log.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	return db, mock
+}
+
+func TestLastAccountNo(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+
+	query := "SELECT accountno FROM wallets ORDER BY id DESC LIMIT 1"
+
+	mock.ExpectQuery(query).WillReturnRows(sqlmock.NewRows([]string{"accountno"}).AddRow(w.AccountNo))
+	acc, err := repo.GetLastAccountNo()
+	assert.Equal(t, w.AccountNo, acc)
+	assert.NoError(t, err)
+
+	mock.ExpectQuery(query).WillReturnRows(sqlmock.NewRows([]string{"accountno"}).AddRow("KZT000"))
+	_, err = repo.GetLastAccountNo()
+	assert.Error(t, err)
+}
+
+func TestInsertWallet(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO wallets (accountno, iin, currency) VALUES ($1, $2, $3)").WithArgs(w.AccountNo, w.IIN, "USD").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventWalletCreated, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	assert.NoError(t, repo.InsertWallet(w.AccountNo, w.IIN, "USD"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetWallets(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+
+	query := "SELECT w.accountno, w.id, to_char(w.ts, 'YYYY-MM-DD HH24:MI:SS'), to_char(w.updated_at, 'YYYY-MM-DD HH24:MI:SS'), w.amount, w.currency, " + heldSQL + " FROM wallets w WHERE w.iin = $2 ORDER BY w.id"
+
+	// 0.40 of the 1.00 on the ledger is held
+	rows := sqlmock.NewRows([]string{"accountno", "id", "ts", "updated_at", "amount", "currency", "held"}).
+		AddRow(w.AccountNo, w.ID, w.Ts, w.UpdatedAt, 100, w.Ledger.Currency, 40)
+
+	mock.ExpectQuery(query).WithArgs(sqlmock.AnyArg(), w.IIN).WillReturnRows(rows)
+	wallets, err := repo.GetWallets(w.IIN)
+	assert.Equal(t, []domain.Wallet{{ID: w.ID, Ts: w.Ts, AccountNo: w.AccountNo, Ledger: domain.NewMoney(100, "KZT"), Available: domain.NewMoney(60, "KZT")}}, wallets)
+	assert.NoError(t, err)
+}
+
+func TestGetWallet(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+
+	query := "SELECT w.accountno, w.id, w.iin, to_char(w.ts, 'YYYY-MM-DD HH24:MI:SS'), to_char(w.updated_at, 'YYYY-MM-DD HH24:MI:SS'), w.amount, w.currency, " + heldSQL + " FROM wallets w WHERE w.accountno = $2"
+
+	rows := sqlmock.NewRows([]string{"accountno", "id", "iin", "ts", "updated_at", "amount", "currency", "held"}).
+		AddRow(w.AccountNo, w.ID, w.IIN, w.Ts, w.UpdatedAt, 100, w.Ledger.Currency, 40)
+	mock.ExpectQuery(query).WithArgs(sqlmock.AnyArg(), w.AccountNo).WillReturnRows(rows)
+	mock.ExpectQuery(query).WithArgs(sqlmock.AnyArg(), "KZT0000000009").WillReturnError(sql.ErrNoRows)
+
+	wallet, err := repo.GetWallet(w.AccountNo)
+	assert.NoError(t, err)
+	assert.Equal(t, &domain.Wallet{ID: w.ID, Ts: w.Ts, AccountNo: w.AccountNo, IIN: w.IIN, Ledger: domain.NewMoney(100, "KZT"), Available: domain.NewMoney(60, "KZT")}, wallet)
+	_, err = repo.GetWallet("KZT0000000009")
+	assert.Equal(t, myerrors.ErrWalletNotFound, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestConfirmIIN(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+
+	query := "SELECT iin FROM wallets WHERE accountno = $1"
+
+	mock.ExpectQuery(query).WithArgs(w.AccountNo).WillReturnRows(sqlmock.NewRows([]string{"iin"}).AddRow(w.IIN))
+	ok, err := repo.ConfirmIIN(w.IIN, w.AccountNo)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+
+	mock.ExpectQuery(query).WithArgs(w.AccountNo).WillReturnError(sql.ErrNoRows)
+	ok, err = repo.ConfirmIIN(w.IIN, w.AccountNo)
+	assert.False(t, ok)
+	assert.Error(t, err)
+}
+
+func TestGetBalanceAt(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+
+	query := "SELECT w.currency, COALESCE((SELECT SUM(p.amount) FROM postings p JOIN transactions t ON t.id = p.transaction_id WHERE p.accountno = w.accountno AND t.ts < $1), 0) FROM wallets w WHERE w.accountno = $2"
+	at := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery(query).WithArgs(at, w.AccountNo).WillReturnRows(sqlmock.NewRows([]string{"currency", "amount"}).AddRow("KZT", 12345))
+	balance, err := repo.GetBalanceAt(w.AccountNo, at)
+	assert.NoError(t, err)
+	assert.Equal(t, domain.NewMoney(12345, "KZT"), balance)
+}
+
+func TestGetTransactions(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+
+	query := "SELECT id, to_char(ts, 'YYYY-MM-DD HH24:MI:SS'), transfer_type, from_acc, to_acc, amount, currency, to_amount, to_currency, fx_rate, reverses_id, step_up FROM transactions WHERE (from_acc = $1 OR to_acc = $2) ORDER BY id ASC LIMIT $3"
+
+	rows := sqlmock.NewRows([]string{"id", "ts", "type", "from", "to", "amount", "currency", "to_amount", "to_currency", "fx_rate", "reverses_id", "step_up"}).
+		AddRow(1, "2021-12-31 19:36:36", "topup", domain.FundingAccount, w.AccountNo, 123, "KZT", 123, "KZT", "", nil, "")
+
+	mock.ExpectQuery(query).WithArgs(w.AccountNo, w.AccountNo, 2).WillReturnRows(rows)
+	txs, err := repo.GetTransactions(domain.TransactionFilter{Account: w.AccountNo, Limit: 2})
+	assert.NoError(t, err)
+	if assert.Len(t, txs, 1) {
+		assert.Equal(t, domain.NewMoney(123, "KZT"), txs[0].Credited)
+	}
+}
+
+func TestTopUp(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+	key := &domain.IdempotencyKey{Key: "2f1c7a52", IIN: w.IIN, RequestHash: "hash"}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE wallets SET amount = amount + $1, updated_at = now() WHERE accountno = $2 AND currency = $3 RETURNING amount").
+		WithArgs(100, w.AccountNo, "KZT").WillReturnRows(sqlmock.NewRows([]string{"amount"}).AddRow("100"))
+	mock.ExpectQuery("INSERT INTO transactions(transfer_type, from_acc, to_acc, amount, currency, to_amount, to_currency, fx_rate, step_up) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id").
+		WithArgs("topup", domain.FundingAccount, w.AccountNo, 100, "KZT", 100, "KZT", "", "").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	mock.ExpectExec("INSERT INTO postings(transaction_id, accountno, amount, currency) VALUES($1, $2, $3, $4), ($1, $5, $6, $7)").
+		WithArgs(7, domain.FundingAccount, -100, "KZT", w.AccountNo, 100, "KZT").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventWalletToppedUp, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM idempotency_keys WHERE iin = $1 AND idem_key = $2 AND expires_at <= $3").
+		WithArgs(key.IIN, key.Key, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO idempotency_keys(iin, idem_key, request_hash, response, transaction_id, expires_at) VALUES($1, $2, $3, $4, $5, $6)").
+		WithArgs(key.IIN, key.Key, key.RequestHash, `{"amount":"1.00","currency":"KZT"}`, 7, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, repo.TopUp(w.AccountNo, domain.NewMoney(100, domain.DefaultCurrency), key))
+	assert.Equal(t, `{"amount":"1.00","currency":"KZT"}`, key.Response)
+	assert.Equal(t, 7, key.TransactionID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTopUpConcurrent(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+	key := &domain.IdempotencyKey{Key: "2f1c7a52", IIN: w.IIN, RequestHash: "hash"}
+
+	// the same key is stored by a concurrent request before this one commits, so it is answered as a replay
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE wallets SET amount = amount + $1, updated_at = now() WHERE accountno = $2 AND currency = $3 RETURNING amount").
+		WithArgs(100, w.AccountNo, "KZT").WillReturnRows(sqlmock.NewRows([]string{"amount"}).AddRow("200"))
+	mock.ExpectQuery("INSERT INTO transactions(transfer_type, from_acc, to_acc, amount, currency, to_amount, to_currency, fx_rate, step_up) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id").
+		WithArgs("topup", domain.FundingAccount, w.AccountNo, 100, "KZT", 100, "KZT", "", "").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(8))
+	mock.ExpectExec("INSERT INTO postings(transaction_id, accountno, amount, currency) VALUES($1, $2, $3, $4), ($1, $5, $6, $7)").
+		WithArgs(8, domain.FundingAccount, -100, "KZT", w.AccountNo, 100, "KZT").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventWalletToppedUp, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM idempotency_keys WHERE iin = $1 AND idem_key = $2 AND expires_at <= $3").
+		WithArgs(key.IIN, key.Key, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO idempotency_keys(iin, idem_key, request_hash, response, transaction_id, expires_at) VALUES($1, $2, $3, $4, $5, $6)").
+		WithArgs(key.IIN, key.Key, key.RequestHash, `{"amount":"2.00","currency":"KZT"}`, 8, sqlmock.AnyArg()).
+		WillReturnError(&pq.Error{Code: "23505", Table: "idempotency_keys"})
+	mock.ExpectRollback()
+	mock.ExpectQuery("SELECT idem_key, iin, request_hash, response, transaction_id FROM idempotency_keys WHERE iin = $1 AND idem_key = $2 AND expires_at > $3").
+		WithArgs(key.IIN, key.Key, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"idem_key", "iin", "request_hash", "response", "transaction_id"}).
+			AddRow(key.Key, key.IIN, key.RequestHash, `{"amount":"1.00","currency":"KZT"}`, 7))
+
+	assert.NoError(t, repo.TopUp(w.AccountNo, domain.NewMoney(100, domain.DefaultCurrency), key))
+	assert.Equal(t, `{"amount":"1.00","currency":"KZT"}`, key.Response)
+	assert.Equal(t, 7, key.TransactionID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTopUpUnknownAccount(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE wallets SET amount = amount + $1, updated_at = now() WHERE accountno = $2 AND currency = $3 RETURNING amount").
+		WithArgs(100, w.AccountNo, "KZT").WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	assert.Equal(t, myerrors.ErrUpdateRows, repo.TopUp(w.AccountNo, domain.NewMoney(100, domain.DefaultCurrency), nil))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTransfer(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000001").WillReturnRows(sqlmock.NewRows([]string{"available", "currency"}).AddRow(5000, "KZT"))
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000002").WillReturnRows(sqlmock.NewRows([]string{"available", "currency"}).AddRow(5000, "KZT"))
+	mock.ExpectExec("UPDATE wallets SET amount = amount - $1, updated_at = now() WHERE accountno = $2").WithArgs(123, "KZT0000000002").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE wallets SET amount = amount + $1, updated_at = now() WHERE accountno = $2").WithArgs(123, "KZT0000000001").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO transactions(transfer_type, from_acc, to_acc, amount, currency, to_amount, to_currency, fx_rate, step_up) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id").
+		WithArgs("transfer", "KZT0000000002", "KZT0000000001", 123, "KZT", 123, "KZT", "", domain.StepUpNotRequired).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec("INSERT INTO postings(transaction_id, accountno, amount, currency) VALUES($1, $2, $3, $4), ($1, $5, $6, $7)").
+		WithArgs(1, "KZT0000000002", -123, "KZT", "KZT0000000001", 123, "KZT").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventTransferSent, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventTransferReceived, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	conv := domain.NewConversion(domain.NewMoney(123, domain.DefaultCurrency))
+	transfer, err := repo.Transfer("KZT0000000002", "KZT0000000001", conv, nil, domain.StepUp{Decision: domain.StepUpNotRequired})
+	assert.NoError(t, err)
+	assert.Equal(t, &domain.Transaction{ID: 1, Type: "transfer", From: "KZT0000000002", To: "KZT0000000001", Amount: conv.Debit,
+		Credited: conv.Credit, StepUp: domain.StepUpNotRequired}, transfer)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTransferCheckViolation(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000001").WillReturnRows(sqlmock.NewRows([]string{"available", "currency"}).AddRow(5000, "KZT"))
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000002").WillReturnRows(sqlmock.NewRows([]string{"available", "currency"}).AddRow(5000, "KZT"))
+	mock.ExpectExec("UPDATE wallets SET amount = amount - $1, updated_at = now() WHERE accountno = $2").WithArgs(123, "KZT0000000001").
+		WillReturnError(&pq.Error{Code: "23514", Constraint: "wallets_amount_non_negative"})
+	mock.ExpectRollback()
+
+	_, err := repo.Transfer("KZT0000000001", "KZT0000000002", domain.NewConversion(domain.NewMoney(123, domain.DefaultCurrency)), nil, domain.StepUp{Decision: domain.StepUpNotRequired})
+	assert.Equal(t, myerrors.ErrInsufficientFunds, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	_, err = repo.Transfer("KZT0000000001", "KZT0000000002", domain.NewConversion(domain.NewMoney(-123, domain.DefaultCurrency)), nil, domain.StepUp{Decision: domain.StepUpNotRequired})
+	assert.Equal(t, myerrors.ErrInvalidAmt, err)
+}
+
+func TestTransferRetriesDeadlock(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000001").WillReturnError(&pq.Error{Code: "40P01"})
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000001").WillReturnRows(sqlmock.NewRows([]string{"available", "currency"}).AddRow(5000, "KZT"))
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000002").WillReturnRows(sqlmock.NewRows([]string{"available", "currency"}).AddRow(5000, "KZT"))
+	mock.ExpectExec("UPDATE wallets SET amount = amount - $1, updated_at = now() WHERE accountno = $2").WithArgs(123, "KZT0000000001").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE wallets SET amount = amount + $1, updated_at = now() WHERE accountno = $2").WithArgs(123, "KZT0000000002").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO transactions(transfer_type, from_acc, to_acc, amount, currency, to_amount, to_currency, fx_rate, step_up) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id").
+		WithArgs("transfer", "KZT0000000001", "KZT0000000002", 123, "KZT", 123, "KZT", "", domain.StepUpNotRequired).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec("INSERT INTO postings(transaction_id, accountno, amount, currency) VALUES($1, $2, $3, $4), ($1, $5, $6, $7)").
+		WithArgs(1, "KZT0000000001", -123, "KZT", "KZT0000000002", 123, "KZT").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventTransferSent, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventTransferReceived, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	_, err := repo.Transfer("KZT0000000001", "KZT0000000002", domain.NewConversion(domain.NewMoney(123, domain.DefaultCurrency)), nil, domain.StepUp{Decision: domain.StepUpNotRequired})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetIdempotencyKey(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+
+	query := "SELECT idem_key, iin, request_hash, response, transaction_id FROM idempotency_keys WHERE iin = $1 AND idem_key = $2 AND expires_at > $3"
+
+	mock.ExpectQuery(query).WithArgs(w.IIN, "2f1c7a52", sqlmock.AnyArg()).WillReturnError(sql.ErrNoRows)
+	key, err := repo.GetIdempotencyKey(w.IIN, "2f1c7a52")
+	assert.Nil(t, key)
+	assert.NoError(t, err)
+}
+
+func TestTransferCrossCurrency(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+	conv := domain.Conversion{Debit: domain.NewMoney(1000, "USD"), Credit: domain.NewMoney(470250, "KZT"), Rate: "470.25"}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000002").WillReturnRows(sqlmock.NewRows([]string{"available", "currency"}).AddRow(5000, "KZT"))
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "USD0000000001").WillReturnRows(sqlmock.NewRows([]string{"available", "currency"}).AddRow(5000, "USD"))
+	mock.ExpectExec("UPDATE wallets SET amount = amount - $1, updated_at = now() WHERE accountno = $2").WithArgs(1000, "USD0000000001").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE wallets SET amount = amount + $1, updated_at = now() WHERE accountno = $2").WithArgs(470250, "KZT0000000002").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO transactions(transfer_type, from_acc, to_acc, amount, currency, to_amount, to_currency, fx_rate, step_up) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id").
+		WithArgs("transfer", "USD0000000001", "KZT0000000002", 1000, "USD", 470250, "KZT", "470.25", domain.StepUpNotRequired).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectExec("INSERT INTO postings(transaction_id, accountno, amount, currency) VALUES($1, $2, $3, $4), ($1, $5, $6, $7), ($1, $8, $9, $10), ($1, $11, $12, $13)").
+		WithArgs(3, "USD0000000001", -1000, "USD", "SYSTEM_FX_USD", 1000, "USD", "SYSTEM_FX_KZT", -470250, "KZT", "KZT0000000002", 470250, "KZT").
+		WillReturnResult(sqlmock.NewResult(0, 4))
+	mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventTransferSent, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventTransferReceived, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	_, err := repo.Transfer("USD0000000001", "KZT0000000002", conv, nil, domain.StepUp{Decision: domain.StepUpNotRequired})
+	assert.NoError(t, err)
+
+	// credit currency has to match the receiving wallet
+	mock.ExpectBegin()
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000002").WillReturnRows(sqlmock.NewRows([]string{"available", "currency"}).AddRow(5000, "KZT"))
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "USD0000000001").WillReturnRows(sqlmock.NewRows([]string{"available", "currency"}).AddRow(5000, "USD"))
+	mock.ExpectRollback()
+
+	_, err = repo.Transfer("USD0000000001", "KZT0000000002", domain.NewConversion(domain.NewMoney(1000, "USD")), nil, domain.StepUp{Decision: domain.StepUpNotRequired})
+	assert.Equal(t, myerrors.ErrCurrencyMismatch, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReverse(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+	txColumns := []string{"id", "transfer_type", "from_acc", "to_acc", "amount", "currency", "to_amount", "to_currency", "fx_rate"}
+
+	// a top-up is reversed into the funding account which has no wallet
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, transfer_type, from_acc, to_acc, amount, currency, to_amount, to_currency, fx_rate FROM transactions WHERE id = $1 FOR UPDATE").WithArgs(5).
+		WillReturnRows(sqlmock.NewRows(txColumns).AddRow(5, "topup", domain.FundingAccount, w.AccountNo, 100, "KZT", 100, "KZT", ""))
+	mock.ExpectQuery("SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE reverses_id = $1").WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(0))
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), w.AccountNo).WillReturnRows(sqlmock.NewRows([]string{"available", "currency"}).AddRow(5000, "KZT"))
+	mock.ExpectExec("UPDATE wallets SET amount = amount - $1, updated_at = now() WHERE accountno = $2").WithArgs(40, w.AccountNo).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO transactions(transfer_type, from_acc, to_acc, amount, currency, to_amount, to_currency, fx_rate, step_up) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id").
+		WithArgs(domain.ReversalType, w.AccountNo, domain.FundingAccount, 40, "KZT", 40, "KZT", "", "").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(6))
+	mock.ExpectExec("INSERT INTO postings(transaction_id, accountno, amount, currency) VALUES($1, $2, $3, $4), ($1, $5, $6, $7)").
+		WithArgs(6, w.AccountNo, -40, "KZT", domain.FundingAccount, 40, "KZT").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectQuery("UPDATE transactions SET reverses_id = $1 WHERE id = $2 RETURNING to_char(ts, 'YYYY-MM-DD HH24:MI:SS')").WithArgs(5, 6).
+		WillReturnRows(sqlmock.NewRows([]string{"ts"}).AddRow("2021-12-31 19:36:36"))
+	// the funding account has no wallet to notify
+	mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventTransferSent, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	partial := domain.NewMoney(40, "KZT")
+	reversal, err := repo.Reverse(5, &partial)
+	assert.NoError(t, err)
+	if assert.NotNil(t, reversal) {
+		assert.Equal(t, 6, reversal.ID)
+		assert.Equal(t, 5, reversal.ReversesID)
+		assert.Equal(t, "2021-12-31 19:36:36", reversal.Ts)
+	}
+
+	// nothing left to reverse
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, transfer_type, from_acc, to_acc, amount, currency, to_amount, to_currency, fx_rate FROM transactions WHERE id = $1 FOR UPDATE").WithArgs(5).
+		WillReturnRows(sqlmock.NewRows(txColumns).AddRow(5, "topup", domain.FundingAccount, w.AccountNo, 100, "KZT", 100, "KZT", ""))
+	mock.ExpectQuery("SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE reverses_id = $1").WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(100))
+	mock.ExpectRollback()
+
+	_, err = repo.Reverse(5, nil)
+	assert.Equal(t, myerrors.ErrAlreadyReversed, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTransferHeldFunds(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+
+	// the ledger may cover the transfer, but held money is not available
+	mock.ExpectBegin()
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000001").WillReturnRows(sqlmock.NewRows([]string{"available", "currency"}).AddRow(100, "KZT"))
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000002").WillReturnRows(sqlmock.NewRows([]string{"available", "currency"}).AddRow(0, "KZT"))
+	mock.ExpectRollback()
+
+	_, err := repo.Transfer("KZT0000000001", "KZT0000000002", domain.NewConversion(domain.NewMoney(123, domain.DefaultCurrency)), nil, domain.StepUp{Decision: domain.StepUpNotRequired})
+	assert.Equal(t, myerrors.ErrInsufficientFunds, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPlaceHold(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+	expiresAt := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000001").WillReturnRows(sqlmock.NewRows([]string{"available", "currency"}).AddRow(150, "KZT"))
+	mock.ExpectQuery("INSERT INTO holds(accountno, payee, amount, currency, expires_at, step_up) VALUES($1, $2, $3, $4, $5, $6) RETURNING "+holdColumns).
+		WithArgs("KZT0000000001", "KZT0000000002", 100, "KZT", expiresAt, domain.StepUpTOTP).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "ts", "accountno", "payee", "amount", "currency", "captured", "status", "transaction_id", "expires_at", "step_up"}).
+			AddRow(4, "2021-12-31 19:36:36", "KZT0000000001", "KZT0000000002", 100, "KZT", 0, domain.HoldActive, 0, expiresAt, domain.StepUpTOTP))
+	mock.ExpectCommit()
+
+	hold, err := repo.PlaceHold("KZT0000000001", "KZT0000000002", domain.NewMoney(100, "KZT"), expiresAt, domain.StepUp{Decision: domain.StepUpTOTP})
+	assert.NoError(t, err)
+	assert.Equal(t, &domain.Hold{ID: 4, Ts: "2021-12-31 19:36:36", AccountNo: "KZT0000000001", Payee: "KZT0000000002", Amount: domain.NewMoney(100, "KZT"),
+		Captured: domain.NewMoney(0, "KZT"), Status: domain.HoldActive, ExpiresAt: expiresAt, StepUp: domain.StepUpTOTP}, hold)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000001").WillReturnRows(sqlmock.NewRows([]string{"available", "currency"}).AddRow(150, "KZT"))
+	mock.ExpectRollback()
+
+	_, err = repo.PlaceHold("KZT0000000001", "KZT0000000002", domain.NewMoney(100, "USD"), expiresAt, domain.StepUp{Decision: domain.StepUpNotRequired})
+	assert.Equal(t, myerrors.ErrCurrencyMismatch, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCaptureHold(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+	selectHold := "SELECT " + holdColumns + " FROM holds WHERE id = $1 FOR UPDATE"
+	holdRows := func(expiresAt time.Time) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "ts", "accountno", "payee", "amount", "currency", "captured", "status", "transaction_id", "expires_at", "step_up"}).
+			AddRow(4, "2021-12-31 19:36:36", "KZT0000000002", "KZT0000000001", 100, "KZT", 0, domain.HoldActive, 0, expiresAt, domain.StepUpTOTP)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectHold).WithArgs(4).WillReturnRows(holdRows(time.Now().Add(time.Hour)))
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000001").WillReturnRows(sqlmock.NewRows([]string{"available", "currency"}).AddRow(0, "KZT"))
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000002").WillReturnRows(sqlmock.NewRows([]string{"available", "currency"}).AddRow(0, "KZT"))
+	mock.ExpectExec("UPDATE wallets SET amount = amount - $1, updated_at = now() WHERE accountno = $2").WithArgs(100, "KZT0000000002").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE wallets SET amount = amount + $1, updated_at = now() WHERE accountno = $2").WithArgs(100, "KZT0000000001").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO transactions(transfer_type, from_acc, to_acc, amount, currency, to_amount, to_currency, fx_rate, step_up) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id").
+		WithArgs(domain.HoldType, "KZT0000000002", "KZT0000000001", 100, "KZT", 100, "KZT", "", domain.StepUpTOTP).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(9))
+	mock.ExpectExec("INSERT INTO postings(transaction_id, accountno, amount, currency) VALUES($1, $2, $3, $4), ($1, $5, $6, $7)").
+		WithArgs(9, "KZT0000000002", -100, "KZT", "KZT0000000001", 100, "KZT").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("UPDATE holds SET status = $1, captured = $2, transaction_id = $3 WHERE id = $4").
+		WithArgs(domain.HoldCaptured, 100, 9, 4).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventTransferSent, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(outbox).WithArgs(sqlmock.AnyArg(), domain.EventTransferReceived, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	hold, err := repo.CaptureHold(4, domain.NewConversion(domain.NewMoney(100, "KZT")))
+	assert.NoError(t, err)
+	if assert.NotNil(t, hold) {
+		assert.Equal(t, domain.HoldCaptured, hold.Status)
+		assert.Equal(t, 9, hold.TransactionID)
+	}
+
+	// an active hold past its expiry cannot be captured even before ExpireHolds marks it
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectHold).WithArgs(4).WillReturnRows(holdRows(time.Now().Add(-time.Minute)))
+	mock.ExpectRollback()
+
+	_, err = repo.CaptureHold(4, domain.NewConversion(domain.NewMoney(100, "KZT")))
+	assert.Equal(t, myerrors.ErrHoldNotActive, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestInsertSchedule(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+	nextRun := time.Date(2022, 2, 1, 9, 0, 0, 0, time.UTC)
+	s := domain.Schedule{IIN: w.IIN, From: "KZT0000000001", To: "KZT0000000002", Amount: domain.NewMoney(15000000, "KZT"), Recurrence: "0 9 1 * *", NextRun: nextRun}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO schedules(iin, from_acc, to_acc, amount, currency, recurrence, next_run, step_up) VALUES($1, $2, $3, $4, $5, $6, $7, $8) RETURNING "+scheduleColumns).
+		WithArgs(w.IIN, "KZT0000000001", "KZT0000000002", 15000000, "KZT", "0 9 1 * *", nextRun, domain.StepUpTOTP).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "ts", "iin", "from_acc", "to_acc", "amount", "currency", "recurrence", "next_run", "status", "failures", "step_up"}).
+			AddRow(3, "2021-12-31 19:36:36", w.IIN, "KZT0000000001", "KZT0000000002", 15000000, "KZT", "0 9 1 * *", nextRun, domain.ScheduleActive, 0, domain.StepUpTOTP))
+	mock.ExpectCommit()
+
+	stored, err := repo.InsertSchedule(s, domain.StepUp{Decision: domain.StepUpTOTP})
+	assert.NoError(t, err)
+	s.ID, s.Ts, s.Status, s.StepUp = 3, "2021-12-31 19:36:36", domain.ScheduleActive, domain.StepUpTOTP
+	assert.Equal(t, &s, stored)
+
+	// a used confirmation creates no schedule
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE transfer_confirmations SET used_at = $1 WHERE token_hash = $2 AND used_at IS NULL AND expires_at > $1").
+		WithArgs(sqlmock.AnyArg(), "hash").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	_, err = repo.InsertSchedule(s, domain.StepUp{Decision: domain.StepUpConfirmation, ConfirmationHash: "hash"})
+	assert.Equal(t, myerrors.ErrInvalidConfirmation, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCancelSchedule(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+	cancel := "UPDATE schedules SET status = $1 WHERE id = $2 AND status IN ($3, $4) RETURNING " + scheduleColumns
+
+	// the schedule exists but already ran
+	mock.ExpectQuery(cancel).WithArgs(domain.ScheduleCancelled, 3, domain.ScheduleActive, domain.SchedulePaused).WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT " + scheduleColumns + " FROM schedules WHERE id = $1").WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "ts", "iin", "from_acc", "to_acc", "amount", "currency", "recurrence", "next_run", "status", "failures", "step_up"}).
+			AddRow(3, "2021-12-31 19:36:36", w.IIN, "KZT0000000001", "KZT0000000002", 100, "KZT", "", time.Now(), domain.ScheduleDone, 0, domain.StepUpNotRequired))
+	_, err := repo.CancelSchedule(3)
+	assert.Equal(t, myerrors.ErrScheduleNotActive, err)
+
+	mock.ExpectQuery(cancel).WithArgs(domain.ScheduleCancelled, 4, domain.ScheduleActive, domain.SchedulePaused).WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT " + scheduleColumns + " FROM schedules WHERE id = $1").WithArgs(4).WillReturnError(sql.ErrNoRows)
+	_, err = repo.CancelSchedule(4)
+	assert.Equal(t, myerrors.ErrScheduleNotFound, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestInsertBatch(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+	b := domain.Batch{IIN: w.IIN, From: "KZT0000000001", Mode: domain.BatchBestEffort, Total: domain.NewMoney(300, "KZT"), Lines: []domain.BatchLine{
+		{Line: 1, To: "KZT0000000002", Amount: domain.NewMoney(100, "KZT"), Reference: "salary"},
+		{Line: 2, To: "KZT0000000003", Amount: domain.NewMoney(200, "KZT")},
+	}}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO batches(iin, from_acc, mode, status, total, currency, step_up) VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING "+batchColumns).
+		WithArgs(w.IIN, "KZT0000000001", domain.BatchBestEffort, domain.BatchPending, 300, "KZT", domain.StepUpNotRequired).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "ts", "iin", "from_acc", "mode", "status", "total", "currency", "step_up"}).
+			AddRow(4, "2021-12-31 19:36:36", w.IIN, "KZT0000000001", domain.BatchBestEffort, domain.BatchPending, 300, "KZT", domain.StepUpNotRequired))
+	mock.ExpectExec("INSERT INTO batch_lines(batch_id, line, to_acc, amount, currency, reference) VALUES ($1, $2, $3, $4, $5, $6), ($7, $8, $9, $10, $11, $12)").
+		WithArgs(4, 1, "KZT0000000002", 100, "KZT", "salary", 4, 2, "KZT0000000003", 200, "KZT", "").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	stored, err := repo.InsertBatch(b, domain.StepUp{Decision: domain.StepUpNotRequired})
+	assert.NoError(t, err)
+	if assert.NotNil(t, stored) {
+		assert.Equal(t, 4, stored.ID)
+		assert.Equal(t, domain.BatchPending, stored.Status)
+		assert.Equal(t, domain.LinePending, stored.Lines[1].Status)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClaimBatch(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+	claim := "UPDATE batches SET status = $1 WHERE id = $2 AND status = $3"
+
+	mock.ExpectExec(claim).WithArgs(domain.BatchRunning, 4, domain.BatchPending).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(claim).WithArgs(domain.BatchRunning, 4, domain.BatchPending).WillReturnResult(sqlmock.NewResult(0, 0))
+	claimed, err := repo.ClaimBatch(4)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+	claimed, err = repo.ClaimBatch(4)
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetBatchNotFound(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+
+	mock.ExpectQuery("SELECT " + batchColumns + " FROM batches WHERE id = $1").WithArgs(4).WillReturnError(sql.ErrNoRows)
+	_, err := repo.GetBatch(4)
+	assert.Equal(t, myerrors.ErrBatchNotFound, err)
+}
+
+func TestInsertSubscription(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+
+	rows := sqlmock.NewRows([]string{"id", "ts", "iin", "url", "secret", "events"}).
+		AddRow(2, "2022-01-10 12:00:00", "910815450350", "http://localhost/hook", "secret", "wallet.created,transfer.sent")
+	mock.ExpectQuery("INSERT INTO webhook_subscriptions(iin, url, secret, events) VALUES($1, $2, $3, $4) RETURNING "+subscriptionColumns).
+		WithArgs("910815450350", "http://localhost/hook", "secret", "wallet.created,transfer.sent").WillReturnRows(rows)
+	s, err := repo.InsertSubscription(domain.Subscription{IIN: "910815450350", URL: "http://localhost/hook", Secret: "secret",
+		Events: []string{domain.EventWalletCreated, domain.EventTransferSent}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2, s.ID)
+		assert.Equal(t, []string{domain.EventWalletCreated, domain.EventTransferSent}, s.Events)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestEnqueueEvent(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+	now := time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC)
+	e := domain.Event{ID: "4f1e", Type: domain.EventWalletCreated, Ts: now, Account: "KZT0000000001"}
+
+	mock.ExpectExec("INSERT INTO webhook_deliveries(subscription_id, event_id, event_type, payload, next_attempt) "+
+		"SELECT s.id, $1, $2, $3, $4 FROM webhook_subscriptions s JOIN wallets w ON w.iin = s.iin WHERE w.accountno = $5 AND $2 = ANY(string_to_array(s.events, ',')) "+
+		"ON CONFLICT (subscription_id, event_id) DO NOTHING").
+		WithArgs("4f1e", domain.EventWalletCreated, e.Payload(), now, "KZT0000000001").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	queued, err := repo.EnqueueEvent(e)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, queued)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRequeueDelivery(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+	now := time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC)
+	requeue := "UPDATE webhook_deliveries SET status = $1, attempts = 0, next_attempt = $2 WHERE id = $3 AND status = $4"
+
+	mock.ExpectExec(requeue).WithArgs(domain.DeliveryPending, now, 3, domain.DeliveryDead).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(requeue).WithArgs(domain.DeliveryPending, now, 3, domain.DeliveryDead).WillReturnResult(sqlmock.NewResult(0, 0))
+	assert.NoError(t, repo.RequeueDelivery(3, now))
+	assert.Equal(t, myerrors.ErrDeliveryNotDead, repo.RequeueDelivery(3, now))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetUnpublishedEvents(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+	now := time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC)
+	amount := domain.NewMoney(100, domain.DefaultCurrency)
+	e := domain.Event{ID: "4f1e", Type: domain.EventWalletToppedUp, Ts: now, Account: "KZT0000000001", Amount: &amount, TransactionID: 7}
+
+	mock.ExpectQuery("SELECT payload FROM outbox WHERE published_at IS NULL ORDER BY id LIMIT $1").WithArgs(10).
+		WillReturnRows(sqlmock.NewRows([]string{"payload"}).AddRow(e.Payload()))
+	mock.ExpectExec("UPDATE outbox SET published_at = $1 WHERE event_id = $2").WithArgs(now, "4f1e").WillReturnResult(sqlmock.NewResult(0, 1))
+	events, err := repo.GetUnpublishedEvents(10)
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Event{e}, events)
+	assert.NoError(t, repo.MarkEventPublished("4f1e", now))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetEventsAfter(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+	e := domain.Event{ID: "6c3d", Type: domain.EventWalletCreated, Ts: time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC), Account: "KZT0000000003"}
+
+	mock.ExpectQuery("SELECT id FROM outbox WHERE event_id = $1").WithArgs("4f1e").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(41))
+	mock.ExpectQuery("SELECT o.payload FROM outbox o JOIN wallets w ON w.accountno = o.payload::json->>'account' WHERE w.iin = $1 AND o.id > $2 ORDER BY o.id LIMIT $3").WithArgs("910815450350", 41, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"payload"}).AddRow(e.Payload()))
+	mock.ExpectQuery("SELECT id FROM outbox WHERE event_id = $1").WithArgs("unknown").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	events, err := repo.GetEventsAfter("910815450350", "4f1e", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Event{e}, events)
+	_, err = repo.GetEventsAfter("910815450350", "unknown", 10)
+	assert.Equal(t, myerrors.ErrEventNotFound, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetEventsSince(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+	e := domain.Event{ID: "6c3d", Type: domain.EventWalletCreated, Ts: time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC), Account: "KZT0000000003"}
+
+	mock.ExpectQuery("SELECT COALESCE(MAX(id), 0) FROM outbox").WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(41))
+	mock.ExpectQuery("SELECT id, payload FROM outbox WHERE id > $1 ORDER BY id LIMIT $2").WithArgs(41, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payload"}).AddRow(43, e.Payload()))
+	mock.ExpectQuery("SELECT id, payload FROM outbox WHERE id > $1 ORDER BY id LIMIT $2").WithArgs(43, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payload"}))
+	position, err := repo.GetOutboxPosition()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(41), position)
+	events, position, err := repo.GetEventsSince(position, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Event{e}, events)
+	assert.Equal(t, int64(43), position)
+	events, position, err = repo.GetEventsSince(position, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+	assert.Equal(t, int64(43), position)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestInsertUser(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+	u := domain.User{IIN: "910815450350", Username: "sth", PasswordHash: "hash", Roles: []domain.Role{domain.RoleCustomer}}
+
+	query := "INSERT INTO users(iin, username, password_hash, roles) VALUES($1, $2, $3, $4) RETURNING " + userColumns
+	mock.ExpectQuery(query).WithArgs(u.IIN, u.Username, u.PasswordHash, "customer").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "ts", "iin", "username", "password_hash", "roles"}).
+			AddRow(4, "2022-01-10 12:00:00", u.IIN, u.Username, u.PasswordHash, "customer"))
+	mock.ExpectQuery(query).WithArgs(u.IIN, u.Username, u.PasswordHash, "customer").
+		WillReturnError(&pq.Error{Code: "23505", Table: "users", Constraint: "users_username"})
+	stored, err := repo.InsertUser(u)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, stored.ID)
+	assert.Equal(t, u.Roles, stored.Roles)
+	_, err = repo.InsertUser(u)
+	assert.Equal(t, myerrors.ErrUserExists, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+	expiresAt := time.Date(2022, 2, 10, 12, 0, 0, 0, time.UTC)
+	next := domain.RefreshToken{Hash: "next", FamilyID: "family", UserID: 4, Status: domain.RefreshTokenActive, ExpiresAt: expiresAt}
+
+	use := "UPDATE refresh_tokens SET status = $1 WHERE token_hash = $2 AND status = $3"
+	mock.ExpectBegin()
+	mock.ExpectExec(use).WithArgs(domain.RefreshTokenUsed, "first", domain.RefreshTokenActive).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO refresh_tokens(token_hash, family_id, user_id, status, expires_at) VALUES($1, $2, $3, $4, $5)").
+		WithArgs("next", "family", 4, domain.RefreshTokenActive, expiresAt).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	rotated, err := repo.RotateRefreshToken("first", next)
+	assert.NoError(t, err)
+	assert.True(t, rotated)
+
+	// the token was used by a concurrent refresh
+	mock.ExpectBegin()
+	mock.ExpectExec(use).WithArgs(domain.RefreshTokenUsed, "first", domain.RefreshTokenActive).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	rotated, err = repo.RotateRefreshToken("first", next)
+	assert.NoError(t, err)
+	assert.False(t, rotated)
+
+	mock.ExpectExec("UPDATE refresh_tokens SET status = $1 WHERE family_id = $2 AND status = $3").
+		WithArgs(domain.RefreshTokenRevoked, "family", domain.RefreshTokenActive).WillReturnResult(sqlmock.NewResult(0, 2))
+	assert.NoError(t, repo.RevokeRefreshTokens("family"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRevocations(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+	revokedAt := time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC)
+	r := domain.Revocation{Kind: domain.RevokedUser, Subject: "910815450350", RevokedAt: revokedAt, ExpiresAt: revokedAt.Add(time.Hour)}
+
+	mock.ExpectExec("INSERT INTO revocations(kind, subject, revoked_at, expires_at) VALUES($1, $2, $3, $4) "+
+		"ON CONFLICT (kind, subject) DO UPDATE SET revoked_at = EXCLUDED.revoked_at, expires_at = EXCLUDED.expires_at").
+		WithArgs(r.Kind, r.Subject, r.RevokedAt, r.ExpiresAt).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT kind, subject, revoked_at, expires_at FROM revocations WHERE revoked_at >= $1 ORDER BY revoked_at").WithArgs(revokedAt).
+		WillReturnRows(sqlmock.NewRows([]string{"kind", "subject", "revoked_at", "expires_at"}).
+			AddRow(r.Kind, r.Subject, r.RevokedAt, r.ExpiresAt))
+	mock.ExpectExec("DELETE FROM revocations WHERE expires_at <= $1").WithArgs(revokedAt.Add(time.Hour)).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(t, repo.InsertRevocation(r))
+	revocations, err := repo.GetRevocations(revokedAt)
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.Revocation{r}, revocations)
+	deleted, err := repo.DeleteExpiredRevocations(revokedAt.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTOTP(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+	lockedUntil := time.Date(2022, 1, 10, 12, 15, 0, 0, time.UTC)
+
+	mock.ExpectQuery("SELECT secret, active, last_step, failed_attempts, locked_until FROM totp_authenticators WHERE iin = $1").WithArgs("910815450350").
+		WillReturnRows(sqlmock.NewRows([]string{"secret", "active", "last_step", "failed_attempts", "locked_until"}).
+			AddRow("SECRET", false, 0, 0, nil))
+	mock.ExpectExec("UPDATE totp_authenticators SET locked_until = CASE WHEN failed_attempts + 1 >= $1 THEN $2 ELSE locked_until END, "+
+		"failed_attempts = failed_attempts + 1 WHERE iin = $3").WithArgs(5, lockedUntil, "910815450350").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE totp_authenticators SET last_step = $1, failed_attempts = 0, locked_until = NULL, active = active OR $2 WHERE iin = $3 AND last_step < $1").
+		WithArgs(101, true, "910815450350").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	stored, err := repo.GetTOTP("910815450350")
+	assert.NoError(t, err)
+	assert.Equal(t, domain.TOTP{IIN: "910815450350", Secret: "SECRET"}, *stored)
+	assert.NoError(t, repo.FailTOTP("910815450350", 5, lockedUntil))
+	used, err := repo.UseTOTPStep("910815450350", 101, true)
+	assert.NoError(t, err)
+	assert.True(t, used)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetTransferConfirmation(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+	now := time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC)
+	query := "SELECT iin, from_acc, to_acc, amount, currency, expires_at FROM transfer_confirmations WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2"
+	columns := []string{"iin", "from_acc", "to_acc", "amount", "currency", "expires_at"}
+
+	mock.ExpectQuery(query).WithArgs("hash", now).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("910815450350", "KZT0000000001", "KZT0000000002", 100, "KZT", now.Add(5*time.Minute)))
+	mock.ExpectQuery(query).WithArgs("used", now).WillReturnRows(sqlmock.NewRows(columns))
+
+	c, err := repo.GetTransferConfirmation("hash", now)
+	assert.NoError(t, err)
+	assert.Equal(t, domain.TransferConfirmation{Hash: "hash", IIN: "910815450350", From: "KZT0000000001", To: "KZT0000000002",
+		Amount: domain.NewMoney(100, "KZT"), ExpiresAt: now.Add(5 * time.Minute)}, *c)
+	_, err = repo.GetTransferConfirmation("used", now)
+	assert.Equal(t, myerrors.ErrInvalidConfirmation, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTransferWithUsedConfirmation(t *testing.T) {
+	db, mock := NewMock()
+	defer db.Close()
+	repo := &postgresDBInterface{db}
+
+	// the confirmation is used up in the transaction of the transfer, which is rolled back if it is used already
+	mock.ExpectBegin()
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000001").WillReturnRows(sqlmock.NewRows([]string{"available", "currency"}).AddRow(500, "KZT"))
+	mock.ExpectQuery(lock).WithArgs(sqlmock.AnyArg(), "KZT0000000002").WillReturnRows(sqlmock.NewRows([]string{"available", "currency"}).AddRow(10, "KZT"))
+	mock.ExpectExec("UPDATE transfer_confirmations SET used_at = $1 WHERE token_hash = $2 AND used_at IS NULL AND expires_at > $1").
+		WithArgs(sqlmock.AnyArg(), "hash").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	stepUp := domain.StepUp{Decision: domain.StepUpConfirmation, ConfirmationHash: "hash"}
+	_, err := repo.Transfer("KZT0000000001", "KZT0000000002", domain.NewConversion(domain.NewMoney(123, domain.DefaultCurrency)), nil, stepUp)
+	assert.Equal(t, myerrors.ErrInvalidConfirmation, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
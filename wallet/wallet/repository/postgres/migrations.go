@@ -0,0 +1,30 @@
+package postgres
+
+import (
+	"database/sql"
+	"embed"
+	"io/fs"
+	"wallet/wallet/repository/migrate"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// NewMigrator returns migrator of PostgreSQL schema embedded in the binary
+func NewMigrator(dbURL string) (*migrate.Migrator, error) {
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		return nil, err
+	}
+	files, err := fs.Sub(migrations, "migrations")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	migrator, err := migrate.New(db, files, migrate.Postgres)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return migrator, nil
+}
@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS wallets
+(
+    id bigserial PRIMARY KEY,
+    ts timestamp NOT NULL DEFAULT now(),
+    updated_at timestamp NOT NULL DEFAULT now(),
+    iin varchar(255) NOT NULL,
+    accountno varchar(255) NOT NULL UNIQUE,
+    amount bigint NOT NULL DEFAULT 0,
+    CONSTRAINT wallets_amount_non_negative CHECK (amount >= 0)
+);
+
+INSERT INTO wallets (accountno, iin)
+VALUES ('KZT0000000000', 'account_init')
+ON CONFLICT DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS transactions
+(
+    id bigserial PRIMARY KEY,
+    ts timestamp NOT NULL DEFAULT now(),
+    transfer_type varchar(255) NOT NULL,
+    from_acc varchar(255) NOT NULL DEFAULT '',
+    to_acc varchar(255) NOT NULL,
+    amount bigint NOT NULL CHECK (amount >= 0)
+);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys
+(
+    iin varchar(255) NOT NULL,
+    idem_key varchar(255) NOT NULL,
+    request_hash char(64) NOT NULL,
+    response varchar(255) NOT NULL DEFAULT '',
+    transaction_id bigint NOT NULL REFERENCES transactions (id),
+    ts timestamp NOT NULL DEFAULT now(),
+    expires_at timestamptz NOT NULL,
+    PRIMARY KEY (iin, idem_key)
+);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS postings
+(
+    id bigserial PRIMARY KEY,
+    transaction_id bigint NOT NULL REFERENCES transactions (id),
+    accountno varchar(255) NOT NULL,
+    amount bigint NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS postings_transaction_id ON postings (transaction_id);
+
+CREATE INDEX IF NOT EXISTS postings_accountno ON postings (accountno);
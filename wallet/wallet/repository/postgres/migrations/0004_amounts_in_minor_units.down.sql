@@ -0,0 +1,24 @@
+UPDATE idempotency_keys SET response = substring(response from '"amount":"([0-9]+)\.')
+WHERE response LIKE '{"amount":"%';
+
+UPDATE idempotency_keys k
+SET request_hash = encode(sha256(convert_to('topup', 'UTF8') || '\x00'::bytea || convert_to(t.to_acc, 'UTF8') ||
+    '\x00'::bytea || convert_to((t.amount / 100)::text, 'UTF8')), 'hex')
+FROM transactions t
+WHERE t.id = k.transaction_id AND t.transfer_type = 'topup' AND t.amount % 100 = 0
+  AND k.request_hash = encode(sha256(convert_to('topup', 'UTF8') || '\x00'::bytea || convert_to(t.to_acc, 'UTF8') ||
+    '\x00'::bytea || convert_to((t.amount / 100) || '.00 KZT', 'UTF8')), 'hex');
+
+UPDATE idempotency_keys k
+SET request_hash = encode(sha256(convert_to('transfer', 'UTF8') || '\x00'::bytea || convert_to(t.from_acc, 'UTF8') ||
+    '\x00'::bytea || convert_to(t.to_acc, 'UTF8') || '\x00'::bytea || convert_to((t.amount / 100)::text, 'UTF8')), 'hex')
+FROM transactions t
+WHERE t.id = k.transaction_id AND t.transfer_type = 'transfer' AND t.amount % 100 = 0
+  AND k.request_hash = encode(sha256(convert_to('transfer', 'UTF8') || '\x00'::bytea || convert_to(t.from_acc, 'UTF8') ||
+    '\x00'::bytea || convert_to(t.to_acc, 'UTF8') || '\x00'::bytea || convert_to((t.amount / 100) || '.00 KZT', 'UTF8')), 'hex');
+
+UPDATE wallets SET amount = amount / 100;
+
+UPDATE transactions SET amount = amount / 100;
+
+UPDATE postings SET amount = amount / 100;
@@ -0,0 +1,28 @@
+-- stored requests and responses of idempotency keys are rewritten into the new amount format, so that requests made
+-- before the upgrade are still replayed when retried. Top-ups stored the balance as a plain number, transfers stored
+-- nothing. A key whose hash doesn't match its transaction, say of an amount sent as "0100", keeps its hash
+UPDATE idempotency_keys SET response = '{"amount":"' || response || '.00","currency":"KZT"}'
+WHERE response ~ '^[0-9]+$';
+
+UPDATE idempotency_keys k
+SET request_hash = encode(sha256(convert_to('topup', 'UTF8') || '\x00'::bytea || convert_to(t.to_acc, 'UTF8') ||
+    '\x00'::bytea || convert_to(t.amount || '.00 KZT', 'UTF8')), 'hex')
+FROM transactions t
+WHERE t.id = k.transaction_id AND t.transfer_type = 'topup'
+  AND k.request_hash = encode(sha256(convert_to('topup', 'UTF8') || '\x00'::bytea || convert_to(t.to_acc, 'UTF8') ||
+    '\x00'::bytea || convert_to(t.amount::text, 'UTF8')), 'hex');
+
+UPDATE idempotency_keys k
+SET request_hash = encode(sha256(convert_to('transfer', 'UTF8') || '\x00'::bytea || convert_to(t.from_acc, 'UTF8') ||
+    '\x00'::bytea || convert_to(t.to_acc, 'UTF8') || '\x00'::bytea || convert_to(t.amount || '.00 KZT', 'UTF8')), 'hex')
+FROM transactions t
+WHERE t.id = k.transaction_id AND t.transfer_type = 'transfer'
+  AND k.request_hash = encode(sha256(convert_to('transfer', 'UTF8') || '\x00'::bytea || convert_to(t.from_acc, 'UTF8') ||
+    '\x00'::bytea || convert_to(t.to_acc, 'UTF8') || '\x00'::bytea || convert_to(t.amount::text, 'UTF8')), 'hex');
+
+-- amounts were stored in whole tenge, from now on they are in tiyn
+UPDATE wallets SET amount = amount * 100;
+
+UPDATE transactions SET amount = amount * 100;
+
+UPDATE postings SET amount = amount * 100;
@@ -0,0 +1,9 @@
+ALTER TABLE postings DROP COLUMN IF EXISTS currency;
+
+ALTER TABLE transactions
+    DROP COLUMN IF EXISTS fx_rate,
+    DROP COLUMN IF EXISTS to_currency,
+    DROP COLUMN IF EXISTS to_amount,
+    DROP COLUMN IF EXISTS currency;
+
+ALTER TABLE wallets DROP COLUMN IF EXISTS currency;
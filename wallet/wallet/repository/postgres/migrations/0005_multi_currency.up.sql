@@ -0,0 +1,12 @@
+ALTER TABLE wallets ADD COLUMN IF NOT EXISTS currency char(3) NOT NULL DEFAULT 'KZT';
+
+-- amount and currency are debited from from_acc, to_amount in to_currency is credited to to_acc
+ALTER TABLE transactions
+    ADD COLUMN IF NOT EXISTS currency char(3) NOT NULL DEFAULT 'KZT',
+    ADD COLUMN IF NOT EXISTS to_amount bigint NOT NULL DEFAULT 0 CHECK (to_amount >= 0),
+    ADD COLUMN IF NOT EXISTS to_currency char(3) NOT NULL DEFAULT 'KZT',
+    ADD COLUMN IF NOT EXISTS fx_rate varchar(32) NOT NULL DEFAULT '';
+
+UPDATE transactions SET to_amount = amount;
+
+ALTER TABLE postings ADD COLUMN IF NOT EXISTS currency char(3) NOT NULL DEFAULT 'KZT';
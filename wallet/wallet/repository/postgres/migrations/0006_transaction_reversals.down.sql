@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS transactions_reverses_id;
+
+ALTER TABLE transactions DROP COLUMN IF EXISTS reverses_id;
@@ -0,0 +1,4 @@
+-- reversal transactions point at the transaction they (partially) refund
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS reverses_id bigint REFERENCES transactions (id);
+
+CREATE INDEX IF NOT EXISTS transactions_reverses_id ON transactions (reverses_id);
@@ -0,0 +1,17 @@
+-- holds reserve wallet money, only active holds that have not expired reduce the available balance
+CREATE TABLE IF NOT EXISTS holds
+(
+    id bigserial PRIMARY KEY,
+    ts timestamp NOT NULL DEFAULT now(),
+    accountno varchar(255) NOT NULL REFERENCES wallets (accountno),
+    amount bigint NOT NULL CHECK (amount > 0),
+    currency char(3) NOT NULL,
+    status varchar(16) NOT NULL DEFAULT 'active',
+    captured bigint NOT NULL DEFAULT 0 CHECK (captured >= 0 AND captured <= amount),
+    transaction_id bigint REFERENCES transactions (id),
+    expires_at timestamptz NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS holds_accountno_status ON holds (accountno, status);
+
+CREATE INDEX IF NOT EXISTS holds_status_expires_at ON holds (status, expires_at);
@@ -0,0 +1,30 @@
+-- schedules are executed by the worker once next_run has passed, schedule_runs keeps the outcome of every execution
+CREATE TABLE IF NOT EXISTS schedules
+(
+    id bigserial PRIMARY KEY,
+    ts timestamp NOT NULL DEFAULT now(),
+    iin varchar(255) NOT NULL,
+    from_acc varchar(255) NOT NULL REFERENCES wallets (accountno),
+    to_acc varchar(255) NOT NULL REFERENCES wallets (accountno),
+    amount bigint NOT NULL CHECK (amount > 0),
+    currency char(3) NOT NULL,
+    recurrence varchar(255) NOT NULL DEFAULT '',
+    next_run timestamptz NOT NULL,
+    status varchar(16) NOT NULL DEFAULT 'active',
+    failures integer NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS schedules_iin ON schedules (iin);
+
+CREATE INDEX IF NOT EXISTS schedules_status_next_run ON schedules (status, next_run);
+
+CREATE TABLE IF NOT EXISTS schedule_runs
+(
+    id bigserial PRIMARY KEY,
+    schedule_id bigint NOT NULL REFERENCES schedules (id),
+    ts timestamptz NOT NULL,
+    outcome varchar(16) NOT NULL,
+    error varchar(255) NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS schedule_runs_schedule_id ON schedule_runs (schedule_id);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS transactions_to_acc_id;
+
+DROP INDEX IF EXISTS transactions_from_acc_id;
@@ -0,0 +1,4 @@
+-- transaction history is read per account in id order, one direction at a time
+CREATE INDEX IF NOT EXISTS transactions_from_acc_id ON transactions (from_acc, id);
+
+CREATE INDEX IF NOT EXISTS transactions_to_acc_id ON transactions (to_acc, id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS batch_lines;
+DROP TABLE IF EXISTS batches;
@@ -0,0 +1,29 @@
+-- batches are run by the worker once uploaded, batch_lines keeps every transfer of a batch with its outcome
+CREATE TABLE IF NOT EXISTS batches
+(
+    id bigserial PRIMARY KEY,
+    ts timestamp NOT NULL DEFAULT now(),
+    iin varchar(255) NOT NULL,
+    from_acc varchar(255) NOT NULL REFERENCES wallets (accountno),
+    mode varchar(16) NOT NULL,
+    status varchar(16) NOT NULL DEFAULT 'pending',
+    total bigint NOT NULL CHECK (total > 0),
+    currency char(3) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS batches_status ON batches (status);
+
+CREATE TABLE IF NOT EXISTS batch_lines
+(
+    id bigserial PRIMARY KEY,
+    batch_id bigint NOT NULL REFERENCES batches (id),
+    line integer NOT NULL,
+    to_acc varchar(255) NOT NULL REFERENCES wallets (accountno),
+    amount bigint NOT NULL CHECK (amount > 0),
+    currency char(3) NOT NULL,
+    reference varchar(255) NOT NULL DEFAULT '',
+    status varchar(16) NOT NULL DEFAULT 'pending',
+    transaction_id bigint REFERENCES transactions (id),
+    error varchar(255) NOT NULL DEFAULT '',
+    UNIQUE (batch_id, line)
+);
@@ -0,0 +1,30 @@
+-- webhook_subscriptions are matched to events by the IIN owning the wallet, events is a comma separated list of types.
+-- webhook_deliveries queues every event for every matching subscription until it is delivered or dead
+CREATE TABLE IF NOT EXISTS webhook_subscriptions
+(
+    id bigserial PRIMARY KEY,
+    ts timestamp NOT NULL DEFAULT now(),
+    iin varchar(255) NOT NULL,
+    url varchar(2048) NOT NULL,
+    secret varchar(255) NOT NULL,
+    events varchar(255) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS webhook_subscriptions_iin ON webhook_subscriptions (iin);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries
+(
+    id bigserial PRIMARY KEY,
+    ts timestamp NOT NULL DEFAULT now(),
+    subscription_id bigint NOT NULL REFERENCES webhook_subscriptions (id) ON DELETE CASCADE,
+    event_type varchar(64) NOT NULL,
+    payload text NOT NULL,
+    status varchar(16) NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    next_attempt timestamptz NOT NULL,
+    last_error varchar(255) NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_subscription_id ON webhook_deliveries (subscription_id);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_status_next_attempt ON webhook_deliveries (status, next_attempt);
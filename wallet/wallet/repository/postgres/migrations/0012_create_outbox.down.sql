@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS webhook_deliveries_subscription_id_event_id;
+
+ALTER TABLE webhook_deliveries DROP COLUMN IF EXISTS event_id;
+
+DROP TABLE IF EXISTS outbox;
@@ -0,0 +1,19 @@
+-- outbox keeps events written in the same transaction as the change they report until the relay has published them.
+-- Deliveries of an event to a subscription are kept unique by event_id so that republished events are dropped
+CREATE TABLE IF NOT EXISTS outbox
+(
+    id bigserial PRIMARY KEY,
+    ts timestamp NOT NULL DEFAULT now(),
+    event_id varchar(64) NOT NULL UNIQUE,
+    event_type varchar(64) NOT NULL,
+    payload text NOT NULL,
+    published_at timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS outbox_unpublished ON outbox (id) WHERE published_at IS NULL;
+
+ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS event_id varchar(64) NOT NULL DEFAULT '';
+
+UPDATE webhook_deliveries SET event_id = 'delivery-' || id;
+
+CREATE UNIQUE INDEX IF NOT EXISTS webhook_deliveries_subscription_id_event_id ON webhook_deliveries (subscription_id, event_id);
@@ -0,0 +1,25 @@
+-- users of the built-in auth service, roles is a comma separated list.
+-- refresh_tokens are stored by SHA-256 of the token, tokens rotated from one login share family_id
+CREATE TABLE IF NOT EXISTS users
+(
+    id bigserial PRIMARY KEY,
+    ts timestamp NOT NULL DEFAULT now(),
+    iin varchar(255) NOT NULL,
+    username varchar(64) NOT NULL,
+    password_hash varchar(255) NOT NULL,
+    roles varchar(255) NOT NULL DEFAULT 'customer',
+    CONSTRAINT users_iin UNIQUE (iin),
+    CONSTRAINT users_username UNIQUE (username)
+);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens
+(
+    token_hash char(64) PRIMARY KEY,
+    ts timestamp NOT NULL DEFAULT now(),
+    family_id varchar(64) NOT NULL,
+    user_id bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    status varchar(16) NOT NULL DEFAULT 'active',
+    expires_at timestamptz NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_family_id ON refresh_tokens (family_id);
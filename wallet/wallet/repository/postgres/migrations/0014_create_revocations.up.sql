@@ -0,0 +1,14 @@
+-- revocations of tokens by jti, sessions by sid and users by IIN, kept until every token they revoke has expired.
+-- Instances keep them in memory and poll for ones revoked since, so that checking a token needs no query
+CREATE TABLE IF NOT EXISTS revocations
+(
+    kind varchar(16) NOT NULL,
+    subject varchar(255) NOT NULL,
+    revoked_at timestamptz NOT NULL,
+    expires_at timestamptz NOT NULL,
+    PRIMARY KEY (kind, subject)
+);
+
+CREATE INDEX IF NOT EXISTS revocations_revoked_at ON revocations (revoked_at);
+
+CREATE INDEX IF NOT EXISTS revocations_expires_at ON revocations (expires_at);
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS transfer_confirmations;
+
+DROP TABLE IF EXISTS totp_authenticators;
+
+ALTER TABLE transactions DROP COLUMN IF EXISTS step_up;
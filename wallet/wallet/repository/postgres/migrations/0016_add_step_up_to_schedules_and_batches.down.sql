@@ -0,0 +1,2 @@
+ALTER TABLE batches DROP COLUMN IF EXISTS step_up;
+ALTER TABLE schedules DROP COLUMN IF EXISTS step_up;
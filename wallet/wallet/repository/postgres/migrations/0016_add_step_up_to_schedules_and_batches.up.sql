@@ -0,0 +1,4 @@
+-- step_up is how the second factor of a schedule or batch was decided on when it was created, its transfers are
+-- made with that decision
+ALTER TABLE schedules ADD COLUMN IF NOT EXISTS step_up varchar(16) NOT NULL DEFAULT '';
+ALTER TABLE batches ADD COLUMN IF NOT EXISTS step_up varchar(16) NOT NULL DEFAULT '';
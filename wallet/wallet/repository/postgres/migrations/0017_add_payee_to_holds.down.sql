@@ -0,0 +1,2 @@
+ALTER TABLE holds DROP COLUMN IF EXISTS step_up;
+ALTER TABLE holds DROP COLUMN IF EXISTS payee;
@@ -0,0 +1,1081 @@
+// Package repositorytest holds the conformance suite every repository.DBInterface implementation must pass
+package repositorytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+	"wallet/domain"
+	"wallet/myerrors"
+	"wallet/wallet/auth"
+	"wallet/wallet/repository"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Run runs the conformance suite against repository returned by newRepo, which may already contain data
+func Run(t *testing.T, newRepo func(t *testing.T) repository.DBInterface) {
+	t.Run("Wallets", func(t *testing.T) { testWallets(t, newRepo(t)) })
+	t.Run("TopUp", func(t *testing.T) { testTopUp(t, newRepo(t)) })
+	t.Run("Transfer", func(t *testing.T) { testTransfer(t, newRepo(t)) })
+	t.Run("TransactionHistory", func(t *testing.T) { testTransactionHistory(t, newRepo(t)) })
+	t.Run("CrossCurrencyTransfer", func(t *testing.T) { testCrossCurrencyTransfer(t, newRepo(t)) })
+	t.Run("Reverse", func(t *testing.T) { testReverse(t, newRepo(t)) })
+	t.Run("Holds", func(t *testing.T) { testHolds(t, newRepo(t)) })
+	t.Run("Schedules", func(t *testing.T) { testSchedules(t, newRepo(t)) })
+	t.Run("Batches", func(t *testing.T) { testBatches(t, newRepo(t)) })
+	t.Run("Webhooks", func(t *testing.T) { testWebhooks(t, newRepo(t)) })
+	t.Run("Outbox", func(t *testing.T) { testOutbox(t, newRepo(t)) })
+	t.Run("IdempotencyKey", func(t *testing.T) { testIdempotencyKey(t, newRepo(t)) })
+	t.Run("Users", func(t *testing.T) { testUsers(t, newRepo(t)) })
+	t.Run("RefreshTokens", func(t *testing.T) { testRefreshTokens(t, newRepo(t)) })
+	t.Run("Sessions", func(t *testing.T) { testSessions(t, newRepo(t)) })
+	t.Run("Revocations", func(t *testing.T) { testRevocations(t, newRepo(t)) })
+	t.Run("TOTP", func(t *testing.T) { testTOTP(t, newRepo(t)) })
+	t.Run("TransferConfirmations", func(t *testing.T) { testTransferConfirmations(t, newRepo(t)) })
+	t.Run("ConcurrentTransfers", func(t *testing.T) { testConcurrentTransfers(t, newRepo(t)) })
+}
+
+// newIIN returns an IIN no other test run has used
+func newIIN() string {
+	return fmt.Sprintf("%012d", time.Now().UnixNano()%1e12)
+}
+
+// kzt returns amount of tiyn in the default currency
+func kzt(amount int64) domain.Money {
+	return domain.NewMoney(amount, domain.DefaultCurrency)
+}
+
+// same returns transfer of amount without exchange
+// notRequired is the step-up decision of transfers below the threshold
+var notRequired = domain.StepUp{Decision: domain.StepUpNotRequired}
+
+func same(amount domain.Money) domain.Conversion {
+	return domain.NewConversion(amount)
+}
+
+// transferError makes transfer with db for checks that only care whether it failed
+func transferError(db repository.DBInterface, from, to string, conv domain.Conversion, key *domain.IdempotencyKey, stepUp domain.StepUp) error {
+	_, err := db.Transfer(from, to, conv, key, stepUp)
+	return err
+}
+
+// newWallet inserts KZT wallet with account number following the last one, the way AddWalletUsecase does
+func newWallet(t *testing.T, db repository.DBInterface, IIN string) string {
+	return newCurrencyWallet(t, db, IIN, domain.DefaultCurrency)
+}
+
+// newCurrencyWallet inserts wallet of currency with account number following the last one
+func newCurrencyWallet(t *testing.T, db repository.DBInterface, IIN, currency string) string {
+	last, err := db.GetLastAccountNo()
+	require.NoError(t, err)
+	num, err := strconv.Atoi(last[3:])
+	require.NoError(t, err)
+	account := fmt.Sprintf("%s%010d", currency, num+1)
+	require.NoError(t, db.InsertWallet(account, IIN, currency))
+	return account
+}
+
+func testWallets(t *testing.T, db repository.DBInterface) {
+	IIN := newIIN()
+	first := newWallet(t, db, IIN)
+	second := newWallet(t, db, IIN)
+
+	last, err := db.GetLastAccountNo()
+	assert.NoError(t, err)
+	assert.Equal(t, second, last)
+	assert.Error(t, db.InsertWallet(second, IIN, domain.DefaultCurrency), "account numbers are unique")
+
+	list, err := db.GetWalletList(IIN)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{first, second}, list)
+
+	wallets, err := db.GetWallets(IIN)
+	assert.NoError(t, err)
+	if assert.Len(t, wallets, 2) {
+		assert.Equal(t, first, wallets[0].AccountNo)
+		assert.Equal(t, kzt(0), wallets[0].Ledger)
+		assert.Equal(t, kzt(0), wallets[0].Available)
+	}
+
+	wallet, err := db.GetWallet(second)
+	if assert.NoError(t, err) {
+		assert.Equal(t, second, wallet.AccountNo)
+		assert.Equal(t, IIN, wallet.IIN)
+		assert.Equal(t, kzt(0), wallet.Available)
+	}
+	_, err = db.GetWallet("KZT_unknown")
+	assert.Equal(t, myerrors.ErrWalletNotFound, err)
+
+	ok, err := db.ConfirmIIN(IIN, first)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = db.ConfirmIIN("someone else", first)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	_, err = db.ConfirmIIN(IIN, "KZT_unknown")
+	assert.Equal(t, myerrors.ErrWalletNotFound, err)
+	_, err = db.GetAmount("KZT_unknown")
+	assert.Equal(t, myerrors.ErrWalletNotFound, err)
+}
+
+func testTopUp(t *testing.T, db repository.DBInterface) {
+	account := newWallet(t, db, newIIN())
+
+	assert.NoError(t, db.TopUp(account, kzt(150), nil))
+	assert.NoError(t, db.TopUp(account, kzt(50), nil))
+	amount, err := db.GetAmount(account)
+	assert.NoError(t, err)
+	assert.Equal(t, kzt(200), amount)
+
+	assert.Equal(t, myerrors.ErrUpdateRows, db.TopUp("KZT_unknown", kzt(50), nil))
+	assert.Equal(t, myerrors.ErrUpdateRows, db.TopUp(account, domain.NewMoney(50, "USD"), nil), "wallet currency differs")
+
+	transactions, err := db.GetTransactions(domain.TransactionFilter{Account: account})
+	assert.NoError(t, err)
+	if assert.Len(t, transactions, 2) {
+		assert.Equal(t, "topup", transactions[0].Type)
+		assert.Equal(t, domain.FundingAccount, transactions[0].From)
+		assert.Equal(t, account, transactions[0].To)
+		assert.Equal(t, kzt(150), transactions[0].Amount)
+	}
+
+	tb, err := db.GetTrialBalance()
+	assert.NoError(t, err)
+	assert.True(t, tb.Balanced)
+	assert.NotContains(t, tb.Mismatched, account)
+}
+
+func testTransfer(t *testing.T, db repository.DBInterface) {
+	IIN := newIIN()
+	from, to := newWallet(t, db, IIN), newWallet(t, db, IIN)
+	require.NoError(t, db.TopUp(from, kzt(100), nil))
+
+	made, err := db.Transfer(from, to, same(kzt(60)), nil, domain.StepUp{Decision: domain.StepUpTOTP})
+	if assert.NoError(t, err) {
+		assert.NotZero(t, made.ID)
+		assert.Equal(t, domain.NewTransfer(made.ID, from, to, same(kzt(60)), domain.StepUpTOTP), *made)
+	}
+	assert.Equal(t, myerrors.ErrInsufficientFunds, transferError(db, from, to, same(kzt(41)), nil, notRequired))
+	assert.Equal(t, myerrors.ErrInvalidAmt, transferError(db, from, to, same(kzt(-1)), nil, notRequired))
+	assert.Equal(t, myerrors.ErrInvalidAmt, transferError(db, from, to, same(domain.NewMoney(1, "XXX")), nil, notRequired))
+	assert.Equal(t, myerrors.ErrCurrencyMismatch, transferError(db, from, to, same(domain.NewMoney(1, "USD")), nil, notRequired))
+
+	amount, err := db.GetAmount(from)
+	assert.NoError(t, err)
+	assert.Equal(t, kzt(40), amount)
+	amount, err = db.GetAmount(to)
+	assert.NoError(t, err)
+	assert.Equal(t, kzt(60), amount)
+
+	transactions, err := db.GetTransactions(domain.TransactionFilter{Account: to})
+	assert.NoError(t, err)
+	if assert.Len(t, transactions, 1) {
+		assert.Equal(t, "transfer", transactions[0].Type)
+		assert.Equal(t, from, transactions[0].From)
+		assert.Equal(t, kzt(60), transactions[0].Amount)
+		assert.Equal(t, kzt(60), transactions[0].Credited)
+		assert.Empty(t, transactions[0].Rate)
+		assert.Equal(t, domain.StepUpTOTP, transactions[0].StepUp)
+	}
+
+	tb, err := db.GetTrialBalance()
+	assert.NoError(t, err)
+	assert.True(t, tb.Balanced)
+	assert.NotContains(t, tb.Mismatched, from)
+	assert.NotContains(t, tb.Mismatched, to)
+}
+
+func testTransactionHistory(t *testing.T, db repository.DBInterface) {
+	IIN := newIIN()
+	account, other, third := newWallet(t, db, IIN), newWallet(t, db, IIN), newWallet(t, db, IIN)
+	require.NoError(t, db.TopUp(account, kzt(1000), nil))
+	require.NoError(t, db.TopUp(other, kzt(1000), nil))
+	require.NoError(t, transferError(db, account, other, same(kzt(100)), nil, notRequired))
+	require.NoError(t, transferError(db, other, account, same(kzt(200)), nil, notRequired))
+	require.NoError(t, transferError(db, account, third, same(kzt(300)), nil, notRequired))
+
+	amounts := func(filter domain.TransactionFilter) []int64 {
+		filter.Account = account
+		transactions, err := db.GetTransactions(filter)
+		require.NoError(t, err)
+		var amounts []int64
+		for _, transaction := range transactions {
+			amounts = append(amounts, transaction.Amount.Amount)
+		}
+		return amounts
+	}
+	min, max := int64(150), int64(300)
+	assert.Equal(t, []int64{1000, 100, 200, 300}, amounts(domain.TransactionFilter{}))
+	assert.Equal(t, []int64{300, 200, 100, 1000}, amounts(domain.TransactionFilter{Desc: true}))
+	assert.Equal(t, []int64{100, 300}, amounts(domain.TransactionFilter{Direction: domain.DirectionOut}))
+	assert.Equal(t, []int64{1000, 200}, amounts(domain.TransactionFilter{Direction: domain.DirectionIn}))
+	assert.Equal(t, []int64{1000}, amounts(domain.TransactionFilter{Type: "topup"}))
+	assert.Equal(t, []int64{100, 200}, amounts(domain.TransactionFilter{Counterparty: other}))
+	assert.Equal(t, []int64{200}, amounts(domain.TransactionFilter{Counterparty: other, Direction: domain.DirectionIn}))
+	assert.Equal(t, []int64{200, 300}, amounts(domain.TransactionFilter{MinAmount: &min, MaxAmount: &max}))
+	assert.Equal(t, []int64{1000, 100, 200, 300}, amounts(domain.TransactionFilter{Since: time.Now().Add(-24 * time.Hour)}))
+	assert.Empty(t, amounts(domain.TransactionFilter{Since: time.Now().Add(24 * time.Hour)}))
+	assert.Empty(t, amounts(domain.TransactionFilter{Until: time.Now().Add(-24 * time.Hour)}))
+
+	// pages continue after the last transaction of the previous one in either order
+	page, err := db.GetTransactions(domain.TransactionFilter{Account: account, Limit: 3})
+	require.NoError(t, err)
+	require.Len(t, page, 3)
+	assert.Equal(t, []int64{300}, amounts(domain.TransactionFilter{Cursor: page[2].ID, Limit: 3}))
+	assert.Equal(t, []int64{100, 1000}, amounts(domain.TransactionFilter{Cursor: page[2].ID, Desc: true}))
+
+	// balances at a point in time are what statements open with
+	balance, err := db.GetBalanceAt(account, time.Now().Add(24*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, kzt(800), balance)
+	balance, err = db.GetBalanceAt(account, time.Now().Add(-24*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, kzt(0), balance)
+	_, err = db.GetBalanceAt("KZT9999999999", time.Now())
+	assert.Error(t, err)
+}
+
+func testCrossCurrencyTransfer(t *testing.T, db repository.DBInterface) {
+	IIN := newIIN()
+	from, to := newCurrencyWallet(t, db, IIN, "USD"), newWallet(t, db, IIN)
+	require.NoError(t, db.TopUp(from, domain.NewMoney(1000, "USD"), nil))
+
+	wallets, err := db.GetWallets(IIN)
+	assert.NoError(t, err)
+	if assert.Len(t, wallets, 2) {
+		assert.Equal(t, domain.NewMoney(1000, "USD"), wallets[0].Ledger)
+	}
+
+	conv := domain.Conversion{Debit: domain.NewMoney(400, "USD"), Credit: kzt(188100), Rate: "470.25"}
+	assert.NoError(t, transferError(db, from, to, conv, nil, notRequired))
+	reversed := domain.Conversion{Debit: kzt(1), Credit: domain.NewMoney(1, "USD"), Rate: "1"}
+	assert.Equal(t, myerrors.ErrCurrencyMismatch, transferError(db, from, to, reversed, nil, notRequired))
+
+	amount, err := db.GetAmount(from)
+	assert.NoError(t, err)
+	assert.Equal(t, domain.NewMoney(600, "USD"), amount)
+	amount, err = db.GetAmount(to)
+	assert.NoError(t, err)
+	assert.Equal(t, kzt(188100), amount)
+
+	transactions, err := db.GetTransactions(domain.TransactionFilter{Account: to})
+	assert.NoError(t, err)
+	if assert.Len(t, transactions, 1) {
+		assert.Equal(t, conv.Debit, transactions[0].Amount)
+		assert.Equal(t, conv.Credit, transactions[0].Credited)
+		assert.Equal(t, "470.25", transactions[0].Rate)
+	}
+
+	tb, err := db.GetTrialBalance()
+	assert.NoError(t, err)
+	assert.True(t, tb.Balanced)
+	assert.Zero(t, tb.Totals["USD"])
+	assert.Zero(t, tb.Totals["KZT"])
+	assert.NotContains(t, tb.Mismatched, from)
+	assert.NotContains(t, tb.Mismatched, to)
+}
+
+func testReverse(t *testing.T, db repository.DBInterface) {
+	IIN := newIIN()
+	from, to := newWallet(t, db, IIN), newWallet(t, db, IIN)
+	require.NoError(t, db.TopUp(from, kzt(100), nil))
+	require.NoError(t, transferError(db, from, to, same(kzt(60)), nil, notRequired))
+	transactions, err := db.GetTransactions(domain.TransactionFilter{Account: to})
+	require.NoError(t, err)
+	require.Len(t, transactions, 1)
+	transfer := transactions[0].ID
+
+	partial := kzt(20)
+	reversal, err := db.Reverse(transfer, &partial)
+	assert.NoError(t, err)
+	if assert.NotNil(t, reversal) {
+		assert.Equal(t, domain.ReversalType, reversal.Type)
+		assert.Equal(t, to, reversal.From)
+		assert.Equal(t, from, reversal.To)
+		assert.Equal(t, transfer, reversal.ReversesID)
+	}
+	tooMuch := kzt(41)
+	_, err = db.Reverse(transfer, &tooMuch)
+	assert.Equal(t, myerrors.ErrRefundTooLarge, err)
+	_, err = db.Reverse(reversal.ID, nil)
+	assert.Equal(t, myerrors.ErrNotReversible, err)
+
+	// the rest is refunded when no amount is given, after that nothing is left to reverse
+	_, err = db.Reverse(transfer, nil)
+	assert.NoError(t, err)
+	_, err = db.Reverse(transfer, nil)
+	assert.Equal(t, myerrors.ErrAlreadyReversed, err)
+	_, err = db.Reverse(1<<30, nil)
+	assert.Equal(t, myerrors.ErrTxNotFound, err)
+
+	amount, err := db.GetAmount(from)
+	assert.NoError(t, err)
+	assert.Equal(t, kzt(100), amount)
+	amount, err = db.GetAmount(to)
+	assert.NoError(t, err)
+	assert.Equal(t, kzt(0), amount)
+
+	transactions, err = db.GetTransactions(domain.TransactionFilter{Account: to})
+	assert.NoError(t, err)
+	if assert.Len(t, transactions, 3) {
+		assert.Zero(t, transactions[0].ReversesID)
+		assert.Equal(t, transfer, transactions[1].ReversesID)
+		assert.Equal(t, transfer, transactions[2].ReversesID)
+	}
+
+	// a top-up is reversed back into the funding account, but not beyond what the wallet holds
+	topUps, err := db.GetTransactions(domain.TransactionFilter{Account: from})
+	require.NoError(t, err)
+	_, err = db.Reverse(topUps[0].ID, nil)
+	assert.NoError(t, err)
+	amount, err = db.GetAmount(from)
+	assert.NoError(t, err)
+	assert.Equal(t, kzt(0), amount)
+
+	require.NoError(t, db.TopUp(from, kzt(10), nil))
+	require.NoError(t, transferError(db, from, to, same(kzt(10)), nil, notRequired))
+	require.NoError(t, transferError(db, to, from, same(kzt(10)), nil, notRequired))
+	transactions, err = db.GetTransactions(domain.TransactionFilter{Account: to})
+	require.NoError(t, err)
+	spent := transactions[len(transactions)-2]
+	require.Equal(t, from, spent.From)
+	_, err = db.Reverse(spent.ID, nil)
+	assert.Equal(t, myerrors.ErrInsufficientFunds, err, "receiver already spent the money")
+
+	tb, err := db.GetTrialBalance()
+	assert.NoError(t, err)
+	assert.True(t, tb.Balanced)
+	assert.NotContains(t, tb.Mismatched, from)
+	assert.NotContains(t, tb.Mismatched, to)
+}
+
+func testHolds(t *testing.T, db repository.DBInterface) {
+	IIN := newIIN()
+	from, to := newWallet(t, db, IIN), newWallet(t, db, IIN)
+	require.NoError(t, db.TopUp(from, kzt(100), nil))
+
+	hold, err := db.PlaceHold(from, to, kzt(70), time.Now().Add(time.Hour), domain.StepUp{Decision: domain.StepUpTOTP})
+	require.NoError(t, err)
+	assert.Equal(t, domain.HoldActive, hold.Status)
+	assert.Equal(t, from, hold.AccountNo)
+	assert.Equal(t, to, hold.Payee)
+	assert.Equal(t, domain.StepUpTOTP, hold.StepUp)
+	_, err = db.PlaceHold(from, to, kzt(31), time.Now().Add(time.Hour), notRequired)
+	assert.Equal(t, myerrors.ErrInsufficientFunds, err)
+	_, err = db.PlaceHold(from, to, domain.NewMoney(1, "USD"), time.Now().Add(time.Hour), notRequired)
+	assert.Equal(t, myerrors.ErrCurrencyMismatch, err)
+
+	// held money stays on the ledger but cannot be transferred
+	wallets, err := db.GetWallets(IIN)
+	require.NoError(t, err)
+	require.Len(t, wallets, 2)
+	assert.Equal(t, kzt(100), wallets[0].Ledger)
+	assert.Equal(t, kzt(30), wallets[0].Available)
+	assert.Equal(t, myerrors.ErrInsufficientFunds, transferError(db, from, to, same(kzt(31)), nil, notRequired))
+
+	// captures go to the payee with the step-up decision of the hold
+	_, err = db.CaptureHold(hold.ID, same(kzt(71)))
+	assert.Equal(t, myerrors.ErrCaptureTooLarge, err)
+	captured, err := db.CaptureHold(hold.ID, same(kzt(50)))
+	require.NoError(t, err)
+	assert.Equal(t, domain.HoldCaptured, captured.Status)
+	assert.Equal(t, kzt(50), captured.Captured)
+	assert.NotZero(t, captured.TransactionID)
+	_, err = db.CaptureHold(hold.ID, same(kzt(10)))
+	assert.Equal(t, myerrors.ErrHoldNotActive, err)
+	_, err = db.ReleaseHold(hold.ID)
+	assert.Equal(t, myerrors.ErrHoldNotActive, err)
+
+	stored, err := db.GetHold(hold.ID)
+	require.NoError(t, err)
+	assert.Equal(t, domain.HoldCaptured, stored.Status)
+	assert.Equal(t, captured.TransactionID, stored.TransactionID)
+	assert.Equal(t, to, stored.Payee)
+	assert.Equal(t, domain.StepUpTOTP, stored.StepUp)
+	_, err = db.GetHold(1 << 30)
+	assert.Equal(t, myerrors.ErrHoldNotFound, err)
+
+	// the uncaptured rest of the hold is available again
+	amount, err := db.GetAmount(from)
+	assert.NoError(t, err)
+	assert.Equal(t, kzt(50), amount)
+	amount, err = db.GetAmount(to)
+	assert.NoError(t, err)
+	assert.Equal(t, kzt(50), amount)
+	transactions, err := db.GetTransactions(domain.TransactionFilter{Account: to})
+	require.NoError(t, err)
+	if assert.Len(t, transactions, 1) {
+		assert.Equal(t, domain.HoldType, transactions[0].Type)
+		assert.Equal(t, domain.StepUpTOTP, transactions[0].StepUp)
+	}
+
+	released, err := db.PlaceHold(from, to, kzt(50), time.Now().Add(time.Hour), notRequired)
+	require.NoError(t, err)
+	released, err = db.ReleaseHold(released.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, domain.HoldReleased, released.Status)
+	assert.NoError(t, transferError(db, from, to, same(kzt(10)), nil, notRequired))
+
+	expiring, err := db.PlaceHold(from, to, kzt(40), time.Now().Add(time.Hour), notRequired)
+	require.NoError(t, err)
+	expired, err := db.ExpireHolds(time.Now().Add(2 * time.Hour))
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, expired, 1)
+	stored, err = db.GetHold(expiring.ID)
+	require.NoError(t, err)
+	assert.Equal(t, domain.HoldExpired, stored.Status)
+	assert.NoError(t, transferError(db, from, to, same(kzt(40)), nil, notRequired))
+
+	tb, err := db.GetTrialBalance()
+	assert.NoError(t, err)
+	assert.True(t, tb.Balanced)
+	assert.NotContains(t, tb.Mismatched, from)
+	assert.NotContains(t, tb.Mismatched, to)
+}
+
+func testSchedules(t *testing.T, db repository.DBInterface) {
+	IIN := newIIN()
+	from, to := newWallet(t, db, IIN), newWallet(t, db, IIN)
+	due := time.Now().Add(-time.Minute).Truncate(time.Second)
+
+	// a schedule created with a confirmation uses it up
+	c := domain.TransferConfirmation{Hash: auth.HashToken(IIN), IIN: IIN, From: from, To: to, Amount: kzt(500), ExpiresAt: time.Now().Add(time.Minute)}
+	require.NoError(t, db.InsertTransferConfirmation(c))
+	stepUp := domain.StepUp{Decision: domain.StepUpConfirmation, ConfirmationHash: c.Hash}
+	s, err := db.InsertSchedule(domain.Schedule{IIN: IIN, From: from, To: to, Amount: kzt(500), Recurrence: "0 9 1 * *", NextRun: due}, stepUp)
+	require.NoError(t, err)
+	assert.NotZero(t, s.ID)
+	assert.Equal(t, domain.ScheduleActive, s.Status)
+	assert.Equal(t, domain.StepUpConfirmation, s.StepUp)
+	_, err = db.InsertSchedule(domain.Schedule{IIN: IIN, From: from, To: to, Amount: kzt(500), NextRun: due}, stepUp)
+	assert.Equal(t, myerrors.ErrInvalidConfirmation, err, "a confirmation is used once")
+	later, err := db.InsertSchedule(domain.Schedule{IIN: IIN, From: from, To: to, Amount: kzt(100), NextRun: time.Now().Add(time.Hour)}, notRequired)
+	require.NoError(t, err)
+
+	schedules, err := db.GetSchedules(IIN)
+	assert.NoError(t, err)
+	if assert.Len(t, schedules, 2) {
+		assert.Equal(t, kzt(500), schedules[0].Amount)
+		assert.Equal(t, "0 9 1 * *", schedules[0].Recurrence)
+		assert.Equal(t, domain.StepUpConfirmation, schedules[0].StepUp)
+		assert.True(t, due.Equal(schedules[0].NextRun), "next run %v", schedules[0].NextRun)
+	}
+
+	dueSchedules, err := db.GetDueSchedules(time.Now())
+	assert.NoError(t, err)
+	ids := make([]int, 0, len(dueSchedules))
+	for _, d := range dueSchedules {
+		ids = append(ids, d.ID)
+	}
+	assert.Contains(t, ids, s.ID)
+	assert.NotContains(t, ids, later.ID)
+
+	// a failed run moves the schedule on without running it again right away
+	s.NextRun = time.Now().Add(time.Hour).Truncate(time.Second)
+	s.Failures = 1
+	ranAt := time.Now().Truncate(time.Second)
+	assert.NoError(t, db.RecordScheduleRun(*s, domain.ScheduleRun{Ts: ranAt, Outcome: domain.RunFailed, Error: myerrors.ErrInsufficientFunds.Error()}))
+	stored, err := db.GetSchedule(s.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, stored.Failures)
+	assert.True(t, s.NextRun.Equal(stored.NextRun))
+	runs, err := db.GetScheduleRuns(s.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, runs, 1) {
+		assert.Equal(t, domain.RunFailed, runs[0].Outcome)
+		assert.Equal(t, myerrors.ErrInsufficientFunds.Error(), runs[0].Error)
+		assert.True(t, ranAt.Equal(runs[0].Ts))
+	}
+
+	cancelled, err := db.CancelSchedule(s.ID)
+	assert.NoError(t, err)
+	if assert.NotNil(t, cancelled) {
+		assert.Equal(t, domain.ScheduleCancelled, cancelled.Status)
+	}
+	_, err = db.CancelSchedule(s.ID)
+	assert.Equal(t, myerrors.ErrScheduleNotActive, err)
+	_, err = db.CancelSchedule(1 << 30)
+	assert.Equal(t, myerrors.ErrScheduleNotFound, err)
+
+	// a run finishing after the schedule was cancelled does not bring it back
+	s.Status = domain.ScheduleActive
+	assert.NoError(t, db.RecordScheduleRun(*s, domain.ScheduleRun{Ts: time.Now(), Outcome: domain.RunSucceeded}))
+	stored, err = db.GetSchedule(s.ID)
+	require.NoError(t, err)
+	assert.Equal(t, domain.ScheduleCancelled, stored.Status)
+}
+
+func testBatches(t *testing.T, db repository.DBInterface) {
+	IIN := newIIN()
+	from, to := newWallet(t, db, IIN), newWallet(t, db, IIN)
+	require.NoError(t, db.TopUp(to, kzt(100), nil))
+	transactions, err := db.GetTransactions(domain.TransactionFilter{Account: to})
+	require.NoError(t, err)
+	require.Len(t, transactions, 1)
+
+	b, err := db.InsertBatch(domain.Batch{IIN: IIN, From: from, Mode: domain.BatchBestEffort, Total: kzt(300), Lines: []domain.BatchLine{
+		{Line: 1, To: to, Amount: kzt(100), Reference: "salary"},
+		{Line: 2, To: to, Amount: kzt(200)},
+	}}, domain.StepUp{Decision: domain.StepUpTOTP})
+	require.NoError(t, err)
+	assert.NotZero(t, b.ID)
+	assert.Equal(t, domain.BatchPending, b.Status)
+
+	stored, err := db.GetBatch(b.ID)
+	require.NoError(t, err)
+	assert.Equal(t, kzt(300), stored.Total)
+	assert.Equal(t, domain.StepUpTOTP, stored.StepUp)
+	if assert.Len(t, stored.Lines, 2) {
+		assert.Equal(t, domain.BatchLine{Line: 1, To: to, Amount: kzt(100), Reference: "salary", Status: domain.LinePending}, stored.Lines[0])
+	}
+	pending, err := db.GetPendingBatches()
+	assert.NoError(t, err)
+	ids := make([]int, 0, len(pending))
+	for _, p := range pending {
+		ids = append(ids, p.ID)
+	}
+	assert.Contains(t, ids, b.ID)
+
+	// only one worker gets to run a batch
+	claimed, err := db.ClaimBatch(b.ID)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+	claimed, err = db.ClaimBatch(b.ID)
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+
+	assert.NoError(t, db.UpdateBatchLine(b.ID, domain.BatchLine{Line: 1, Status: domain.LineSucceeded, TransactionID: transactions[0].ID}))
+	assert.NoError(t, db.UpdateBatchLine(b.ID, domain.BatchLine{Line: 2, Status: domain.LineFailed, Error: myerrors.ErrInsufficientFunds.Error()}))
+	assert.NoError(t, db.FinishBatch(b.ID, domain.BatchPartial))
+	stored, err = db.GetBatch(b.ID)
+	require.NoError(t, err)
+	assert.Equal(t, domain.BatchPartial, stored.Status)
+	if assert.Len(t, stored.Lines, 2) {
+		assert.Equal(t, domain.LineSucceeded, stored.Lines[0].Status)
+		assert.Equal(t, transactions[0].ID, stored.Lines[0].TransactionID)
+		assert.Equal(t, domain.LineFailed, stored.Lines[1].Status)
+		assert.Equal(t, myerrors.ErrInsufficientFunds.Error(), stored.Lines[1].Error)
+		assert.Equal(t, kzt(200), stored.Lines[1].Amount)
+	}
+
+	_, err = db.GetBatch(1 << 30)
+	assert.Equal(t, myerrors.ErrBatchNotFound, err)
+}
+
+func testWebhooks(t *testing.T, db repository.DBInterface) {
+	IIN := newIIN()
+	account, other := newWallet(t, db, IIN), newWallet(t, db, newIIN())
+	s, err := db.InsertSubscription(domain.Subscription{IIN: IIN, URL: "http://localhost/hook", Secret: "secret", Events: []string{domain.EventWalletToppedUp, domain.EventTransferReceived}})
+	require.NoError(t, err)
+	assert.NotZero(t, s.ID)
+	stored, err := db.GetSubscription(s.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{domain.EventWalletToppedUp, domain.EventTransferReceived}, stored.Events)
+	assert.Equal(t, "secret", stored.Secret)
+	subscriptions, err := db.GetSubscriptions(IIN)
+	assert.NoError(t, err)
+	assert.Len(t, subscriptions, 1)
+
+	// only events of wallets of the subscriber of a type it asked for are queued
+	now := time.Now().Truncate(time.Second)
+	amount := kzt(100)
+	for _, e := range []domain.Event{
+		{ID: account + "-1", Type: domain.EventWalletToppedUp, Ts: now, Account: account, Amount: &amount},
+		{ID: account + "-2", Type: domain.EventTransferSent, Ts: now, Account: account, Counterparty: other, Amount: &amount},
+		{ID: other + "-1", Type: domain.EventWalletToppedUp, Ts: now, Account: other, Amount: &amount},
+	} {
+		_, err := db.EnqueueEvent(e)
+		require.NoError(t, err)
+	}
+
+	// an event published again is not queued twice
+	queued, err := db.EnqueueEvent(domain.Event{ID: account + "-1", Type: domain.EventWalletToppedUp, Ts: now, Account: account, Amount: &amount})
+	require.NoError(t, err)
+	assert.Zero(t, queued)
+	due := dueDeliveries(t, db, s.ID, now)
+	require.Len(t, due, 1)
+	d := due[0]
+	assert.Equal(t, domain.EventWalletToppedUp, d.EventType)
+	assert.Equal(t, domain.DeliveryPending, d.Status)
+	assert.Equal(t, IIN, d.IIN)
+	assert.Equal(t, "http://localhost/hook", d.URL)
+	assert.Equal(t, "secret", d.Secret)
+	assert.Equal(t, account+"-1", d.EventID)
+	assert.JSONEq(t, `{"id":"`+account+`-1","type":"wallet.topped_up","ts":"`+now.Format(time.RFC3339)+`","account":"`+account+`","amount":{"amount":"1.00","currency":"KZT"}}`, d.Payload)
+
+	// a failed attempt is retried later, one out of attempts is dead
+	d.Attempts, d.NextAttempt, d.LastError = 1, now.Add(time.Hour), "status 500"
+	require.NoError(t, db.RecordDelivery(d))
+	assert.Empty(t, dueDeliveries(t, db, s.ID, now))
+	d.Status = domain.DeliveryDead
+	require.NoError(t, db.RecordDelivery(d))
+	dead, err := db.GetDeadDeliveries(IIN)
+	require.NoError(t, err)
+	if assert.Len(t, dead, 1) {
+		assert.Equal(t, "status 500", dead[0].LastError)
+		assert.Equal(t, 1, dead[0].Attempts)
+	}
+	require.NoError(t, db.RequeueDelivery(d.ID, now))
+	assert.Equal(t, myerrors.ErrDeliveryNotDead, db.RequeueDelivery(d.ID, now))
+	requeued, err := db.GetDelivery(d.ID)
+	require.NoError(t, err)
+	assert.Equal(t, domain.DeliveryPending, requeued.Status)
+	assert.Zero(t, requeued.Attempts)
+	assert.Len(t, dueDeliveries(t, db, s.ID, now), 1)
+
+	require.NoError(t, db.DeleteSubscription(s.ID))
+	assert.Equal(t, myerrors.ErrSubscriptionNotFound, db.DeleteSubscription(s.ID))
+	_, err = db.GetSubscription(s.ID)
+	assert.Equal(t, myerrors.ErrSubscriptionNotFound, err)
+	_, err = db.GetDelivery(d.ID)
+	assert.Equal(t, myerrors.ErrDeliveryNotFound, err)
+}
+
+// dueDeliveries returns deliveries due at now to subscription, other tests may share the DB
+func dueDeliveries(t *testing.T, db repository.DBInterface, subscriptionID int, now time.Time) []domain.Delivery {
+	due, err := db.GetDueDeliveries(now, 1000)
+	require.NoError(t, err)
+	var deliveries []domain.Delivery
+	for _, d := range due {
+		if d.SubscriptionID == subscriptionID {
+			deliveries = append(deliveries, d)
+		}
+	}
+	return deliveries
+}
+
+func testOutbox(t *testing.T, db repository.DBInterface) {
+	start, err := db.GetOutboxPosition()
+	require.NoError(t, err)
+	IIN := newIIN()
+	account, other := newWallet(t, db, IIN), newWallet(t, db, newIIN())
+	require.NoError(t, db.TopUp(account, kzt(500), nil))
+	require.NoError(t, transferError(db, account, other, same(kzt(200)), nil, notRequired))
+
+	// changes of balance are written to the outbox together with the events they cause
+	events := outboxEvents(t, db, account, other)
+	require.Len(t, events, 5)
+	types := make([]string, len(events))
+	for i, e := range events {
+		types[i] = e.Type
+		assert.NotEmpty(t, e.ID)
+		assert.False(t, e.Ts.IsZero())
+	}
+	assert.Equal(t, []string{domain.EventWalletCreated, domain.EventWalletCreated, domain.EventWalletToppedUp, domain.EventTransferSent, domain.EventTransferReceived}, types)
+	if assert.NotNil(t, events[2].Amount) {
+		assert.Equal(t, kzt(500), *events[2].Amount)
+	}
+	assert.NotZero(t, events[2].TransactionID)
+	assert.Equal(t, other, events[3].Counterparty)
+	assert.Equal(t, account, events[4].Counterparty)
+	assert.Equal(t, events[3].TransactionID, events[4].TransactionID)
+
+	// the outbox is followed from a position, published or not
+	since, position, err := db.GetEventsSince(start, 100000)
+	require.NoError(t, err)
+	assert.Equal(t, events, eventsOf(since, account, other))
+	latest, err := db.GetOutboxPosition()
+	require.NoError(t, err)
+	assert.Equal(t, latest, position)
+	since, next, err := db.GetEventsSince(position, 10)
+	require.NoError(t, err)
+	assert.Empty(t, since)
+	assert.Equal(t, position, next)
+	since, next, err = db.GetEventsSince(start, 1)
+	require.NoError(t, err)
+	assert.Len(t, since, 1)
+	assert.Greater(t, next, start)
+
+	// a failed transfer leaves nothing behind
+	assert.Error(t, transferError(db, other, account, same(kzt(1000)), nil, notRequired))
+	assert.Len(t, outboxEvents(t, db, account, other), 5)
+
+	// published events are not handed out again
+	for _, e := range events[:3] {
+		require.NoError(t, db.MarkEventPublished(e.ID, time.Now()))
+	}
+	left := outboxEvents(t, db, account, other)
+	if assert.Len(t, left, 2) {
+		assert.Equal(t, events[3].ID, left[0].ID)
+	}
+
+	// events of the user's wallets are replayed after a given one, published or not
+	after, err := db.GetEventsAfter(IIN, events[0].ID, 10)
+	require.NoError(t, err)
+	if assert.Len(t, after, 2) {
+		assert.Equal(t, events[2].ID, after[0].ID)
+		assert.Equal(t, events[3].ID, after[1].ID)
+	}
+	after, err = db.GetEventsAfter(IIN, events[0].ID, 1)
+	require.NoError(t, err)
+	assert.Len(t, after, 1)
+	after, err = db.GetEventsAfter(IIN, events[4].ID, 10)
+	require.NoError(t, err)
+	assert.Empty(t, after)
+	_, err = db.GetEventsAfter(IIN, "unknown", 10)
+	assert.Equal(t, myerrors.ErrEventNotFound, err)
+
+	// reversals and captures of holds move money too, so they are written to the outbox like transfers
+	partial := kzt(50)
+	reversal, err := db.Reverse(events[3].TransactionID, &partial)
+	require.NoError(t, err)
+	hold, err := db.PlaceHold(account, other, kzt(100), time.Now().Add(time.Hour), notRequired)
+	require.NoError(t, err)
+	captured, err := db.CaptureHold(hold.ID, same(kzt(80)))
+	require.NoError(t, err)
+	moved := outboxEvents(t, db, account, other)[2:]
+	if assert.Len(t, moved, 4) {
+		assert.Equal(t, domain.EventTransferSent, moved[0].Type)
+		assert.Equal(t, other, moved[0].Account)
+		assert.Equal(t, domain.EventTransferReceived, moved[1].Type)
+		assert.Equal(t, account, moved[1].Account)
+		assert.Equal(t, reversal.ID, moved[0].TransactionID)
+		assert.Equal(t, reversal.ID, moved[1].TransactionID)
+		assert.Equal(t, domain.EventTransferSent, moved[2].Type)
+		assert.Equal(t, account, moved[2].Account)
+		assert.Equal(t, domain.EventTransferReceived, moved[3].Type)
+		assert.Equal(t, other, moved[3].Account)
+		assert.Equal(t, captured.TransactionID, moved[2].TransactionID)
+		assert.Equal(t, captured.TransactionID, moved[3].TransactionID)
+		if assert.NotNil(t, moved[3].Amount) {
+			assert.Equal(t, kzt(80), *moved[3].Amount)
+		}
+	}
+}
+
+// outboxEvents returns unpublished events of given accounts, other tests may share the DB
+func outboxEvents(t *testing.T, db repository.DBInterface, accounts ...string) []domain.Event {
+	unpublished, err := db.GetUnpublishedEvents(100000)
+	require.NoError(t, err)
+	return eventsOf(unpublished, accounts...)
+}
+
+// eventsOf returns those of events that are of given accounts
+func eventsOf(all []domain.Event, accounts ...string) []domain.Event {
+	var events []domain.Event
+	for _, e := range all {
+		for _, account := range accounts {
+			if e.Account == account {
+				events = append(events, e)
+				break
+			}
+		}
+	}
+	return events
+}
+
+func testIdempotencyKey(t *testing.T, db repository.DBInterface) {
+	IIN := newIIN()
+	account := newWallet(t, db, IIN)
+
+	key, err := db.GetIdempotencyKey(IIN, "unknown")
+	assert.NoError(t, err)
+	assert.Nil(t, key)
+
+	stored := &domain.IdempotencyKey{Key: "topup-1", IIN: IIN, RequestHash: "hash", ExpiresAt: time.Now().Add(time.Hour)}
+	assert.NoError(t, db.TopUp(account, kzt(70), stored))
+	assert.JSONEq(t, `{"amount":"0.70","currency":"KZT"}`, stored.Response)
+	assert.NotZero(t, stored.TransactionID)
+
+	key, err = db.GetIdempotencyKey(IIN, "topup-1")
+	assert.NoError(t, err)
+	if assert.NotNil(t, key) {
+		assert.Equal(t, "hash", key.RequestHash)
+		assert.Equal(t, stored.Response, key.Response)
+		assert.Equal(t, stored.TransactionID, key.TransactionID)
+	}
+
+	// a concurrent request with the same key is a replay and must not move money twice
+	again := &domain.IdempotencyKey{Key: "topup-1", IIN: IIN, RequestHash: "hash", ExpiresAt: time.Now().Add(time.Hour)}
+	assert.NoError(t, db.TopUp(account, kzt(70), again))
+	assert.Equal(t, stored.Response, again.Response)
+	assert.Equal(t, stored.TransactionID, again.TransactionID)
+	other := &domain.IdempotencyKey{Key: "topup-1", IIN: IIN, RequestHash: "other", ExpiresAt: time.Now().Add(time.Hour)}
+	assert.Equal(t, myerrors.ErrIdempotencyConflict, db.TopUp(account, kzt(70), other))
+	amount, err := db.GetAmount(account)
+	assert.NoError(t, err)
+	assert.Equal(t, kzt(70), amount)
+
+	to := newWallet(t, db, newIIN())
+	transfer := &domain.IdempotencyKey{Key: "transfer-1", IIN: IIN, RequestHash: "hash", ExpiresAt: time.Now().Add(time.Hour)}
+	made, err := db.Transfer(account, to, domain.NewConversion(kzt(20)), transfer, domain.StepUp{})
+	require.NoError(t, err)
+	assert.Equal(t, transfer.TransactionID, made.ID)
+	var transaction domain.Transaction
+	if assert.NoError(t, json.Unmarshal([]byte(transfer.Response), &transaction)) {
+		assert.Equal(t, domain.NewTransfer(transfer.TransactionID, account, to, domain.NewConversion(kzt(20)), ""), transaction)
+	}
+	// the replay returns the transaction of the first request
+	again = &domain.IdempotencyKey{Key: "transfer-1", IIN: IIN, RequestHash: "hash", ExpiresAt: time.Now().Add(time.Hour)}
+	replayed, err := db.Transfer(account, to, domain.NewConversion(kzt(20)), again, domain.StepUp{})
+	assert.NoError(t, err)
+	assert.Equal(t, made, replayed)
+	assert.Equal(t, transfer.Response, again.Response)
+	amount, err = db.GetAmount(account)
+	assert.NoError(t, err)
+	assert.Equal(t, kzt(50), amount)
+}
+
+func testUsers(t *testing.T, db repository.DBInterface) {
+	IIN := newIIN()
+	username := "user" + IIN
+	user, err := db.InsertUser(domain.User{IIN: IIN, Username: username, PasswordHash: "hash", Roles: []domain.Role{domain.RoleSupport, domain.RoleAuditor}})
+	require.NoError(t, err)
+	assert.NotZero(t, user.ID)
+	assert.NotEmpty(t, user.Ts)
+
+	got, err := db.GetUserByUsername(username)
+	assert.NoError(t, err)
+	assert.Equal(t, user, got)
+	got, err = db.GetUser(user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, user, got)
+
+	_, err = db.InsertUser(domain.User{IIN: IIN, Username: "other" + IIN, PasswordHash: "hash", Roles: []domain.Role{domain.RoleCustomer}})
+	assert.Equal(t, myerrors.ErrUserExists, err, "IINs are unique")
+	_, err = db.InsertUser(domain.User{IIN: newIIN(), Username: username, PasswordHash: "hash", Roles: []domain.Role{domain.RoleCustomer}})
+	assert.Equal(t, myerrors.ErrUserExists, err, "usernames are unique")
+
+	_, err = db.GetUserByUsername("unknown" + IIN)
+	assert.Equal(t, myerrors.ErrUserNotFound, err)
+	_, err = db.GetUser(0)
+	assert.Equal(t, myerrors.ErrUserNotFound, err)
+}
+
+func testRefreshTokens(t *testing.T, db repository.DBInterface) {
+	IIN := newIIN()
+	user, err := db.InsertUser(domain.User{IIN: IIN, Username: "user" + IIN, PasswordHash: "hash", Roles: []domain.Role{domain.RoleCustomer}})
+	require.NoError(t, err)
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	first := domain.RefreshToken{Hash: auth.HashToken(IIN + "first"), FamilyID: IIN, UserID: user.ID, Status: domain.RefreshTokenActive, ExpiresAt: expiresAt}
+	require.NoError(t, db.InsertRefreshToken(first))
+
+	got, err := db.GetRefreshToken(first.Hash)
+	require.NoError(t, err)
+	assert.Equal(t, first.FamilyID, got.FamilyID)
+	assert.Equal(t, user.ID, got.UserID)
+	assert.Equal(t, domain.RefreshTokenActive, got.Status)
+	assert.True(t, expiresAt.Equal(got.ExpiresAt), "expires at %v, got %v", expiresAt, got.ExpiresAt)
+	_, err = db.GetRefreshToken(auth.HashToken(IIN + "unknown"))
+	assert.Equal(t, myerrors.ErrInvalidRefreshToken, err)
+
+	second := first
+	second.Hash = auth.HashToken(IIN + "second")
+	rotated, err := db.RotateRefreshToken(first.Hash, second)
+	assert.NoError(t, err)
+	assert.True(t, rotated)
+	third := first
+	third.Hash = auth.HashToken(IIN + "third")
+	rotated, err = db.RotateRefreshToken(first.Hash, third)
+	assert.NoError(t, err)
+	assert.False(t, rotated, "a used token can't be rotated again")
+	_, err = db.GetRefreshToken(third.Hash)
+	assert.Equal(t, myerrors.ErrInvalidRefreshToken, err)
+
+	got, err = db.GetRefreshToken(first.Hash)
+	require.NoError(t, err)
+	assert.Equal(t, domain.RefreshTokenUsed, got.Status)
+
+	assert.NoError(t, db.RevokeRefreshTokens(first.FamilyID))
+	got, err = db.GetRefreshToken(second.Hash)
+	require.NoError(t, err)
+	assert.Equal(t, domain.RefreshTokenRevoked, got.Status)
+	got, err = db.GetRefreshToken(first.Hash)
+	require.NoError(t, err)
+	assert.Equal(t, domain.RefreshTokenUsed, got.Status, "used tokens stay used to tell reuse")
+	rotated, err = db.RotateRefreshToken(second.Hash, third)
+	assert.NoError(t, err)
+	assert.False(t, rotated, "a revoked token can't be rotated")
+}
+
+func testSessions(t *testing.T, db repository.DBInterface) {
+	IIN := newIIN()
+	user, err := db.InsertUser(domain.User{IIN: IIN, Username: "user" + IIN, PasswordHash: "hash", Roles: []domain.Role{domain.RoleCustomer}})
+	require.NoError(t, err)
+	now := time.Now()
+	token := func(name, family string, expiresAt time.Time) domain.RefreshToken {
+		return domain.RefreshToken{Hash: auth.HashToken(IIN + name), FamilyID: IIN + family, UserID: user.ID, Status: domain.RefreshTokenActive, ExpiresAt: expiresAt}
+	}
+	require.NoError(t, db.InsertRefreshToken(token("phone", "phone", now.Add(time.Hour))))
+	rotated, err := db.RotateRefreshToken(auth.HashToken(IIN+"phone"), token("phone-refreshed", "phone", now.Add(2*time.Hour)))
+	require.NoError(t, err)
+	require.True(t, rotated)
+	require.NoError(t, db.InsertRefreshToken(token("laptop", "laptop", now.Add(time.Hour))))
+	require.NoError(t, db.InsertRefreshToken(token("expired", "expired", now.Add(-time.Minute))))
+	require.NoError(t, db.InsertRefreshToken(token("logged-out", "logged-out", now.Add(time.Hour))))
+	require.NoError(t, db.RevokeRefreshTokens(IIN+"logged-out"))
+
+	sessions, err := db.GetSessions(IIN, now)
+	assert.NoError(t, err)
+	var ids []string
+	for _, s := range sessions {
+		ids = append(ids, s.ID)
+		assert.NotEmpty(t, s.CreatedAt)
+		assert.NotEmpty(t, s.RefreshedAt)
+		assert.LessOrEqual(t, s.CreatedAt, s.RefreshedAt)
+	}
+	assert.ElementsMatch(t, []string{IIN + "phone", IIN + "laptop"}, ids, "one session per family with an active token")
+
+	sessions, err = db.GetSessions(newIIN(), now)
+	assert.NoError(t, err)
+	assert.Empty(t, sessions)
+}
+
+func testRevocations(t *testing.T, db repository.DBInterface) {
+	IIN := newIIN()
+	now := time.Now().UTC().Truncate(time.Second)
+	user := domain.Revocation{Kind: domain.RevokedUser, Subject: IIN, RevokedAt: now, ExpiresAt: now.Add(time.Hour)}
+	token := domain.Revocation{Kind: domain.RevokedToken, Subject: IIN, RevokedAt: now.Add(time.Second), ExpiresAt: now.Add(-time.Second)}
+	require.NoError(t, db.InsertRevocation(user))
+	require.NoError(t, db.InsertRevocation(token))
+
+	find := func(since time.Time) []domain.Revocation {
+		revocations, err := db.GetRevocations(since)
+		require.NoError(t, err)
+		var found []domain.Revocation
+		for _, r := range revocations {
+			if r.Subject == IIN {
+				r.RevokedAt, r.ExpiresAt = r.RevokedAt.UTC(), r.ExpiresAt.UTC()
+				found = append(found, r)
+			}
+		}
+		return found
+	}
+	assert.Equal(t, []domain.Revocation{user, token}, find(now))
+	assert.Equal(t, []domain.Revocation{token}, find(now.Add(time.Second)))
+
+	// revoking the user again moves the cut-off
+	user.RevokedAt, user.ExpiresAt = now.Add(2*time.Second), now.Add(2*time.Hour)
+	require.NoError(t, db.InsertRevocation(user))
+	assert.Equal(t, []domain.Revocation{token, user}, find(now))
+
+	deleted, err := db.DeleteExpiredRevocations(now)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, deleted, 1)
+	assert.Equal(t, []domain.Revocation{user}, find(now))
+}
+
+func testTOTP(t *testing.T, db repository.DBInterface) {
+	IIN := newIIN()
+	_, err := db.GetTOTP(IIN)
+	assert.Equal(t, myerrors.ErrTOTPNotEnrolled, err)
+
+	require.NoError(t, db.SaveTOTP(domain.TOTP{IIN: IIN, Secret: "PENDING"}))
+	require.NoError(t, db.SaveTOTP(domain.TOTP{IIN: IIN, Secret: "SECRET"}))
+	used, err := db.UseTOTPStep(IIN, 100, true)
+	assert.NoError(t, err)
+	assert.True(t, used)
+	stored, err := db.GetTOTP(IIN)
+	require.NoError(t, err)
+	assert.Equal(t, domain.TOTP{IIN: IIN, Secret: "SECRET", Active: true, LastStep: 100}, *stored)
+
+	used, err = db.UseTOTPStep(IIN, 100, false)
+	assert.NoError(t, err)
+	assert.False(t, used, "a code is accepted once")
+	used, err = db.UseTOTPStep(IIN, 99, false)
+	assert.NoError(t, err)
+	assert.False(t, used, "codes older than the last accepted one are rejected")
+
+	lockedUntil := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, db.FailTOTP(IIN, 3, lockedUntil))
+	}
+	stored, err = db.GetTOTP(IIN)
+	require.NoError(t, err)
+	assert.Equal(t, 2, stored.FailedAttempts)
+	assert.True(t, stored.LockedUntil.IsZero())
+	require.NoError(t, db.FailTOTP(IIN, 3, lockedUntil))
+	stored, err = db.GetTOTP(IIN)
+	require.NoError(t, err)
+	assert.Equal(t, 3, stored.FailedAttempts)
+	assert.True(t, lockedUntil.Equal(stored.LockedUntil), "the third wrong code in a row locks codes out")
+
+	used, err = db.UseTOTPStep(IIN, 101, false)
+	assert.NoError(t, err)
+	assert.True(t, used)
+	stored, err = db.GetTOTP(IIN)
+	require.NoError(t, err)
+	assert.Zero(t, stored.FailedAttempts)
+	assert.True(t, stored.LockedUntil.IsZero())
+	assert.True(t, stored.Active)
+
+	require.NoError(t, db.DeleteTOTP(IIN))
+	_, err = db.GetTOTP(IIN)
+	assert.Equal(t, myerrors.ErrTOTPNotEnrolled, err)
+}
+
+func testTransferConfirmations(t *testing.T, db repository.DBInterface) {
+	IIN := newIIN()
+	from, to := newWallet(t, db, IIN), newWallet(t, db, newIIN())
+	require.NoError(t, db.TopUp(from, kzt(50), nil))
+	now := time.Now().UTC().Truncate(time.Second)
+	c := domain.TransferConfirmation{Hash: auth.HashToken(IIN), IIN: IIN, From: from, To: to, Amount: kzt(100), ExpiresAt: now.Add(time.Minute)}
+	expired := domain.TransferConfirmation{Hash: auth.HashToken(IIN + "expired"), IIN: IIN, From: from, To: to, Amount: kzt(100), ExpiresAt: now}
+	require.NoError(t, db.InsertTransferConfirmation(c))
+	require.NoError(t, db.InsertTransferConfirmation(expired))
+
+	stored, err := db.GetTransferConfirmation(c.Hash, now)
+	if assert.NoError(t, err) {
+		stored.ExpiresAt = stored.ExpiresAt.UTC()
+		assert.Equal(t, c, *stored)
+	}
+	_, err = db.GetTransferConfirmation(expired.Hash, now)
+	assert.Equal(t, myerrors.ErrInvalidConfirmation, err)
+	_, err = db.GetTransferConfirmation(auth.HashToken(IIN+"unknown"), now)
+	assert.Equal(t, myerrors.ErrInvalidConfirmation, err)
+
+	// a transfer that fails leaves the confirmation for another try, one that goes through uses it up
+	stepUp := domain.StepUp{Decision: domain.StepUpConfirmation, ConfirmationHash: c.Hash}
+	assert.Equal(t, myerrors.ErrInsufficientFunds, transferError(db, from, to, same(kzt(100)), nil, stepUp))
+	_, err = db.GetTransferConfirmation(c.Hash, now)
+	assert.NoError(t, err)
+	require.NoError(t, db.TopUp(from, kzt(50), nil))
+	assert.NoError(t, transferError(db, from, to, same(kzt(100)), nil, stepUp))
+	_, err = db.GetTransferConfirmation(c.Hash, now)
+	assert.Equal(t, myerrors.ErrInvalidConfirmation, err, "a confirmation is used once")
+	require.NoError(t, db.TopUp(from, kzt(100), nil))
+	assert.Equal(t, myerrors.ErrInvalidConfirmation, transferError(db, from, to, same(kzt(100)), nil, stepUp))
+	amount, err := db.GetAmount(from)
+	assert.NoError(t, err)
+	assert.Equal(t, kzt(100), amount, "a transfer with a used confirmation moves no money")
+	transactions, err := db.GetTransactions(domain.TransactionFilter{Account: from, Direction: domain.DirectionOut})
+	if assert.NoError(t, err) && assert.Len(t, transactions, 1) {
+		assert.Equal(t, domain.StepUpConfirmation, transactions[0].StepUp)
+	}
+	_, err = db.PlaceHold(from, to, kzt(100), now.Add(time.Hour), stepUp)
+	assert.Equal(t, myerrors.ErrInvalidConfirmation, err, "holds use up confirmations like transfers")
+}
+
+func testConcurrentTransfers(t *testing.T, db repository.DBInterface) {
+	IIN := newIIN()
+	a, b := newWallet(t, db, IIN), newWallet(t, db, IIN)
+	require.NoError(t, db.TopUp(a, kzt(1000), nil))
+	require.NoError(t, db.TopUp(b, kzt(1000), nil))
+
+	const workers = 50
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, transferError(db, a, b, same(kzt(7)), nil, notRequired))
+		}()
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, transferError(db, b, a, same(kzt(8)), nil, notRequired))
+		}()
+	}
+	wg.Wait()
+
+	amount, err := db.GetAmount(a)
+	assert.NoError(t, err)
+	assert.Equal(t, kzt(1000+workers), amount)
+	amount, err = db.GetAmount(b)
+	assert.NoError(t, err)
+	assert.Equal(t, kzt(1000-workers), amount)
+}
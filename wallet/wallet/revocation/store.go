@@ -0,0 +1,146 @@
+// Package revocation keeps revoked access tokens in memory, so that checking a token on every request needs no DB
+// round-trip. Revocations are persisted to the DB when the store has one and every instance picks up revocations
+// made by the others on Sync
+package revocation
+
+import (
+	"log"
+	"sync"
+	"time"
+	"wallet/domain"
+	"wallet/wallet/repository"
+)
+
+// syncOverlap is how far back from the last sync Sync looks, so that revocations committed while it ran or stamped
+// by an instance with a slightly late clock are not missed
+const syncOverlap = time.Minute
+
+// Store is a revocation store, its methods are safe for concurrent use
+type Store struct {
+	db        repository.DBInterface
+	retention time.Duration
+	mu        sync.RWMutex
+	revoked   map[string]map[string]domain.Revocation
+	synced    time.Time
+	now       func() time.Time
+}
+
+// RevokeToken revokes access token with jti until it expires at expiresAt
+func (s *Store) RevokeToken(jti string, expiresAt time.Time) error {
+	return s.revoke(domain.RevokedToken, jti, expiresAt)
+}
+
+// RevokeSession revokes access tokens issued in session sid
+func (s *Store) RevokeSession(sid string) error {
+	return s.revoke(domain.RevokedSession, sid, time.Time{})
+}
+
+// RevokeUser revokes access tokens of IIN issued until now, tokens issued later are valid
+func (s *Store) RevokeUser(IIN string) error {
+	return s.revoke(domain.RevokedUser, IIN, time.Time{})
+}
+
+// revoke persists revocation of kind and adds it to the store. A revocation that fails to persist is left out of the
+// store too, so that no instance honours a revocation the others will never see. Revocations without expiresAt are
+// kept for retention, by when access tokens they revoke have expired
+func (s *Store) revoke(kind, subject string, expiresAt time.Time) error {
+	now := s.now()
+	if expiresAt.IsZero() {
+		expiresAt = now.Add(s.retention)
+	}
+	r := domain.Revocation{Kind: kind, Subject: subject, RevokedAt: now, ExpiresAt: expiresAt}
+	if s.db != nil {
+		if err := s.db.InsertRevocation(r); err != nil {
+			log.Printf("ERROR|Persisting revocation of %s %s: %v\n", kind, subject, err)
+			return err
+		}
+	}
+	s.mu.Lock()
+	s.add(r)
+	s.mu.Unlock()
+	log.Printf("INFO|Revoked %s %s\n", kind, subject)
+	return nil
+}
+
+// add adds r to the store unless it has a later revocation of the same subject, s.mu must be locked
+func (s *Store) add(r domain.Revocation) {
+	subjects, ok := s.revoked[r.Kind]
+	if !ok {
+		subjects = make(map[string]domain.Revocation)
+		s.revoked[r.Kind] = subjects
+	}
+	if old, ok := subjects[r.Subject]; ok && old.RevokedAt.After(r.RevokedAt) {
+		return
+	}
+	subjects[r.Subject] = r
+}
+
+// IsRevoked tells if access token with jti, issued at issuedAt in session sid to IIN is revoked. Empty jti and sid
+// are not checked, tokens of other issuers may lack them
+func (s *Store) IsRevoked(jti, sid, IIN string, issuedAt time.Time) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.revoked[domain.RevokedToken][jti]; ok && jti != "" {
+		return true
+	}
+	if _, ok := s.revoked[domain.RevokedSession][sid]; ok && sid != "" {
+		return true
+	}
+	// iat has a precision of seconds, so tokens issued in the second of the revocation are revoked too
+	r, ok := s.revoked[domain.RevokedUser][IIN]
+	return ok && issuedAt.Unix() <= r.RevokedAt.Unix()
+}
+
+// Sync loads revocations persisted since the last sync, by other instances too
+func (s *Store) Sync() error {
+	if s.db == nil {
+		return nil
+	}
+	s.mu.RLock()
+	since := s.synced
+	s.mu.RUnlock()
+	if !since.IsZero() {
+		since = since.Add(-syncOverlap)
+	}
+	now := s.now()
+	revocations, err := s.db.GetRevocations(since)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range revocations {
+		s.add(r)
+	}
+	s.synced = now
+	return nil
+}
+
+// Prune removes revocations that expired by now, from the DB too
+func (s *Store) Prune() (int, error) {
+	now := s.now()
+	s.mu.Lock()
+	for _, subjects := range s.revoked {
+		for subject, r := range subjects {
+			if !r.ExpiresAt.After(now) {
+				delete(subjects, subject)
+			}
+		}
+	}
+	s.mu.Unlock()
+	if s.db == nil {
+		return 0, nil
+	}
+	return s.db.DeleteExpiredRevocations(now)
+}
+
+// NewStore returns Store persisting revocations to db, nil db keeps them in memory of this instance only. Session
+// and user revocations are kept for retention, which must be at least the lifetime of access tokens
+func NewStore(db repository.DBInterface, retention time.Duration) *Store {
+	return &Store{
+		db:        db,
+		retention: retention,
+		revoked:   make(map[string]map[string]domain.Revocation),
+		now:       time.Now,
+	}
+}
@@ -0,0 +1,98 @@
+package revocation
+
+import (
+	"errors"
+	"testing"
+	"time"
+	"wallet/domain"
+	"wallet/wallet/repository"
+	"wallet/wallet/repository/memory"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsRevoked(t *testing.T) {
+	now := time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC)
+	s := NewStore(nil, time.Hour)
+	s.now = func() time.Time { return now }
+	assert.NoError(t, s.RevokeToken("jti", now.Add(time.Minute)))
+	assert.NoError(t, s.RevokeSession("sid"))
+	assert.NoError(t, s.RevokeUser("910815450350"))
+
+	cases := []struct {
+		name          string
+		jti, sid, IIN string
+		issuedAt      time.Time
+		revoked       bool
+	}{
+		{"valid", "other", "other", "880316450123", now.Add(-time.Minute), false},
+		{"token", "jti", "other", "880316450123", now.Add(-time.Minute), true},
+		{"session", "other", "sid", "880316450123", now.Add(-time.Minute), true},
+		{"user before revocation", "other", "other", "910815450350", now.Add(-time.Minute), true},
+		{"user in the second of revocation", "other", "other", "910815450350", now.Add(500 * time.Millisecond), true},
+		{"user after revocation", "other", "other", "910815450350", now.Add(time.Second), false},
+		{"no jti nor sid", "", "", "880316450123", now.Add(-time.Minute), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.revoked, s.IsRevoked(c.jti, c.sid, c.IIN, c.issuedAt))
+		})
+	}
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC)
+	db := memory.NewMemoryDBInterface()
+	s := NewStore(db, time.Hour)
+	s.now = func() time.Time { return now }
+	assert.NoError(t, s.RevokeToken("jti", now.Add(time.Minute)))
+	assert.NoError(t, s.RevokeSession("sid"))
+
+	now = now.Add(30 * time.Minute)
+	deleted, err := s.Prune()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.False(t, s.IsRevoked("jti", "", "", now), "token expired, so its revocation is dropped")
+	assert.True(t, s.IsRevoked("", "sid", "", now))
+}
+
+func TestSync(t *testing.T) {
+	now := time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC)
+	db := memory.NewMemoryDBInterface()
+	a, b := NewStore(db, time.Hour), NewStore(db, time.Hour)
+	a.now = func() time.Time { return now }
+	b.now = func() time.Time { return now }
+
+	assert.NoError(t, a.RevokeSession("sid"))
+	assert.False(t, b.IsRevoked("", "sid", "", now), "not synced yet")
+	assert.NoError(t, b.Sync())
+	assert.True(t, b.IsRevoked("", "sid", "", now))
+
+	// a revocation stamped just before the last sync is still picked up
+	now = now.Add(10 * time.Second)
+	a.now = func() time.Time { return now.Add(-20 * time.Second) }
+	assert.NoError(t, a.RevokeUser("910815450350"))
+	assert.NoError(t, b.Sync())
+	assert.True(t, b.IsRevoked("", "", "910815450350", now.Add(-time.Minute)))
+
+	assert.NoError(t, NewStore(nil, time.Hour).Sync(), "memory only store has nothing to sync")
+}
+
+// failingDB fails to persist revocations
+type failingDB struct {
+	repository.DBInterface
+}
+
+func (db failingDB) InsertRevocation(r domain.Revocation) error {
+	return errors.New("connection refused")
+}
+
+func TestRevokeNotPersisted(t *testing.T) {
+	now := time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC)
+	s := NewStore(failingDB{memory.NewMemoryDBInterface()}, time.Hour)
+	s.now = func() time.Time { return now }
+	assert.Error(t, s.RevokeToken("jti", now.Add(time.Minute)))
+	assert.Error(t, s.RevokeSession("sid"))
+	assert.Error(t, s.RevokeUser("910815450350"))
+	assert.False(t, s.IsRevoked("jti", "sid", "910815450350", now.Add(-time.Minute)), "only persisted revocations are kept")
+}
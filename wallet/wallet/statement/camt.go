@@ -0,0 +1,162 @@
+package statement
+
+import (
+	"encoding/xml"
+	"io"
+	"strconv"
+	"time"
+	"wallet/domain"
+)
+
+// camtNamespace is the version of ISO 20022 bank to customer statement written
+const camtNamespace = "urn:iso:std:iso:20022:tech:xsd:camt.053.001.02"
+
+// isoDateTime and isoDate are the ISO 20022 date formats
+const (
+	isoDateTime = "2006-01-02T15:04:05"
+	isoDate     = "2006-01-02"
+)
+
+type camtDocument struct {
+	XMLName xml.Name `xml:"Document"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Stmt    struct {
+		GrpHdr struct {
+			MsgId   string
+			CreDtTm string
+		}
+		Stmt camtStatement
+	} `xml:"BkToCstmrStmt"`
+}
+
+type camtStatement struct {
+	Id      string
+	CreDtTm string
+	FrToDt  struct {
+		FrDtTm string
+		ToDtTm string
+	}
+	Acct struct {
+		Id  string `xml:"Id>Othr>Id"`
+		Ccy string
+	}
+	Bal  []camtBalance
+	Ntry []camtEntry
+}
+
+// camtAccount identifies a wallet by its account number
+type camtAccount struct {
+	Id string `xml:"Id>Othr>Id"`
+}
+
+type camtBalance struct {
+	Tp        string `xml:"Tp>CdOrPrtry>Cd"`
+	Amt       camtAmount
+	CdtDbtInd string
+	Dt        string `xml:"Dt>Dt"`
+}
+
+type camtAmount struct {
+	Ccy   string `xml:"Ccy,attr"`
+	Value string `xml:",chardata"`
+}
+
+type camtEntry struct {
+	NtryRef     string
+	Amt         camtAmount
+	CdtDbtInd   string
+	RvslInd     bool `xml:",omitempty"`
+	Sts         string
+	BookgDt     string `xml:"BookgDt>DtTm"`
+	ValDt       string `xml:"ValDt>Dt"`
+	AcctSvcrRef string
+	BkTxCd      string `xml:"BkTxCd>Prtry>Cd"`
+	TxDtls      struct {
+		AcctSvcrRef string       `xml:"Refs>AcctSvcrRef"`
+		DbtrAcct    *camtAccount `xml:"RltdPties>DbtrAcct,omitempty"`
+		CdtrAcct    *camtAccount `xml:"RltdPties>CdtrAcct,omitempty"`
+	} `xml:"NtryDtls>TxDtls"`
+}
+
+// writeCAMT053 renders statement as ISO 20022 camt.053 message, entries are referenced by transaction ID
+func writeCAMT053(w io.Writer, s *domain.Statement) error {
+	now := time.Now().UTC().Format(isoDateTime)
+	doc := camtDocument{Xmlns: camtNamespace}
+	doc.Stmt.GrpHdr.MsgId = statementID(s)
+	doc.Stmt.GrpHdr.CreDtTm = now
+	stmt := &doc.Stmt.Stmt
+	stmt.Id = statementID(s)
+	stmt.CreDtTm = now
+	stmt.FrToDt.FrDtTm = s.Since.Format(isoDateTime)
+	stmt.FrToDt.ToDtTm = s.Until.Format(isoDateTime)
+	stmt.Acct.Id = s.AccountNo
+	stmt.Acct.Ccy = s.Opening.Currency
+	stmt.Bal = []camtBalance{
+		newCAMTBalance("OPBD", s.Opening, s.Since),
+		newCAMTBalance("CLBD", s.Closing, lastDay(s)),
+	}
+	for _, line := range s.Lines {
+		bookedAt, err := bookingTime(line)
+		if err != nil {
+			return err
+		}
+		ref := strconv.Itoa(line.ID)
+		entry := camtEntry{
+			NtryRef:     ref,
+			Amt:         camtAmount{Ccy: line.Change.Currency, Value: line.Change.Decimal()},
+			CdtDbtInd:   "CRDT",
+			RvslInd:     line.Type == domain.ReversalType,
+			Sts:         "BOOK",
+			BookgDt:     bookedAt.Format(isoDateTime),
+			ValDt:       bookedAt.Format(isoDate),
+			AcctSvcrRef: ref,
+			BkTxCd:      line.Type,
+		}
+		entry.TxDtls.AcctSvcrRef = ref
+		if line.Change.Amount < 0 {
+			entry.Amt.Value = domain.NewMoney(-line.Change.Amount, line.Change.Currency).Decimal()
+			entry.CdtDbtInd = "DBIT"
+			entry.TxDtls.CdtrAcct = &camtAccount{line.Counterparty}
+		} else {
+			entry.TxDtls.DbtrAcct = &camtAccount{line.Counterparty}
+		}
+		stmt.Ntry = append(stmt.Ntry, entry)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// newCAMTBalance returns balance of type code, negative balances are debit ones
+func newCAMTBalance(code string, balance domain.Money, at time.Time) camtBalance {
+	b := camtBalance{Tp: code, CdtDbtInd: "CRDT", Dt: at.Format(isoDate)}
+	if balance.Amount < 0 {
+		balance.Amount = -balance.Amount
+		b.CdtDbtInd = "DBIT"
+	}
+	b.Amt = camtAmount{Ccy: balance.Currency, Value: balance.Decimal()}
+	return b
+}
+
+// statementID identifies statement of an account for a period starting at given day
+func statementID(s *domain.Statement) string {
+	return s.AccountNo + "-" + s.Since.Format("20060102")
+}
+
+// lastDay returns the last moment covered by statement
+func lastDay(s *domain.Statement) time.Time {
+	return s.Until.Add(-time.Second)
+}
+
+// bookingTime parses when transaction on the statement line was made
+func bookingTime(line domain.StatementLine) (time.Time, error) {
+	return time.Parse(dateLayout, line.Ts)
+}
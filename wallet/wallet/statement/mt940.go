@@ -0,0 +1,84 @@
+package statement
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"wallet/domain"
+)
+
+// mt940Types maps transfer types to SWIFT transaction type identification codes
+var mt940Types = map[string]string{
+	"topup":             "NMSC",
+	"transfer":          "NTRF",
+	domain.HoldType:     "NTRF",
+	domain.ReversalType: "NTRF",
+}
+
+// writeMT940 renders statement as SWIFT MT940 message, entries are referenced by transaction ID
+func writeMT940(w io.Writer, s *domain.Statement) error {
+	var b strings.Builder
+	field := func(tag, value string) {
+		b.WriteString(":" + tag + ":" + value + "\r\n")
+	}
+	field("20", "ST"+s.Since.Format("060102")+s.Until.Format("060102"))
+	field("25", s.AccountNo)
+	// statement number is the year and day of year the period starts on
+	field("28C", fmt.Sprintf("%s%03d", s.Since.Format("06"), s.Since.YearDay()))
+	field("60F", mt940Balance(s.Opening, s.Since))
+	for _, line := range s.Lines {
+		bookedAt, err := bookingTime(line)
+		if err != nil {
+			return err
+		}
+		mark, amount := "C", line.Change.Amount
+		if amount < 0 {
+			mark, amount = "D", -amount
+		}
+		if line.Type == domain.ReversalType {
+			mark = "R" + mark
+		}
+		code, ok := mt940Types[line.Type]
+		if !ok {
+			code = "NMSC"
+		}
+		ref := strconv.Itoa(line.ID)
+		field("61", bookedAt.Format("060102")+bookedAt.Format("0102")+mark+mt940Amount(domain.NewMoney(amount, line.Change.Currency))+code+ref+"//"+ref)
+		field("86", mt940Text(line.Type+" "+line.Counterparty))
+	}
+	field("62F", mt940Balance(s.Closing, lastDay(s)))
+	b.WriteString("-\r\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// mt940Balance formats balance at given date as credit or debit mark, date, currency and amount
+func mt940Balance(balance domain.Money, at time.Time) string {
+	mark := "C"
+	if balance.Amount < 0 {
+		mark, balance.Amount = "D", -balance.Amount
+	}
+	return mark + at.Format("060102") + balance.Currency + mt940Amount(balance)
+}
+
+// mt940Amount formats amount with decimal comma
+func mt940Amount(amount domain.Money) string {
+	return strings.Replace(amount.Decimal(), ".", ",", 1)
+}
+
+// mt940Text keeps characters of the SWIFT character set and the length of a narrative line
+func mt940Text(s string) string {
+	text := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune("/-?:().,'+ ", r):
+			return r
+		}
+		return ' '
+	}, s)
+	if len(text) > 65 {
+		text = text[:65]
+	}
+	return text
+}
@@ -0,0 +1,110 @@
+package statement
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"wallet/domain"
+)
+
+// Layout of PDF pages in points, A4 with a monospaced font so that columns line up
+const (
+	pageWidth    = 595
+	pageHeight   = 842
+	margin       = 50
+	fontSize     = 9
+	leading      = 12
+	linesPerPage = (pageHeight - 2*margin) / leading
+)
+
+// writePDF renders statement as a plain table spread over as many pages as it takes
+func writePDF(w io.Writer, s *domain.Statement) error {
+	lines := []string{
+		"Statement of account " + s.AccountNo,
+		fmt.Sprintf("Period %s - %s", s.Since.Format(dateLayout), s.Until.Format(dateLayout)),
+		"Opening balance " + s.Opening.String(),
+		"",
+		fmt.Sprintf("%-19s %8s %-8s %-16s %16s %16s", "Date", "ID", "Type", "Counterparty", "Amount", "Balance"),
+	}
+	for _, line := range s.Lines {
+		lines = append(lines, fmt.Sprintf("%-19s %8d %-8s %-16s %16s %16s", line.Ts, line.ID, line.Type, line.Counterparty, line.Change.Decimal(), line.Balance.Decimal()))
+	}
+	lines = append(lines, "", "Closing balance "+s.Closing.String())
+
+	var pages [][]string
+	for len(lines) > linesPerPage {
+		pages = append(pages, lines[:linesPerPage])
+		lines = lines[linesPerPage:]
+	}
+	pages = append(pages, lines)
+	return newPDF(pages).writeTo(w)
+}
+
+// pdf assembles a PDF document from numbered objects, object n is objects[n-1]
+type pdf struct {
+	objects []string
+}
+
+// newPDF lays out pages of text lines, objects 1 to 3 are the catalog, the page tree and the font
+func newPDF(pages [][]string) *pdf {
+	doc := &pdf{objects: make([]string, 3)}
+	kids := make([]string, 0, len(pages))
+	for i, lines := range pages {
+		var content strings.Builder
+		fmt.Fprintf(&content, "BT\n/F1 %d Tf\n%d TL\n%d %d Td\n", fontSize, leading, margin, pageHeight-margin)
+		for _, line := range lines {
+			fmt.Fprintf(&content, "(%s) Tj T*\n", escapePDF(line))
+		}
+		fmt.Fprintf(&content, "ET\nBT\n/F1 %d Tf\n%d %d Td\n(Page %d of %d) Tj\nET\n", fontSize, pageWidth-margin-80, margin/2, i+1, len(pages))
+		contentID := doc.add(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()))
+		pageID := doc.add(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", pageWidth, pageHeight, contentID))
+		kids = append(kids, fmt.Sprintf("%d 0 R", pageID))
+	}
+	doc.objects[0] = "<< /Type /Catalog /Pages 2 0 R >>"
+	doc.objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages))
+	doc.objects[2] = "<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>"
+	return doc
+}
+
+// add appends object and returns its number
+func (p *pdf) add(object string) int {
+	p.objects = append(p.objects, object)
+	return len(p.objects)
+}
+
+// writeTo writes objects followed by the cross-reference table locating them
+func (p *pdf) writeTo(w io.Writer) error {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(p.objects))
+	for i, object := range p.objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(p.objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(p.objects)+1, xref)
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// escapePDF escapes text for a PDF string literal, characters outside of ASCII are replaced as the font lacks them
+func escapePDF(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteRune('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,101 @@
+// Package statement renders account statements in the formats accountants import them in
+package statement
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+	"wallet/domain"
+	"wallet/myerrors"
+)
+
+// Statement formats
+const (
+	CSV     = "csv"
+	JSONL   = "jsonl"
+	PDF     = "pdf"
+	CAMT053 = "camt053"
+	MT940   = "mt940"
+)
+
+// dateLayout is how period bounds are rendered
+const dateLayout = "2006-01-02 15:04:05"
+
+// format describes how a statement is rendered and served
+type format struct {
+	contentType string
+	extension   string
+	write       func(io.Writer, *domain.Statement) error
+}
+
+var formats = map[string]format{
+	CSV:     {"text/csv; charset=utf-8", "csv", writeCSV},
+	JSONL:   {"application/x-ndjson", "jsonl", writeJSONL},
+	PDF:     {"application/pdf", "pdf", writePDF},
+	CAMT053: {"application/xml", "xml", writeCAMT053},
+	MT940:   {"text/plain; charset=us-ascii", "sta", writeMT940},
+}
+
+// ContentType returns MIME type of format, false if format is not supported
+func ContentType(format string) (string, bool) {
+	f, ok := formats[format]
+	return f.contentType, ok
+}
+
+// Extension returns file name extension of statements in format
+func Extension(format string) string {
+	return formats[format].extension
+}
+
+// Write renders statement s to w in format
+func Write(w io.Writer, s *domain.Statement, format string) error {
+	f, ok := formats[format]
+	if !ok {
+		return myerrors.ErrUnsupportedFormat
+	}
+	return f.write(w, s)
+}
+
+// writeCSV writes one row per transaction between rows with opening and closing balance, amounts are signed decimals
+func writeCSV(w io.Writer, s *domain.Statement) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"date", "id", "type", "counterparty", "amount", "balance", "currency"})
+	cw.Write([]string{s.Since.Format(dateLayout), "", "opening", "", "", s.Opening.Decimal(), s.Opening.Currency})
+	for _, line := range s.Lines {
+		cw.Write([]string{line.Ts, strconv.Itoa(line.ID), line.Type, line.Counterparty, line.Change.Decimal(), line.Balance.Decimal(), line.Balance.Currency})
+	}
+	cw.Write([]string{s.Until.Format(dateLayout), "", "closing", "", "", s.Closing.Decimal(), s.Closing.Currency})
+	cw.Flush()
+	return cw.Error()
+}
+
+// balanceRecord is the first and the last JSON line of a statement
+type balanceRecord struct {
+	Record    string       `json:"record"`
+	AccountNo string       `json:"accountno"`
+	Since     time.Time    `json:"since"`
+	Until     time.Time    `json:"until"`
+	Balance   domain.Money `json:"balance"`
+}
+
+// transactionRecord is a JSON line of a statement transaction
+type transactionRecord struct {
+	Record string `json:"record"`
+	domain.StatementLine
+}
+
+// writeJSONL writes opening balance, transactions and closing balance as one JSON object per line told apart by "record"
+func writeJSONL(w io.Writer, s *domain.Statement) error {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(balanceRecord{Record: "opening", AccountNo: s.AccountNo, Since: s.Since, Until: s.Until, Balance: s.Opening}); err != nil {
+		return err
+	}
+	for _, line := range s.Lines {
+		if err := enc.Encode(transactionRecord{Record: "transaction", StatementLine: line}); err != nil {
+			return err
+		}
+	}
+	return enc.Encode(balanceRecord{Record: "closing", AccountNo: s.AccountNo, Since: s.Since, Until: s.Until, Balance: s.Closing})
+}
@@ -0,0 +1,143 @@
+package statement
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"wallet/domain"
+	"wallet/myerrors"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testStatement(transactions int) *domain.Statement {
+	since := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	var txs []domain.Transaction
+	for i := 1; i <= transactions; i++ {
+		tx := domain.Transaction{ID: i, Ts: "2022-01-15 10:00:00", Type: "transfer", From: "KZT0000000001", To: "KZT0000000002", Amount: domain.NewMoney(150, "KZT"), Credited: domain.NewMoney(150, "KZT")}
+		if i%2 == 0 {
+			tx.From, tx.To = tx.To, tx.From
+		}
+		txs = append(txs, tx)
+	}
+	return domain.NewStatement("KZT0000000001", since, since.AddDate(0, 1, 0), domain.NewMoney(1000, "KZT"), txs)
+}
+
+func TestCSV(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, testStatement(2), CSV))
+	rows, err := csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"date", "id", "type", "counterparty", "amount", "balance", "currency"},
+		{"2022-01-01 00:00:00", "", "opening", "", "", "10.00", "KZT"},
+		{"2022-01-15 10:00:00", "1", "transfer", "KZT0000000002", "-1.50", "8.50", "KZT"},
+		{"2022-01-15 10:00:00", "2", "transfer", "KZT0000000002", "1.50", "10.00", "KZT"},
+		{"2022-02-01 00:00:00", "", "closing", "", "", "10.00", "KZT"},
+	}, rows)
+}
+
+func TestJSONL(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, testStatement(3), JSONL))
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	if assert.Len(t, records, 5) {
+		assert.Equal(t, "opening", records[0]["record"])
+		assert.Equal(t, "transaction", records[1]["record"])
+		assert.Equal(t, "KZT0000000002", records[1]["counterparty"])
+		assert.Equal(t, map[string]interface{}{"amount": "10.00", "currency": "KZT"}, records[2]["balance"])
+		assert.Equal(t, "closing", records[4]["record"])
+		assert.Equal(t, map[string]interface{}{"amount": "8.50", "currency": "KZT"}, records[4]["balance"])
+	}
+}
+
+func TestPDF(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, testStatement(100), PDF))
+	doc := buf.String()
+	assert.True(t, strings.HasPrefix(doc, "%PDF-1.4\n"))
+	assert.True(t, strings.HasSuffix(doc, "%%EOF\n"))
+	assert.Contains(t, doc, "/Count 2")
+	assert.Contains(t, doc, "(Closing balance 10.00 KZT) Tj")
+
+	// every cross-reference entry points at the object it lists
+	startxref := regexp.MustCompile(`startxref\n(\d+)\n`).FindStringSubmatch(doc)
+	require.Len(t, startxref, 2)
+	xref, err := strconv.Atoi(startxref[1])
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(doc[xref:], "xref\n"))
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllStringSubmatch(doc[xref:], -1)
+	require.NotEmpty(t, entries)
+	for i, entry := range entries {
+		offset, _ := strconv.Atoi(entry[1])
+		assert.True(t, strings.HasPrefix(doc[offset:], strconv.Itoa(i+1)+" 0 obj\n"), "object %d", i+1)
+	}
+}
+
+func TestCAMT053(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, testStatement(2), CAMT053))
+	var doc camtDocument
+	require.NoError(t, xml.Unmarshal(buf.Bytes(), &doc))
+	stmt := doc.Stmt.Stmt
+	assert.Equal(t, "KZT0000000001", stmt.Acct.Id)
+	assert.Equal(t, []camtBalance{
+		{Tp: "OPBD", Amt: camtAmount{Ccy: "KZT", Value: "10.00"}, CdtDbtInd: "CRDT", Dt: "2022-01-01"},
+		{Tp: "CLBD", Amt: camtAmount{Ccy: "KZT", Value: "10.00"}, CdtDbtInd: "CRDT", Dt: "2022-01-31"},
+	}, stmt.Bal)
+	if assert.Len(t, stmt.Ntry, 2) {
+		assert.Equal(t, "1", stmt.Ntry[0].NtryRef)
+		assert.Equal(t, "DBIT", stmt.Ntry[0].CdtDbtInd)
+		assert.Equal(t, camtAmount{Ccy: "KZT", Value: "1.50"}, stmt.Ntry[0].Amt)
+		assert.Equal(t, &camtAccount{"KZT0000000002"}, stmt.Ntry[0].TxDtls.CdtrAcct)
+		assert.Equal(t, "2022-01-15T10:00:00", stmt.Ntry[0].BookgDt)
+		assert.Equal(t, "2", stmt.Ntry[1].AcctSvcrRef)
+		assert.Equal(t, "CRDT", stmt.Ntry[1].CdtDbtInd)
+		assert.Equal(t, &camtAccount{"KZT0000000002"}, stmt.Ntry[1].TxDtls.DbtrAcct)
+	}
+}
+
+func TestMT940(t *testing.T) {
+	s := testStatement(2)
+	s.Lines[1].Type = domain.ReversalType
+	s.Lines[1].Counterparty = domain.FundingAccount
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, s, MT940))
+	assert.Equal(t, strings.Join([]string{
+		":20:ST220101220201",
+		":25:KZT0000000001",
+		":28C:22001",
+		":60F:C220101KZT10,00",
+		":61:2201150115D1,50NTRF1//1",
+		":86:transfer KZT0000000002",
+		":61:2201150115RC1,50NTRF2//2",
+		":86:reversal SYSTEM FUNDING",
+		":62F:C220131KZT10,00",
+		"-",
+		"",
+	}, "\r\n"), buf.String())
+}
+
+func TestUnsupportedFormat(t *testing.T) {
+	assert.Equal(t, myerrors.ErrUnsupportedFormat, Write(&bytes.Buffer{}, testStatement(0), "xlsx"))
+	_, ok := ContentType("xlsx")
+	assert.False(t, ok)
+}
+
+func TestEscapePDF(t *testing.T) {
+	assert.Equal(t, `a\(b\)c\\ ?`, escapePDF(`a(b)c\ ü`))
+}
@@ -0,0 +1,166 @@
+// Package stream fans wallet events relayed from the outbox out to clients connected to the streaming endpoint
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"wallet/domain"
+	"wallet/myerrors"
+)
+
+// seenSize is how many of the latest event IDs are kept for dropping events published again
+const seenSize = 1000
+
+// bufferSize is how many events are queued for a subscriber before it is dropped as too slow to keep up
+const bufferSize = 64
+
+// OwnerFunc returns IIN of the user owning account
+type OwnerFunc func(account string) (string, error)
+
+// Broker hands every published event to subscribers of the user owning its account. It lives in process and every
+// instance feeds its own broker from the outbox, so that clients get events whichever instance relays them
+type Broker struct {
+	owner       OwnerFunc
+	ownersMu    sync.Mutex
+	owners      map[string]string
+	mu          sync.Mutex
+	seen        map[string]bool
+	recent      []string
+	subscribers map[string]map[*Subscription]bool
+}
+
+// Subscription gets events of wallets of its user on C, including wallets created after it was opened. C is closed
+// when the subscription is closed or dropped
+type Subscription struct {
+	C      <-chan domain.Event
+	events chan domain.Event
+	IIN    string
+	broker *Broker
+}
+
+// Publish hands e to subscribers of the user owning its account, an event published again is dropped. The owner is
+// looked up without holding the broker, so that a slow lookup doesn't hold up subscribing and closing
+func (b *Broker) Publish(e domain.Event) error {
+	b.mu.Lock()
+	seen, watched := b.seen[e.ID], len(b.subscribers) > 0
+	b.mu.Unlock()
+	if seen {
+		return nil
+	}
+	var IIN string
+	if watched {
+		var err error
+		if IIN, err = b.ownerOf(e.Account); err != nil {
+			return err
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.seen[e.ID] {
+		return nil
+	}
+	for s := range b.subscribers[IIN] {
+		select {
+		case s.events <- e:
+		default:
+			b.drop(s)
+		}
+	}
+	b.seen[e.ID] = true
+	b.recent = append(b.recent, e.ID)
+	if len(b.recent) > seenSize {
+		delete(b.seen, b.recent[0])
+		b.recent = b.recent[1:]
+	}
+	return nil
+}
+
+// ownerOf returns IIN of the user owning account, wallets never change hands so owners are looked up once. Accounts
+// without wallet have no owner
+func (b *Broker) ownerOf(account string) (string, error) {
+	b.ownersMu.Lock()
+	IIN, ok := b.owners[account]
+	b.ownersMu.Unlock()
+	if ok {
+		return IIN, nil
+	}
+	IIN, err := b.owner(account)
+	if errors.Is(err, myerrors.ErrWalletNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	b.ownersMu.Lock()
+	b.owners[account] = IIN
+	b.ownersMu.Unlock()
+	return IIN, nil
+}
+
+// Subscribe returns subscription to events of wallets of the user with IIN
+func (b *Broker) Subscribe(IIN string) *Subscription {
+	events := make(chan domain.Event, bufferSize)
+	s := &Subscription{
+		C:      events,
+		events: events,
+		IIN:    IIN,
+		broker: b,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers[IIN] == nil {
+		b.subscribers[IIN] = make(map[*Subscription]bool)
+	}
+	b.subscribers[IIN][s] = true
+	return s
+}
+
+// Close stops events of s and closes its channel
+func (s *Subscription) Close() {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	s.broker.drop(s)
+}
+
+// drop removes s from subscribers unless it was already removed
+func (b *Broker) drop(s *Subscription) {
+	if b.subscribers[s.IIN][s] {
+		delete(b.subscribers[s.IIN], s)
+		if len(b.subscribers[s.IIN]) == 0 {
+			delete(b.subscribers, s.IIN)
+		}
+		close(s.events)
+	}
+}
+
+// NewBroker returns Broker without subscribers looking owners of accounts up with owner
+func NewBroker(owner OwnerFunc) *Broker {
+	return &Broker{
+		owner:       owner,
+		owners:      make(map[string]string),
+		seen:        make(map[string]bool),
+		subscribers: make(map[string]map[*Subscription]bool),
+	}
+}
+
+// WriteEvent writes server-sent event named name with single line data, id is left out if empty so that clients
+// keep the ID of the last event that had one
+func WriteEvent(w io.Writer, id, name string, data []byte) error {
+	if id != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+	return err
+}
+
+// WriteHeartbeat writes a comment clients ignore, it keeps idle connections open and finds out the gone ones
+func WriteHeartbeat(w io.Writer) error {
+	_, err := io.WriteString(w, ": ping\n\n")
+	return err
+}
@@ -0,0 +1,136 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+	"wallet/domain"
+	"wallet/myerrors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func event(id, account string) domain.Event {
+	return domain.Event{ID: id, Type: domain.EventWalletToppedUp, Account: account}
+}
+
+// owners returns OwnerFunc of wallets, looked up accounts are counted in lookups
+func owners(wallets map[string]string, lookups map[string]int) OwnerFunc {
+	return func(account string) (string, error) {
+		lookups[account]++
+		IIN, ok := wallets[account]
+		if !ok {
+			return "", myerrors.ErrWalletNotFound
+		}
+		return IIN, nil
+	}
+}
+
+func TestBrokerPublish(t *testing.T) {
+	wallets, lookups := map[string]string{"KZT0000000001": "910815450350", "KZT0000000002": "880316450123"}, map[string]int{}
+	b := NewBroker(owners(wallets, lookups))
+	assert.NoError(t, b.Publish(event("0", "KZT0000000001")))
+	assert.Empty(t, lookups, "owners are not looked up without subscribers")
+	s := b.Subscribe("910815450350")
+
+	assert.NoError(t, b.Publish(event("1", "KZT0000000001")))
+	assert.NoError(t, b.Publish(event("2", "KZT0000000002")))
+	assert.NoError(t, b.Publish(event("1", "KZT0000000001")))
+	assert.NoError(t, b.Publish(event("3", "KZT0000000001")))
+	assert.NoError(t, b.Publish(event("4", "KZT0000000404")))
+	// wallets created after subscribing are streamed too
+	wallets["KZT0000000003"] = "910815450350"
+	assert.NoError(t, b.Publish(domain.Event{ID: "5", Type: domain.EventWalletCreated, Account: "KZT0000000003"}))
+	assert.Equal(t, "1", (<-s.C).ID)
+	assert.Equal(t, "3", (<-s.C).ID)
+	assert.Equal(t, "5", (<-s.C).ID)
+	assert.Empty(t, s.C)
+	assert.Equal(t, map[string]int{"KZT0000000001": 1, "KZT0000000002": 1, "KZT0000000003": 1, "KZT0000000404": 1}, lookups)
+
+	s.Close()
+	s.Close()
+	_, open := <-s.C
+	assert.False(t, open)
+	assert.NoError(t, b.Publish(event("6", "KZT0000000001")))
+}
+
+func TestBrokerLookupError(t *testing.T) {
+	b := NewBroker(func(account string) (string, error) {
+		return "", errors.New("connection refused")
+	})
+	s := b.Subscribe("910815450350")
+	defer s.Close()
+	// the relay publishes the event again once the owner can be looked up
+	assert.Error(t, b.Publish(event("1", "KZT0000000001")))
+	b.owner = owners(map[string]string{"KZT0000000001": "910815450350"}, map[string]int{})
+	assert.NoError(t, b.Publish(event("1", "KZT0000000001")))
+	assert.Equal(t, "1", (<-s.C).ID)
+}
+
+func TestBrokerLookupDoesNotBlock(t *testing.T) {
+	looking, release := make(chan bool), make(chan bool)
+	b := NewBroker(func(account string) (string, error) {
+		looking <- true
+		<-release
+		return "910815450350", nil
+	})
+	s := b.Subscribe("910815450350")
+	defer s.Close()
+	published := make(chan error)
+	go func() {
+		published <- b.Publish(event("1", "KZT0000000001"))
+	}()
+	<-looking
+
+	// others subscribe and close while the owner is being looked up
+	done := make(chan bool)
+	go func() {
+		b.Subscribe("880316450123").Close()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("subscribing waited for the lookup of an owner")
+	}
+	release <- true
+	assert.NoError(t, <-published)
+	assert.Equal(t, "1", (<-s.C).ID)
+}
+
+func TestBrokerForgetsOldEvents(t *testing.T) {
+	b := NewBroker(owners(map[string]string{"KZT0000000001": "910815450350"}, map[string]int{}))
+	for i := 1; i <= seenSize+1; i++ {
+		assert.NoError(t, b.Publish(event(fmt.Sprint(i), "KZT0000000001")))
+	}
+	s := b.Subscribe("910815450350")
+	defer s.Close()
+	assert.NoError(t, b.Publish(event("2", "KZT0000000001")))
+	assert.NoError(t, b.Publish(event("1", "KZT0000000001")))
+	assert.Equal(t, "1", (<-s.C).ID)
+	assert.Empty(t, s.C)
+}
+
+func TestBrokerDropsSlowSubscriber(t *testing.T) {
+	b := NewBroker(owners(map[string]string{"KZT0000000001": "910815450350"}, map[string]int{}))
+	s := b.Subscribe("910815450350")
+	for i := 0; i <= bufferSize; i++ {
+		assert.NoError(t, b.Publish(event(fmt.Sprint(i), "KZT0000000001")))
+	}
+	received := 0
+	for range s.C {
+		received++
+	}
+	assert.Equal(t, bufferSize, received)
+	s.Close()
+}
+
+func TestWriteEvent(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, WriteEvent(&buf, "4f1e", domain.EventWalletToppedUp, []byte(`{"id":"4f1e"}`)))
+	assert.NoError(t, WriteEvent(&buf, "", "balance", []byte(`{}`)))
+	assert.NoError(t, WriteHeartbeat(&buf))
+	assert.Equal(t, "id: 4f1e\nevent: wallet.topped_up\ndata: {\"id\":\"4f1e\"}\n\nevent: balance\ndata: {}\n\n: ping\n\n", buf.String())
+}
@@ -0,0 +1,184 @@
+package usecase
+
+import (
+	"errors"
+	"log"
+	"regexp"
+	"time"
+	"unicode/utf8"
+	"wallet/domain"
+	"wallet/myerrors"
+	"wallet/wallet/auth"
+	"wallet/wallet/repository"
+	"wallet/wallet/revocation"
+)
+
+var (
+	iinPattern      = regexp.MustCompile(`^[0-9]{12}$`)
+	usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{3,64}$`)
+)
+
+type AuthUsecase interface {
+	Register(IIN, username, password, callerIIN string, anyUser bool) (*domain.User, error)
+	Login(username, password string) (*domain.TokenPair, error)
+	Refresh(refreshToken string) (*domain.TokenPair, error)
+	Logout(refreshToken string) error
+}
+
+type authUsecaseImpl struct {
+	dbConn      repository.DBInterface
+	issuer      *auth.Issuer
+	revocations *revocation.Store
+	refreshTTL  time.Duration
+	iterations  int
+}
+
+// Register creates user with IIN, username and password, registered users are customers. An IIN can only be
+// registered by a caller whose token is of that IIN, or anyUser, so that nobody claims the IIN of somebody else,
+// whether or not it owns wallets yet
+func (uc *authUsecaseImpl) Register(IIN, username, password, callerIIN string, anyUser bool) (*domain.User, error) {
+	if !iinPattern.MatchString(IIN) {
+		return nil, myerrors.ErrInvalidIIN
+	}
+	if callerIIN != IIN && !anyUser {
+		log.Printf("ERROR|Registering %s without its token\n", IIN)
+		return nil, myerrors.ErrIINOwnershipRequired
+	}
+	if !usernamePattern.MatchString(username) {
+		return nil, myerrors.ErrInvalidUsername
+	}
+	if n := utf8.RuneCountInString(password); n < 8 || n > 128 {
+		return nil, myerrors.ErrWeakPassword
+	}
+	hash, err := auth.HashPassword(password, uc.iterations)
+	if err != nil {
+		return nil, err
+	}
+	user, err := uc.dbConn.InsertUser(domain.User{IIN: IIN, Username: username, PasswordHash: hash, Roles: []domain.Role{domain.RoleCustomer}})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("INFO|Registered user %d\n", user.ID)
+	return user, nil
+}
+
+// Login checks password of the user and issues access token with a refresh token starting a new family
+func (uc *authUsecaseImpl) Login(username, password string) (*domain.TokenPair, error) {
+	user, err := uc.dbConn.GetUserByUsername(username)
+	if errors.Is(err, myerrors.ErrUserNotFound) {
+		// hashing takes as long as checking a password would, so that response times don't tell which users exist
+		auth.HashPassword(password, uc.iterations)
+		return nil, myerrors.ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	ok, err := auth.CheckPassword(user.PasswordHash, password)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, myerrors.ErrInvalidCredentials
+	}
+	familyID, err := auth.NewOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+	return uc.issue(*user, familyID, "")
+}
+
+// Refresh exchanges refresh token for access token and the next refresh token of its family. Presenting a token that
+// was used already means it was stolen or replayed, so the whole family is revoked and its holder has to log in again
+func (uc *authUsecaseImpl) Refresh(refreshToken string) (*domain.TokenPair, error) {
+	hash := auth.HashToken(refreshToken)
+	token, err := uc.dbConn.GetRefreshToken(hash)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case token.Status == domain.RefreshTokenUsed:
+		return nil, uc.revokeReused(token.FamilyID)
+	case token.Status != domain.RefreshTokenActive, !time.Now().Before(token.ExpiresAt):
+		return nil, myerrors.ErrInvalidRefreshToken
+	}
+	user, err := uc.dbConn.GetUser(token.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return uc.issue(*user, token.FamilyID, hash)
+}
+
+// Logout revokes refresh token along with the rest of its family and access tokens issued in its session
+func (uc *authUsecaseImpl) Logout(refreshToken string) error {
+	token, err := uc.dbConn.GetRefreshToken(auth.HashToken(refreshToken))
+	if err != nil {
+		return err
+	}
+	return revokeSession(uc.dbConn, uc.revocations, token.FamilyID)
+}
+
+// issue issues access token of user and refresh token of family, which uses up refresh token with hash used if set
+func (uc *authUsecaseImpl) issue(user domain.User, familyID, used string) (*domain.TokenPair, error) {
+	access, err := uc.issuer.AccessToken(user, familyID)
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := auth.NewOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+	next := domain.RefreshToken{
+		Hash:      auth.HashToken(refresh),
+		FamilyID:  familyID,
+		UserID:    user.ID,
+		Status:    domain.RefreshTokenActive,
+		ExpiresAt: time.Now().Add(uc.refreshTTL),
+	}
+	if used == "" {
+		err = uc.dbConn.InsertRefreshToken(next)
+	} else {
+		var rotated bool
+		rotated, err = uc.dbConn.RotateRefreshToken(used, next)
+		if err == nil && !rotated {
+			// another request refreshed with the same token first
+			err = uc.revokeReused(familyID)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &domain.TokenPair{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		ExpiresIn:    int(uc.issuer.TTL().Seconds()),
+	}, nil
+}
+
+// revokeReused revokes session of a refresh token that was presented again after it was used
+func (uc *authUsecaseImpl) revokeReused(familyID string) error {
+	log.Printf("ERROR|Refresh token of family %s reused, revoking the family\n", familyID)
+	if err := revokeSession(uc.dbConn, uc.revocations, familyID); err != nil {
+		return err
+	}
+	return myerrors.ErrRefreshTokenReused
+}
+
+// revokeSession revokes refresh tokens of family familyID and access tokens issued in its session
+func revokeSession(dbConn repository.DBInterface, revocations *revocation.Store, familyID string) error {
+	if err := dbConn.RevokeRefreshTokens(familyID); err != nil {
+		return err
+	}
+	return revocations.RevokeSession(familyID)
+}
+
+// NewAuthUsecase returns AuthUsecase issuing access tokens with issuer and refresh tokens valid for refreshTTL,
+// passwords are hashed with iterations of PBKDF2 and sessions logged out of are revoked in revocations
+func NewAuthUsecase(dbConn repository.DBInterface, issuer *auth.Issuer, revocations *revocation.Store, refreshTTL time.Duration, iterations int) AuthUsecase {
+	return &authUsecaseImpl{
+		dbConn:      dbConn,
+		issuer:      issuer,
+		revocations: revocations,
+		refreshTTL:  refreshTTL,
+		iterations:  iterations,
+	}
+}
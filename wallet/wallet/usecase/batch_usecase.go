@@ -0,0 +1,219 @@
+package usecase
+
+import (
+	"fmt"
+	"log"
+	"wallet/domain"
+	"wallet/myerrors"
+	"wallet/wallet/fx"
+	"wallet/wallet/repository"
+)
+
+// maxBatchLines limits how many transfers a single batch may hold
+const maxBatchLines = 1000
+
+type BatchUsecase interface {
+	CreateBatch(from, mode string, instructions []domain.BatchInstruction, IIN string, transferAuth domain.TransferAuth) (*domain.Batch, error)
+	GetBatch(batchID int, IIN string, anyWallet bool) (*domain.Batch, error)
+	RunPendingBatches() (int, error)
+}
+
+type batchUsecaseImpl struct {
+	dbConn    repository.DBInterface
+	transfers TransferUsecase
+	rates     fx.FXRateProvider
+}
+
+// CreateBatch validates every instruction up front and stores the batch for the worker to run. A batch with invalid
+// lines is returned rejected with the error of each of them and ErrInvalidBatch. An all-or-nothing batch must also
+// be covered by the balance of the source wallet. A batch totalling above the step-up threshold needs a one-time code
+// or a confirmation token without receiver in transferAuth, its lines are made with that decision
+func (uc *batchUsecaseImpl) CreateBatch(from, mode string, instructions []domain.BatchInstruction, IIN string, transferAuth domain.TransferAuth) (*domain.Batch, error) {
+	if mode == "" {
+		mode = domain.BatchAllOrNothing
+	}
+	if mode != domain.BatchAllOrNothing && mode != domain.BatchBestEffort {
+		return nil, myerrors.ErrInvalidBatch
+	}
+	if len(instructions) == 0 || len(instructions) > maxBatchLines {
+		return nil, myerrors.ErrInvalidBatch
+	}
+	ok, err := uc.dbConn.ConfirmIIN(IIN, from)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, myerrors.ErrIINMismatch
+	}
+	balance, err := uc.dbConn.GetAmount(from)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &domain.Batch{IIN: IIN, From: from, Mode: mode, Status: domain.BatchPending, Total: domain.NewMoney(0, balance.Currency)}
+	references := make(map[string]bool)
+	valid := true
+	for i, in := range instructions {
+		line := domain.BatchLine{Line: i + 1, To: in.To, Reference: in.Reference, Status: domain.LinePending}
+		amount, err := uc.validateLine(from, balance.Currency, in)
+		if err == nil && in.Reference != "" && references[in.Reference] {
+			err = myerrors.ErrDuplicateReference
+		}
+		if err != nil {
+			valid = false
+			line.Status, line.Error = domain.LineFailed, err.Error()
+		}
+		references[in.Reference] = true
+		line.Amount = amount
+		b.Total.Amount += amount.Amount
+		b.Lines = append(b.Lines, line)
+	}
+	if !valid {
+		b.Status = domain.BatchRejected
+		return b, myerrors.ErrInvalidBatch
+	}
+	if mode == domain.BatchAllOrNothing && b.Total.Amount > balance.Amount {
+		return nil, myerrors.ErrInsufficientFunds
+	}
+	stepUp, err := uc.transfers.AuthorizeTransfer(from, "", b.Total, IIN, transferAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := uc.dbConn.InsertBatch(*b, stepUp)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("INFO|Batch %d of %d transfers totalling %s from %s created\n", stored.ID, len(stored.Lines), stored.Total, from)
+	return stored, nil
+}
+
+// validateLine parses amount of instruction and checks that it can be transferred to its receiver
+func (uc *batchUsecaseImpl) validateLine(from, currency string, in domain.BatchInstruction) (domain.Money, error) {
+	amount, err := domain.ParseMoney(in.Amount, currency)
+	if err != nil || !amount.IsPositive() {
+		return domain.NewMoney(0, currency), myerrors.ErrInvalidAmt
+	}
+	if in.To == "" || in.To == from {
+		return amount, myerrors.ErrWalletNotFound
+	}
+	if _, err := convert(uc.dbConn, uc.rates, from, in.To, amount); err != nil {
+		return amount, err
+	}
+	return amount, nil
+}
+
+// GetBatch gets batch with the status of each of its lines, anyWallet lets the user see batches of others
+func (uc *batchUsecaseImpl) GetBatch(batchID int, IIN string, anyWallet bool) (*domain.Batch, error) {
+	b, err := uc.dbConn.GetBatch(batchID)
+	if err != nil {
+		return nil, err
+	}
+	if !anyWallet && b.IIN != IIN {
+		return nil, myerrors.ErrIINMismatch
+	}
+	return b, nil
+}
+
+// RunPendingBatches runs batches waiting for the worker and returns how many of them it ran
+func (uc *batchUsecaseImpl) RunPendingBatches() (int, error) {
+	pending, err := uc.dbConn.GetPendingBatches()
+	if err != nil {
+		return 0, err
+	}
+	ran := 0
+	for _, p := range pending {
+		claimed, err := uc.dbConn.ClaimBatch(p.ID)
+		if err != nil {
+			log.Printf("ERROR|Claiming batch %d: %v\n", p.ID, err)
+			continue
+		}
+		if !claimed {
+			// another worker is running it
+			continue
+		}
+		b, err := uc.dbConn.GetBatch(p.ID)
+		if err != nil {
+			log.Printf("ERROR|Getting batch %d: %v\n", p.ID, err)
+			continue
+		}
+		uc.runBatch(b)
+		ran++
+	}
+	return ran, nil
+}
+
+// runBatch makes the transfers of batch one by one through the transfer usecase. Each line is an idempotent transfer
+// keyed by batch and line, so running a line again never moves money twice
+func (uc *batchUsecaseImpl) runBatch(b *domain.Batch) {
+	failed := 0
+	for i := range b.Lines {
+		line := &b.Lines[i]
+		if failed > 0 && b.Mode == domain.BatchAllOrNothing {
+			line.Status = domain.LineSkipped
+		} else if err := uc.transferLine(b, line); err != nil {
+			failed++
+			line.Status, line.Error = domain.LineFailed, err.Error()
+		} else {
+			line.Status = domain.LineSucceeded
+		}
+		if err := uc.dbConn.UpdateBatchLine(b.ID, *line); err != nil {
+			log.Printf("ERROR|Recording line %d of batch %d: %v\n", line.Line, b.ID, err)
+		}
+	}
+
+	status := domain.BatchCompleted
+	switch {
+	case failed > 0 && b.Mode == domain.BatchAllOrNothing:
+		uc.rollBack(b)
+		status = domain.BatchFailed
+	case failed == len(b.Lines):
+		status = domain.BatchFailed
+	case failed > 0:
+		status = domain.BatchPartial
+	}
+	if err := uc.dbConn.FinishBatch(b.ID, status); err != nil {
+		log.Printf("ERROR|Finishing batch %d: %v\n", b.ID, err)
+	}
+	log.Printf("INFO|Batch %d %s with %d of %d lines failed\n", b.ID, status, failed, len(b.Lines))
+}
+
+// transferLine makes transfer of line and records the transaction it produced
+func (uc *batchUsecaseImpl) transferLine(b *domain.Batch, line *domain.BatchLine) error {
+	key := fmt.Sprintf("batch-%d-%d", b.ID, line.Line)
+	transfer, err := uc.transfers.RunTransfer(b.From, line.To, line.Amount, b.IIN, key, b.StepUp)
+	if err != nil {
+		return err
+	}
+	line.TransactionID = transfer.ID
+	return nil
+}
+
+// rollBack reverses lines of a failed all-or-nothing batch that were already made. A line whose receiver has
+// spent the money in the meantime can not be reversed and stays succeeded for an admin to sort out
+func (uc *batchUsecaseImpl) rollBack(b *domain.Batch) {
+	for i := range b.Lines {
+		line := &b.Lines[i]
+		if line.Status != domain.LineSucceeded {
+			continue
+		}
+		if _, err := uc.dbConn.Reverse(line.TransactionID, nil); err != nil {
+			log.Printf("ERROR|Rolling back line %d of batch %d: %v\n", line.Line, b.ID, err)
+			continue
+		}
+		line.Status = domain.LineRolledBack
+		if err := uc.dbConn.UpdateBatchLine(b.ID, *line); err != nil {
+			log.Printf("ERROR|Recording line %d of batch %d: %v\n", line.Line, b.ID, err)
+		}
+	}
+}
+
+// NewBatchUsecase returns new BatchUsecase making transfers through transfers, rates are used to check
+// up front that lines to wallets of another currency can be converted
+func NewBatchUsecase(db repository.DBInterface, transfers TransferUsecase, rates fx.FXRateProvider) BatchUsecase {
+	return &batchUsecaseImpl{
+		dbConn:    db,
+		transfers: transfers,
+		rates:     rates,
+	}
+}
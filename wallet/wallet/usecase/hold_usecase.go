@@ -0,0 +1,148 @@
+package usecase
+
+import (
+	"log"
+	"time"
+	"wallet/domain"
+	"wallet/myerrors"
+	"wallet/wallet/fx"
+	"wallet/wallet/repository"
+)
+
+type HoldUsecase interface {
+	PlaceHold(account, payee string, amt domain.Money, ttl time.Duration, IIN string, transferAuth domain.TransferAuth) (*domain.Hold, error)
+	CaptureHold(holdID int, to string, amt *domain.Money, IIN string, anyWallet bool) (*domain.Hold, error)
+	ReleaseHold(holdID int, IIN string, anyWallet bool) (*domain.Hold, error)
+	ExpireHolds() (int, error)
+}
+
+type holdUsecaseImpl struct {
+	dbConn  repository.DBInterface
+	rates   fx.FXRateProvider
+	holdTTL time.Duration
+	stepUp  domain.StepUpPolicy
+}
+
+// PlaceHold reserves amt of the user's wallet for ttl, or for the default hold TTL if ttl is zero, for the merchant
+// owning payee to capture. The user authorizes the hold as they would a transfer to payee, so holds above the step-up
+// threshold need a one-time code or confirmation token in transferAuth
+func (uc *holdUsecaseImpl) PlaceHold(account, payee string, amt domain.Money, ttl time.Duration, IIN string, transferAuth domain.TransferAuth) (*domain.Hold, error) {
+	if !amt.IsPositive() || ttl < 0 {
+		return nil, myerrors.ErrInvalidAmt
+	}
+	if ttl == 0 {
+		ttl = uc.holdTTL
+	}
+	ok, err := uc.dbConn.ConfirmIIN(IIN, account)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, myerrors.ErrIINMismatch
+	}
+	// the payee has to be a wallet the held money can be converted to
+	if _, err := convert(uc.dbConn, uc.rates, account, payee, amt); err != nil {
+		return nil, err
+	}
+	stepUp, err := authorizeTransfer(uc.dbConn, uc.rates, uc.stepUp, account, payee, amt, IIN, transferAuth)
+	if err != nil {
+		return nil, err
+	}
+	hold, err := uc.dbConn.PlaceHold(account, payee, amt, time.Now().Add(ttl), stepUp)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("INFO|Hold %d of %s placed on %s for %s until %s\n", hold.ID, amt, account, payee, hold.ExpiresAt.Format(time.RFC3339))
+	return hold, nil
+}
+
+// CaptureHold transfers amt of the hold, or all of it if amt is nil, to its payee converting it if needed. Only the
+// owner of the payee may capture unless anyWallet is set, and only into the payee, so to must be the payee if set.
+// The owner of the held wallet authorized the capture when placing the hold, so no step-up is asked for
+func (uc *holdUsecaseImpl) CaptureHold(holdID int, to string, amt *domain.Money, IIN string, anyWallet bool) (*domain.Hold, error) {
+	if amt != nil && !amt.IsPositive() {
+		return nil, myerrors.ErrInvalidAmt
+	}
+	hold, err := uc.ownHold(holdID, IIN, anyWallet, true)
+	if err != nil {
+		return nil, err
+	}
+	if to != "" && to != hold.Payee {
+		log.Printf("ERROR|Capturing hold %d into %s instead of its payee\n", holdID, to)
+		return nil, myerrors.ErrHoldPayeeMismatch
+	}
+	if amt == nil {
+		amt = &hold.Amount
+	}
+	conv, err := convert(uc.dbConn, uc.rates, hold.AccountNo, hold.Payee, *amt)
+	if err != nil {
+		return nil, err
+	}
+	captured, err := uc.dbConn.CaptureHold(holdID, conv)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("INFO|Hold %d captured by transaction %d of %s\n", holdID, captured.TransactionID, captured.Captured)
+	return captured, nil
+}
+
+// ReleaseHold gives the held money back to the available balance. Only the owner of the held wallet or of its payee
+// may release unless anyWallet is set
+func (uc *holdUsecaseImpl) ReleaseHold(holdID int, IIN string, anyWallet bool) (*domain.Hold, error) {
+	if _, err := uc.ownHold(holdID, IIN, anyWallet, false); err != nil {
+		return nil, err
+	}
+	return uc.dbConn.ReleaseHold(holdID)
+}
+
+// ExpireHolds marks holds past their expiry as expired
+func (uc *holdUsecaseImpl) ExpireHolds() (int, error) {
+	expired, err := uc.dbConn.ExpireHolds(time.Now())
+	if err != nil {
+		return 0, err
+	}
+	if expired > 0 {
+		log.Printf("INFO|%d holds expired\n", expired)
+	}
+	return expired, nil
+}
+
+// ownHold retrieves hold, checking that the user owns its payee or, unless payeeOnly, the held wallet. Nothing is
+// checked if anyWallet
+func (uc *holdUsecaseImpl) ownHold(holdID int, IIN string, anyWallet, payeeOnly bool) (*domain.Hold, error) {
+	hold, err := uc.dbConn.GetHold(holdID)
+	if err != nil {
+		return nil, err
+	}
+	if anyWallet {
+		return hold, nil
+	}
+	accounts := []string{hold.Payee}
+	if !payeeOnly {
+		accounts = append(accounts, hold.AccountNo)
+	}
+	for _, account := range accounts {
+		if account == "" {
+			continue
+		}
+		ok, err := uc.dbConn.ConfirmIIN(IIN, account)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return hold, nil
+		}
+	}
+	return nil, myerrors.ErrIINMismatch
+}
+
+// NewHoldUsecase returns new HoldUsecase, holds placed without a TTL expire after holdTTL and placing them asks for
+// step-up by given policy
+func NewHoldUsecase(db repository.DBInterface, rates fx.FXRateProvider, holdTTL time.Duration, stepUp domain.StepUpPolicy) HoldUsecase {
+	return &holdUsecaseImpl{
+		dbConn:  db,
+		rates:   rates,
+		holdTTL: holdTTL,
+		stepUp:  stepUp,
+	}
+}
@@ -1,21 +1,101 @@
 package usecase
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log"
 	"strconv"
+	"strings"
+	"time"
+	"wallet/domain"
+	"wallet/myerrors"
+	"wallet/wallet/fx"
+	"wallet/wallet/repository"
 )
 
-// generateAccountNo generates new account based on an increment on last account in DB
-func generateAccountNo(prev string) (string, bool) {
+// generateAccountNo generates new account of currency based on an increment on last account in DB
+func generateAccountNo(prev, currency string) (string, bool) {
 	num, err := strconv.Atoi(prev)
 	if err != nil {
 		return "", false
 	}
 	num++
 	if len(strconv.Itoa(num)) <= 10 {
-		return fmt.Sprintf("KZT%010d", num), true
+		return fmt.Sprintf("%s%010d", currency, num), true
 	}
 	log.Println("Limit exceeded")
 	return "", false
 }
+
+// newIdempotencyKey builds idempotency key for request made of given parts, nil if client sent no key
+func newIdempotencyKey(key, IIN string, ttl time.Duration, parts ...string) *domain.IdempotencyKey {
+	if key == "" {
+		return nil
+	}
+	hash := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return &domain.IdempotencyKey{
+		Key:         key,
+		IIN:         IIN,
+		RequestHash: hex.EncodeToString(hash[:]),
+		ExpiresAt:   time.Now().Add(ttl),
+	}
+}
+
+// findReplay returns previously stored key if request is a replay, or error if key was used for another request
+func findReplay(db repository.DBInterface, key *domain.IdempotencyKey) (*domain.IdempotencyKey, error) {
+	if key == nil {
+		return nil, nil
+	}
+	stored, err := db.GetIdempotencyKey(key.IIN, key.Key)
+	if err != nil || stored == nil {
+		return nil, err
+	}
+	if stored.RequestHash != key.RequestHash {
+		return nil, myerrors.ErrIdempotencyConflict
+	}
+	log.Printf("INFO|Replaying request with idempotency key %s of transaction %d\n", stored.Key, stored.TransactionID)
+	return stored, nil
+}
+
+// decodeResponse decodes amount stored as response of idempotent top-up
+func decodeResponse(key *domain.IdempotencyKey) (domain.Money, error) {
+	var amount domain.Money
+	if err := json.Unmarshal([]byte(key.Response), &amount); err != nil {
+		return domain.Money{}, err
+	}
+	return amount, nil
+}
+
+// convert works out how much the receiving wallet is credited for amount debited from the sending one
+func convert(db repository.DBInterface, rates fx.FXRateProvider, from, to string, amt domain.Money) (domain.Conversion, error) {
+	fromBalance, err := db.GetAmount(from)
+	if err != nil {
+		return domain.Conversion{}, err
+	}
+	if fromBalance.Currency != amt.Currency {
+		return domain.Conversion{}, myerrors.ErrCurrencyMismatch
+	}
+	toBalance, err := db.GetAmount(to)
+	if err != nil {
+		return domain.Conversion{}, err
+	}
+	if toBalance.Currency == amt.Currency {
+		return domain.NewConversion(amt), nil
+	}
+
+	rate, err := rates.Rate(amt.Currency, toBalance.Currency)
+	if err != nil {
+		log.Printf("ERROR|No %s/%s rate: %v\n", amt.Currency, toBalance.Currency, err)
+		return domain.Conversion{}, err
+	}
+	credit, err := fx.Convert(amt, toBalance.Currency, rate)
+	if err != nil {
+		return domain.Conversion{}, err
+	}
+	if !credit.IsPositive() {
+		return domain.Conversion{}, myerrors.ErrInvalidAmt
+	}
+	return domain.Conversion{Debit: amt, Credit: credit, Rate: rate}, nil
+}
@@ -0,0 +1,30 @@
+package usecase
+
+import (
+	"wallet/domain"
+	"wallet/myerrors"
+	"wallet/wallet/repository"
+)
+
+type LedgerUsecase interface {
+	GetTrialBalance(canAudit bool) (*domain.TrialBalance, error)
+}
+
+type ledgerUsecaseImpl struct {
+	dbConn repository.DBInterface
+}
+
+// GetTrialBalance verifies that ledger postings sum up to zero, canAudit tells whether the user may view it
+func (uc *ledgerUsecaseImpl) GetTrialBalance(canAudit bool) (*domain.TrialBalance, error) {
+	if !canAudit {
+		return nil, myerrors.ErrPermissionDenied
+	}
+	return uc.dbConn.GetTrialBalance()
+}
+
+// NewLedgerUsecase returns new LedgerUsecase
+func NewLedgerUsecase(db repository.DBInterface) LedgerUsecase {
+	return &ledgerUsecaseImpl{
+		dbConn: db,
+	}
+}
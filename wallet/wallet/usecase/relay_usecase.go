@@ -0,0 +1,50 @@
+package usecase
+
+import (
+	"log"
+	"time"
+	"wallet/wallet/events"
+	"wallet/wallet/repository"
+)
+
+// relayBatchSize limits how many outbox events a single run of the relay publishes
+const relayBatchSize = 100
+
+type RelayUsecase interface {
+	Relay() (int, error)
+}
+
+type relayUsecaseImpl struct {
+	dbConn    repository.DBInterface
+	publisher events.EventPublisher
+}
+
+// Relay publishes events of the outbox in the order they were written and returns how many of them were published.
+// A failed event stops the run so that later events do not overtake it, it is published again by the next run.
+// An event published but not marked as such is published again too, publishers drop repeats by event ID
+func (uc *relayUsecaseImpl) Relay() (int, error) {
+	unpublished, err := uc.dbConn.GetUnpublishedEvents(relayBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	published := 0
+	for _, e := range unpublished {
+		if err := uc.publisher.Publish(e); err != nil {
+			log.Printf("ERROR|Publishing %s event %s: %v\n", e.Type, e.ID, err)
+			return published, err
+		}
+		if err := uc.dbConn.MarkEventPublished(e.ID, time.Now()); err != nil {
+			return published, err
+		}
+		published++
+	}
+	return published, nil
+}
+
+// NewRelayUsecase returns new RelayUsecase handing outbox events to publisher
+func NewRelayUsecase(db repository.DBInterface, publisher events.EventPublisher) RelayUsecase {
+	return &relayUsecaseImpl{
+		dbConn:    db,
+		publisher: publisher,
+	}
+}
@@ -0,0 +1,170 @@
+package usecase
+
+import (
+	"fmt"
+	"log"
+	"time"
+	"wallet/domain"
+	"wallet/myerrors"
+	"wallet/wallet/cron"
+	"wallet/wallet/repository"
+)
+
+// maxScheduleFailures is how many runs in a row may fail on insufficient funds before a schedule is paused
+const maxScheduleFailures = 3
+
+type ScheduleUsecase interface {
+	CreateSchedule(from, to string, amt domain.Money, at time.Time, recurrence, IIN string, transferAuth domain.TransferAuth) (*domain.Schedule, error)
+	GetSchedules(IIN string) ([]domain.Schedule, error)
+	CancelSchedule(scheduleID int, IIN string, anyWallet bool) (*domain.Schedule, error)
+	RunDueSchedules() (int, error)
+}
+
+type scheduleUsecaseImpl struct {
+	dbConn        repository.DBInterface
+	transfers     TransferUsecase
+	retryInterval time.Duration
+}
+
+// CreateSchedule schedules transfer of amt from the user's wallet at given time, or at every time recurrence matches.
+// A recurring schedule without a start time first runs at the next match. A schedule of amount above the step-up
+// threshold needs a one-time code or confirmation token in transferAuth, its runs are made with that decision
+func (uc *scheduleUsecaseImpl) CreateSchedule(from, to string, amt domain.Money, at time.Time, recurrence, IIN string, transferAuth domain.TransferAuth) (*domain.Schedule, error) {
+	if !amt.IsPositive() {
+		return nil, myerrors.ErrInvalidAmt
+	}
+	now := time.Now()
+	switch {
+	case recurrence != "":
+		expr, err := cron.Parse(recurrence)
+		if err != nil {
+			return nil, err
+		}
+		if at.IsZero() {
+			at = expr.Next(now)
+		}
+		if at.IsZero() {
+			return nil, myerrors.ErrInvalidSchedule
+		}
+	case at.IsZero():
+		return nil, myerrors.ErrInvalidSchedule
+	}
+	if at.Before(now.Add(-time.Minute)) {
+		return nil, myerrors.ErrInvalidSchedule
+	}
+
+	ok, err := uc.dbConn.ConfirmIIN(IIN, from)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, myerrors.ErrIINMismatch
+	}
+	stepUp, err := uc.transfers.AuthorizeTransfer(from, to, amt, IIN, transferAuth)
+	if err != nil {
+		return nil, err
+	}
+	s, err := uc.dbConn.InsertSchedule(domain.Schedule{IIN: IIN, From: from, To: to, Amount: amt, Recurrence: recurrence, NextRun: at}, stepUp)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("INFO|Schedule %d of %s from %s to %s created, first run at %s\n", s.ID, amt, from, to, at.Format(time.RFC3339))
+	return s, nil
+}
+
+// GetSchedules gets schedules of the user with their runs
+func (uc *scheduleUsecaseImpl) GetSchedules(IIN string) ([]domain.Schedule, error) {
+	schedules, err := uc.dbConn.GetSchedules(IIN)
+	if err != nil {
+		return nil, err
+	}
+	for i := range schedules {
+		if schedules[i].Runs, err = uc.dbConn.GetScheduleRuns(schedules[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return schedules, nil
+}
+
+// CancelSchedule stops schedule of the user, anyWallet lets the user cancel schedules of others
+func (uc *scheduleUsecaseImpl) CancelSchedule(scheduleID int, IIN string, anyWallet bool) (*domain.Schedule, error) {
+	s, err := uc.dbConn.GetSchedule(scheduleID)
+	if err != nil {
+		return nil, err
+	}
+	if !anyWallet && s.IIN != IIN {
+		return nil, myerrors.ErrIINMismatch
+	}
+	return uc.dbConn.CancelSchedule(scheduleID)
+}
+
+// RunDueSchedules executes schedules whose time has come and returns how many transfers were made.
+// Each run is an idempotent transfer keyed by schedule and run time, so a run picked up by two workers moves money once
+func (uc *scheduleUsecaseImpl) RunDueSchedules() (int, error) {
+	due, err := uc.dbConn.GetDueSchedules(time.Now())
+	if err != nil {
+		return 0, err
+	}
+	transferred := 0
+	for _, s := range due {
+		now := time.Now()
+		key := fmt.Sprintf("schedule-%d-%d", s.ID, s.NextRun.Unix())
+		run := domain.ScheduleRun{Ts: now, Outcome: domain.RunSucceeded}
+		switch _, err := uc.transfers.RunTransfer(s.From, s.To, s.Amount, s.IIN, key, s.StepUp); err {
+		case nil:
+			transferred++
+			s.Failures = 0
+			s.NextRun, s.Status = nextRun(s, now)
+		case myerrors.ErrIdempotencyConflict:
+			// another worker is making the same run
+			continue
+		case myerrors.ErrInsufficientFunds:
+			run.Outcome, run.Error = domain.RunFailed, err.Error()
+			s.Failures++
+			if s.Failures >= maxScheduleFailures {
+				log.Printf("INFO|Schedule %d paused after %d failed runs\n", s.ID, s.Failures)
+				s.Status = domain.SchedulePaused
+			} else {
+				s.NextRun = now.Add(uc.retryInterval)
+			}
+		case myerrors.ErrIINMismatch, myerrors.ErrCurrencyMismatch, myerrors.ErrRateUnavailable, myerrors.ErrInvalidAmt:
+			// retrying will not help, the user has to create a new schedule
+			run.Outcome, run.Error = domain.RunFailed, err.Error()
+			s.Status = domain.SchedulePaused
+		default:
+			// transient errors leave the schedule due for the next pass
+			log.Printf("ERROR|Running schedule %d: %v\n", s.ID, err)
+			continue
+		}
+		if err := uc.dbConn.RecordScheduleRun(s, run); err != nil {
+			log.Printf("ERROR|Recording run of schedule %d: %v\n", s.ID, err)
+		}
+	}
+	return transferred, nil
+}
+
+// nextRun returns when schedule is to run after a successful run at now, a schedule without one is done
+func nextRun(s domain.Schedule, now time.Time) (time.Time, string) {
+	if s.Recurrence == "" {
+		return s.NextRun, domain.ScheduleDone
+	}
+	expr, err := cron.Parse(s.Recurrence)
+	if err != nil {
+		return s.NextRun, domain.ScheduleDone
+	}
+	next := expr.Next(now)
+	if next.IsZero() {
+		return s.NextRun, domain.ScheduleDone
+	}
+	return next, domain.ScheduleActive
+}
+
+// NewScheduleUsecase returns new ScheduleUsecase making transfers through transfers, runs failing on
+// insufficient funds are retried after retryInterval
+func NewScheduleUsecase(db repository.DBInterface, transfers TransferUsecase, retryInterval time.Duration) ScheduleUsecase {
+	return &scheduleUsecaseImpl{
+		dbConn:        db,
+		transfers:     transfers,
+		retryInterval: retryInterval,
+	}
+}
@@ -0,0 +1,90 @@
+package usecase
+
+import (
+	"log"
+	"time"
+	"wallet/domain"
+	"wallet/myerrors"
+	"wallet/wallet/repository"
+	"wallet/wallet/revocation"
+)
+
+type SessionUsecase interface {
+	GetSessions(IIN, currentSessionID string) ([]domain.Session, error)
+	RevokeSession(IIN, sessionID string) error
+	RevokeToken(principal domain.Principal) error
+	RevokeAllSessions(IIN string) error
+}
+
+type sessionUsecaseImpl struct {
+	dbConn      repository.DBInterface
+	revocations *revocation.Store
+}
+
+// GetSessions gets active sessions of IIN, marking the one with currentSessionID as current
+func (uc *sessionUsecaseImpl) GetSessions(IIN, currentSessionID string) ([]domain.Session, error) {
+	sessions, err := uc.dbConn.GetSessions(IIN, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentSessionID
+	}
+	return sessions, nil
+}
+
+// RevokeSession revokes session of IIN, so that neither its refresh nor access tokens are accepted any more
+func (uc *sessionUsecaseImpl) RevokeSession(IIN, sessionID string) error {
+	sessions, err := uc.dbConn.GetSessions(IIN, time.Now())
+	if err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		if s.ID == sessionID {
+			return revokeSession(uc.dbConn, uc.revocations, sessionID)
+		}
+	}
+	return myerrors.ErrSessionNotFound
+}
+
+// RevokeToken revokes access token of principal along with the session it was issued in
+func (uc *sessionUsecaseImpl) RevokeToken(principal domain.Principal) error {
+	if principal.TokenID == "" && principal.SessionID == "" {
+		return myerrors.ErrTokenNotRevocable
+	}
+	if principal.TokenID != "" {
+		if err := uc.revocations.RevokeToken(principal.TokenID, principal.ExpiresAt); err != nil {
+			return err
+		}
+	}
+	if principal.SessionID != "" {
+		return revokeSession(uc.dbConn, uc.revocations, principal.SessionID)
+	}
+	return nil
+}
+
+// RevokeAllSessions revokes every session of IIN and every access token issued to IIN so far, by this service or not
+func (uc *sessionUsecaseImpl) RevokeAllSessions(IIN string) error {
+	sessions, err := uc.dbConn.GetSessions(IIN, time.Now())
+	if err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		if err := uc.dbConn.RevokeRefreshTokens(s.ID); err != nil {
+			return err
+		}
+	}
+	if err := uc.revocations.RevokeUser(IIN); err != nil {
+		return err
+	}
+	log.Printf("INFO|Revoked %d sessions of %s\n", len(sessions), IIN)
+	return nil
+}
+
+// NewSessionUsecase returns SessionUsecase revoking access tokens in revocations
+func NewSessionUsecase(dbConn repository.DBInterface, revocations *revocation.Store) SessionUsecase {
+	return &sessionUsecaseImpl{
+		dbConn:      dbConn,
+		revocations: revocations,
+	}
+}
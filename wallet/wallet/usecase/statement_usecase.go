@@ -0,0 +1,53 @@
+package usecase
+
+import (
+	"time"
+	"wallet/domain"
+	"wallet/myerrors"
+	"wallet/wallet/repository"
+)
+
+type StatementUsecase interface {
+	GetStatement(IIN, account string, since, until time.Time, anyWallet bool) (*domain.Statement, error)
+}
+
+type statementUsecaseImpl struct {
+	dbConn       repository.DBInterface
+	transactions GetTransactionsUsecase
+}
+
+// GetStatement gets statement of account for transactions made in [since, until). Transactions are read through
+// GetTransactionsUsecase page by page, so only the owner of the account gets its statement unless anyWallet is set
+func (uc *statementUsecaseImpl) GetStatement(IIN, account string, since, until time.Time, anyWallet bool) (*domain.Statement, error) {
+	if since.IsZero() || until.IsZero() || !since.Before(until) {
+		return nil, myerrors.ErrInvalidPeriod
+	}
+	filter := domain.TransactionFilter{Account: account, Since: since, Until: until, Limit: maxPageSize}
+	var transactions []domain.Transaction
+	for {
+		page, err := uc.transactions.GetTransactions(IIN, filter, anyWallet)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, page.Transactions...)
+		if page.NextCursor == "" {
+			break
+		}
+		if filter.Cursor, err = domain.DecodeCursor(page.NextCursor); err != nil {
+			return nil, err
+		}
+	}
+	opening, err := uc.dbConn.GetBalanceAt(account, since)
+	if err != nil {
+		return nil, err
+	}
+	return domain.NewStatement(account, since, until, opening, transactions), nil
+}
+
+// NewStatementUsecase returns new StatementUsecase reading transactions through transactions
+func NewStatementUsecase(db repository.DBInterface, transactions GetTransactionsUsecase) StatementUsecase {
+	return &statementUsecaseImpl{
+		dbConn:       db,
+		transactions: transactions,
+	}
+}
@@ -0,0 +1,208 @@
+package usecase
+
+import (
+	"log"
+	"time"
+	"wallet/domain"
+	"wallet/myerrors"
+	"wallet/wallet/auth"
+	"wallet/wallet/fx"
+	"wallet/wallet/repository"
+)
+
+// totpIssuer is the name authenticator apps show codes of the wallet under
+const totpIssuer = "Wallet"
+
+type StepUpUsecase interface {
+	EnrolTOTP(IIN string) (*domain.TOTPEnrolment, error)
+	ActivateTOTP(IIN, code string) error
+	DisableTOTP(IIN, code string) error
+	ConfirmTransfer(from, to string, amt domain.Money, IIN, code string) (*domain.ConfirmationToken, error)
+}
+
+type stepUpUsecaseImpl struct {
+	dbConn repository.DBInterface
+	policy domain.StepUpPolicy
+}
+
+// EnrolTOTP starts enrolment of authenticator of IIN with a new secret, replacing a pending one. The authenticator
+// is not asked for codes until activated
+func (uc *stepUpUsecaseImpl) EnrolTOTP(IIN string) (*domain.TOTPEnrolment, error) {
+	t, err := uc.dbConn.GetTOTP(IIN)
+	switch {
+	case err == myerrors.ErrTOTPNotEnrolled:
+	case err != nil:
+		return nil, err
+	case t.Active:
+		return nil, myerrors.ErrTOTPAlreadyEnrolled
+	}
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	if err := uc.dbConn.SaveTOTP(domain.TOTP{IIN: IIN, Secret: secret}); err != nil {
+		return nil, err
+	}
+	return &domain.TOTPEnrolment{Secret: secret, URI: auth.TOTPURI(totpIssuer, IIN, secret)}, nil
+}
+
+// ActivateTOTP activates pending authenticator of IIN with its code, proving the user has set it up
+func (uc *stepUpUsecaseImpl) ActivateTOTP(IIN, code string) error {
+	t, err := uc.dbConn.GetTOTP(IIN)
+	if err != nil {
+		return err
+	}
+	if t.Active {
+		return myerrors.ErrTOTPAlreadyEnrolled
+	}
+	if err := checkCode(uc.dbConn, uc.policy, t, code, true); err != nil {
+		return err
+	}
+	log.Printf("INFO|Authenticator of %s activated\n", IIN)
+	return nil
+}
+
+// DisableTOTP deletes authenticator of IIN, which takes its code
+func (uc *stepUpUsecaseImpl) DisableTOTP(IIN, code string) error {
+	t, err := activeTOTP(uc.dbConn, IIN)
+	if err != nil {
+		return err
+	}
+	if err := checkCode(uc.dbConn, uc.policy, t, code, false); err != nil {
+		return err
+	}
+	log.Printf("INFO|Authenticator of %s disabled\n", IIN)
+	return uc.dbConn.DeleteTOTP(IIN)
+}
+
+// ConfirmTransfer checks code of authenticator of IIN and returns token that lets the transfer of amt from to go
+// through once without a code, for clients that ask for the code before sending the transfer
+func (uc *stepUpUsecaseImpl) ConfirmTransfer(from, to string, amt domain.Money, IIN, code string) (*domain.ConfirmationToken, error) {
+	if !amt.IsPositive() {
+		return nil, myerrors.ErrInvalidAmt
+	}
+	ok, err := uc.dbConn.ConfirmIIN(IIN, from)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, myerrors.ErrIINMismatch
+	}
+	t, err := activeTOTP(uc.dbConn, IIN)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCode(uc.dbConn, uc.policy, t, code, false); err != nil {
+		return nil, err
+	}
+	token, err := auth.NewOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+	c := domain.TransferConfirmation{
+		Hash:      auth.HashToken(token),
+		IIN:       IIN,
+		From:      from,
+		To:        to,
+		Amount:    amt,
+		ExpiresAt: time.Now().Add(uc.policy.ConfirmationTTL),
+	}
+	if err := uc.dbConn.InsertTransferConfirmation(c); err != nil {
+		return nil, err
+	}
+	return &domain.ConfirmationToken{ConfirmationToken: token, ExpiresIn: int(uc.policy.ConfirmationTTL.Seconds())}, nil
+}
+
+// authorizeTransfer checks second factor of transfer of amt from to by IIN when policy asks for one, returning the
+// decision to make the transfer with. A confirmation is only checked here, the transfer uses it up
+func authorizeTransfer(dbConn repository.DBInterface, rates fx.FXRateProvider, policy domain.StepUpPolicy,
+	from, to string, amt domain.Money, IIN string, transferAuth domain.TransferAuth) (domain.StepUp, error) {
+	if !requiresStepUp(rates, policy, amt) {
+		return domain.StepUp{Decision: domain.StepUpNotRequired}, nil
+	}
+	if transferAuth.ConfirmationToken != "" {
+		hash := auth.HashToken(transferAuth.ConfirmationToken)
+		c, err := dbConn.GetTransferConfirmation(hash, time.Now())
+		if err != nil {
+			return domain.StepUp{}, err
+		}
+		if !c.Matches(IIN, from, to, amt) {
+			return domain.StepUp{}, myerrors.ErrInvalidConfirmation
+		}
+		return domain.StepUp{Decision: domain.StepUpConfirmation, ConfirmationHash: hash}, nil
+	}
+	if transferAuth.Code == "" {
+		return domain.StepUp{}, myerrors.ErrStepUpRequired
+	}
+	t, err := activeTOTP(dbConn, IIN)
+	if err != nil {
+		return domain.StepUp{}, err
+	}
+	if err := checkCode(dbConn, policy, t, transferAuth.Code, false); err != nil {
+		return domain.StepUp{}, err
+	}
+	return domain.StepUp{Decision: domain.StepUpTOTP}, nil
+}
+
+// requiresStepUp tells if amt is above threshold of policy, amounts that can't be converted to its currency are
+// treated as above it
+func requiresStepUp(rates fx.FXRateProvider, policy domain.StepUpPolicy, amt domain.Money) bool {
+	if !policy.Enabled() {
+		return false
+	}
+	if amt.Currency != policy.Threshold.Currency {
+		rate, err := rates.Rate(amt.Currency, policy.Threshold.Currency)
+		if err != nil {
+			log.Printf("ERROR|No %s/%s rate to check step-up threshold: %v\n", amt.Currency, policy.Threshold.Currency, err)
+			return true
+		}
+		if amt, err = fx.Convert(amt, policy.Threshold.Currency, rate); err != nil {
+			return true
+		}
+	}
+	return amt.Amount > policy.Threshold.Amount
+}
+
+// activeTOTP gets activated authenticator of IIN
+func activeTOTP(dbConn repository.DBInterface, IIN string) (*domain.TOTP, error) {
+	t, err := dbConn.GetTOTP(IIN)
+	if err != nil {
+		return nil, err
+	}
+	if !t.Active {
+		return nil, myerrors.ErrTOTPNotEnrolled
+	}
+	return t, nil
+}
+
+// checkCode checks code of authenticator t, activating it if activate is set. Wrong and reused codes count towards
+// the lockout of policy and no code is checked while it lasts
+func checkCode(dbConn repository.DBInterface, policy domain.StepUpPolicy, t *domain.TOTP, code string, activate bool) error {
+	now := time.Now()
+	if now.Before(t.LockedUntil) {
+		return myerrors.ErrOTPLocked
+	}
+	step, ok, err := auth.CheckTOTP(t.Secret, code, now)
+	if err != nil {
+		return err
+	}
+	if ok {
+		used, err := dbConn.UseTOTPStep(t.IIN, step, activate)
+		if err != nil || used {
+			return err
+		}
+	}
+	log.Printf("ERROR|Wrong one-time code of %s\n", t.IIN)
+	if err := dbConn.FailTOTP(t.IIN, policy.MaxAttempts, now.Add(policy.Lockout)); err != nil {
+		return err
+	}
+	return myerrors.ErrInvalidOTP
+}
+
+// NewStepUpUsecase returns StepUpUsecase checking codes and issuing confirmations by policy
+func NewStepUpUsecase(dbConn repository.DBInterface, policy domain.StepUpPolicy) StepUpUsecase {
+	return &stepUpUsecaseImpl{
+		dbConn: dbConn,
+		policy: policy,
+	}
+}
@@ -0,0 +1,123 @@
+package usecase
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"wallet/domain"
+	"wallet/myerrors"
+	"wallet/wallet/repository"
+	"wallet/wallet/stream"
+)
+
+// replayLimit is how many missed events a resuming client gets at most, a client that missed more is told to reset
+const replayLimit = 1000
+
+// followBatchSize limits how many outbox events are read at once while following the outbox
+const followBatchSize = 100
+
+type StreamUsecase interface {
+	Open(IIN, lastEventID string) (*stream.Subscription, domain.Replay, []domain.Wallet, error)
+	GetWallet(IIN, account string) (*domain.Wallet, error)
+	Follow() (int, error)
+}
+
+type streamUsecaseImpl struct {
+	dbConn    repository.DBInterface
+	broker    *stream.Broker
+	mu        sync.Mutex
+	following bool
+	position  int64
+}
+
+// Open subscribes to events of the user's wallets, including wallets created later, returning events missed since
+// lastEventID and current balances of the wallets. Missed events are read from the outbox after subscribing, so an
+// event may come both replayed and live. A client whose last event is unknown or who missed more than replayLimit
+// events is told to reset
+func (uc *streamUsecaseImpl) Open(IIN, lastEventID string) (*stream.Subscription, domain.Replay, []domain.Wallet, error) {
+	s := uc.broker.Subscribe(IIN)
+	var replay domain.Replay
+	if lastEventID != "" {
+		missed, err := uc.dbConn.GetEventsAfter(IIN, lastEventID, replayLimit+1)
+		switch {
+		case errors.Is(err, myerrors.ErrEventNotFound) || len(missed) > replayLimit:
+			replay.Reset = true
+		case err != nil:
+			s.Close()
+			return nil, replay, nil, err
+		default:
+			replay.Events = missed
+		}
+	}
+	wallets, err := uc.dbConn.GetWallets(IIN)
+	if err != nil {
+		s.Close()
+		return nil, replay, nil, err
+	}
+	return s, replay, wallets, nil
+}
+
+// GetWallet gets current balance of the user's wallet
+func (uc *streamUsecaseImpl) GetWallet(IIN, account string) (*domain.Wallet, error) {
+	wallet, err := uc.dbConn.GetWallet(account)
+	if err != nil {
+		return nil, err
+	}
+	if wallet.IIN != IIN {
+		return nil, myerrors.ErrIINMismatch
+	}
+	return wallet, nil
+}
+
+// Follow hands events written to the outbox since the last run to the broker and returns how many of them there
+// were. Every instance follows the outbox on its own, whichever instance relays the events, so that every client gets
+// them live. The first run starts at the end of the outbox, earlier events are replayed to resuming clients by Open.
+// A failed event is handed again by the next run along with those read with it, the broker drops repeats
+func (uc *streamUsecaseImpl) Follow() (int, error) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	if !uc.following {
+		position, err := uc.dbConn.GetOutboxPosition()
+		if err != nil {
+			return 0, err
+		}
+		uc.position, uc.following = position, true
+	}
+	followed := 0
+	for {
+		events, position, err := uc.dbConn.GetEventsSince(uc.position, followBatchSize)
+		if err != nil {
+			return followed, err
+		}
+		for _, e := range events {
+			if err := uc.broker.Publish(e); err != nil {
+				log.Printf("ERROR|Streaming %s event %s: %v\n", e.Type, e.ID, err)
+				return followed, err
+			}
+			followed++
+		}
+		uc.position = position
+		if len(events) < followBatchSize {
+			return followed, nil
+		}
+	}
+}
+
+// WalletOwner returns stream.OwnerFunc looking owners of wallets up in db
+func WalletOwner(db repository.DBInterface) stream.OwnerFunc {
+	return func(account string) (string, error) {
+		wallet, err := db.GetWallet(account)
+		if err != nil {
+			return "", err
+		}
+		return wallet.IIN, nil
+	}
+}
+
+// NewStreamUsecase returns new StreamUsecase of events published to broker
+func NewStreamUsecase(db repository.DBInterface, broker *stream.Broker) StreamUsecase {
+	return &streamUsecaseImpl{
+		dbConn: db,
+		broker: broker,
+	}
+}
@@ -1,23 +1,35 @@
 package usecase
 
 import (
+	"log"
+	"time"
 	"wallet/domain"
 	"wallet/myerrors"
+	"wallet/wallet/fx"
 	"wallet/wallet/repository"
 )
 
+// Sizes of transaction history pages, a page asking for more gets maxPageSize
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
 type GetTransactionsUsecase interface {
-	GetTransactions(IIN, account string, isAdmin bool) ([]domain.Transaction, error)
+	GetTransactions(IIN string, filter domain.TransactionFilter, anyWallet bool) (*domain.TransactionPage, error)
 }
 
 type getTransactionsUsecaseImpl struct {
 	dbConn repository.DBInterface
 }
 
-// GetTransactions gets all transactions
-func (uc *getTransactionsUsecaseImpl) GetTransactions(IIN, account string, isAdmin bool) ([]domain.Transaction, error) {
-	if !isAdmin {
-		ok, err := uc.dbConn.ConfirmIIN(IIN, account)
+// GetTransactions gets a page of transactions of filter.Account matching the filter
+func (uc *getTransactionsUsecaseImpl) GetTransactions(IIN string, filter domain.TransactionFilter, anyWallet bool) (*domain.TransactionPage, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	if !anyWallet {
+		ok, err := uc.dbConn.ConfirmIIN(IIN, filter.Account)
 		if err != nil {
 			return nil, err
 		}
@@ -25,7 +37,25 @@ func (uc *getTransactionsUsecaseImpl) GetTransactions(IIN, account string, isAdm
 			return nil, myerrors.ErrIINMismatch
 		}
 	}
-	return uc.dbConn.GetTransactions(account)
+	switch {
+	case filter.Limit == 0:
+		filter.Limit = defaultPageSize
+	case filter.Limit > maxPageSize:
+		filter.Limit = maxPageSize
+	}
+	limit := filter.Limit
+	// one transaction past the page tells whether there is a next one
+	filter.Limit++
+	transactions, err := uc.dbConn.GetTransactions(filter)
+	if err != nil {
+		return nil, err
+	}
+	page := &domain.TransactionPage{Transactions: transactions}
+	if len(transactions) > limit {
+		page.Transactions = transactions[:limit]
+		page.NextCursor = domain.EncodeCursor(transactions[limit-1].ID)
+	}
+	return page, nil
 }
 
 // NewGetTransactionsUsecase returns new TransactionsUsecase
@@ -36,45 +66,114 @@ func NewGetTransactionsUsecase(db repository.DBInterface) GetTransactionsUsecase
 }
 
 type TransferUsecase interface {
-	MakeTransfer(from, to, amt, IIN string) error
+	MakeTransfer(from, to string, amt domain.Money, IIN, idempotencyKey string, transferAuth domain.TransferAuth) (*domain.Transaction, error)
+	AuthorizeTransfer(from, to string, amt domain.Money, IIN string, transferAuth domain.TransferAuth) (domain.StepUp, error)
+	RunTransfer(from, to string, amt domain.Money, IIN, idempotencyKey, stepUp string) (*domain.Transaction, error)
 }
 
 type transferUsecaseImpl struct {
-	dbConn repository.DBInterface
+	dbConn         repository.DBInterface
+	idempotencyTTL time.Duration
+	rates          fx.FXRateProvider
+	stepUp         domain.StepUpPolicy
+}
+
+// MakeTransfer implements transfer logic and returns the transaction made, a replayed idempotency key returns the
+// transaction it made without moving money again.
+// Amount is in currency of the sending wallet and is converted when the receiving wallet holds another currency.
+// Transfers above the step-up threshold need a one-time code or confirmation token in transferAuth
+func (uc *transferUsecaseImpl) MakeTransfer(from, to string, amt domain.Money, IIN, idempotencyKey string, transferAuth domain.TransferAuth) (*domain.Transaction, error) {
+	return uc.transfer(from, to, amt, IIN, idempotencyKey, func() (domain.StepUp, error) {
+		return uc.AuthorizeTransfer(from, to, amt, IIN, transferAuth)
+	})
+}
+
+// AuthorizeTransfer checks second factor of transfer of amt from to by IIN against the step-up threshold and returns
+// the decision, for schedules and batches that are authorized when created and transfer later
+func (uc *transferUsecaseImpl) AuthorizeTransfer(from, to string, amt domain.Money, IIN string, transferAuth domain.TransferAuth) (domain.StepUp, error) {
+	return authorizeTransfer(uc.dbConn, uc.rates, uc.stepUp, from, to, amt, IIN, transferAuth)
+}
+
+// RunTransfer makes transfer like MakeTransfer with step-up decision recorded when it was authorized, for workers
+// running transfers of schedules and batches without the user
+func (uc *transferUsecaseImpl) RunTransfer(from, to string, amt domain.Money, IIN, idempotencyKey, stepUp string) (*domain.Transaction, error) {
+	return uc.transfer(from, to, amt, IIN, idempotencyKey, func() (domain.StepUp, error) {
+		return domain.StepUp{Decision: stepUp}, nil
+	})
 }
 
-// MakeTransfer implements transfer logic
-func (uc *transferUsecaseImpl) MakeTransfer(from, to, amt, IIN string) error {
+// transfer makes transfer of amt from to with step-up decision of authorize
+func (uc *transferUsecaseImpl) transfer(from, to string, amt domain.Money, IIN, idempotencyKey string, authorize func() (domain.StepUp, error)) (*domain.Transaction, error) {
+	if !amt.IsPositive() {
+		return nil, myerrors.ErrInvalidAmt
+	}
+	key := newIdempotencyKey(idempotencyKey, IIN, uc.idempotencyTTL, "transfer", from, to, amt.String())
+	stored, err := findReplay(uc.dbConn, key)
+	if err != nil {
+		return nil, err
+	}
+	if stored != nil {
+		return domain.DecodeTransfer(stored.Response)
+	}
+
 	ok, err := uc.dbConn.ConfirmIIN(IIN, from)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if !ok {
-		return myerrors.ErrIINMismatch
+		return nil, myerrors.ErrIINMismatch
 	}
 
-	if err := uc.dbConn.UpdateTransferStatus(from, to); err != nil {
-		return err
+	conv, err := convert(uc.dbConn, uc.rates, from, to, amt)
+	if err != nil {
+		return nil, err
 	}
+	stepUp, err := authorize()
+	if err != nil {
+		return nil, err
+	}
+	return uc.dbConn.Transfer(from, to, conv, key, stepUp)
+}
 
-	if err := uc.dbConn.Transfer(from, to, amt); err != nil {
-		if err != nil {
-			if err := uc.dbConn.SetZeroStatus(from, to); err != nil {
-				return err
-			}
-		}
-		return err
+// NewTransferUsecase returns new TransferUsecase converting between currencies at rates of given provider and
+// asking for step-up by given policy
+func NewTransferUsecase(db repository.DBInterface, idempotencyTTL time.Duration, rates fx.FXRateProvider, stepUp domain.StepUpPolicy) TransferUsecase {
+	return &transferUsecaseImpl{
+		dbConn:         db,
+		idempotencyTTL: idempotencyTTL,
+		rates:          rates,
+		stepUp:         stepUp,
 	}
+}
 
-	if err := uc.dbConn.SetZeroStatus(from, to); err != nil {
-		return err
+type ReversalUsecase interface {
+	Reverse(transactionID int, amt *domain.Money, canReverse bool) (*domain.Transaction, error)
+}
+
+type reversalUsecaseImpl struct {
+	dbConn repository.DBInterface
+}
+
+// Reverse refunds amt of transaction to its sender, or everything not yet refunded if amt is nil, canReverse tells
+// whether the user may refund
+func (uc *reversalUsecaseImpl) Reverse(transactionID int, amt *domain.Money, canReverse bool) (*domain.Transaction, error) {
+	if !canReverse {
+		return nil, myerrors.ErrPermissionDenied
 	}
-	return nil
+	if amt != nil && !amt.IsPositive() {
+		return nil, myerrors.ErrInvalidAmt
+	}
+	reversal, err := uc.dbConn.Reverse(transactionID, amt)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("INFO|Transaction %d reversed by transaction %d of %s\n", transactionID, reversal.ID, reversal.Amount)
+	return reversal, nil
 }
 
-// NewTransferUsecase returns new TransferUsecase
-func NewTransferUsecase(db repository.DBInterface) TransferUsecase {
-	return &transferUsecaseImpl{
+// NewReversalUsecase returns new ReversalUsecase
+func NewReversalUsecase(db repository.DBInterface) ReversalUsecase {
+	return &reversalUsecaseImpl{
 		dbConn: db,
 	}
 }
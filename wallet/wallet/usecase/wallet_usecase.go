@@ -3,22 +3,25 @@ package usecase
 import (
 	"fmt"
 	"log"
-	"strconv"
+	"time"
 	"wallet/domain"
 	"wallet/myerrors"
 	"wallet/wallet/repository"
 )
 
 type AddWalletUsecase interface {
-	MakeWallet(IIN string) (string, error)
+	MakeWallet(IIN, currency string) (string, error)
 }
 
 type addWalletUsecaseImpl struct {
 	dbConn repository.DBInterface
 }
 
-// Creates new wallet and returns account number
-func (uc *addWalletUsecaseImpl) MakeWallet(IIN string) (string, error) {
+// Creates new wallet of given currency and returns account number
+func (uc *addWalletUsecaseImpl) MakeWallet(IIN, currency string) (string, error) {
+	if _, ok := domain.CurrencyExponent(currency); !ok {
+		return "", myerrors.ErrUnsupportedCurrency
+	}
 	// Get last account number from DB
 	lastAccountNo, err := uc.dbConn.GetLastAccountNo()
 	if err != nil {
@@ -29,12 +32,12 @@ func (uc *addWalletUsecaseImpl) MakeWallet(IIN string) (string, error) {
 		lastAccountNo = "KZT00000000000"
 	}
 	// Generate new account number
-	newAccountNo, ok := generateAccountNo(lastAccountNo[3:])
+	newAccountNo, ok := generateAccountNo(lastAccountNo[3:], currency)
 	if !ok {
-		return "", fmt.Errorf("Limit exceeded")
+		return "", myerrors.ErrWalletLimit
 	}
 	// Insert newly generated wallet
-	if err = uc.dbConn.InsertWallet(newAccountNo, IIN); err != nil {
+	if err = uc.dbConn.InsertWallet(newAccountNo, IIN, currency); err != nil {
 		log.Printf("Error when inserting new wallet: %v", err)
 		return "", fmt.Errorf("addWalletUsecaseImpl error:%w", err)
 	}
@@ -50,6 +53,7 @@ func NewAddWalletUsecase(db repository.DBInterface) AddWalletUsecase {
 
 type GetWalletsUsecase interface {
 	GetWallets(IIN string) ([]domain.Wallet, error)
+	GetWallet(IIN, account string, anyWallet bool) (*domain.Wallet, error)
 }
 type getWalletsUsecaseImpl struct {
 	dbConn repository.DBInterface
@@ -63,6 +67,18 @@ func (uc *getWalletsUsecaseImpl) GetWallets(IIN string) ([]domain.Wallet, error)
 	return wallets, nil
 }
 
+// GetWallet gets the user's wallet by account number, anyWallet lets the user get wallets of others
+func (uc *getWalletsUsecaseImpl) GetWallet(IIN, account string, anyWallet bool) (*domain.Wallet, error) {
+	wallet, err := uc.dbConn.GetWallet(account)
+	if err != nil {
+		return nil, err
+	}
+	if !anyWallet && wallet.IIN != IIN {
+		return nil, myerrors.ErrIINMismatch
+	}
+	return wallet, nil
+}
+
 func NewGetWalletsUsecase(db repository.DBInterface) GetWalletsUsecase {
 	return &getWalletsUsecaseImpl{
 		dbConn: db,
@@ -70,42 +86,57 @@ func NewGetWalletsUsecase(db repository.DBInterface) GetWalletsUsecase {
 }
 
 type TopUpUsecase interface {
-	TopUp(IIN, account, initAmt string) (string, error)
-	// GetAmount(string) (string, error)
+	TopUp(IIN, account string, amt domain.Money, idempotencyKey string) (domain.Money, error)
 }
 
 type topUpUsecaseImpl struct {
-	dbConn repository.DBInterface
+	dbConn         repository.DBInterface
+	idempotencyTTL time.Duration
 }
 
-// TopUp implements account topup logic
-func (uc *topUpUsecaseImpl) TopUp(IIN, account, amt string) (string, error) {
+// TopUp implements account topup logic, a replayed idempotency key returns the originally stored amount
+func (uc *topUpUsecaseImpl) TopUp(IIN, account string, amt domain.Money, idempotencyKey string) (domain.Money, error) {
+	if !amt.IsPositive() {
+		return domain.Money{}, myerrors.ErrInvalidAmt
+	}
+	key := newIdempotencyKey(idempotencyKey, IIN, uc.idempotencyTTL, "topup", account, amt.String())
+	stored, err := findReplay(uc.dbConn, key)
+	if err != nil {
+		return domain.Money{}, err
+	}
+	if stored != nil {
+		return decodeResponse(stored)
+	}
+
 	ok, err := uc.dbConn.ConfirmIIN(IIN, account)
 	if err != nil {
-		return "", err
+		return domain.Money{}, err
 	}
 	if !ok {
-		return "", myerrors.ErrIINMismatch
+		return domain.Money{}, myerrors.ErrIINMismatch
 	}
-	amtInt, err := strconv.Atoi(amt)
-	if err != nil || amtInt < 0 {
-		return "", myerrors.ErrInvalidAmt
+	balance, err := uc.dbConn.GetAmount(account)
+	if err != nil {
+		return domain.Money{}, err
+	}
+	if balance.Currency != amt.Currency {
+		return domain.Money{}, myerrors.ErrCurrencyMismatch
 	}
 
-	if err = uc.dbConn.TopUp(account, amtInt); err != nil {
-		return "", err
+	if err = uc.dbConn.TopUp(account, amt, key); err != nil {
+		return domain.Money{}, err
 	}
-	amount, err := uc.dbConn.GetAmount(account)
-	if err != nil {
-		return "", err
+	if key != nil {
+		return decodeResponse(key)
 	}
-	return amount, nil
+	return uc.dbConn.GetAmount(account)
 }
 
 // NewTopUpUsecase returns new TopUpUsecase
-func NewTopUpUsecase(db repository.DBInterface) TopUpUsecase {
+func NewTopUpUsecase(db repository.DBInterface, idempotencyTTL time.Duration) TopUpUsecase {
 	return &topUpUsecaseImpl{
-		dbConn: db,
+		dbConn:         db,
+		idempotencyTTL: idempotencyTTL,
 	}
 }
 
@@ -0,0 +1,172 @@
+package usecase
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/url"
+	"time"
+	"wallet/domain"
+	"wallet/myerrors"
+	"wallet/wallet/repository"
+	"wallet/wallet/webhook"
+)
+
+// deliveryBatchSize limits how many deliveries a single run of the delivery worker attempts
+const deliveryBatchSize = 100
+
+type WebhookUsecase interface {
+	Subscribe(URL, secret string, events []string, IIN string) (*domain.Subscription, error)
+	GetSubscriptions(IIN string) ([]domain.Subscription, error)
+	Unsubscribe(subscriptionID int, IIN string, anyWallet bool) error
+	GetDeadDeliveries(IIN string) ([]domain.Delivery, error)
+	Redeliver(deliveryID int, IIN string, anyWallet bool) error
+	DeliverDue() (int, error)
+	Publish(e domain.Event) error
+}
+
+type webhookUsecaseImpl struct {
+	dbConn repository.DBInterface
+	sender webhook.Sender
+}
+
+// Subscribe asks for events of the user's wallets to be posted to URL. Without events the subscription gets every
+// event type and without secret one is generated, the secret is only returned here. URLs of loopback, link-local
+// and private hosts are rejected
+func (uc *webhookUsecaseImpl) Subscribe(URL, secret string, events []string, IIN string) (*domain.Subscription, error) {
+	u, err := url.Parse(URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, myerrors.ErrInvalidSubscription
+	}
+	if err := webhook.CheckHost(URL); err != nil {
+		log.Printf("ERROR|Webhook subscription to %s: %v\n", u.Host, err)
+		return nil, myerrors.ErrForbiddenWebhookHost
+	}
+	if len(events) == 0 {
+		events = domain.EventTypes
+	}
+	seen := make(map[string]bool)
+	for _, e := range events {
+		if !domain.IsEventType(e) || seen[e] {
+			return nil, myerrors.ErrInvalidSubscription
+		}
+		seen[e] = true
+	}
+	if secret == "" {
+		if secret, err = newSecret(); err != nil {
+			return nil, err
+		}
+	}
+	s, err := uc.dbConn.InsertSubscription(domain.Subscription{IIN: IIN, URL: URL, Secret: secret, Events: events})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("INFO|Webhook subscription %d to %v created\n", s.ID, s.Events)
+	return s, nil
+}
+
+// GetSubscriptions gets subscriptions of the user without their secrets
+func (uc *webhookUsecaseImpl) GetSubscriptions(IIN string) ([]domain.Subscription, error) {
+	subscriptions, err := uc.dbConn.GetSubscriptions(IIN)
+	if err != nil {
+		return nil, err
+	}
+	for i := range subscriptions {
+		subscriptions[i].Secret = ""
+	}
+	return subscriptions, nil
+}
+
+// Unsubscribe deletes subscription with its pending and dead deliveries, anyWallet lets the user delete
+// subscriptions of others
+func (uc *webhookUsecaseImpl) Unsubscribe(subscriptionID int, IIN string, anyWallet bool) error {
+	s, err := uc.dbConn.GetSubscription(subscriptionID)
+	if err != nil {
+		return err
+	}
+	if !anyWallet && s.IIN != IIN {
+		return myerrors.ErrIINMismatch
+	}
+	return uc.dbConn.DeleteSubscription(subscriptionID)
+}
+
+// GetDeadDeliveries gets deliveries to the user's subscriptions that ran out of attempts
+func (uc *webhookUsecaseImpl) GetDeadDeliveries(IIN string) ([]domain.Delivery, error) {
+	return uc.dbConn.GetDeadDeliveries(IIN)
+}
+
+// Redeliver queues dead delivery again with a fresh set of attempts, anyWallet lets the user redeliver
+// deliveries of others
+func (uc *webhookUsecaseImpl) Redeliver(deliveryID int, IIN string, anyWallet bool) error {
+	d, err := uc.dbConn.GetDelivery(deliveryID)
+	if err != nil {
+		return err
+	}
+	if !anyWallet && d.IIN != IIN {
+		return myerrors.ErrIINMismatch
+	}
+	return uc.dbConn.RequeueDelivery(deliveryID, time.Now())
+}
+
+// DeliverDue attempts deliveries that are due and returns how many of them were delivered. A failed delivery is
+// retried with exponential backoff until it runs out of attempts and is dead. Deliveries are at least once,
+// receivers drop repeats by delivery ID
+func (uc *webhookUsecaseImpl) DeliverDue() (int, error) {
+	now := time.Now()
+	due, err := uc.dbConn.GetDueDeliveries(now, deliveryBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	delivered := 0
+	for _, d := range due {
+		d.Attempts++
+		if err := uc.sender.Send(d); err != nil {
+			d.LastError = err.Error()
+			if len(d.LastError) > 255 {
+				d.LastError = d.LastError[:255]
+			}
+			d.NextAttempt = now.Add(webhook.Backoff(d.Attempts))
+			if d.Attempts >= webhook.MaxAttempts {
+				d.Status = domain.DeliveryDead
+				log.Printf("ERROR|Webhook delivery %d to %s is dead after %d attempts: %v\n", d.ID, d.URL, d.Attempts, err)
+			}
+		} else {
+			d.Status, d.LastError = domain.DeliveryDelivered, ""
+			delivered++
+		}
+		if err := uc.dbConn.RecordDelivery(d); err != nil {
+			log.Printf("ERROR|Recording webhook delivery %d: %v\n", d.ID, err)
+		}
+	}
+	return delivered, nil
+}
+
+// Publish queues e for subscribers of its wallet that asked for its type, an event published again is not queued
+// twice. Makes WebhookUsecase an EventPublisher of the outbox relay
+func (uc *webhookUsecaseImpl) Publish(e domain.Event) error {
+	queued, err := uc.dbConn.EnqueueEvent(e)
+	if err != nil {
+		return err
+	}
+	if queued > 0 {
+		log.Printf("INFO|Queued %d webhook deliveries of %s event %s\n", queued, e.Type, e.ID)
+	}
+	return nil
+}
+
+// newSecret returns random hex secret to sign deliveries with
+func newSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// NewWebhookUsecase returns new WebhookUsecase posting deliveries with sender
+func NewWebhookUsecase(db repository.DBInterface, sender webhook.Sender) WebhookUsecase {
+	return &webhookUsecaseImpl{
+		dbConn: db,
+		sender: sender,
+	}
+}
@@ -0,0 +1,177 @@
+// Package webhook signs and posts wallet events to subscribers
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+	"wallet/domain"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Headers of every delivery, receivers use DeliveryHeader to drop deliveries they already got
+const (
+	EventHeader     = "X-Wallet-Event"
+	DeliveryHeader  = "X-Wallet-Delivery"
+	SignatureHeader = "X-Wallet-Signature"
+)
+
+// MaxAttempts is how many times a delivery is tried before it is dead
+const MaxAttempts = 8
+
+// Retry delays double from firstRetry after every failed attempt up to maxRetry
+const (
+	firstRetry = 30 * time.Second
+	maxRetry   = 6 * time.Hour
+)
+
+// resolveTimeout limits how long resolving host of a subscription URL may take when it is checked
+const resolveTimeout = 5 * time.Second
+
+// ErrForbiddenAddress is returned for hosts resolving to addresses subscribers may not be at
+var ErrForbiddenAddress = errors.New("address is loopback, link-local or private")
+
+// IsPublic reports whether ip may receive deliveries. Loopback, link-local, private and unspecified addresses may
+// not, so that subscriptions can't make the delivery worker post to services inside the network
+func IsPublic(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() &&
+		!ip.IsPrivate() && !ip.IsUnspecified() && !ip.IsMulticast()
+}
+
+// CheckHost fails with ErrForbiddenAddress if host of rawURL is, or resolves to, an address that is not public.
+// Hosts that don't resolve yet pass, the sender checks addresses again on every dial
+func CheckHost(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	ips, err := lookup(ctx, u.Hostname())
+	if err != nil {
+		return nil
+	}
+	for _, ip := range ips {
+		if !IsPublic(ip) {
+			return ErrForbiddenAddress
+		}
+	}
+	return nil
+}
+
+// lookup resolves host to its addresses, IP literals resolve to themselves
+func lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+// Sender posts deliveries to their subscribers
+type Sender interface {
+	Send(d domain.Delivery) error
+}
+
+type httpSender struct {
+	client  *fasthttp.Client
+	timeout time.Duration
+}
+
+// Send posts payload of d to URL of its subscription, anything but a 2xx response is an error
+func (s *httpSender) Send(d domain.Delivery) error {
+	req, res := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+	req.SetRequestURI(d.URL)
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.Header.SetContentType("application/json")
+	req.Header.Set(EventHeader, d.EventType)
+	req.Header.Set(DeliveryHeader, strconv.Itoa(d.ID))
+	req.Header.Set(SignatureHeader, SignatureHeaderValue(d.Secret, time.Now().Unix(), d.Payload))
+	req.SetBodyString(d.Payload)
+	if err := s.client.DoTimeout(req, res, s.timeout); err != nil {
+		return err
+	}
+	if status := res.StatusCode(); status < 200 || status > 299 {
+		return fmt.Errorf("status %d", status)
+	}
+	return nil
+}
+
+// NewHTTPSender returns Sender giving up on a subscriber that did not respond within timeout. It only connects to
+// public addresses
+func NewHTTPSender(timeout time.Duration) Sender {
+	return newHTTPSender(timeout, IsPublic)
+}
+
+// newHTTPSender returns Sender connecting only to addresses allowed by allow
+func newHTTPSender(timeout time.Duration, allow func(ip net.IP) bool) Sender {
+	return &httpSender{
+		client:  &fasthttp.Client{Dial: dialAllowed(timeout, allow)},
+		timeout: timeout,
+	}
+}
+
+// dialAllowed returns dial func connecting to the first address of host allow lets through. The host is resolved
+// once and the connection is made to the checked address, so that DNS rebinding can't swap in another one
+func dialAllowed(timeout time.Duration, allow func(ip net.IP) bool) fasthttp.DialFunc {
+	return func(addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		ips, err := lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			if allow(ip) {
+				return fasthttp.DialTimeout(net.JoinHostPort(ip.String(), port), timeout)
+			}
+		}
+		return nil, fmt.Errorf("dialing %s: %w", host, ErrForbiddenAddress)
+	}
+}
+
+// Sign returns hex HMAC-SHA256 of payload sent at unix time ts keyed by secret
+func Sign(secret string, ts int64, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.%s", ts, payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignatureHeaderValue returns SignatureHeader of payload sent at ts like "t=1641816000,v1=5257a869...".
+// Receivers recompute v1 with Sign and reject old t to guard against replays
+func SignatureHeaderValue(secret string, ts int64, payload string) string {
+	return fmt.Sprintf("t=%d,v1=%s", ts, Sign(secret, ts, payload))
+}
+
+// Backoff returns how long to wait before the next attempt after given number of failed ones
+func Backoff(attempts int) time.Duration {
+	delay := firstRetry
+	for i := 1; i < attempts && delay < maxRetry; i++ {
+		delay *= 2
+	}
+	if delay > maxRetry {
+		delay = maxRetry
+	}
+	return delay
+}
@@ -0,0 +1,106 @@
+package webhook
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"wallet/domain"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSend(t *testing.T) {
+	var got *http.Request
+	var body string
+	status := http.StatusNoContent
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		got, body = r, string(data)
+		w.WriteHeader(status)
+	}))
+	defer stub.Close()
+
+	d := domain.Delivery{ID: 3, URL: stub.URL + "/hook", Secret: "secret", EventType: domain.EventWalletCreated, Payload: `{"type":"wallet.created"}`}
+	sender := newHTTPSender(time.Second, allowAll)
+	assert.NoError(t, sender.Send(d))
+	if assert.NotNil(t, got) {
+		assert.Equal(t, http.MethodPost, got.Method)
+		assert.Equal(t, "/hook", got.URL.Path)
+		assert.Equal(t, d.Payload, body)
+		assert.Equal(t, domain.EventWalletCreated, got.Header.Get(EventHeader))
+		assert.Equal(t, "3", got.Header.Get(DeliveryHeader))
+
+		// the receiver recomputes the signature from the timestamp and body
+		parts := strings.Split(got.Header.Get(SignatureHeader), ",")
+		if assert.Len(t, parts, 2) {
+			ts, err := strconv.ParseInt(strings.TrimPrefix(parts[0], "t="), 10, 64)
+			assert.NoError(t, err)
+			assert.Equal(t, "v1="+Sign("secret", ts, body), parts[1])
+		}
+	}
+
+	status = http.StatusInternalServerError
+	assert.EqualError(t, sender.Send(d), "status 500")
+}
+
+func TestSendUnreachable(t *testing.T) {
+	stub := httptest.NewServer(http.NotFoundHandler())
+	url := stub.URL
+	stub.Close()
+	assert.Error(t, newHTTPSender(time.Second, allowAll).Send(domain.Delivery{ID: 1, URL: url, Payload: "{}"}))
+}
+
+// allowAll lets tests deliver to stubs listening on loopback
+func allowAll(net.IP) bool {
+	return true
+}
+
+func TestSendForbiddenAddress(t *testing.T) {
+	hit := false
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hit = true
+	}))
+	defer stub.Close()
+
+	err := NewHTTPSender(time.Second).Send(domain.Delivery{ID: 1, URL: stub.URL, Payload: "{}"})
+	assert.ErrorIs(t, err, ErrForbiddenAddress)
+	assert.False(t, hit, "nothing is posted to loopback")
+}
+
+func TestCheckHost(t *testing.T) {
+	for _, URL := range []string{
+		"http://127.0.0.1/hook",
+		"http://localhost:8080/hook",
+		"http://[::1]/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://10.0.0.7/hook",
+		"https://172.16.0.1/hook",
+		"https://192.168.1.10/hook",
+		"http://[fd00::1]/hook",
+		"http://0.0.0.0/hook",
+	} {
+		assert.ErrorIs(t, CheckHost(URL), ErrForbiddenAddress, URL)
+	}
+	assert.NoError(t, CheckHost("https://93.184.216.34/hook"))
+	assert.NoError(t, CheckHost("https://hooks.invalid/hook"), "hosts that don't resolve are checked when dialled")
+}
+
+func TestSign(t *testing.T) {
+	// HMAC-SHA256 of "1641816000.{}" keyed by "secret"
+	assert.Equal(t, "1187c20b5fe4e9d0b5efaee09dac9b27aecc408c1033028a78f20b58c2f50589", Sign("secret", 1641816000, "{}"))
+	assert.NotEqual(t, Sign("secret", 1641816000, "{}"), Sign("other", 1641816000, "{}"))
+	assert.NotEqual(t, Sign("secret", 1641816000, "{}"), Sign("secret", 1641816001, "{}"))
+	assert.Equal(t, "t=1641816000,v1="+Sign("secret", 1641816000, "{}"), SignatureHeaderValue("secret", 1641816000, "{}"))
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, 30*time.Second, Backoff(1))
+	assert.Equal(t, time.Minute, Backoff(2))
+	assert.Equal(t, 4*time.Minute, Backoff(4))
+	assert.Equal(t, 6*time.Hour, Backoff(MaxAttempts*2))
+}